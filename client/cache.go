@@ -0,0 +1,148 @@
+package client
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache is an in-memory cache of GET responses that follows the
+// server's Cache-Control and ETag headers. Fresh responses are returned without
+// a request, while stale ones are revalidated with If-None-Match. The cache is
+// bounded to a number of responses, and the least recently used ones are
+// evicted first. It is safe to use concurrently.
+type ResponseCache struct {
+	mu      sync.Mutex
+	max     int
+	list    *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// DefaultCacheSize is the default number of responses that NewResponseCache
+// keeps if the given size is not positive.
+const DefaultCacheSize = 256
+
+// NewResponseCache creates a new cache that keeps up to max responses.
+func NewResponseCache(max int) *ResponseCache {
+	if max <= 0 {
+		max = DefaultCacheSize
+	}
+
+	return &ResponseCache{
+		max:     max,
+		list:    list.New(),
+		entries: make(map[string]*list.Element, max),
+	}
+}
+
+type cacheEntry struct {
+	key     string
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// Len returns the number of cached responses.
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.list.Len()
+}
+
+// Clear removes all cached responses.
+func (c *ResponseCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.list.Init()
+	c.entries = make(map[string]*list.Element, c.max)
+}
+
+func (c *ResponseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	c.list.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// put caches the response body with the given headers, or removes the previous
+// response if the headers don't allow caching.
+func (c *ResponseCache) put(key string, body []byte, h http.Header) {
+	e, ok := newCacheEntry(key, body, h, time.Now())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, exists := c.entries[key]; exists {
+		c.list.Remove(el)
+		delete(c.entries, key)
+	}
+
+	if !ok {
+		return
+	}
+
+	c.entries[key] = c.list.PushFront(e)
+
+	for c.list.Len() > c.max {
+		el := c.list.Back()
+		c.list.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// newCacheEntry creates a cache entry from the response headers. False is
+// returned if the response can't be cached.
+func newCacheEntry(key string, body []byte, h http.Header, now time.Time) (*cacheEntry, bool) {
+	var maxAge time.Duration
+	var noCache bool
+
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		switch {
+		case directive == "no-store":
+			return nil, false
+		case directive == "no-cache":
+			// Keep the response, but always revalidate it.
+			noCache = true
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil && secs > 0 {
+				maxAge = time.Duration(secs) * time.Second
+			}
+		}
+	}
+
+	if noCache {
+		maxAge = 0
+	}
+
+	var etag = h.Get("ETag")
+
+	// Responses that are neither fresh nor revalidatable are useless.
+	if maxAge == 0 && etag == "" {
+		return nil, false
+	}
+
+	return &cacheEntry{
+		key:     key,
+		body:    body,
+		etag:    etag,
+		expires: now.Add(maxAge),
+	}, true
+}
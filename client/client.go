@@ -1,16 +1,21 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/pkg/errors"
 )
@@ -43,6 +48,16 @@ type ErrUnexpectedStatusCode struct {
 	Code   int
 	Body   string
 	ErrMsg string
+	// Method and Path are of the request that failed. Path includes the API
+	// prefix.
+	Method string
+	Path   string
+	// Slug, RequestID and Fields are copied from the error response, if any.
+	// RequestID falls back to the X-Request-Id header for responses that
+	// aren't from the API, such as those from a reverse proxy.
+	Slug      string
+	RequestID string
+	Fields    map[string]string
 }
 
 func (err ErrUnexpectedStatusCode) StatusCode() int {
@@ -51,6 +66,13 @@ func (err ErrUnexpectedStatusCode) StatusCode() int {
 
 func (err ErrUnexpectedStatusCode) Error() string {
 	var errstr = fmt.Sprintf("Unexpected status code %d", err.Code)
+	if err.Method != "" {
+		errstr += fmt.Sprintf(" from %s %s", err.Method, err.Path)
+	}
+	if err.RequestID != "" {
+		errstr += fmt.Sprintf(" (request %s)", err.RequestID)
+	}
+
 	switch {
 	case err.ErrMsg != "":
 		errstr += ": " + err.ErrMsg
@@ -61,6 +83,95 @@ func (err ErrUnexpectedStatusCode) Error() string {
 	return errstr
 }
 
+// ErrUnauthorized is returned instead of ErrUnexpectedStatusCode when the
+// server responds with 401 Unauthorized, which usually means that the user has
+// to sign in again.
+type ErrUnauthorized struct {
+	ErrUnexpectedStatusCode
+}
+
+func (err ErrUnauthorized) Unwrap() error {
+	return err.ErrUnexpectedStatusCode
+}
+
+// ErrForbidden is returned instead of ErrUnexpectedStatusCode when the server
+// responds with 403 Forbidden, which means that the user doesn't have the
+// permission to do the action.
+type ErrForbidden struct {
+	ErrUnexpectedStatusCode
+}
+
+func (err ErrForbidden) Unwrap() error {
+	return err.ErrUnexpectedStatusCode
+}
+
+// ErrValidation is returned instead of ErrUnexpectedStatusCode when the server
+// responds with 422 Unprocessable Entity, which means that some of the given
+// fields are invalid. Fields maps the names of those fields to their error
+// messages.
+type ErrValidation struct {
+	ErrUnexpectedStatusCode
+}
+
+func (err ErrValidation) Unwrap() error {
+	return err.ErrUnexpectedStatusCode
+}
+
+// ErrUnavailable is returned instead of ErrUnexpectedStatusCode when the server
+// responds with 503 Service Unavailable, which means that the failure is
+// temporary, such as when the server's disk is full. Requests that can be
+// retried already are; others, such as uploads, may be sent again later.
+type ErrUnavailable struct {
+	ErrUnexpectedStatusCode
+}
+
+func (err ErrUnavailable) Unwrap() error {
+	return err.ErrUnexpectedStatusCode
+}
+
+// ErrReadOnly is returned instead of ErrUnavailable when the server is in
+// read-only mode, in which it rejects all writes until the owner turns it off.
+type ErrReadOnly struct {
+	ErrUnavailable
+}
+
+func (err ErrReadOnly) Unwrap() error {
+	return err.ErrUnavailable
+}
+
+// statusError returns the typed error for the status code, or the given error
+// itself if there's none.
+func statusError(err ErrUnexpectedStatusCode) error {
+	switch err.Code {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized{err}
+	case http.StatusForbidden:
+		return ErrForbidden{err}
+	case http.StatusUnprocessableEntity:
+		return ErrValidation{err}
+	case http.StatusServiceUnavailable:
+		if err.Slug == httperr.ErrSlug(smolboard.ErrReadOnly) {
+			return ErrReadOnly{ErrUnavailable{err}}
+		}
+		return ErrUnavailable{err}
+	default:
+		return err
+	}
+}
+
+// ErrIncompatibleAPI is returned when the server's API version doesn't match the
+// one this client was built for.
+type ErrIncompatibleAPI struct {
+	Server int
+	Client int
+}
+
+func (err ErrIncompatibleAPI) Error() string {
+	return fmt.Sprintf(
+		"incompatible server API version %d, expected %d", err.Server, err.Client,
+	)
+}
+
 // Client contains a single stateful HTTP client. Each session should have its
 // own client, as each client has its own cookiejar.
 type Client struct {
@@ -70,9 +181,105 @@ type Client struct {
 	agent  string
 	remote string
 	socket bool
+	token  string
+	// reauthing is 1 while ReauthFunc is running.
+	reauthing int32
+	// version is the server's version from the last fetchVersion.
+	version *smolboard.VersionInfo
 
 	// Tries sets the number of tries to connect. Default 4.
 	Tries int
+	// CookieName is the name of the session token cookie. It must match the
+	// server's. Default smolboard.DefaultCookieName.
+	CookieName string
+	// BearerAuth makes the client send the session token in the Authorization
+	// header. The server prefers the header over the cookie, so the cookie
+	// that is still kept in the jar is ignored. The token is taken from the
+	// last sign in or sign up, or it can be set with SetToken.
+	BearerAuth bool
+	// StrictAPIVersion makes Version return an ErrIncompatibleAPI if the
+	// server's API version is not smolboard.APIVersion. A warning is logged
+	// instead if this is false.
+	StrictAPIVersion bool
+	// ReauthFunc, if not nil, is called when a request fails because the
+	// session expired, which is a 410 Gone. It could sign in again with cached
+	// credentials, for example. The request is then retried once if it returns
+	// nil, or the original error is returned otherwise. Requests made while
+	// ReauthFunc is running are never reauthenticated.
+	ReauthFunc func() error
+	// Cache, if not nil, caches GET responses according to the server's
+	// Cache-Control and ETag headers. It is cleared after any other request
+	// succeeds. Use NewResponseCache to create one.
+	Cache *ResponseCache
+	// MaxRawSize is the maximum size of the bodies read by GetBytes. Default
+	// DefaultMaxRawSize if 0.
+	MaxRawSize int64
+	// RequestTimeout is the maximum duration of each try of a request,
+	// including reading the response. Default DefaultRequestTimeout if 0, or
+	// no timeout if negative.
+	RequestTimeout time.Duration
+	// UploadTimeout replaces RequestTimeout for uploads and file downloads,
+	// which can take minutes for large files. Default DefaultUploadTimeout if 0, or no
+	// timeout if negative.
+	UploadTimeout time.Duration
+}
+
+const (
+	// DefaultRequestTimeout is the default RequestTimeout.
+	DefaultRequestTimeout = 10 * time.Second
+	// DefaultUploadTimeout is the default UploadTimeout.
+	DefaultUploadTimeout = 10 * time.Minute
+)
+
+func (c *Client) requestTimeout() time.Duration {
+	if c.RequestTimeout == 0 {
+		return DefaultRequestTimeout
+	}
+	return c.RequestTimeout
+}
+
+func (c *Client) uploadTimeout() time.Duration {
+	if c.UploadTimeout == 0 {
+		return DefaultUploadTimeout
+	}
+	return c.UploadTimeout
+}
+
+// withTimeout returns a copy of the request that is canceled after the given
+// duration, if it's positive. The returned function must be called once the
+// response is read.
+func withTimeout(q *http.Request, d time.Duration) (*http.Request, context.CancelFunc) {
+	if d <= 0 {
+		return q, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(q.Context(), d)
+	return q.WithContext(ctx), cancel
+}
+
+// cancelBody cancels the request's timeout once the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// DefaultMaxRawSize is the default maximum size of the bodies read by GetBytes.
+const DefaultMaxRawSize = 32 << 20 // 32MB
+
+// ErrBodyTooLarge is returned by GetBytes if the response body is larger than
+// the client's MaxRawSize.
+type ErrBodyTooLarge struct {
+	Max int64
+}
+
+func (err ErrBodyTooLarge) Error() string {
+	return fmt.Sprintf("response body is larger than %d bytes", err.Max)
 }
 
 // NewClient makes a new client. Host is optional. This client is HTTPS by
@@ -87,15 +294,44 @@ func NewClient(host string) (*Client, error) {
 		Client: http.Client{
 			Jar: NewJar(),
 		},
-		ctx:  context.Background(),
-		host: u,
+		ctx:   context.Background(),
+		host:  u,
+		agent: DefaultUserAgent(),
 
-		Tries: 4,
+		Tries:      4,
+		CookieName: smolboard.DefaultCookieName,
 	}
 
 	return client, nil
 }
 
+// NewClientChecked makes a new client like NewClient, then fetches the
+// server's version, so that an unreachable or incompatible server fails here
+// instead of on the first real call. ErrIncompatibleAPI is returned if the
+// server's API version is not smolboard.APIVersion. The version is kept in
+// ServerVersion.
+func NewClientChecked(ctx context.Context, host string) (*Client, error) {
+	c, err := NewClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := c.WithContext(ctx).fetchVersion(true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.version = v
+	return c, nil
+}
+
+// ServerVersion returns the server's version that was last fetched, either by
+// NewClientChecked or Session.Version, or nil if it never was. Copies of the
+// client made afterwards keep it.
+func (c *Client) ServerVersion() *smolboard.VersionInfo {
+	return c.version
+}
+
 // dialer to be used w/ unix
 var dialer = net.Dialer{
 	Timeout: 30 * time.Second,
@@ -117,9 +353,11 @@ func NewSocketClient(host *url.URL, socket string) (*Client, error) {
 		},
 		ctx:    context.Background(),
 		host:   host,
+		agent:  DefaultUserAgent(),
 		socket: true,
 
-		Tries: 4,
+		Tries:      4,
+		CookieName: smolboard.DefaultCookieName,
 	}
 
 	return client, nil
@@ -145,9 +383,10 @@ func NewHTTPClientFromRequest(backendHTTP string, r *http.Request) (*Client, err
 	return c, nil
 }
 
-// NewSocketClientFromRequest creates a new stateful client with cookies and
-// useragents from the request.
-func NewSocketClientFromRequest(socket string, r *http.Request) (*Client, error) {
+// NewSocketClientFromRequest creates a new stateful client with the token
+// cookie and useragents from the request. The token cookie is looked up using
+// the given cookie name.
+func NewSocketClientFromRequest(socket, cookieName string, r *http.Request) (*Client, error) {
 	var u = &url.URL{
 		Scheme: "http",
 		Host:   r.Host,
@@ -166,10 +405,11 @@ func NewSocketClientFromRequest(socket string, r *http.Request) (*Client, error)
 	}
 
 	c.ctx = r.Context()
+	c.CookieName = cookieName
 	c.SetUserAgent(r.UserAgent())
 	c.SetRemoteAddr(r.RemoteAddr)
 
-	if t, err := r.Cookie("token"); err == nil {
+	if t, err := r.Cookie(cookieName); err == nil {
 		c.SetCookies([]*http.Cookie{t})
 	}
 
@@ -180,6 +420,11 @@ func NewSocketClientFromRequest(socket string, r *http.Request) (*Client, error)
 	return c, nil
 }
 
+// Context returns the implicit context of the client's requests.
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
 // WithContext shallow-copies the client and returns another one with the
 // implicit context set.
 func (c *Client) WithContext(ctx context.Context) *Client {
@@ -189,21 +434,195 @@ func (c *Client) WithContext(ctx context.Context) *Client {
 	return cpy
 }
 
+// WithInsecureSkipVerify shallow-copies the client and returns another one that
+// does not verify the server's TLS certificate. This is only meant for local
+// or development servers with self-signed certificates; never use it against
+// a production server, as it allows anyone to intercept the connection.
+func (c *Client) WithInsecureSkipVerify() *Client {
+	var transport *http.Transport
+
+	switch t := c.Transport.(type) {
+	case *http.Transport:
+		transport = t.Clone()
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	default:
+		// Unknown transports can't be configured, so leave them alone.
+		return c.WithContext(c.ctx)
+	}
+
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = true
+
+	cpy := c.WithContext(c.ctx)
+	cpy.Transport = transport
+	return cpy
+}
+
+// DefaultMaxIdleConnsPerHost is the default MaxIdleConnsPerHost of
+// TransportOptions. The standard library only keeps 2, which makes parallel
+// requests to the same host reconnect all the time.
+const DefaultMaxIdleConnsPerHost = 16
+
+// TransportOptions tunes how the client reuses connections. See
+// WithTransportOptions.
+type TransportOptions struct {
+	// MaxIdleConnsPerHost is the number of idle connections kept for reuse.
+	// It should be at least the number of parallel requests, such as the
+	// concurrency of SyncPosts. Default DefaultMaxIdleConnsPerHost if 0.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long idle connections are kept for. The
+	// transport's current timeout is kept if 0.
+	IdleConnTimeout time.Duration
+	// HTTP2 makes the client try HTTP/2 even if the transport has a custom
+	// dialer or TLS config, which would otherwise disable it. The transport's
+	// current setting is kept if false.
+	HTTP2 bool
+}
+
+// WithTransportOptions shallow-copies the client and returns another one that
+// uses a copy of its transport with the given options. Clients without a
+// transport use a copy of the default one. Unknown transports can't be
+// configured, so they're left alone. Socket clients don't keep connections
+// alive, so only HTTP2 applies to them.
+func (c *Client) WithTransportOptions(opts TransportOptions) *Client {
+	var transport *http.Transport
+
+	switch t := c.Transport.(type) {
+	case *http.Transport:
+		transport = t.Clone()
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	default:
+		return c.WithContext(c.ctx)
+	}
+
+	if opts.MaxIdleConnsPerHost == 0 {
+		opts.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+
+	// The total limit would otherwise cap the per-host one.
+	if transport.MaxIdleConns != 0 && transport.MaxIdleConns < opts.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = opts.MaxIdleConnsPerHost
+	}
+
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+
+	if opts.HTTP2 {
+		transport.ForceAttemptHTTP2 = true
+	}
+
+	cpy := c.WithContext(c.ctx)
+	cpy.Transport = transport
+	return cpy
+}
+
 // SetRemoteAddr sets the address that will be used for X-Forwarded-For.
 func (c *Client) SetRemoteAddr(addr string) {
 	c.remote = addr
 }
 
+// DefaultUserAgent returns the user agent that clients are made with, which is
+// smolboard-client followed by smolboard's version.
+func DefaultUserAgent() string {
+	return "smolboard-client/" + smolboard.Version
+}
+
+// SetUserAgent overrides the client's user agent, which is DefaultUserAgent by
+// default. Go's default user agent is sent if it is empty.
 func (c *Client) SetUserAgent(userAgent string) {
 	c.agent = userAgent
 }
 
 func (c *Client) Cookies() []*http.Cookie {
-	return c.Jar.Cookies(c.host)
+	return c.Jar.Cookies(c.cookieURL())
 }
 
 func (c *Client) SetCookies(cookies []*http.Cookie) {
-	c.Jar.SetCookies(c.host, cookies)
+	c.Jar.SetCookies(c.cookieURL(), cookies)
+}
+
+// cookieURL returns the URL that the client's own cookies are stored under,
+// which is the host URL within the cookie scope's path, if any.
+func (c *Client) cookieURL() *url.URL {
+	if jar, ok := c.Jar.(*Jar); ok && jar.Path != "" {
+		cpy := *c.host
+		cpy.Path = jar.Path
+		return &cpy
+	}
+	return c.host
+}
+
+// SetCookieScope sets the domain and path that the client's cookies are scoped
+// to, which is needed when the server is reverse-proxied under a subdomain or
+// a subpath. Either may be empty to keep the default: cookies are only sent to
+// the same host, regardless of the path. Custom cookiejars are left alone.
+func (c *Client) SetCookieScope(domain, path string) {
+	if jar, ok := c.Jar.(*Jar); ok {
+		jar.Domain = domain
+		jar.Path = path
+	}
+}
+
+// SetToken sets the token sent with BearerAuth.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Token returns the token sent with BearerAuth.
+func (c *Client) Token() string {
+	return c.token
+}
+
+// setHeaders sets the headers that are sent with every request.
+func (c *Client) setHeaders(q *http.Request) {
+	// Override the UserAgent if we have one.
+	if c.agent != "" {
+		q.Header.Set("User-Agent", c.agent)
+	}
+
+	q.Header.Set("X-Forwarded-For", c.remote)
+
+	if c.BearerAuth && c.token != "" {
+		q.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
+// ClearToken forgets the session, which is both the token sent with
+// BearerAuth and the token cookie.
+func (c *Client) ClearToken() {
+	c.token = ""
+
+	var cookies = []*http.Cookie{}
+	for _, cookie := range c.Cookies() {
+		if cookie.Name != c.CookieName {
+			cookies = append(cookies, cookie)
+		}
+	}
+
+	// Other jars merge the cookies instead of replacing them, so the token
+	// cookie has to be expired explicitly.
+	if _, ok := c.Jar.(*Jar); !ok {
+		cookies = append(cookies, &http.Cookie{Name: c.CookieName, MaxAge: -1})
+	}
+
+	c.SetCookies(cookies)
+}
+
+// TokenCookie returns the session token cookie, or nil if there is none.
+func (c *Client) TokenCookie() *http.Cookie {
+	for _, cookie := range c.Cookies() {
+		if cookie.Name == c.CookieName {
+			return cookie
+		}
+	}
+	return nil
 }
 
 // HostURL returns a copy of the client's host URL with the Path pointing to
@@ -224,114 +643,112 @@ func (c *Client) Endpoint() string {
 	return c.Host() + "/api/v1"
 }
 
+// DoOnce sends the request once, without retrying it. It times out after
+// RequestTimeout.
 func (c *Client) DoOnce(q *http.Request) (*http.Response, error) {
-	// Override the UserAgent if we have one.
-	if c.agent != "" {
-		q.Header.Set("User-Agent", c.agent)
-	}
+	return c.doOnce(q, c.requestTimeout())
+}
 
-	q.Header.Set("X-Forwarded-For", c.remote)
+// DoUpload is DoOnce for uploads, which times out after UploadTimeout instead.
+func (c *Client) DoUpload(q *http.Request) (*http.Response, error) {
+	return c.doOnce(q, c.uploadTimeout())
+}
+
+func (c *Client) doOnce(q *http.Request, timeout time.Duration) (*http.Response, error) {
+	c.setHeaders(q)
 
 	// Use HTTP if socket.
 	if c.socket {
 		q.URL.Scheme = "http"
 	}
 
+	q, cancel := withTimeout(q, timeout)
+
 	r, err := c.Client.Do(q)
 	if err != nil {
+		cancel()
 		return nil, errors.Wrap(err, "Failed to send request")
 	}
 
-	if r.StatusCode < 200 || r.StatusCode > 299 {
-		// Start reading the body for the error.
-		defer r.Body.Close()
-
-		var unexp = ErrUnexpectedStatusCode{Code: r.StatusCode}
+	r.Body = cancelBody{r.Body, cancel}
 
-		b, err := ioutil.ReadAll(r.Body)
-		if err == nil {
-			var errResp smolboard.ErrResponse
-			if json.Unmarshal(b, &errResp); errResp.Error != "" {
-				unexp.ErrMsg = errResp.Error
-			} else {
-				if len(b) > 100 {
-					unexp.Body = string(b[:97]) + "..."
-				} else {
-					unexp.Body = string(b)
-				}
-			}
-		}
-
-		return nil, unexp
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return nil, unexpectedStatus(r)
 	}
 
 	return r, nil
 }
 
-func (c *Client) Do(req func() (*http.Request, error)) (r *http.Response, err error) {
+// unexpectedStatus reads the error from the response's body and closes it.
+func unexpectedStatus(r *http.Response) error {
+	defer r.Body.Close()
 
-Retry:
-	for i := 0; i < c.Tries; i++ {
-		q, err := req()
-		if err != nil {
-			return nil, err
-		}
+	var unexp = ErrUnexpectedStatusCode{
+		Code:      r.StatusCode,
+		RequestID: r.Header.Get("X-Request-Id"),
+	}
 
-		// Override the UserAgent if we have one.
-		if c.agent != "" {
-			q.Header.Set("User-Agent", c.agent)
-		}
+	if r.Request != nil {
+		unexp.Method = r.Request.Method
+		unexp.Path = r.Request.URL.Path
+	}
 
-		q.Header.Set("X-Forwarded-For", c.remote)
+	b, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		var errResp smolboard.ErrResponse
+		if json.Unmarshal(b, &errResp); errResp.Error != "" {
+			unexp.ErrMsg = errResp.Error
+			unexp.Slug = errResp.Slug
+			unexp.Fields = errResp.Fields
 
-		// Use HTTP if socket.
-		if c.socket {
-			q.URL.Scheme = "http"
+			if errResp.RequestID != "" {
+				unexp.RequestID = errResp.RequestID
+			}
+		} else {
+			if len(b) > 100 {
+				unexp.Body = string(b[:97]) + "..."
+			} else {
+				unexp.Body = string(b)
+			}
 		}
+	}
 
-		r, err = c.Client.Do(q)
-		if err != nil {
-			err = errors.Wrap(err, "Failed to send request")
-			continue
-		}
+	return statusError(unexp)
+}
 
-		switch {
-		case r.StatusCode < 200: // 0-199, not sure
-			fallthrough
-		case r.StatusCode > 499: // > 500, server error
-			fallthrough
-		case r.StatusCode == http.StatusTooManyRequests: // rate limited
-			r.Body.Close()
-			continue Retry
-		default:
-			break Retry // user error, break
-		}
-	}
+// Do sends the request made by req, retrying it up to Tries times on server
+// errors. The request is also retried once after ReauthFunc succeeds if the
+// session expired.
+func (c *Client) Do(req func() (*http.Request, error)) (*http.Response, error) {
+	return c.doReauth(req, c.requestTimeout())
+}
 
-	if err == nil && (r.StatusCode < 200 || r.StatusCode > 299) {
-		// Start reading the body for the error.
-		defer r.Body.Close()
+// DoDownload is Do for downloading files, where each try times out after
+// UploadTimeout instead, as large files can take as long as uploading them.
+func (c *Client) DoDownload(req func() (*http.Request, error)) (*http.Response, error) {
+	return c.doReauth(req, c.uploadTimeout())
+}
 
-		var unexp = ErrUnexpectedStatusCode{Code: r.StatusCode}
+func (c *Client) doReauth(req func() (*http.Request, error), timeout time.Duration) (*http.Response, error) {
+	r, err := c.doRetry(req, c.retryPolicy(), timeout)
+	if c.ReauthFunc == nil || ErrGetStatusCode(err, 0) != http.StatusGone {
+		return r, err
+	}
 
-		b, err := ioutil.ReadAll(r.Body)
-		if err == nil {
-			var errResp smolboard.ErrResponse
-			if json.Unmarshal(b, &errResp); errResp.Error != "" {
-				unexp.ErrMsg = errResp.Error
-			} else {
-				if len(b) > 100 {
-					unexp.Body = string(b[:97]) + "..."
-				} else {
-					unexp.Body = string(b)
-				}
-			}
-		}
+	// Don't reauthenticate requests made by ReauthFunc, or if another request
+	// is already doing it.
+	if !atomic.CompareAndSwapInt32(&c.reauthing, 0, 1) {
+		return r, err
+	}
 
-		return nil, unexp
+	reauthErr := c.ReauthFunc()
+	atomic.StoreInt32(&c.reauthing, 0)
+
+	if reauthErr != nil {
+		return nil, err
 	}
 
-	return
+	return c.doRetry(req, c.retryPolicy(), timeout)
 }
 
 func (c *Client) DoJSON(dst interface{}, q func() (*http.Request, error)) error {
@@ -349,6 +766,66 @@ func (c *Client) DoJSON(dst interface{}, q func() (*http.Request, error)) error
 	return nil
 }
 
+// GetBytes sends a GET request and returns the raw response body along with
+// its content type. It is meant for endpoints that don't return JSON, such as
+// feeds and exports. The body is read up to MaxRawSize bytes.
+func (c *Client) GetBytes(ctx context.Context, path string, v url.Values) ([]byte, string, error) {
+	var max = c.MaxRawSize
+	if max <= 0 {
+		max = DefaultMaxRawSize
+	}
+
+	r, err := c.Do(func() (*http.Request, error) {
+		var url = fmt.Sprintf("%s%s?%s", c.Endpoint(), path, v.Encode())
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		return r, errors.Wrap(err, "Failed to create request")
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Body.Close()
+
+	// Read one more byte to know if the body is over the limit.
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Failed to read body")
+	}
+
+	if int64(len(b)) > max {
+		return nil, "", ErrBodyTooLarge{Max: max}
+	}
+
+	return b, r.Header.Get("Content-Type"), nil
+}
+
+// Upload sends a POST request with the given body, such as a multipart form
+// with files. The body is only sent once, since it can't be rewound, and the
+// request times out after UploadTimeout instead of RequestTimeout.
+func (c *Client) Upload(path string, resp interface{}, contentType string, body io.Reader) error {
+	q, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.Endpoint()+path, body)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create request")
+	}
+	q.Header.Set("Content-Type", contentType)
+
+	r, err := c.DoUpload(q)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if c.Cache != nil {
+		c.Cache.Clear()
+	}
+
+	if resp != nil {
+		err := json.NewDecoder(r.Body).Decode(resp)
+		return errors.Wrap(err, "Failed to decode JSON")
+	}
+
+	return nil
+}
+
 func (c *Client) Post(path string, resp interface{}, v url.Values) error {
 	return c.Request("POST", path, resp, v)
 }
@@ -361,10 +838,67 @@ func (c *Client) Delete(path string, resp interface{}, v url.Values) error {
 	return c.Request("DELETE", path, resp, v)
 }
 
+// RequestJSON sends a request with the given body encoded as a JSON object,
+// which the server decodes like a form, so arrays are kept as multiple values.
+// The body must not have nested objects. It can be nil to send no body.
+func (c *Client) RequestJSON(ctx context.Context, method, path string, body, resp interface{}) error {
+	var b []byte
+
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "Failed to encode JSON")
+		}
+		b = j
+	}
+
+	var req = func() (*http.Request, error) {
+		r, err := http.NewRequestWithContext(ctx, method, c.Endpoint()+path, bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create request")
+		}
+
+		if body != nil {
+			r.Header.Set("Content-Type", "application/json")
+		}
+
+		return r, nil
+	}
+
+	if err := c.DoJSON(resp, req); err != nil {
+		return err
+	}
+
+	// Anything but a GET may change what the cached responses would be.
+	if c.Cache != nil && method != http.MethodGet {
+		c.Cache.Clear()
+	}
+
+	return nil
+}
+
+// DeleteWithBody sends a DELETE request with the values in a URL-encoded body
+// instead of the query.
+func (c *Client) DeleteWithBody(path string, resp interface{}, v url.Values) error {
+	return c.request(http.MethodDelete, path, resp, v, true)
+}
+
 func (c *Client) Request(method, path string, resp interface{}, v url.Values) (err error) {
-	return c.DoJSON(resp, func() (r *http.Request, err error) {
-		switch method {
-		case http.MethodPatch, http.MethodPost, http.MethodPut:
+	var body bool
+
+	switch method {
+	case http.MethodPatch, http.MethodPost, http.MethodPut:
+		body = true
+	}
+
+	return c.request(method, path, resp, v, body)
+}
+
+// request sends a request with the values in a URL-encoded body if body is
+// true, or in the query otherwise.
+func (c *Client) request(method, path string, resp interface{}, v url.Values, body bool) error {
+	var req = func() (r *http.Request, err error) {
+		if body {
 			r, err = http.NewRequestWithContext(
 				c.ctx,
 				method, c.Endpoint()+path, strings.NewReader(v.Encode()),
@@ -372,11 +906,79 @@ func (c *Client) Request(method, path string, resp interface{}, v url.Values) (e
 			if err == nil {
 				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			}
-		default:
+		} else {
 			var url = fmt.Sprintf("%s%s?%s", c.Endpoint(), path, v.Encode())
 			r, err = http.NewRequestWithContext(c.ctx, method, url, nil)
 		}
 
 		return r, errors.Wrap(err, "Failed to create request")
+	}
+
+	if c.Cache == nil {
+		return c.DoJSON(resp, req)
+	}
+
+	if method == http.MethodGet {
+		var key = fmt.Sprintf("%s%s?%s", c.Endpoint(), path, v.Encode())
+		return c.doCachedJSON(key, resp, req)
+	}
+
+	// Anything else may change what the cached responses would be.
+	if err := c.DoJSON(resp, req); err != nil {
+		return err
+	}
+
+	c.Cache.Clear()
+	return nil
+}
+
+// doCachedJSON is DoJSON with the response cached in c.Cache under the given
+// key.
+func (c *Client) doCachedJSON(key string, dst interface{}, req func() (*http.Request, error)) error {
+	var cached = c.Cache.get(key)
+	if cached != nil && cached.fresh(time.Now()) {
+		return decodeJSON(cached.body, dst)
+	}
+
+	r, err := c.Do(func() (*http.Request, error) {
+		q, err := req()
+		if err == nil && cached != nil && cached.etag != "" {
+			q.Header.Set("If-None-Match", cached.etag)
+		}
+		return q, err
 	})
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	var body []byte
+	var header = r.Header
+
+	if r.StatusCode == http.StatusNotModified && cached != nil {
+		body = cached.body
+
+		// The ETag may be left out, since it's the same one.
+		if header.Get("ETag") == "" {
+			header = header.Clone()
+			header.Set("ETag", cached.etag)
+		}
+	} else {
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read body")
+		}
+	}
+
+	// Cache the body again, since the headers may have a new max age.
+	c.Cache.put(key, body, header)
+
+	return decodeJSON(body, dst)
+}
+
+func decodeJSON(body []byte, dst interface{}) error {
+	if dst == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(body, dst), "Failed to decode JSON")
 }
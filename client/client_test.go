@@ -0,0 +1,1382 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+)
+
+func newVersionServer(tls bool) *httptest.Server {
+	var h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/version" {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(smolboard.VersionInfo{
+			APIVersion: smolboard.APIVersion,
+		})
+	})
+
+	if tls {
+		return httptest.NewTLSServer(h)
+	}
+	return httptest.NewServer(h)
+}
+
+func newTestSession(t *testing.T, host string) *Session {
+	t.Helper()
+
+	c, err := NewClient(host)
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	c.Tries = 1
+
+	return NewSessionWithClient(c)
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	srv := newVersionServer(true)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	t.Run("Verified", func(t *testing.T) {
+		if _, err := s.Version(); err == nil {
+			t.Fatal("Unexpected success with a self-signed certificate")
+		}
+	})
+
+	t.Run("Insecure", func(t *testing.T) {
+		insecure := NewSessionWithClient(s.Client.WithInsecureSkipVerify())
+
+		v, err := insecure.Version()
+		if err != nil {
+			t.Fatal("Failed to get version:", err)
+		}
+		if v.APIVersion != smolboard.APIVersion {
+			t.Fatal("Unexpected API version:", v.APIVersion)
+		}
+
+		// The original client should still verify certificates.
+		if _, err := s.Version(); err == nil {
+			t.Fatal("Unexpected success from the original client")
+		}
+	})
+}
+
+func TestTransportOptions(t *testing.T) {
+	c, err := NewClient("https://example.com")
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+
+	tuned := c.WithTransportOptions(TransportOptions{
+		IdleConnTimeout: time.Minute,
+		HTTP2:           true,
+	})
+
+	tr, ok := tuned.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Unexpected transport: %T", tuned.Transport)
+	}
+
+	if tr.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost {
+		t.Fatal("Unexpected max idle conns per host:", tr.MaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != time.Minute || !tr.ForceAttemptHTTP2 {
+		t.Fatalf("Unexpected transport options: %v, %v", tr.IdleConnTimeout, tr.ForceAttemptHTTP2)
+	}
+
+	tuned = c.WithTransportOptions(TransportOptions{MaxIdleConnsPerHost: 200})
+	tr = tuned.Transport.(*http.Transport)
+
+	if tr.MaxIdleConnsPerHost != 200 || tr.MaxIdleConns < 200 {
+		t.Fatalf("Unexpected idle conns: %d per host, %d total", tr.MaxIdleConnsPerHost, tr.MaxIdleConns)
+	}
+
+	// The original client should still use the default transport.
+	if c.Transport != nil {
+		t.Fatalf("Unexpected transport on the original client: %T", c.Transport)
+	}
+}
+
+// BenchmarkTransportOptions compares the throughput of parallel requests to the
+// same host with the default and tuned transports.
+func BenchmarkTransportOptions(b *testing.B) {
+	var body = bytes.Repeat([]byte("a"), 64<<10)
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL)
+	if err != nil {
+		b.Fatal("Failed to create client:", err)
+	}
+
+	var clients = []struct {
+		name   string
+		client *Client
+	}{
+		// Each needs a fresh transport, as the default one is shared.
+		{"Default", c.WithTransportOptions(TransportOptions{MaxIdleConnsPerHost: 2})},
+		{"Tuned", c.WithTransportOptions(TransportOptions{MaxIdleConnsPerHost: 64})},
+	}
+
+	for _, test := range clients {
+		c := test.client
+
+		b.Run(test.name, func(b *testing.B) {
+			defer c.CloseIdleConnections()
+
+			b.SetBytes(int64(len(body)))
+			b.SetParallelism(8)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, err := c.GetBytes(context.Background(), "/file", nil); err != nil {
+						b.Error("Failed to get file:", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestNewClientChecked(t *testing.T) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/version", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(smolboard.VersionInfo{
+			Version:    "v1.2.3",
+			APIVersion: smolboard.APIVersion,
+		})
+	})
+	mux.HandleFunc("/future/api/v1/version", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(smolboard.VersionInfo{
+			Version:    "v9.0.0",
+			APIVersion: smolboard.APIVersion + 1,
+		})
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Run("Compatible", func(t *testing.T) {
+		c, err := NewClientChecked(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal("Failed to create client:", err)
+		}
+
+		v := c.ServerVersion()
+		if v == nil || v.Version != "v1.2.3" || v.APIVersion != smolboard.APIVersion {
+			t.Fatalf("Unexpected server version: %#v", v)
+		}
+	})
+
+	t.Run("Incompatible", func(t *testing.T) {
+		_, err := NewClientChecked(context.Background(), srv.URL+"/future")
+
+		var incompat ErrIncompatibleAPI
+		if !errors.As(err, &incompat) || incompat.Server != smolboard.APIVersion+1 {
+			t.Fatal("Unexpected error with an incompatible server:", err)
+		}
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		dead := httptest.NewServer(http.NotFoundHandler())
+		dead.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := NewClientChecked(ctx, dead.URL); err == nil {
+			t.Fatal("Unexpected success with an unreachable server")
+		}
+	})
+
+	// Plain clients don't know the version until it's fetched.
+	c, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	if c.ServerVersion() != nil {
+		t.Fatal("Unexpected server version before fetching it")
+	}
+}
+
+func TestPlainHTTP(t *testing.T) {
+	srv := newVersionServer(false)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	if _, err := s.Version(); err != nil {
+		t.Fatal("Failed to get version over plain HTTP:", err)
+	}
+}
+
+func TestCookieScope(t *testing.T) {
+	const token = "hunter2"
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/smolboard/api/v1/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(smolboard.DefaultCookieName)
+		if err != nil || c.Value != token {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(smolboard.UserPart{Username: "ひめありかわ"})
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL+"/smolboard")
+	s.Client.SetCookieScope("127.0.0.1", "/smolboard")
+	s.Client.SetCookies([]*http.Cookie{
+		{Name: smolboard.DefaultCookieName, Value: token, Path: "/"},
+	})
+
+	t.Run("Cookies", func(t *testing.T) {
+		c := s.Client.TokenCookie()
+		if c == nil {
+			t.Fatal("Token cookie not found")
+		}
+		if c.Domain != "127.0.0.1" || c.Path != "/smolboard" {
+			t.Fatalf("Unexpected cookie scope: domain %q, path %q", c.Domain, c.Path)
+		}
+	})
+
+	t.Run("Sent", func(t *testing.T) {
+		u, err := s.Me()
+		if err != nil {
+			t.Fatal("Failed to get self:", err)
+		}
+		if u.Username != "ひめありかわ" {
+			t.Fatal("Unexpected username:", u.Username)
+		}
+	})
+
+	t.Run("OutOfScope", func(t *testing.T) {
+		for _, rawURL := range []string{
+			srv.URL + "/api/v1/users/@me",
+			srv.URL + "/smolboardx/api/v1",
+			"http://example.com/smolboard/api/v1",
+		} {
+			u, _ := url.Parse(rawURL)
+
+			if cookies := s.Client.Jar.Cookies(u); len(cookies) > 0 {
+				t.Errorf("Unexpected cookies sent to %s: %v", rawURL, cookies)
+			}
+		}
+	})
+}
+
+func TestResponseCache(t *testing.T) {
+	var hits, revalidations int
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/filetypes", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		json.NewEncoder(w).Encode([]string{"image/png"})
+	})
+	mux.HandleFunc("/api/v1/version", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		json.NewEncoder(w).Encode(smolboard.VersionInfo{APIVersion: smolboard.APIVersion})
+	})
+	mux.HandleFunc("/api/v1/signout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+	s.Client.Cache = NewResponseCache(1)
+
+	t.Run("Fresh", func(t *testing.T) {
+		hits = 0
+
+		for i := 0; i < 2; i++ {
+			ts, err := s.AllowedTypes()
+			if err != nil {
+				t.Fatal("Failed to get allowed types:", err)
+			}
+			if len(ts) != 1 || ts[0] != "image/png" {
+				t.Fatalf("Unexpected allowed types: %v", ts)
+			}
+		}
+
+		if hits != 1 {
+			t.Fatal("Unexpected number of requests:", hits)
+		}
+	})
+
+	t.Run("Revalidate", func(t *testing.T) {
+		hits = 0
+
+		for i := 0; i < 2; i++ {
+			v, err := s.Version()
+			if err != nil {
+				t.Fatal("Failed to get version:", err)
+			}
+			if v.APIVersion != smolboard.APIVersion {
+				t.Fatal("Unexpected API version:", v.APIVersion)
+			}
+		}
+
+		if hits != 2 || revalidations != 1 {
+			t.Fatalf("Unexpected %d requests with %d revalidations", hits, revalidations)
+		}
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		// The version evicted the allowed types.
+		if n := s.Client.Cache.Len(); n != 1 {
+			t.Fatal("Unexpected cache size:", n)
+		}
+
+		hits = 0
+
+		if _, err := s.AllowedTypes(); err != nil {
+			t.Fatal("Failed to get allowed types:", err)
+		}
+		if hits != 1 {
+			t.Fatal("Evicted response was served from cache")
+		}
+	})
+
+	t.Run("Cleared", func(t *testing.T) {
+		if err := s.Signout(); err != nil {
+			t.Fatal("Failed to sign out:", err)
+		}
+		if n := s.Client.Cache.Len(); n != 0 {
+			t.Fatal("Cache not cleared after a POST:", n)
+		}
+	})
+}
+
+func TestStatusErrors(t *testing.T) {
+	var mux = http.NewServeMux()
+
+	var verr = httperr.NewValidationError()
+	verr.Add("username", smolboard.ErrIllegalName)
+	verr.Add("password", smolboard.ErrPasswordTooShort)
+
+	for code, err := range map[int]error{
+		http.StatusUnauthorized:        smolboard.ErrInvalidPassword,
+		http.StatusForbidden:           smolboard.ErrActionNotPermitted,
+		http.StatusNotFound:            smolboard.ErrUserNotFound,
+		http.StatusUnprocessableEntity: verr,
+		http.StatusServiceUnavailable:  errors.New("storage error"),
+	} {
+		code, err := code, err
+
+		mux.HandleFunc(fmt.Sprintf("/api/v1/%d", code), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(smolboard.ErrResponse{
+				Error:  err.Error(),
+				Slug:   httperr.ErrSlug(err),
+				Fields: httperr.ErrFields(err),
+			})
+		})
+	}
+
+	mux.HandleFunc("/api/v1/read-only", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(smolboard.ErrResponse{
+			Error: smolboard.ErrReadOnly.Error(),
+			Slug:  httperr.ErrSlug(smolboard.ErrReadOnly),
+		})
+	})
+
+	// Errors from a reverse proxy only have the request ID in the header.
+	mux.HandleFunc("/api/v1/proxy", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "ひめ-1")
+		http.Error(w, "request header too large", http.StatusBadRequest)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		err := s.Client.Get("/401", nil, nil)
+
+		var unauth ErrUnauthorized
+		if !errors.As(err, &unauth) {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+		if unauth.Slug != httperr.ErrSlug(smolboard.ErrInvalidPassword) {
+			t.Fatal("Unexpected slug:", unauth.Slug)
+		}
+		if ErrGetStatusCode(err, 0) != http.StatusUnauthorized {
+			t.Fatal("Unexpected status code:", ErrGetStatusCode(err, 0))
+		}
+	})
+
+	t.Run("Forbidden", func(t *testing.T) {
+		err := s.Client.Get("/403", nil, nil)
+
+		var forbidden ErrForbidden
+		if !errors.As(err, &forbidden) {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+
+		// The fallback type should still match.
+		var unexp ErrUnexpectedStatusCode
+		if !errors.As(err, &unexp) || unexp.Code != http.StatusForbidden {
+			t.Fatalf("Error doesn't unwrap to the status code error: %v", err)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		err := s.Client.Get("/422", nil, nil)
+
+		var invalid ErrValidation
+		if !errors.As(err, &invalid) {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+		if invalid.Slug != httperr.ValidationSlug {
+			t.Fatal("Unexpected slug:", invalid.Slug)
+		}
+
+		var fields = map[string]string{
+			"username": smolboard.ErrIllegalName.Error(),
+			"password": smolboard.ErrPasswordTooShort.Error(),
+		}
+		if len(invalid.Fields) != len(fields) {
+			t.Fatal("Unexpected fields:", invalid.Fields)
+		}
+		for name, msg := range fields {
+			if invalid.Fields[name] != msg {
+				t.Fatalf("Unexpected error for field %q: %q", name, invalid.Fields[name])
+			}
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		err := s.Client.Get("/503", nil, nil)
+
+		var unavailable ErrUnavailable
+		if !errors.As(err, &unavailable) {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+		if errors.As(err, new(ErrReadOnly)) {
+			t.Fatal("Unexpected read-only error for a storage error")
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		err := s.Client.Post("/read-only", nil, nil)
+
+		if !errors.As(err, new(ErrReadOnly)) {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+		if !errors.As(err, new(ErrUnavailable)) {
+			t.Fatal("Read-only error is not unavailable")
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		err := s.Client.Get("/404", nil, nil)
+
+		if _, ok := err.(ErrUnexpectedStatusCode); !ok {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+		if errors.As(err, new(ErrUnauthorized)) || errors.As(err, new(ErrForbidden)) {
+			t.Fatal("Unexpected typed error for 404")
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		err := s.Client.Post("/403", nil, nil)
+
+		var unexp ErrUnexpectedStatusCode
+		if !errors.As(err, &unexp) {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+		if unexp.Method != "POST" || unexp.Path != "/api/v1/403" {
+			t.Fatalf("Unexpected request %s %s", unexp.Method, unexp.Path)
+		}
+		if !strings.Contains(err.Error(), "POST /api/v1/403") {
+			t.Fatal("Request missing from the error:", err)
+		}
+
+		err = s.Client.Get("/proxy", nil, nil)
+
+		if !errors.As(err, &unexp) {
+			t.Fatalf("Unexpected error type %T: %v", err, err)
+		}
+		if unexp.Method != "GET" || unexp.Path != "/api/v1/proxy" || unexp.RequestID != "ひめ-1" {
+			t.Fatalf("Unexpected request %s %s (%s)", unexp.Method, unexp.Path, unexp.RequestID)
+		}
+		if !strings.Contains(err.Error(), "ひめ-1") {
+			t.Fatal("Request ID missing from the error:", err)
+		}
+	})
+}
+
+func TestReauthFunc(t *testing.T) {
+	var token = "old"
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusGone)
+			json.NewEncoder(w).Encode(smolboard.ErrResponse{
+				Error: smolboard.ErrSessionExpired.Error(),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(smolboard.UserPart{Username: "ひめありかわ"})
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+	s.Client.BearerAuth = true
+	s.Client.SetToken("old")
+
+	// Expire the session.
+	token = "new"
+
+	t.Run("Success", func(t *testing.T) {
+		var calls int
+		s.Client.ReauthFunc = func() error {
+			calls++
+			s.Client.SetToken("new")
+			return nil
+		}
+
+		u, err := s.Me()
+		if err != nil {
+			t.Fatal("Failed to get self after reauthenticating:", err)
+		}
+		if u.Username != "ひめありかわ" {
+			t.Fatal("Unexpected username:", u.Username)
+		}
+		if calls != 1 {
+			t.Fatal("Unexpected number of reauths:", calls)
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		s.Client.SetToken("old")
+
+		var calls int
+		s.Client.ReauthFunc = func() error {
+			calls++
+			return errors.New("no credentials")
+		}
+
+		_, err := s.Me()
+		if ErrGetStatusCode(err, 0) != http.StatusGone {
+			t.Fatal("Unexpected error after failing to reauthenticate:", err)
+		}
+		if calls != 1 {
+			t.Fatal("Unexpected number of reauths:", calls)
+		}
+	})
+
+	t.Run("Loop", func(t *testing.T) {
+		s.Client.SetToken("old")
+
+		var calls int
+		s.Client.ReauthFunc = func() error {
+			calls++
+			// This also expires, but it must not reauthenticate again.
+			_, err := s.Me()
+			return err
+		}
+
+		_, err := s.Me()
+		if ErrGetStatusCode(err, 0) != http.StatusGone {
+			t.Fatal("Unexpected error after looping:", err)
+		}
+		if calls != 1 {
+			t.Fatal("Unexpected number of reauths:", calls)
+		}
+	})
+}
+
+func TestGetBytes(t *testing.T) {
+	const feed = `<?xml version="1.0" encoding="utf-8"?><feed></feed>`
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/feed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/atom+xml")
+		w.Write([]byte(feed))
+	})
+	mux.HandleFunc("/api/v1/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	b, ctype, err := s.Client.GetBytes(context.Background(), "/feed", nil)
+	if err != nil {
+		t.Fatal("Failed to get feed:", err)
+	}
+	if string(b) != feed || ctype != "application/atom+xml" {
+		t.Fatalf("Unexpected feed %q with content type %q", b, ctype)
+	}
+
+	_, _, err = s.Client.GetBytes(context.Background(), "/missing", nil)
+	if ErrGetStatusCode(err, 0) != http.StatusNotFound {
+		t.Fatal("Unexpected error getting a missing endpoint:", err)
+	}
+
+	s.Client.MaxRawSize = int64(len(feed)) - 1
+
+	_, _, err = s.Client.GetBytes(context.Background(), "/feed", nil)
+	if !errors.As(err, new(ErrBodyTooLarge)) {
+		t.Fatal("Unexpected error getting a feed over the limit:", err)
+	}
+}
+
+func TestDeleteWithBody(t *testing.T) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/posts/1", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"method": r.Method,
+			"type":   r.Header.Get("Content-Type"),
+			"query":  r.URL.RawQuery,
+			"body":   string(b),
+		})
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	var v = url.Values{"reason": {"ひめ"}}
+	var resp map[string]string
+
+	if err := s.Client.DeleteWithBody("/posts/1", &resp, v); err != nil {
+		t.Fatal("Failed to delete:", err)
+	}
+
+	expect := map[string]string{
+		"method": "DELETE",
+		"type":   "application/x-www-form-urlencoded",
+		"query":  "",
+		"body":   v.Encode(),
+	}
+
+	for k, v := range expect {
+		if resp[k] != v {
+			t.Fatalf("Unexpected %s %q, expected %q", k, resp[k], v)
+		}
+	}
+
+	// Plain DELETEs still use the query.
+	if err := s.Client.Delete("/posts/1", &resp, v); err != nil {
+		t.Fatal("Failed to delete:", err)
+	}
+	if resp["query"] != v.Encode() || resp["body"] != "" {
+		t.Fatalf("Unexpected plain DELETE: %#v", resp)
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	var tries int
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/flaky", func(w http.ResponseWriter, r *http.Request) {
+		tries++
+
+		b, _ := ioutil.ReadAll(r.Body)
+		if string(b) != "ひめ" {
+			t.Errorf("Unexpected body %q on try %d", b, tries)
+		}
+
+		if tries < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	newRequest := func() *http.Request {
+		q, err := http.NewRequest(http.MethodPost, s.Client.Endpoint()+"/flaky", strings.NewReader("ひめ"))
+		if err != nil {
+			t.Fatal("Failed to create request:", err)
+		}
+		return q
+	}
+
+	var backoffs []int
+
+	r, err := s.Client.DoWithRetry(newRequest(), RetryPolicy{
+		MaxAttempts: 3,
+		Backoff: func(retry int) time.Duration {
+			backoffs = append(backoffs, retry)
+			return time.Millisecond
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to do request:", err)
+	}
+	defer r.Body.Close()
+
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != "ok" {
+		t.Fatalf("Unexpected body %q", b)
+	}
+	if tries != 3 {
+		t.Fatalf("Unexpected tries %d, expected 3", tries)
+	}
+	if fmt.Sprint(backoffs) != "[1 2]" {
+		t.Fatalf("Unexpected backoffs %v", backoffs)
+	}
+
+	// Giving up returns the last status.
+	tries = 0
+
+	_, err = s.Client.DoWithRetry(newRequest(), RetryPolicy{MaxAttempts: 2})
+	if code := ErrGetStatusCode(err, 0); code != http.StatusInternalServerError {
+		t.Fatalf("Unexpected status %d, error: %v", code, err)
+	}
+	if tries != 2 {
+		t.Fatalf("Unexpected tries %d, expected 2", tries)
+	}
+
+	// The predicate can refuse to retry.
+	tries = 0
+
+	_, err = s.Client.DoWithRetry(newRequest(), RetryPolicy{
+		MaxAttempts: 3,
+		Retryable:   func(*http.Response, error) bool { return false },
+	})
+	if err == nil || tries != 1 {
+		t.Fatalf("Unexpected tries %d, error: %v", tries, err)
+	}
+}
+
+// slowReader returns n chunks of data with a delay before each one.
+type slowReader struct {
+	n     int
+	delay time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	r.n--
+
+	time.Sleep(r.delay)
+	return copy(b, "slow "), nil
+}
+
+func TestUploadTimeout(t *testing.T) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/posts", func(w http.ResponseWriter, r *http.Request) {
+		var posts = []smolboard.Post{}
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if p.FormName() == "file" {
+				ioutil.ReadAll(p)
+				posts = append(posts, smolboard.Post{ContentType: "text/plain"})
+			}
+		}
+
+		json.NewEncoder(w).Encode(posts)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// The file takes around 200ms to be sent.
+	var files = func() []UploadFile {
+		return []UploadFile{{
+			Name: "slow.txt",
+			Body: &slowReader{n: 10, delay: 20 * time.Millisecond},
+		}}
+	}
+
+	t.Run("Independent", func(t *testing.T) {
+		s := newTestSession(t, srv.URL)
+		s.Client.RequestTimeout = 50 * time.Millisecond
+		s.Client.UploadTimeout = 10 * time.Second
+
+		posts, err := s.UploadPosts(files(), smolboard.PermissionUser)
+		if err != nil {
+			t.Fatal("Upload timed out with the request timeout:", err)
+		}
+		if len(posts) != 1 {
+			t.Fatal("Unexpected posts:", posts)
+		}
+	})
+
+	t.Run("Exceeded", func(t *testing.T) {
+		s := newTestSession(t, srv.URL)
+		s.Client.RequestTimeout = 10 * time.Second
+		s.Client.UploadTimeout = 50 * time.Millisecond
+
+		_, err := s.UploadPosts(files(), smolboard.PermissionUser)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("Unexpected error:", err)
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		s := newTestSession(t, srv.URL)
+		s.Client.RequestTimeout = 50 * time.Millisecond
+
+		q, err := http.NewRequest("POST", s.Endpoint("/posts"), &slowReader{n: 10, delay: 20 * time.Millisecond})
+		if err != nil {
+			t.Fatal("Failed to create request:", err)
+		}
+
+		if _, err := s.Client.DoOnce(q); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("Unexpected error:", err)
+		}
+	})
+}
+
+func TestUploadSkipDuplicates(t *testing.T) {
+	dupHash, err := ContentHash(strings.NewReader("ひめ"))
+	if err != nil {
+		t.Fatal("Failed to hash:", err)
+	}
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/posts/hash/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimPrefix(r.URL.Path, "/api/v1/posts/hash/") != dupHash {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(smolboard.ErrResponse{
+				Error: smolboard.ErrPostNotFound.Error(),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(smolboard.Post{ID: 1, ContentHash: dupHash})
+	})
+
+	// uploaded contains the name and content of each uploaded file.
+	var uploaded []string
+
+	mux.HandleFunc("/api/v1/posts", func(w http.ResponseWriter, r *http.Request) {
+		var posts = []smolboard.Post{}
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if p.FormName() == "file" {
+				b, _ := ioutil.ReadAll(p)
+				uploaded = append(uploaded, p.FileName()+"="+string(b))
+				posts = append(posts, smolboard.Post{ID: int64(len(uploaded) + 1)})
+			}
+		}
+
+		json.NewEncoder(w).Encode(posts)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	t.Run("Skipped", func(t *testing.T) {
+		posts, err := s.UploadPosts([]UploadFile{
+			{Name: "dup.png", Body: bytes.NewReader([]byte("ひめ")), SkipDuplicates: true},
+			{Name: "new.png", Body: bytes.NewReader([]byte("かぐや")), SkipDuplicates: true},
+			{Name: "plain.png", Body: strings.NewReader("ひめ")},
+		}, smolboard.PermissionUser)
+		if err != nil {
+			t.Fatal("Failed to upload:", err)
+		}
+
+		var ids = make([]int64, len(posts))
+		for i, post := range posts {
+			ids[i] = post.ID
+		}
+
+		if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+			t.Fatal("Unexpected post IDs:", ids)
+		}
+
+		// The hashed file must be rewound before it's uploaded.
+		if len(uploaded) != 2 || uploaded[0] != "new.png=かぐや" || uploaded[1] != "plain.png=ひめ" {
+			t.Fatalf("Unexpected uploaded files: %q", uploaded)
+		}
+	})
+
+	t.Run("AllSkipped", func(t *testing.T) {
+		uploaded = nil
+
+		posts, err := s.UploadPosts([]UploadFile{
+			{Name: "dup.png", Body: bytes.NewReader([]byte("ひめ")), SkipDuplicates: true},
+		}, smolboard.PermissionUser)
+		if err != nil {
+			t.Fatal("Failed to upload:", err)
+		}
+
+		if len(posts) != 1 || posts[0].ID != 1 || len(uploaded) != 0 {
+			t.Fatalf("Unexpected upload of %q, posts: %v", uploaded, posts)
+		}
+	})
+
+	t.Run("Unseekable", func(t *testing.T) {
+		_, err := s.UploadPosts([]UploadFile{
+			{Name: "dup.png", Body: ioutil.NopCloser(strings.NewReader("ひめ")), SkipDuplicates: true},
+		}, smolboard.PermissionUser)
+		if err == nil {
+			t.Fatal("Unexpected success skipping duplicates of an unseekable file")
+		}
+	})
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	var agents = make(chan string, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+
+	if err := s.Client.Get("/", nil, nil); err != nil {
+		t.Fatal("Failed to get:", err)
+	}
+	if agent := <-agents; agent != "smolboard-client/"+smolboard.Version {
+		t.Fatalf("Unexpected default user agent %q", agent)
+	}
+
+	s.Client.SetUserAgent("ひめ/1.0")
+
+	if err := s.Client.Get("/", nil, nil); err != nil {
+		t.Fatal("Failed to get:", err)
+	}
+	if agent := <-agents; agent != "ひめ/1.0" {
+		t.Fatalf("Unexpected user agent %q after overriding it", agent)
+	}
+}
+
+// setenv sets the environment variable until the test ends.
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestNewClientFromEnv(t *testing.T) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if c, err := r.Cookie(smolboard.DefaultCookieName); err == nil {
+			token = c.Value
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"agent": r.UserAgent(),
+			"token": token,
+		})
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	setenv(t, EnvHost, "")
+
+	if _, err := NewClientFromEnv(); !errors.Is(err, ErrNoHostEnv) {
+		t.Fatal("Unexpected error without a host:", err)
+	}
+
+	dir, err := ioutil.TempDir("", "smolboard-env")
+	if err != nil {
+		t.Fatal("Failed to create temp dir:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var cookieFile = filepath.Join(dir, "cookie")
+
+	setenv(t, EnvHost, srv.URL)
+	setenv(t, EnvCookieFile, cookieFile)
+
+	get := func() map[string]string {
+		t.Helper()
+
+		c, err := NewClientFromEnv()
+		if err != nil {
+			t.Fatal("Failed to create client:", err)
+		}
+
+		if c.Host() != srv.URL {
+			t.Fatalf("Unexpected host %q, expected %q", c.Host(), srv.URL)
+		}
+
+		var resp map[string]string
+		if err := c.Get("/users/@me", &resp, nil); err != nil {
+			t.Fatal("Failed to get:", err)
+		}
+
+		return resp
+	}
+
+	// A missing cookie file means there is no session yet.
+	resp := get()
+	if resp["agent"] != ToolUserAgent() {
+		t.Fatalf("Unexpected user agent %q, expected %q", resp["agent"], ToolUserAgent())
+	}
+	if !strings.HasSuffix(resp["agent"], " smolboard-client/"+smolboard.Version) {
+		t.Fatalf("User agent %q doesn't have the version", resp["agent"])
+	}
+	if resp["token"] != "" {
+		t.Fatalf("Unexpected token %q without a cookie file", resp["token"])
+	}
+
+	if err := ioutil.WriteFile(cookieFile, []byte("aGltZQ\n"), 0600); err != nil {
+		t.Fatal("Failed to write cookie file:", err)
+	}
+
+	if resp := get(); resp["token"] != "aGltZQ" {
+		t.Fatalf("Unexpected token %q from the cookie file", resp["token"])
+	}
+}
+
+func TestIsAuthenticated(t *testing.T) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/users/@me/sessions/@this", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			json.NewEncoder(w).Encode(smolboard.Session{ID: 1, Username: "ひめありかわ"})
+		case "Bearer old":
+			w.WriteHeader(http.StatusGone)
+			json.NewEncoder(w).Encode(smolboard.ErrResponse{Error: "session expired"})
+		case "Bearer bogus":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(smolboard.ErrResponse{Error: "session not found"})
+		default:
+			json.NewEncoder(w).Encode(smolboard.Session{})
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var tests = map[string]bool{
+		"good":  true,
+		"old":   false,
+		"bogus": false,
+		"":      false,
+	}
+
+	for token, expect := range tests {
+		s := newTestSession(t, srv.URL)
+		s.Client.BearerAuth = true
+		s.Client.SetToken(token)
+
+		ok, err := s.IsAuthenticated(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error with token %q: %v", token, err)
+		}
+		if ok != expect {
+			t.Fatalf("Unexpected authentication state with token %q: %v", token, ok)
+		}
+	}
+
+	t.Run("NetworkError", func(t *testing.T) {
+		dead := httptest.NewServer(mux)
+		dead.Close()
+
+		s := newTestSession(t, dead.URL)
+
+		if _, err := s.IsAuthenticated(context.Background()); err == nil {
+			t.Fatal("Unexpected nil error from a closed server")
+		}
+	})
+}
+
+func TestSyncPosts(t *testing.T) {
+	var posts = []smolboard.Post{
+		{ID: 4, ContentType: "image/png"},
+		{ID: 3, ContentType: "image/jpeg"},
+		{ID: 2, ContentType: "image/png"},
+		{ID: 1, ContentType: "image/gif"},
+	}
+
+	var mu sync.Mutex
+	var limited bool
+	var downloads = map[string]int{}
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/posts", func(w http.ResponseWriter, r *http.Request) {
+		// Split the posts into 2 pages.
+		var page = smolboard.SearchResults{Posts: posts[:2], Cursor: "next"}
+		if r.FormValue("cursor") == "next" {
+			page = smolboard.SearchResults{Posts: posts[2:]}
+		}
+
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/api/v1/images/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/images/")
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch name {
+		case "1.gif":
+			http.NotFound(w, r)
+			return
+		case "3.jpeg":
+			// Rate limit the first try.
+			if !limited {
+				limited = true
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		downloads[name]++
+		w.Write([]byte(name))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+	s.Client.Tries = 2
+
+	dir, err := ioutil.TempDir("", "smolboard-sync")
+	if err != nil {
+		t.Fatal("Failed to create temp dir:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// Pretend that a previous sync already downloaded this one.
+	if err := ioutil.WriteFile(filepath.Join(dir, "2.png"), []byte("old"), 0644); err != nil {
+		t.Fatal("Failed to write existing file:", err)
+	}
+
+	var filter = PostFilter{
+		Match: func(p smolboard.Post) bool { return p.ID != 4 },
+	}
+
+	r, err := s.SyncPosts(context.Background(), dir, filter, 2)
+	if err != nil {
+		t.Fatal("Failed to sync posts:", err)
+	}
+
+	if r.Downloaded != 1 || r.Skipped != 1 || r.Failed != 1 || len(r.Files) != 3 {
+		t.Fatalf("Unexpected sync result: %#v", r)
+	}
+
+	var expect = []struct {
+		id      int64
+		skipped bool
+		failed  bool
+	}{
+		{3, false, false},
+		{2, true, false},
+		{1, false, true},
+	}
+
+	for i, file := range r.Files {
+		e := expect[i]
+		if file.Post.ID != e.id || file.Skipped != e.skipped || (file.Err != nil) != e.failed {
+			t.Fatalf("Unexpected file %d: %#v", i, file)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "3.jpeg"))
+	if err != nil || string(b) != "3.jpeg" {
+		t.Fatalf("Unexpected downloaded file %q: %v", b, err)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "2.png"))
+	if err != nil || string(b) != "old" {
+		t.Fatalf("Unexpected skipped file %q: %v", b, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "1.gif")); !os.IsNotExist(err) {
+		t.Fatal("Unexpected file for failed download:", err)
+	}
+
+	// Syncing again only retries the failed one.
+	r, err = s.SyncPosts(context.Background(), dir, filter, 2)
+	if err != nil {
+		t.Fatal("Failed to sync posts again:", err)
+	}
+	if r.Downloaded != 0 || r.Skipped != 2 || r.Failed != 1 {
+		t.Fatalf("Unexpected resumed sync result: %#v", r)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if downloads["3.jpeg"] != 1 || downloads["2.png"] != 0 {
+		t.Fatalf("Unexpected downloads: %v", downloads)
+	}
+}
+
+func TestListAndDeleteSessions(t *testing.T) {
+	var sessions = map[int64]smolboard.Session{
+		1: {ID: 1, Username: "ひめありかわ", AuthToken: "current", UserAgent: "smolboard-cli"},
+		2: {ID: 2, Username: "ひめありかわ", UserAgent: "Firefox"},
+	}
+	var mu sync.Mutex
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/api/v1/users/@me/sessions", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var list smolboard.SessionList
+		for _, id := range []int64{1, 2} {
+			if ses, ok := sessions[id]; ok {
+				list.Sessions = append(list.Sessions, ses)
+			}
+		}
+
+		json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("/api/v1/users/@me/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		param := strings.TrimPrefix(r.URL.Path, "/api/v1/users/@me/sessions/")
+
+		switch {
+		case param == "@this" && r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(sessions[1])
+		case r.Method == http.MethodDelete:
+			var id int64
+			fmt.Sscan(param, &id)
+			delete(sessions, id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestSession(t, srv.URL)
+	s.Client.BearerAuth = true
+	s.Client.SetToken("current")
+	s.Client.SetCookies([]*http.Cookie{{Name: s.Client.CookieName, Value: "current"}})
+
+	list, err := s.ListSessions()
+	if err != nil {
+		t.Fatal("Failed to list sessions:", err)
+	}
+
+	if len(list) != 2 {
+		t.Fatalf("Unexpected sessions: %#v", list)
+	}
+	if !list[0].Current || list[1].Current {
+		t.Fatalf("Unexpected current flags: %v, %v", list[0].Current, list[1].Current)
+	}
+	if list[1].UserAgent != "Firefox" {
+		t.Fatalf("Unexpected user agent: %q", list[1].UserAgent)
+	}
+
+	if err := s.DeleteSession(2); err != nil {
+		t.Fatal("Failed to delete other session:", err)
+	}
+
+	if s.Client.Token() != "current" || s.Client.TokenCookie() == nil {
+		t.Fatal("Token was cleared after deleting another session")
+	}
+
+	list, err = s.ListSessions()
+	if err != nil {
+		t.Fatal("Failed to list sessions:", err)
+	}
+	if len(list) != 1 || list[0].ID != 1 {
+		t.Fatalf("Unexpected sessions after deletion: %#v", list)
+	}
+
+	if err := s.DeleteSession(1); err != nil {
+		t.Fatal("Failed to delete current session:", err)
+	}
+
+	if s.Client.Token() != "" {
+		t.Fatalf("Token was not cleared: %q", s.Client.Token())
+	}
+	if c := s.Client.TokenCookie(); c != nil {
+		t.Fatalf("Cookie was not cleared: %#v", c)
+	}
+}
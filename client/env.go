@@ -0,0 +1,92 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EnvHost is the environment variable of the host that NewClientFromEnv
+	// connects to.
+	EnvHost = "SMOLBOARD_HOST"
+	// EnvCookieFile is the environment variable of the path to the file that
+	// NewClientFromEnv loads the session from. It is optional.
+	EnvCookieFile = "SMOLBOARD_COOKIE_FILE"
+)
+
+// ErrNoHostEnv is returned by NewClientFromEnv if EnvHost is unset.
+var ErrNoHostEnv = errors.New("$" + EnvHost + " is not set")
+
+// NewClientFromEnv makes a new client for scripts and other tools. The host is
+// taken from $SMOLBOARD_HOST, and the session is loaded from the cookie file
+// in $SMOLBOARD_COOKIE_FILE if the variable is set and the file exists. The
+// user agent is ToolUserAgent.
+func NewClientFromEnv() (*Client, error) {
+	var host = os.Getenv(EnvHost)
+	if host == "" {
+		return nil, ErrNoHostEnv
+	}
+
+	c, err := NewClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetUserAgent(ToolUserAgent())
+
+	if path := os.Getenv(EnvCookieFile); path != "" {
+		if err := c.LoadCookieFile(path); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// ToolUserAgent returns the user agent that identifies the running program
+// along with the client, such as "smolsync smolboard-client/v0.1.0".
+func ToolUserAgent() string {
+	return filepath.Base(os.Args[0]) + " " + DefaultUserAgent()
+}
+
+// LoadCookieFile loads the session token cookie from the file, which contains
+// only the token, as written by SaveCookieFile.
+func (c *Client) LoadCookieFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read cookie file")
+	}
+
+	var token = strings.TrimSpace(string(b))
+	if token == "" {
+		return nil
+	}
+
+	c.SetCookies(append(c.Cookies(), &http.Cookie{Name: c.CookieName, Value: token}))
+	c.SetToken(token)
+
+	return nil
+}
+
+// SaveCookieFile saves the session token cookie into the file, which is only
+// readable by the current user. The file is removed if there is no session.
+func (c *Client) SaveCookieFile(path string) error {
+	var cookie = c.TokenCookie()
+	if cookie == nil || cookie.Value == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Failed to remove cookie file")
+		}
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path, []byte(cookie.Value+"\n"), 0600); err != nil {
+		return errors.Wrap(err, "Failed to write cookie file")
+	}
+
+	return nil
+}
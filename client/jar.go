@@ -3,12 +3,21 @@ package client
 import (
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 // Jar implements a thread-unsafe single-domain cookiejar.
 type Jar struct {
 	host string
 	cook []*http.Cookie
+
+	// Domain, if not empty, makes the jar send cookies to this domain and its
+	// subdomains instead of only the host the cookies were set for. Returned
+	// cookies have their Domain set to this.
+	Domain string
+	// Path, if not empty, makes the jar only send cookies to URLs under this
+	// path. Returned cookies have their Path set to this.
+	Path string
 }
 
 // NewJar makes a new cookiejar.
@@ -28,8 +37,49 @@ func (jar *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
 // It is up to the implementation to honor the standard cookie use
 // restrictions such as in RFC 6265.
 func (jar *Jar) Cookies(u *url.URL) []*http.Cookie {
-	if u.Host != jar.host {
+	if !jar.matchDomain(u) || !jar.matchPath(u) {
 		return nil
 	}
-	return jar.cook
+
+	if jar.Domain == "" && jar.Path == "" {
+		return jar.cook
+	}
+
+	// Copy the cookies to scope them, as they may belong to the caller.
+	var cookies = make([]*http.Cookie, len(jar.cook))
+
+	for i, cookie := range jar.cook {
+		cpy := *cookie
+		if jar.Domain != "" {
+			cpy.Domain = jar.Domain
+		}
+		if jar.Path != "" {
+			cpy.Path = jar.Path
+		}
+		cookies[i] = &cpy
+	}
+
+	return cookies
+}
+
+func (jar *Jar) matchDomain(u *url.URL) bool {
+	if jar.Domain == "" {
+		return u.Host == jar.host
+	}
+
+	var domain = strings.TrimPrefix(jar.Domain, ".")
+	var host = u.Hostname()
+
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func (jar *Jar) matchPath(u *url.URL) bool {
+	if jar.Path == "" || jar.Path == "/" {
+		return true
+	}
+
+	var prefix = strings.TrimSuffix(jar.Path, "/")
+	var path = u.Path
+
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
 }
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy decides how many times and when a request is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times that the request is sent. The
+	// request is sent once if this is not positive.
+	MaxAttempts int
+	// Backoff, if not nil, returns how long to wait before the given retry,
+	// which starts at 1. If the server sent a Retry-After, then the longer of
+	// the two is waited for.
+	Backoff func(retry int) time.Duration
+	// Retryable, if not nil, returns true if the request should be retried
+	// after the given response or error, only one of which is not nil.
+	// DefaultRetryable is used if this is nil.
+	Retryable func(r *http.Response, err error) bool
+}
+
+// DefaultRetryable returns true for failed requests, server errors and rate
+// limits, which are what the client retries by default.
+func DefaultRetryable(r *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	return r.StatusCode < 200 || r.StatusCode > 499 || r.StatusCode == http.StatusTooManyRequests
+}
+
+// ExponentialBackoff returns a Backoff that waits for base, then twice as long
+// before each retry after, up to max.
+func ExponentialBackoff(base, max time.Duration) func(int) time.Duration {
+	return func(retry int) time.Duration {
+		var wait = base
+		for i := 1; i < retry && wait < max; i++ {
+			wait *= 2
+		}
+		if wait > max {
+			wait = max
+		}
+		return wait
+	}
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) retryable(r *http.Response, err error) bool {
+	if p.Retryable == nil {
+		return DefaultRetryable(r, err)
+	}
+	return p.Retryable(r, err)
+}
+
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff(retry)
+}
+
+// retryPolicy returns the policy of the client's own requests, which are tried
+// up to Tries times. Only the server's Retry-After is waited for.
+func (c *Client) retryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: c.Tries}
+}
+
+// DoWithRetry sends the request, retrying it according to the policy. Each try
+// times out after RequestTimeout. Requests with a body can only be retried if
+// their GetBody is set, which http.NewRequest does for in-memory bodies; they
+// are only sent once otherwise. Like Do, an error is returned for responses
+// that aren't 2xx after the last try.
+func (c *Client) DoWithRetry(req *http.Request, policy RetryPolicy) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		policy.MaxAttempts = 1
+	}
+
+	var sent bool
+
+	return c.doRetry(func() (*http.Request, error) {
+		// The first try sends the original body.
+		if !sent {
+			sent = true
+			return req, nil
+		}
+
+		q := req.Clone(req.Context())
+
+		if req.GetBody != nil {
+			b, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to get request body")
+			}
+			q.Body = b
+		}
+
+		return q, nil
+	}, policy, c.requestTimeout())
+}
+
+func (c *Client) doRetry(
+	req func() (*http.Request, error), policy RetryPolicy, timeout time.Duration) (r *http.Response, err error) {
+
+	var attempts = policy.attempts()
+
+	for i := 0; i < attempts; i++ {
+		var q *http.Request
+
+		// Don't shadow err, as the last send error must be returned.
+		q, err = req()
+		if err != nil {
+			return nil, err
+		}
+
+		c.setHeaders(q)
+
+		// Use HTTP if socket.
+		if c.socket {
+			q.URL.Scheme = "http"
+		}
+
+		var ctx = q.Context()
+
+		q, cancel := withTimeout(q, timeout)
+
+		r, err = c.Client.Do(q)
+		if err != nil {
+			cancel()
+			r = nil
+			err = errors.Wrap(err, "Failed to send request")
+		} else {
+			r.Body = cancelBody{r.Body, cancel}
+		}
+
+		// Don't bother waiting if this is the last try.
+		if i == attempts-1 || !policy.retryable(r, err) {
+			break
+		}
+
+		var wait = policy.backoff(i + 1)
+
+		if r != nil {
+			if after := retryAfter(r); after > wait {
+				wait = after
+			}
+			r.Body.Close()
+		}
+
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Not Modified is only ever sent to revalidate a cached response, so it's
+	// left for the cache to handle.
+	if r.StatusCode != http.StatusNotModified && (r.StatusCode < 200 || r.StatusCode > 299) {
+		return nil, unexpectedStatus(r)
+	}
+
+	return r, nil
+}
+
+// MaxRetryAfter is the maximum duration to wait for when the server responds
+// with a Retry-After header.
+const MaxRetryAfter = 30 * time.Second
+
+// retryAfter returns the duration in the response's Retry-After header, capped
+// to MaxRetryAfter, or 0 if there is none.
+func retryAfter(r *http.Response) time.Duration {
+	secs, err := strconv.Atoi(r.Header.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+
+	var wait = time.Duration(secs) * time.Second
+	if wait > MaxRetryAfter {
+		wait = MaxRetryAfter
+	}
+
+	return wait
+}
+
+// sleep waits for the duration. An error is returned if the context is
+// canceled.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	var timer = time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "Failed to wait before retrying")
+	}
+}
@@ -1,11 +1,20 @@
 package client
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
 )
 
 // Session is the current smolboard HTTP session.
@@ -36,36 +45,94 @@ func (s *Session) AllowedTypes() (ts []string, err error) {
 	return ts, s.Client.Get("/filetypes", &ts, nil)
 }
 
+// Version returns the server's version. The server's API version is checked
+// against the client's; see Client.StrictAPIVersion. The version is also kept
+// in the client's ServerVersion.
+func (s *Session) Version() (*smolboard.VersionInfo, error) {
+	return s.Client.fetchVersion(s.Client.StrictAPIVersion)
+}
+
+// fetchVersion fetches the server's version and keeps it. If strict is true,
+// then ErrIncompatibleAPI is returned if the server's API version is not
+// smolboard.APIVersion; else, a warning is logged.
+func (c *Client) fetchVersion(strict bool) (*smolboard.VersionInfo, error) {
+	var v smolboard.VersionInfo
+
+	if err := c.Get("/version", &v, nil); err != nil {
+		return nil, err
+	}
+
+	c.version = &v
+
+	if v.APIVersion != smolboard.APIVersion {
+		err := ErrIncompatibleAPI{Server: v.APIVersion, Client: smolboard.APIVersion}
+		if strict {
+			return &v, err
+		}
+
+		log.Printf("Warning: %s: %v", c.Host(), err)
+	}
+
+	return &v, nil
+}
+
 // Endpoint returns the current endpoint with the appended path. The path is
 // optional, but it must start with a slash ("/") otherwise.
 func (s *Session) Endpoint(path string) string {
 	return s.Client.Endpoint() + path
 }
 
-// Signin signs a new user in.
+// Signin signs a new user in. The session's token is used for BearerAuth.
 func (s *Session) Signin(username, password string) (sm smolboard.Session, err error) {
-	return sm, s.Client.Post("/signin", &sm, url.Values{
+	err = s.Client.Post("/signin", &sm, url.Values{
+		"username": {username},
+		"password": {password},
+	})
+	if err == nil {
+		s.Client.SetToken(sm.AuthToken)
+	}
+	return
+}
+
+// SigninScoped is Signin with the scope of the new session, which is
+// smolboard.ScopeRead or ScopeWrite.
+func (s *Session) SigninScoped(username, password, scope string) (sm smolboard.Session, err error) {
+	err = s.Client.Post("/signin", &sm, url.Values{
 		"username": {username},
 		"password": {password},
+		"scope":    {scope},
 	})
+	if err == nil {
+		s.Client.SetToken(sm.AuthToken)
+	}
+	return
 }
 
-// Signup registers a new user.
+// Signup registers a new user. The session's token is used for BearerAuth.
 func (s *Session) Signup(username, password, token string) (sm smolboard.Session, err error) {
-	return sm, s.Client.Post("/signup", &sm, url.Values{
+	err = s.Client.Post("/signup", &sm, url.Values{
 		"username": {username},
 		"password": {password},
 		"token":    {token},
 	})
+	if err == nil {
+		s.Client.SetToken(sm.AuthToken)
+	}
+	return
 }
 
 // Signout signs the current user out, which will invalidate their current
 // token.
 func (s *Session) Signout() error {
-	return s.Client.Post("/signout", nil, nil)
+	if err := s.Client.Post("/signout", nil, nil); err != nil {
+		return err
+	}
+
+	s.Client.ClearToken()
+	return nil
 }
 
-// Me returns the current user.
+// Me returns the current user, including their session and post counts.
 func (s *Session) Me() (u smolboard.UserPart, err error) {
 	return u, s.Client.Get("/users/@me", &u, nil)
 }
@@ -83,6 +150,38 @@ func (s *Session) EditMe(pp UserEditParams) (u smolboard.UserPart, err error) {
 	})
 }
 
+// SetEmail sets the current user's email. A verification mail will be sent to
+// the email; the returned status tells whether or not the mail was sent.
+func (s *Session) SetEmail(email string) (ms smolboard.MailStatus, err error) {
+	return ms, s.Client.Request("PUT", "/users/@me/email", &ms, url.Values{
+		"email": {email},
+	})
+}
+
+// VerifyEmail verifies the email using the token that was mailed to it.
+func (s *Session) VerifyEmail(token string) error {
+	return s.Client.Post("/verify-email", nil, url.Values{
+		"token": {token},
+	})
+}
+
+// RequestPasswordReset requests a password reset token to be mailed to the
+// given user's verified email. It succeeds even if the user doesn't exist or has
+// no verified email, so that usernames can't be probed with it.
+func (s *Session) RequestPasswordReset(username string) error {
+	return s.Client.Post("/reset-password", nil, url.Values{
+		"username": {username},
+	})
+}
+
+// ResetPassword sets a new password using the mailed password reset token.
+func (s *Session) ResetPassword(token, password string) error {
+	return s.Client.Post("/reset-password/confirm", nil, url.Values{
+		"token":    {token},
+		"password": {password},
+	})
+}
+
 // DeleteMe deletes the currenet user.
 func (s *Session) DeleteMe() error {
 	return s.Client.Delete("/users/@me", nil, nil)
@@ -103,6 +202,109 @@ func (s *Session) SetUserPermission(username string, p smolboard.Permission) err
 	)
 }
 
+// ImpersonateUser issues a short-lived session of the given user. This endpoint
+// is only allowed for the owner. The returned session's token is not stored.
+func (s *Session) ImpersonateUser(username string) (sm smolboard.Session, err error) {
+	return sm, s.Client.Post(
+		fmt.Sprintf("/users/%s/impersonate", url.PathEscape(username)), &sm, nil,
+	)
+}
+
+// RevokeUserSessions signs the user out of all their sessions and returns the
+// number of revoked sessions. Only administrators can do this.
+func (s *Session) RevokeUserSessions(username string) (int, error) {
+	var r smolboard.SessionRevokeResult
+	return r.Revoked, s.Client.Post(
+		fmt.Sprintf("/users/%s/revoke-sessions", url.PathEscape(username)), &r, nil,
+	)
+}
+
+// PruneInactiveUsers deletes users who have no posts and haven't signed in
+// within olderThan, and returns their usernames. Nothing is deleted if dryRun is
+// true. Only the owner can do this.
+func (s *Session) PruneInactiveUsers(olderThan time.Duration, dryRun bool) ([]string, error) {
+	var r smolboard.UserPruneResult
+	return r.Usernames, s.Client.Post("/users/@prune", &r, url.Values{
+		"older_than": {olderThan.String()},
+		"dry_run":    {strconv.FormatBool(dryRun)},
+	})
+}
+
+// ExpireAllSessions signs out every user, including the current one, and
+// returns the number of deleted sessions, which is 0 if the server uses JWT
+// sessions. Only the owner can do this.
+func (s *Session) ExpireAllSessions() (int, error) {
+	var r smolboard.SessionRevokeResult
+	return r.Revoked, s.Client.Post("/sessions/expire-all", &r, nil)
+}
+
+// ReadOnly returns true if the server is in read-only mode.
+func (s *Session) ReadOnly() (bool, error) {
+	var r smolboard.ReadOnlyState
+	return r.Enabled, s.Client.Get("/read-only", &r, nil)
+}
+
+// SetReadOnly enables or disables the server's read-only mode. Only the owner
+// can do this.
+func (s *Session) SetReadOnly(enabled bool) error {
+	return s.Client.Post("/read-only", nil, url.Values{
+		"enabled": {strconv.FormatBool(enabled)},
+	})
+}
+
+// TransferUserPosts gives all posts of the user, including the soft-deleted
+// ones, to another user. The number of transferred posts is returned. Only
+// administrators can do this.
+func (s *Session) TransferUserPosts(username, toUsername string) (int, error) {
+	var r smolboard.PostTransferResult
+	return r.Transferred, s.Client.Post(
+		fmt.Sprintf("/users/%s/transfer-posts", url.PathEscape(username)), &r,
+		url.Values{"to": {toUsername}},
+	)
+}
+
+// Quota returns the upload quota of the user. Users can only get their own
+// quota, unless they're an administrator.
+func (s *Session) Quota(username string) (q smolboard.UserQuota, err error) {
+	return q, s.Client.Get(fmt.Sprintf("/users/%s/quota", url.PathEscape(username)), &q, nil)
+}
+
+// SetUserQuota overrides the upload quota of the user. Limits of 0 are
+// unlimited. Only administrators can do this.
+func (s *Session) SetUserQuota(
+	username string, maxBytes int64, maxPosts int) (q smolboard.UserQuota, err error) {
+
+	return q, s.Client.Request(
+		"PUT", fmt.Sprintf("/users/%s/quota", url.PathEscape(username)), &q,
+		url.Values{
+			"max_bytes": {strconv.FormatInt(maxBytes, 10)},
+			"max_posts": {strconv.Itoa(maxPosts)},
+		},
+	)
+}
+
+// ResetUserQuota makes the upload quota of the user the default again. Only
+// administrators can do this.
+func (s *Session) ResetUserQuota(username string) error {
+	return s.Client.Delete(fmt.Sprintf("/users/%s/quota", url.PathEscape(username)), nil, nil)
+}
+
+// PendingUsers returns the users awaiting approval from oldest to newest. Only
+// administrators can do this.
+func (s *Session) PendingUsers() (u []smolboard.UserPart, err error) {
+	return u, s.Client.Get("/users/@pending", &u, nil)
+}
+
+// ApproveUser lets a pending user upload. Only administrators can do this.
+func (s *Session) ApproveUser(username string) error {
+	return s.Client.Post(fmt.Sprintf("/users/%s/approve", url.PathEscape(username)), nil, nil)
+}
+
+// RejectUser deletes a pending user. Only administrators can do this.
+func (s *Session) RejectUser(username string) error {
+	return s.Client.Post(fmt.Sprintf("/users/%s/reject", url.PathEscape(username)), nil, nil)
+}
+
 // Users gets a paginated list of users. The default value for count is 50. This
 // endpoint is only allowed for the owner and admins.
 func (s *Session) Users(count, page int) (u smolboard.UserList, err error) {
@@ -152,6 +354,73 @@ func (s *Session) PostSearch(q string, count, page int) (p smolboard.SearchResul
 	})
 }
 
+// PostsAfter returns the post list after the given cursor, which is taken from
+// the last results. An empty cursor returns the first page. Count is defaulted
+// to 25.
+func (s *Session) PostsAfter(cursor string, count int) (p smolboard.SearchResults, err error) {
+	return s.PostSearchAfter("", cursor, count)
+}
+
+// PostSearchAfter is similar to PostsAfter but with searching.
+func (s *Session) PostSearchAfter(q, cursor string, count int) (p smolboard.SearchResults, err error) {
+	if count == 0 {
+		count = 25
+	}
+
+	return p, s.Client.Get("/posts", &p, url.Values{
+		"q":      {q},
+		"c":      {strconv.Itoa(count)},
+		"cursor": {cursor},
+	})
+}
+
+// MaxAllPosts is the maximum number of posts that AllPostsByTag collects.
+const MaxAllPosts = 10000
+
+// ErrTooManyPosts is returned by AllPostsByTag when more than MaxAllPosts posts
+// were found.
+var ErrTooManyPosts = errors.New("too many posts")
+
+// AllPostsByTag pages through all posts with the given tag and returns all of
+// them, newest first. As every post is kept in memory, at most MaxAllPosts
+// posts are collected; if there are more, then the first MaxAllPosts posts are
+// returned along with ErrTooManyPosts. The posts collected so far are also
+// returned if the context is canceled.
+func (s *Session) AllPostsByTag(ctx context.Context, tag string) ([]smolboard.Post, error) {
+	if err := smolboard.TagIsValid(tag); err != nil {
+		return nil, err
+	}
+
+	var query = smolboard.Query{Tags: []string{tag}}.String()
+	var session = NewSessionWithClient(s.Client.WithContext(ctx))
+
+	var posts []smolboard.Post
+	var cursor string
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return posts, err
+		}
+
+		r, err := session.PostSearchAfter(query, cursor, 100)
+		if err != nil {
+			return posts, err
+		}
+
+		posts = append(posts, r.Posts...)
+
+		if len(posts) > MaxAllPosts {
+			return posts[:MaxAllPosts], ErrTooManyPosts
+		}
+
+		if r.Cursor == "" {
+			return posts, nil
+		}
+
+		cursor = r.Cursor
+	}
+}
+
 // PostDirectPath returns the direct path to the post's content.
 func (s *Session) PostDirectPath(post smolboard.Post) string {
 	return fmt.Sprintf("/api/v1/images/%s", url.PathEscape(post.Filename()))
@@ -162,11 +431,258 @@ func (s *Session) PostThumbPath(post smolboard.Post) string {
 	return fmt.Sprintf("/api/v1/images/%s/thumb.jpg", url.PathEscape(post.Filename()))
 }
 
-// DeletePost deletes the given post.
+// PostThumbSizePath returns the JPEG path to the thumbnail of the given post
+// that fits into the given size. The server only allows a few sizes.
+func (s *Session) PostThumbSizePath(post smolboard.Post, w, h int) string {
+	return fmt.Sprintf("%s?w=%d&h=%d", s.PostThumbPath(post), w, h)
+}
+
+// PostThumbnail returns the JPEG thumbnail of the given post that fits into
+// the given size. The server only allows a few sizes.
+func (s *Session) PostThumbnail(post smolboard.Post, w, h int) ([]byte, error) {
+	b, _, err := s.Client.GetBytes(
+		s.Client.Context(),
+		fmt.Sprintf("/images/%s/thumb.jpg", url.PathEscape(post.Filename())),
+		url.Values{
+			"w": {strconv.Itoa(w)},
+			"h": {strconv.Itoa(h)},
+		},
+	)
+	return b, err
+}
+
+// UploadFile is a file to be uploaded with UploadPosts.
+type UploadFile struct {
+	Name string
+	Body io.Reader
+	// SkipDuplicates, if true, hashes the file first and skips uploading it if
+	// a post with the same file already exists, in which case that post is
+	// returned instead, regardless of its permission and expiry. Body must
+	// then be an io.Seeker, which files are.
+	SkipDuplicates bool
+}
+
+// ContentHash returns the hex SHA-256 digest of the content read from r, which
+// is what posts are looked up with in CheckDuplicate.
+func ContentHash(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CheckDuplicate returns the post whose file has the given content hash, if
+// there's one that the user can see. The hash can be made with ContentHash.
+func (s *Session) CheckDuplicate(hash string) (*smolboard.Post, bool, error) {
+	var post smolboard.Post
+
+	err := s.Client.Get(fmt.Sprintf("/posts/hash/%s", url.PathEscape(hash)), &post, nil)
+	if err != nil {
+		if ErrGetStatusCode(err, 0) == http.StatusNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return &post, true, nil
+}
+
+// findDuplicate returns the post that already has the file, or nil if there's
+// none. The file's body is rewound after hashing it.
+func (s *Session) findDuplicate(file UploadFile) (*smolboard.Post, error) {
+	seeker, ok := file.Body.(io.Seeker)
+	if !ok {
+		return nil, fmt.Errorf("file %q must be seekable to skip duplicates", file.Name)
+	}
+
+	off, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to seek file %q", file.Name)
+	}
+
+	hash, err := ContentHash(file.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to hash file %q", file.Name)
+	}
+
+	if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "Failed to rewind file %q", file.Name)
+	}
+
+	post, _, err := s.CheckDuplicate(hash)
+	return post, err
+}
+
+// UploadPosts uploads the given files as posts with the given permission. The
+// files are streamed as they're sent instead of being read into memory first.
+func (s *Session) UploadPosts(files []UploadFile, p smolboard.Permission) (posts []smolboard.Post, err error) {
+	return s.UploadExpiringPosts(files, p, 0)
+}
+
+// UploadExpiringPosts is similar to UploadPosts, but the posts expire after the
+// given TTL, after which the server deletes them. They never expire if the TTL
+// is 0.
+func (s *Session) UploadExpiringPosts(
+	files []UploadFile, p smolboard.Permission, ttl time.Duration) ([]smolboard.Post, error) {
+
+	var existing = make([]*smolboard.Post, len(files))
+	var upload = make([]UploadFile, 0, len(files))
+
+	for i, file := range files {
+		if file.SkipDuplicates {
+			post, err := s.findDuplicate(file)
+			if err != nil {
+				return nil, err
+			}
+			existing[i] = post
+		}
+
+		if existing[i] == nil {
+			upload = append(upload, file)
+		}
+	}
+
+	// Fast path: nothing was skipped.
+	if len(upload) == len(files) {
+		return s.uploadPosts(files, p, ttl)
+	}
+
+	var uploaded []smolboard.Post
+
+	if len(upload) > 0 {
+		u, err := s.uploadPosts(upload, p, ttl)
+		if err != nil {
+			return nil, err
+		}
+		uploaded = u
+	}
+
+	// Put the skipped posts back in the order of the files.
+	var posts = make([]smolboard.Post, 0, len(files))
+
+	for _, post := range existing {
+		switch {
+		case post != nil:
+			posts = append(posts, *post)
+		case len(uploaded) > 0:
+			posts = append(posts, uploaded[0])
+			uploaded = uploaded[1:]
+		}
+	}
+
+	return posts, nil
+}
+
+func (s *Session) uploadPosts(
+	files []UploadFile, p smolboard.Permission, ttl time.Duration) (posts []smolboard.Post, err error) {
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeUploadForm(mw, files, p, ttl))
+	}()
+
+	err = s.Client.Upload("/posts", &posts, mw.FormDataContentType(), pr)
+	// Stop the writer if the request failed before reading the whole body.
+	pr.Close()
+
+	return
+}
+
+// CreateExternalPost creates a post that links to the media at the given URL
+// instead of uploading it. The content type is guessed from the URL by the
+// server if it is empty.
+func (s *Session) CreateExternalPost(
+	mediaURL, contentType string, p smolboard.Permission) (post smolboard.Post, err error) {
+
+	return post, s.Client.Post("/posts/external", &post, url.Values{
+		"url":  {mediaURL},
+		"type": {contentType},
+		"p":    {p.StringInt()},
+	})
+}
+
+func writeUploadForm(mw *multipart.Writer, files []UploadFile, p smolboard.Permission, ttl time.Duration) error {
+	if err := mw.WriteField("p", p.StringInt()); err != nil {
+		return err
+	}
+
+	if ttl > 0 {
+		if err := mw.WriteField("ttl", ttl.String()); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		w, err := mw.CreateFormFile("file", file.Name)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, file.Body); err != nil {
+			return errors.Wrapf(err, "Failed to read file %q", file.Name)
+		}
+	}
+
+	return mw.Close()
+}
+
+// DeletePost deletes the given post. The post can be restored with RestorePost
+// within the server's grace period.
 func (s *Session) DeletePost(id int64) error {
 	return s.Client.Delete(fmt.Sprintf("/posts/%d", id), nil, nil)
 }
 
+// PurgePost deletes the given post permanently. The post cannot be restored.
+func (s *Session) PurgePost(id int64) error {
+	return s.Client.Delete(fmt.Sprintf("/posts/%d", id), nil, url.Values{
+		"hard": {"1"},
+	})
+}
+
+// DeletePosts deletes multiple posts at once. If hard is true, then the posts
+// are deleted permanently. The result of each post is returned in the same
+// order as the given IDs.
+func (s *Session) DeletePosts(ids []int64, hard bool) (r []smolboard.BulkPostResult, err error) {
+	var v = url.Values{"id": formatIDs(ids)}
+	if hard {
+		v.Set("hard", "1")
+	}
+
+	return r, s.Client.Post("/posts/delete", &r, v)
+}
+
+// FavoritePosts adds the given posts to the user's favorites. Posts that are
+// already favorited are skipped.
+func (s *Session) FavoritePosts(ids []int64) error {
+	return s.Client.Post("/posts/favorites", nil, url.Values{"id": formatIDs(ids)})
+}
+
+// UnfavoritePosts removes the given posts from the user's favorites.
+func (s *Session) UnfavoritePosts(ids []int64) error {
+	return s.Client.Post("/posts/favorites/delete", nil, url.Values{"id": formatIDs(ids)})
+}
+
+// Favorites returns the paginated list of the user's favorited posts, latest
+// favorited first. Count is defaulted to 25.
+func (s *Session) Favorites(count, page int) (p smolboard.SearchResults, err error) {
+	if count == 0 {
+		count = 25
+	}
+
+	return p, s.Client.Get("/posts/favorites", &p, url.Values{
+		"c": {strconv.Itoa(count)},
+		"p": {strconv.Itoa(page)},
+	})
+}
+
+// RestorePost restores a deleted post.
+func (s *Session) RestorePost(id int64) error {
+	return s.Client.Post(fmt.Sprintf("/posts/%d/restore", id), nil, nil)
+}
+
 // SetPostPermission sets the given post's permission.
 func (s *Session) SetPostPermission(postID int64, p smolboard.Permission) error {
 	return s.Client.Request(
@@ -177,6 +693,44 @@ func (s *Session) SetPostPermission(postID int64, p smolboard.Permission) error
 	)
 }
 
+// CreateShareLink creates a link that lets anyone see the given post until the
+// TTL passes. The link's path is SharedPostPath.
+func (s *Session) CreateShareLink(postID int64, ttl time.Duration) (l smolboard.ShareLink, err error) {
+	return l, s.Client.Request(
+		"POST",
+		fmt.Sprintf("/posts/%d/share", postID),
+		&l,
+		url.Values{"ttl": {ttl.String()}},
+	)
+}
+
+// SharedPost returns the post that the share link token was made for.
+func (s *Session) SharedPost(token string) (p smolboard.Post, err error) {
+	return p, s.Client.Get("/posts/shared/"+url.PathEscape(token), &p, nil)
+}
+
+// SharedPostPath returns the path to the media of the post that the share link
+// token was made for.
+func (s *Session) SharedPostPath(token string) string {
+	return "/api/v1/images/shared/" + url.PathEscape(token)
+}
+
+// SetPostExpiry sets the time that the given post expires at. The post never
+// expires if the time is zero.
+func (s *Session) SetPostExpiry(postID int64, at time.Time) error {
+	var n int64
+	if !at.IsZero() {
+		n = at.UnixNano()
+	}
+
+	return s.Client.Request(
+		"PATCH",
+		fmt.Sprintf("/posts/%d/expiry", postID),
+		nil,
+		url.Values{"at": {strconv.FormatInt(n, 10)}},
+	)
+}
+
 // TagPost adds a tag to a post.
 func (s *Session) TagPost(postID int64, tag string) error {
 	if err := smolboard.TagIsValid(tag); err != nil {
@@ -188,6 +742,21 @@ func (s *Session) TagPost(postID int64, tag string) error {
 	})
 }
 
+// TagPosts adds a tag to multiple posts at once. Posts that the user cannot
+// change are skipped. The number of posts tagged is returned.
+func (s *Session) TagPosts(postIDs []int64, tag string) (int, error) {
+	if err := smolboard.TagIsValid(tag); err != nil {
+		return 0, err
+	}
+
+	var r smolboard.BulkTagResult
+
+	return r.Updated, s.Client.Post("/posts/tags", &r, url.Values{
+		"id": formatIDs(postIDs),
+		"t":  {tag},
+	})
+}
+
 // UntagPost removes a tag from a post.
 func (s *Session) UntagPost(postID int64, tag string) error {
 	if err := smolboard.TagIsValid(tag); err != nil {
@@ -199,6 +768,136 @@ func (s *Session) UntagPost(postID int64, tag string) error {
 	})
 }
 
+// TransferPost makes the given user the post's poster. Only administrators can
+// do this.
+func (s *Session) TransferPost(postID int64, toUsername string) error {
+	return s.Client.Post(fmt.Sprintf("/posts/%d/transfer", postID), nil, url.Values{
+		"to": {toUsername},
+	})
+}
+
+// RenameTag renames the tag on all posts, merging it into the new tag on posts
+// that already have it. Only administrators can do this.
+func (s *Session) RenameTag(from, to string) error {
+	if err := smolboard.TagIsValid(from); err != nil {
+		return err
+	}
+	if err := smolboard.TagIsValid(to); err != nil {
+		return err
+	}
+
+	return s.Client.Post("/posts/tags/rename", nil, url.Values{
+		"from": {from},
+		"to":   {to},
+	})
+}
+
+// DeleteTagEverywhere removes the tag from all posts. Only administrators can
+// do this.
+func (s *Session) DeleteTagEverywhere(tag string) error {
+	if err := smolboard.TagIsValid(tag); err != nil {
+		return err
+	}
+
+	return s.Client.Post("/posts/tags/delete", nil, url.Values{
+		"t": {tag},
+	})
+}
+
+// TagStats returns the most used tags among the posts that the user can see,
+// along with their counts. Count is defaulted to 25 by the server.
+func (s *Session) TagStats(count int) (stats []smolboard.TagStat, err error) {
+	return stats, s.Client.Get("/posts/tags", &stats, url.Values{
+		"c": {strconv.Itoa(count)},
+	})
+}
+
+// NormalizeTags renames every tag to its normalized form, merging duplicates
+// that only differ by case or spaces. The number of tags that were normalized
+// is returned. Only administrators can do this.
+func (s *Session) NormalizeTags() (int, error) {
+	var r smolboard.TagNormalizeResult
+	return r.Normalized, s.Client.Post("/posts/tags/normalize", &r, nil)
+}
+
+// OrphanedFiles returns the stored files that don't belong to any post. Only
+// administrators can do this.
+func (s *Session) OrphanedFiles() (files []string, err error) {
+	var o smolboard.OrphanedFiles
+	return o.Files, s.Client.Get("/posts/orphans", &o, nil)
+}
+
+// PurgeOrphanedFiles removes the stored files that don't belong to any post. If
+// dryRun is true, the files are only listed. Only administrators can do this.
+func (s *Session) PurgeOrphanedFiles(dryRun bool) (o smolboard.OrphanedFiles, err error) {
+	return o, s.Client.Post("/posts/orphans/purge", &o, url.Values{
+		"dry_run": {strconv.FormatBool(dryRun)},
+	})
+}
+
+// ReportPost reports the given post to the moderators. A post can only be
+// reported once by the same user.
+func (s *Session) ReportPost(postID int64, reason string) error {
+	return s.Client.Post(fmt.Sprintf("/posts/%d/report", postID), nil, url.Values{
+		"reason": {reason},
+	})
+}
+
+// PendingReports returns the paginated list of unresolved reports. The default
+// value for limit is 50. This endpoint is only allowed for the owner and
+// admins.
+func (s *Session) PendingReports(offset, limit int) (r []smolboard.Report, err error) {
+	if limit == 0 {
+		limit = 50
+	}
+
+	return r, s.Client.Get("/reports", &r, url.Values{
+		"o": {strconv.Itoa(offset)},
+		"l": {strconv.Itoa(limit)},
+	})
+}
+
+// ResolveReport resolves the report with the given ID using the given action.
+func (s *Session) ResolveReport(reportID int64, action smolboard.ReportAction) error {
+	return s.Client.Post(fmt.Sprintf("/reports/%d/resolve", reportID), nil, url.Values{
+		"action": {strconv.Itoa(int(action))},
+	})
+}
+
+// CreatePool creates an empty pool with the given name.
+func (s *Session) CreatePool(name string) (p smolboard.Pool, err error) {
+	return p, s.Client.Post("/pools", &p, url.Values{
+		"name": {name},
+	})
+}
+
+// Pool returns the pool with the given ID along with its posts in order. Posts
+// that the current user can't see are left out.
+func (s *Session) Pool(id int64) (p smolboard.PoolPosts, err error) {
+	return p, s.Client.Get(fmt.Sprintf("/pools/%d", id), &p, nil)
+}
+
+// DeletePool deletes the pool with the given ID. Only the owner of the pool and
+// admins can do this.
+func (s *Session) DeletePool(id int64) error {
+	return s.Client.Delete(fmt.Sprintf("/pools/%d", id), nil, nil)
+}
+
+// AddToPool inserts the post into the pool at the given 0-indexed position. The
+// post is appended if the position is negative, and it is moved if it's already
+// in the pool.
+func (s *Session) AddToPool(poolID, postID int64, position int) error {
+	return s.Client.Post(fmt.Sprintf("/pools/%d/posts", poolID), nil, url.Values{
+		"post": {strconv.FormatInt(postID, 10)},
+		"pos":  {strconv.Itoa(position)},
+	})
+}
+
+// RemoveFromPool removes the post from the pool.
+func (s *Session) RemoveFromPool(poolID, postID int64) error {
+	return s.Client.Delete(fmt.Sprintf("/pools/%d/posts/%d", poolID, postID), nil, nil)
+}
+
 // Tokens returns a list of tokens along with extra bits returned from the
 // server to assist in getting information without extra queries.
 func (s *Session) Tokens() (tl smolboard.TokenList, err error) {
@@ -222,11 +921,40 @@ func (s *Session) DeleteToken(token string) error {
 	return s.Client.Delete("/tokens/"+token, nil, nil)
 }
 
-// GetSessions returns a list of sessions.
-func (s *Session) GetSessions() (ses []smolboard.Session, err error) {
+// GetSessions returns all of the current user's sessions.
+func (s *Session) GetSessions() (ses smolboard.SessionList, err error) {
 	return ses, s.Client.Get("/users/@me/sessions", &ses, nil)
 }
 
+// CreateAPIKey creates an API key for the current user with the given scope,
+// which is smolboard.ScopeRead or ScopeWrite. The key's token is
+// only returned here. It is used by setting it as the token of a client with
+// BearerAuth.
+func (s *Session) CreateAPIKey(scope, label string) (k smolboard.APIKey, err error) {
+	return k, s.Client.Post("/users/@me/api-keys", &k, url.Values{
+		"scope": {scope},
+		"label": {label},
+	})
+}
+
+// APIKeys returns the current user's API keys without their tokens.
+func (s *Session) APIKeys() (k []smolboard.APIKey, err error) {
+	return k, s.Client.Get("/users/@me/api-keys", &k, nil)
+}
+
+// RevokeAPIKey revokes one of the current user's API keys.
+func (s *Session) RevokeAPIKey(id int64) error {
+	return s.Client.Delete(fmt.Sprintf("/users/@me/api-keys/%d", id), nil, nil)
+}
+
+// SessionsPage returns a page of the current user's sessions.
+func (s *Session) SessionsPage(count, page int) (ses smolboard.SessionList, err error) {
+	return ses, s.Client.Get("/users/@me/sessions", &ses, url.Values{
+		"c": {strconv.Itoa(count)},
+		"p": {strconv.Itoa(page)},
+	})
+}
+
 // Session returns the session with the given ID.
 func (s *Session) Session(id int64) (ses smolboard.Session, err error) {
 	return ses, s.Client.Get(fmt.Sprintf("/users/@me/sessions/%d", id), &ses, nil)
@@ -237,17 +965,132 @@ func (s *Session) CurrentSession() (ses smolboard.Session, err error) {
 	return ses, s.Client.Get("/users/@me/sessions/@this", &ses, nil)
 }
 
-// DeleteSession deletes the session with the given ID.
+// IsAuthenticated returns true if the client has a valid session. Unlike
+// CurrentSession, a missing or expired session is not an error, so only
+// failing to reach the server is one. An expired session is still renewed
+// first if the client has a ReauthFunc.
+func (s *Session) IsAuthenticated(ctx context.Context) (bool, error) {
+	var ses smolboard.Session
+
+	err := s.Client.WithContext(ctx).Get("/users/@me/sessions/@this", &ses, nil)
+	switch ErrGetStatusCode(err, 0) {
+	case http.StatusUnauthorized, http.StatusGone:
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	// Guests get an empty session.
+	return ses.Username != "", nil
+}
+
+// SessionByID returns the metadata of any user's session. Only administrators
+// can do this.
+func (s *Session) SessionByID(id int64) (ses smolboard.SessionExport, err error) {
+	return ses, s.Client.Get(fmt.Sprintf("/sessions/%d", id), &ses, nil)
+}
+
+// AdminDeleteSession deletes any user's session with the given ID. Only
+// administrators can do this.
+func (s *Session) AdminDeleteSession(id int64) error {
+	return s.Client.Delete(fmt.Sprintf("/sessions/%d", id), nil, nil)
+}
+
+// KeepAlive renews the current session without doing anything else, then
+// returns its new deadline. The renewed token is used for BearerAuth.
+func (s *Session) KeepAlive() (time.Time, error) {
+	var ses smolboard.Session
+
+	if err := s.Client.Get("/sessions/keepalive", &ses, nil); err != nil {
+		return time.Time{}, err
+	}
+
+	if ses.AuthToken != "" {
+		s.Client.SetToken(ses.AuthToken)
+	}
+
+	return time.Unix(0, ses.Deadline), nil
+}
+
+// RotateToken replaces the current session's token with a new one, which is
+// used from now on. The old token stops working immediately.
+func (s *Session) RotateToken() (ses smolboard.Session, err error) {
+	if err = s.Client.Post("/sessions/rotate", &ses, nil); err == nil {
+		s.Client.SetToken(ses.AuthToken)
+	}
+	return
+}
+
+// RenameSession sets the name of the session with the given ID. An empty name
+// clears it.
+func (s *Session) RenameSession(id int64, name string) (ses smolboard.Session, err error) {
+	return ses, s.Client.Request(
+		"PATCH", fmt.Sprintf("/users/@me/sessions/%d", id), &ses,
+		url.Values{"name": {name}},
+	)
+}
+
+// ListSessions returns all of the current user's sessions without their tokens.
+// The session that the client is using has Current set.
+func (s *Session) ListSessions() ([]smolboard.SessionExport, error) {
+	l, err := s.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions = make([]smolboard.SessionExport, len(l.Sessions))
+
+	for i, ses := range l.Sessions {
+		sessions[i] = ses.Export()
+		// The server only sends the token of the current session.
+		sessions[i].Current = ses.AuthToken != ""
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession deletes the session with the given ID. If it is the current
+// session, then this is the same as signing out, and the client's token and
+// cookie are cleared.
 func (s *Session) DeleteSession(id int64) error {
-	return s.Client.Delete(fmt.Sprintf("/users/@me/sessions/%d", id), nil, nil)
+	current, err := s.CurrentSession()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get current session")
+	}
+
+	if err := s.Client.Delete(fmt.Sprintf("/users/@me/sessions/%d", id), nil, nil); err != nil {
+		return err
+	}
+
+	if id == current.ID {
+		s.Client.ClearToken()
+	}
+
+	return nil
 }
 
-// DeleteCurrentSession deletes the current session.
+// DeleteCurrentSession deletes the current session, which signs the user out.
+// The client's token and cookie are cleared.
 func (s *Session) DeleteCurrentSession() error {
-	return s.Client.Delete("/users/@me/sessions/@this", nil, nil)
+	if err := s.Client.Delete("/users/@me/sessions/@this", nil, nil); err != nil {
+		return err
+	}
+
+	s.Client.ClearToken()
+	return nil
 }
 
 // DeleteAllSessions deletes all sessions except for the current one.
 func (s *Session) DeleteAllSessions() error {
 	return s.Client.Delete("/users/@me/sessions", nil, nil)
 }
+
+func formatIDs(ids []int64) []string {
+	var strs = make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatInt(id, 10)
+	}
+	return strs
+}
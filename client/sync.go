@@ -0,0 +1,209 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// PostFilter selects the posts that SyncPosts downloads.
+type PostFilter struct {
+	// Query is the search query, which is the same as PostSearch's. An empty
+	// query matches all posts that the session can see.
+	Query string
+	// Match, if not nil, is called on every post that the query found. The
+	// post is left out if it returns false.
+	Match func(smolboard.Post) bool
+}
+
+func (f PostFilter) match(post smolboard.Post) bool {
+	return f.Match == nil || f.Match(post)
+}
+
+// DefaultSyncConcurrency is the number of parallel downloads that SyncPosts
+// uses if the given concurrency is not positive.
+const DefaultSyncConcurrency = 4
+
+// SyncFile is the result of syncing a single post.
+type SyncFile struct {
+	Post smolboard.Post
+	// Path is the path to the post's local file.
+	Path string
+	// Skipped is true if the file was already downloaded before.
+	Skipped bool
+	// Err is the error downloading the file, if any.
+	Err error
+}
+
+// SyncResult is the result of SyncPosts.
+type SyncResult struct {
+	// Files contains the results of each post, newest first.
+	Files []SyncFile
+
+	Downloaded int
+	Skipped    int
+	Failed     int
+}
+
+// SyncPosts downloads the originals of all posts matching the filter into dir,
+// which is created if needed. Each post is saved under its filename, and posts
+// whose file already exists are skipped, so an interrupted sync can be resumed
+// by calling this again. Files are written under a temporary name and only
+// renamed once they're complete.
+//
+// Failing to download a file doesn't stop the sync; the error is recorded in
+// the file's result instead. An error is only returned if the posts can't be
+// listed or the context is canceled, in which case the results so far are
+// still returned. Rate limited requests are retried after the server's
+// Retry-After, as long as Tries allows it.
+func (s *Session) SyncPosts(
+	ctx context.Context, dir string, filter PostFilter, concurrency int) (SyncResult, error) {
+
+	if concurrency <= 0 {
+		concurrency = DefaultSyncConcurrency
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return SyncResult{}, errors.Wrap(err, "Failed to create directory")
+	}
+
+	var session = NewSessionWithClient(s.Client.WithContext(ctx))
+
+	var posts = make(chan smolboard.Post)
+	var wg sync.WaitGroup
+
+	var mu sync.Mutex
+	var result SyncResult
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for post := range posts {
+				file := session.syncPost(ctx, dir, post)
+
+				mu.Lock()
+				result.Files = append(result.Files, file)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := session.eachPost(ctx, filter, func(post smolboard.Post) {
+		posts <- post
+	})
+
+	close(posts)
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	sort.Slice(result.Files, func(i, j int) bool {
+		return result.Files[i].Post.ID > result.Files[j].Post.ID
+	})
+
+	for _, file := range result.Files {
+		switch {
+		case file.Err != nil:
+			result.Failed++
+		case file.Skipped:
+			result.Skipped++
+		default:
+			result.Downloaded++
+		}
+	}
+
+	return result, err
+}
+
+// eachPost pages through all posts matching the filter.
+func (s *Session) eachPost(ctx context.Context, filter PostFilter, fn func(smolboard.Post)) error {
+	var cursor string
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r, err := s.PostSearchAfter(filter.Query, cursor, 100)
+		if err != nil {
+			return err
+		}
+
+		for _, post := range r.Posts {
+			if filter.match(post) {
+				fn(post)
+			}
+		}
+
+		if r.Cursor == "" {
+			return nil
+		}
+
+		cursor = r.Cursor
+	}
+}
+
+func (s *Session) syncPost(ctx context.Context, dir string, post smolboard.Post) SyncFile {
+	var file = SyncFile{
+		Post: post,
+		Path: filepath.Join(dir, post.Filename()),
+	}
+
+	if _, err := os.Stat(file.Path); err == nil {
+		file.Skipped = true
+		return file
+	}
+
+	file.Err = s.downloadPost(ctx, file.Path, post)
+	return file
+}
+
+// downloadPost downloads the post's original into the given path.
+func (s *Session) downloadPost(ctx context.Context, path string, post smolboard.Post) error {
+	r, err := s.Client.DoDownload(func() (*http.Request, error) {
+		var url = fmt.Sprintf("%s/images/%s", s.Client.Endpoint(), url.PathEscape(post.Filename()))
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		return r, errors.Wrap(err, "Failed to create request")
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	var dir, name = filepath.Split(path)
+	var tmp = filepath.Join(dir, ".sync."+name)
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create file")
+	}
+
+	_, err = io.Copy(f, r.Body)
+	f.Close()
+
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to download file")
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to save file")
+	}
+
+	return nil
+}
@@ -26,7 +26,7 @@ func NewConfig() FrontConfig {
 }
 
 func (c *FrontConfig) Validate() error {
-	return nil
+	return c.Config.Validate()
 }
 
 func New(socket string, cfg FrontConfig) (http.Handler, error) {
@@ -166,7 +166,7 @@ func uploader(r *render.Request) (render.Render, error) {
 		q.Header[k] = v
 	}
 
-	p, err := r.Session.Client.DoOnce(q)
+	p, err := r.Session.Client.DoUpload(q)
 	if err != nil {
 		return render.Empty, err
 	}
@@ -60,9 +60,14 @@ func (r renderCtx) IsAdmin() bool {
 	return r.Current.Permission >= smolboard.PermissionAdministrator
 }
 
+func (r renderCtx) IsTrusted() bool {
+	return r.Current.Permission >= smolboard.PermissionTrusted
+}
+
 func Mount(muxer render.Muxer) http.Handler {
 	mux := chi.NewMux()
 	mux.Get("/", muxer.M(userPanel))
+	mux.Post("/sessions/{sessionID}/rename", muxer.M(renameSession))
 	mux.Post("/sessions/{sessionID}/delete", muxer.M(deleteSession))
 
 	mux.Mount("/tokens", tokens.Mount(muxer))
@@ -85,11 +90,13 @@ func userPanel(r *render.Request) (render.Render, error) {
 		return render.Empty, errors.Wrap(err, "Failed to get current user")
 	}
 
-	s, err := r.Session.GetSessions()
+	l, err := r.Session.GetSessions()
 	if err != nil {
 		return render.Empty, errors.Wrap(err, "Failed to get sessions")
 	}
 
+	var s = l.Sessions
+
 	// Put the current session first.
 	sort.SliceStable(s, func(i, j int) bool {
 		return s[i].AuthToken != ""
@@ -126,6 +133,20 @@ func changePassword(r *render.Request) (render.Render, error) {
 	return render.Empty, nil
 }
 
+func renameSession(r *render.Request) (render.Render, error) {
+	i, err := strconv.ParseInt(chi.URLParam(r.Request, "sessionID"), 10, 64)
+	if err != nil {
+		return render.Empty, errors.Wrap(err, "Failed to parse session ID")
+	}
+
+	if _, err := r.Session.RenameSession(i, r.FormValue("name")); err != nil {
+		return render.Empty, err
+	}
+
+	r.Redirect(r.Referer(), http.StatusSeeOther)
+	return render.Empty, nil
+}
+
 func deleteSession(r *render.Request) (render.Render, error) {
 	i, err := strconv.ParseInt(chi.URLParam(r.Request, "sessionID"), 10, 64)
 	if err != nil {
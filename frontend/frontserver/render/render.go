@@ -14,6 +14,7 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/phogolabs/parcello"
+	"github.com/pkg/errors"
 )
 
 // Renderer represents a renderable page.
@@ -35,15 +36,22 @@ var Empty = Render{}
 
 type Config struct {
 	SiteName string `toml:"siteName"`
+	// CookieName is the name of the session token cookie. It must match the
+	// backend's.
+	CookieName string `toml:"cookieName"`
 }
 
 func NewConfig() Config {
 	return Config{
-		SiteName: "smolboard",
+		SiteName:   "smolboard",
+		CookieName: smolboard.DefaultCookieName,
 	}
 }
 
 func (c *Config) Validate() error {
+	if c.CookieName == "" {
+		return errors.New("missing `cookieName' value")
+	}
 	return nil
 }
 
@@ -71,12 +79,7 @@ type Request struct {
 // TokenCookie returns the cookie that contains the token if any or nil if
 // none. This function searches the cookie from the smolboard client.
 func (r *Request) TokenCookie() *http.Cookie {
-	for _, cookie := range r.Session.Client.Cookies() {
-		if cookie.Name == "token" {
-			return cookie
-		}
-	}
-	return nil
+	return r.Session.Client.TokenCookie()
 }
 
 // Cookie returns the cookie from the Request. These cookies won't have
@@ -135,7 +138,7 @@ func (r *Request) FlushCookies() {
 
 		// Is this a token cookie? Is it invalidated? If yes, then we should
 		// invalidate the username cookie too.
-		if cookie.Name == "token" && cookie.Value == "" {
+		if cookie.Name == r.Config.CookieName && cookie.Value == "" {
 			http.SetCookie(r.Writer, &http.Cookie{
 				Name:    "username",
 				Value:   "",
@@ -240,7 +243,7 @@ func NewMux(backendSocket string, cfg Config) *Mux {
 		Mux: newMux(),
 		cfg: cfg,
 		client: func(r *http.Request) (*client.Client, error) {
-			return client.NewSocketClientFromRequest(backendSocket, r)
+			return client.NewSocketClientFromRequest(backendSocket, cfg.CookieName, r)
 		},
 	}
 }
@@ -252,7 +255,12 @@ func NewHTTPMux(backendHTTP string, cfg Config) *Mux {
 		Mux: newMux(),
 		cfg: cfg,
 		client: func(r *http.Request) (*client.Client, error) {
-			return client.NewHTTPClientFromRequest(backendHTTP, r)
+			c, err := client.NewHTTPClientFromRequest(backendHTTP, r)
+			if err != nil {
+				return nil, err
+			}
+			c.CookieName = cfg.CookieName
+			return c, nil
 		},
 	}
 }
@@ -288,7 +296,7 @@ func (m *Mux) NewRequest(w http.ResponseWriter, r *http.Request) *Request {
 
 	} else {
 		// Update the username cookie if there's a token cookie.
-		if c, err := r.Cookie("token"); err == nil && c.Value != "" {
+		if c, err := r.Cookie(m.cfg.CookieName); err == nil && c.Value != "" {
 			u, err := s.Me()
 			if err == nil {
 				request.CommonCtx.Username = u.Username
@@ -16,8 +16,10 @@ import (
 	"time"
 
 	"github.com/andybalholm/brotli"
+	"github.com/diamondburned/duration"
 	"github.com/diamondburned/smolboard/frontend/frontserver"
 	"github.com/diamondburned/smolboard/server"
+	shttp "github.com/diamondburned/smolboard/server/http"
 	"github.com/diamondburned/smolboard/server/http/upload"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -31,6 +33,9 @@ import (
 var (
 	configGlob = "./config*.toml"
 	noFrontend = false
+	force      = false
+	olderThan  = "180d"
+	dryRun     = false
 )
 
 func stderrlnf(f string, v ...interface{}) {
@@ -63,10 +68,32 @@ func init() {
 		"Disable the default frontend at root",
 	)
 
+	pflag.BoolVarP(
+		&force, "force", "f", force,
+		"Regenerate all thumbnails instead of only the missing ones",
+	)
+
+	pflag.StringVar(
+		&olderThan, "older-than", olderThan,
+		"Only prune users who haven't signed in for this long",
+	)
+
+	pflag.BoolVar(
+		&dryRun, "dry-run", dryRun,
+		"List the users that would be pruned without deleting them",
+	)
+
 	pflag.Usage = func() {
 		stderrlnf("Usage: %s [subcommand] [flags...]", filepath.Base(os.Args[0]))
 		stderrlnf("Subcommands:")
 		stderrlnf("  create-owner   Initialize a new owner user once")
+		stderrlnf("  expire-sessions")
+		stderrlnf("                 Sign out all users, such as after a breach")
+		stderrlnf("  backfill-sessions")
+		stderrlnf("                 Label the devices of sessions from older versions")
+		stderrlnf("  prune-users    Delete users with no posts and no recent sign in")
+		stderrlnf("  regenerate-thumbnails")
+		stderrlnf("                 Render the missing thumbnails of all posts")
 		stderrlnf("  serve          Run the HTTP server")
 		stderrlnf("Flags:")
 		pflag.PrintDefaults()
@@ -124,6 +151,77 @@ func main() {
 			log.Fatalln(err)
 		}
 
+	case "expire-sessions":
+		n, err := server.ExpireAllSessions(context.Background(), cfg.Config)
+		if err != nil {
+			log.Fatalln("Failed to expire sessions:", err)
+		}
+
+		log.Printf("Expired %d sessions.", n)
+
+	case "prune-users":
+		age, err := duration.ParseDuration(olderThan)
+		if err != nil {
+			log.Fatalln("Failed to parse --older-than:", err)
+		}
+
+		u, err := server.PruneInactiveUsers(
+			context.Background(), cfg.Config, time.Duration(age), dryRun,
+		)
+		if err != nil {
+			log.Fatalln("Failed to prune users:", err)
+		}
+
+		for _, username := range u {
+			fmt.Println(username)
+		}
+
+		if dryRun {
+			log.Printf("Would prune %d users.", len(u))
+		} else {
+			log.Printf("Pruned %d users.", len(u))
+		}
+
+	case "backfill-sessions":
+		// Stop on SIGINT. Running this again resumes where it stopped.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+
+		go func() {
+			<-sig
+			cancel()
+		}()
+
+		n, err := server.BackfillSessionMetadata(ctx, cfg.Config)
+		if err != nil {
+			log.Fatalln("Failed to backfill sessions:", err)
+		}
+
+		log.Printf("Backfilled %d sessions.", n)
+
+	case "regenerate-thumbnails":
+		// Stop on SIGINT. Running this again resumes where it stopped.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+
+		go func() {
+			<-sig
+			cancel()
+		}()
+
+		n, err := server.RegenerateThumbnails(ctx, cfg.Config, force)
+		if err != nil {
+			log.Fatalln("Failed to regenerate thumbnails:", err)
+		}
+
+		log.Printf("Regenerated %d thumbnails.", n)
+
 	case "serve":
 		fallthrough
 	default:
@@ -140,6 +238,8 @@ func main() {
 		mux := chi.NewMux()
 		mux.Use(c.Handler)
 		mux.Mount("/api/v1", a)
+		// Unknown API versions would otherwise fall through to the frontend.
+		mux.HandleFunc("/api/*", shttp.NotFound)
 
 		if !noFrontend {
 			f, err := frontserver.New(cfg.SocketPath, cfg.FrontConfig)
@@ -206,5 +306,9 @@ func main() {
 		if err := server.Shutdown(ctx); err != nil {
 			log.Fatalln("Failed to gracefully close the server:", err)
 		}
+
+		if err := a.Close(); err != nil {
+			log.Fatalln("Failed to close the instance:", err)
+		}
 	}
 }
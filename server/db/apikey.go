@@ -0,0 +1,221 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// apiKeyUseResolution is how often the last use of an API key is written, so
+// that reads don't all become writes.
+const apiKeyUseResolution = time.Minute
+
+// IsAPIKey returns true if the token is an API key rather than a session
+// token.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, smolboard.APIKeyPrefix)
+}
+
+// hashAPIKey returns the hex SHA-256 digest of the key, which is what's
+// stored. Keys are random, so they don't need a slow hash.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey returns the API key without marking it as used.
+func (d *Transaction) lookupAPIKey(key string) (*smolboard.APIKey, error) {
+	var k smolboard.APIKey
+
+	err := d.
+		QueryRowx(
+			"SELECT id, username, scope, label, createdat, lastused FROM apikeys"+
+				" WHERE tokenhash = ?",
+			hashAPIKey(key),
+		).
+		StructScan(&k)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, smolboard.ErrInvalidAPIKey
+		}
+		return nil, errors.Wrap(err, "Failed to scan API key")
+	}
+
+	return &k, nil
+}
+
+// queryAPIKey looks up the API key and returns a session for its user. The
+// session's ID is the key's ID, and it has no deadline.
+func (d *Transaction) queryAPIKey(key string) (*smolboard.Session, error) {
+	k, err := d.lookupAPIKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var now = time.Now()
+
+	if now.Sub(time.Unix(0, k.LastUsed)) >= apiKeyUseResolution {
+		k.LastUsed = now.UnixNano()
+
+		_, err := d.Exec("UPDATE apikeys SET lastused = ? WHERE id = ?", k.LastUsed, k.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to save API key use")
+		}
+	}
+
+	d.apiKey = k
+
+	return &smolboard.Session{
+		ID:        k.ID,
+		Username:  k.Username,
+		AuthToken: key,
+		Name:      k.Label,
+		Device:    "API key",
+		Scope:     k.Scope,
+	}, nil
+}
+
+// APIKey returns the API key that the transaction was authenticated with, or
+// nil if it was authenticated with a session or not at all.
+func (d *Transaction) APIKey() *smolboard.APIKey {
+	return d.apiKey
+}
+
+// notAPIKey returns an error if the transaction was authenticated with an API
+// key. Keys can't manage keys or credentials, so a leaked key can't be turned
+// into a longer lasting or more powerful one.
+func (d *Transaction) notAPIKey() error {
+	if d.apiKey != nil {
+		return smolboard.ErrAPIKeyNotAllowed
+	}
+	return nil
+}
+
+// CreateAPIKey creates an API key for the current user with the given scope,
+// which is either ScopeRead or ScopeWrite. The label follows the same rules as
+// session names. The returned key is the only one with its Token, which can't
+// be retrieved again.
+func (d *Transaction) CreateAPIKey(scope, label string) (*smolboard.APIKey, error) {
+	if err := d.notImpersonating(); err != nil {
+		return nil, err
+	}
+
+	if err := d.notAPIKey(); err != nil {
+		return nil, err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return nil, err
+	}
+
+	if err := smolboard.ValidScope(scope); err != nil {
+		return nil, err
+	}
+
+	label, err := smolboard.CleanSessionName(label)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+
+	err = d.QueryRow("SELECT COUNT(*) FROM apikeys WHERE username = ?", d.Session.Username).Scan(&count)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to count API keys")
+	}
+
+	if count >= smolboard.MaxAPIKeys {
+		return nil, smolboard.ErrTooManyAPIKeys
+	}
+
+	t, err := randToken(d.config.TokenLength)
+	if err != nil {
+		return nil, err
+	}
+
+	k := smolboard.APIKey{
+		ID:        int64(apiKeyIDGen.Generate()),
+		Username:  d.Session.Username,
+		Scope:     scope,
+		Label:     label,
+		Token:     smolboard.APIKeyPrefix + t,
+		CreatedAt: time.Now().UnixNano(),
+	}
+
+	_, err = d.Exec(
+		"INSERT INTO apikeys (id, username, tokenhash, scope, label, createdat)"+
+			" VALUES (?, ?, ?, ?, ?, ?)",
+		k.ID, k.Username, hashAPIKey(k.Token), k.Scope, k.Label, k.CreatedAt,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save API key")
+	}
+
+	if err := d.audit("apikey.create", k.Username, k.Scope); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// ListAPIKeys returns the current user's API keys from newest to oldest. Their
+// tokens are not included.
+func (d *Transaction) ListAPIKeys() ([]smolboard.APIKey, error) {
+	if err := d.notAPIKey(); err != nil {
+		return nil, err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return nil, err
+	}
+
+	var keys = []smolboard.APIKey{}
+
+	err := d.Select(&keys,
+		"SELECT id, username, scope, label, createdat, lastused FROM apikeys"+
+			" WHERE username = ? ORDER BY createdat DESC",
+		d.Session.Username,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query API keys")
+	}
+
+	return keys, nil
+}
+
+// deleteAPIKeys deletes all API keys of the user, such as after their password
+// is changed.
+func (d *Transaction) deleteAPIKeys(username string) error {
+	if _, err := d.Exec("DELETE FROM apikeys WHERE username = ?", username); err != nil {
+		return errors.Wrap(err, "Failed to delete API keys")
+	}
+	return nil
+}
+
+// RevokeAPIKey deletes one of the current user's API keys, which stops
+// working immediately.
+func (d *Transaction) RevokeAPIKey(id int64) error {
+	if err := d.notAPIKey(); err != nil {
+		return err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return err
+	}
+
+	ch, err := d.execChanged(
+		"DELETE FROM apikeys WHERE id = ? AND username = ?", id, d.Session.Username)
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete API key")
+	}
+	if !ch {
+		return smolboard.ErrAPIKeyNotFound
+	}
+
+	return d.audit("apikey.revoke", d.Session.Username, "")
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+func TestAPIKeys(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var key *smolboard.APIKey
+
+	t.Run("Create", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if _, err := tx.CreateAPIKey("admin", "bot"); !errors.Is(err, smolboard.ErrInvalidScope) {
+			t.Fatal("Unexpected error creating a key with an invalid scope:", err)
+		}
+
+		k, err := tx.CreateAPIKey(smolboard.ScopeRead, "bot")
+		if err != nil {
+			t.Fatal("Failed to create API key:", err)
+		}
+
+		if !IsAPIKey(k.Token) {
+			t.Fatalf("Unexpected API key token %q", k.Token)
+		}
+
+		keys, err := tx.ListAPIKeys()
+		if err != nil {
+			t.Fatal("Failed to list API keys:", err)
+		}
+
+		if len(keys) != 1 || keys[0].ID != k.ID || keys[0].Token != "" {
+			t.Fatalf("Unexpected API keys: %#v", keys)
+		}
+
+		key = k
+	})
+
+	t.Run("Use", func(t *testing.T) {
+		tx := testBeginTx(t, d, key.Token)
+
+		if tx.Session.Username != user.Username || tx.APIKey() == nil {
+			t.Fatalf("Unexpected session for API key: %#v", tx.Session)
+		}
+
+		if tx.APIKey().LastUsed == 0 {
+			t.Fatal("API key use was not recorded")
+		}
+
+		// Keys can't make more keys or revoke themselves.
+		if _, err := tx.CreateAPIKey(smolboard.ScopeWrite, ""); !errors.Is(err, smolboard.ErrAPIKeyNotAllowed) {
+			t.Fatal("Unexpected error creating a key with a key:", err)
+		}
+		if err := tx.RevokeAPIKey(key.ID); !errors.Is(err, smolboard.ErrAPIKeyNotAllowed) {
+			t.Fatal("Unexpected error revoking a key with a key:", err)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		// Other users' keys can't be revoked.
+		if err := tx.RevokeAPIKey(key.ID); !errors.Is(err, smolboard.ErrAPIKeyNotFound) {
+			t.Fatal("Unexpected error revoking another user's key:", err)
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if err := tx.RevokeAPIKey(key.ID); err != nil {
+			t.Fatal("Failed to revoke API key:", err)
+		}
+	})
+
+	_, err := BeginTx(context.Background(), d, key.Token)
+	if !errors.Is(err, smolboard.ErrInvalidAPIKey) {
+		t.Fatal("Unexpected error using a revoked key:", err)
+	}
+}
+
+func TestAPIKeysRevokedWithSessions(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	// newKey creates a new user with an API key.
+	newKey := func(t *testing.T, name string) *smolboard.APIKey {
+		user := newTestUser(t, d, owner.AuthToken, name, smolboard.PermissionUser)
+
+		var key *smolboard.APIKey
+
+		err := d.Acquire(context.Background(), user.AuthToken, func(tx *Transaction) (err error) {
+			key, err = tx.CreateAPIKey(smolboard.ScopeRead, "bot")
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to create API key:", err)
+		}
+
+		return key
+	}
+
+	t.Run("RevokeUserSessions", func(t *testing.T) {
+		key := newKey(t, "かぐやありかわ")
+
+		err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+			_, err := tx.RevokeUserSessions("かぐやありかわ")
+			return err
+		})
+		if err != nil {
+			t.Fatal("Failed to revoke user sessions:", err)
+		}
+
+		if _, err := BeginTx(context.Background(), d, key.Token); !errors.Is(err, smolboard.ErrInvalidAPIKey) {
+			t.Fatal("Unexpected error using a key of a revoked user:", err)
+		}
+	})
+
+	t.Run("ExpireAllSessions", func(t *testing.T) {
+		key := newKey(t, "いとうまお")
+
+		if _, err := d.ExpireAllSessions(context.Background()); err != nil {
+			t.Fatal("Failed to expire all sessions:", err)
+		}
+
+		if _, err := BeginTx(context.Background(), d, key.Token); !errors.Is(err, smolboard.ErrInvalidAPIKey) {
+			t.Fatal("Unexpected error using a key after expiring all sessions:", err)
+		}
+	})
+}
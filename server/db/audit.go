@@ -0,0 +1,50 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// audit writes an entry into the audit log with the current user as the
+// actor.
+func (d *Transaction) audit(action, target, detail string) error {
+	_, err := d.Exec(
+		"INSERT INTO auditlog VALUES (?, ?, ?, ?, ?)",
+		int64(auditIDGen.Generate()), d.Session.Username, action, target, detail,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write audit entry")
+	}
+
+	return nil
+}
+
+// auditf calls audit with a formatted detail.
+func (d *Transaction) auditf(action, target, f string, v ...interface{}) error {
+	return d.audit(action, target, fmt.Sprintf(f, v...))
+}
+
+// AuditLog returns the audit log from newest to oldest. Only administrators
+// and higher can read the audit log.
+func (d *Transaction) AuditLog(offset, limit int) ([]smolboard.AuditEntry, error) {
+	// SQLite treats a negative limit as no limit at all.
+	if limit < 0 || limit > 100 || offset < 0 {
+		return nil, smolboard.ErrPageCountLimit
+	}
+
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return nil, err
+	}
+
+	var entries = []smolboard.AuditEntry{}
+
+	err := d.Select(&entries,
+		"SELECT * FROM auditlog ORDER BY id DESC LIMIT ?, ?", offset, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query audit log")
+	}
+
+	return entries, nil
+}
@@ -5,9 +5,13 @@ import (
 	"database/sql"
 	"fmt"
 	"net/url"
+	"sync"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/diamondburned/duration"
+	"github.com/diamondburned/smolboard/server/mailer"
+	"github.com/diamondburned/smolboard/server/mailer/smtpmailer"
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
@@ -62,21 +66,365 @@ var migrations = []string{`
 		-- Prevent multiple of the same tags from appearing in one post.
 		UNIQUE (postid, tagname COLLATE NOCASE)
 	);
+`, `
+	CREATE TABLE emails (
+		username TEXT PRIMARY KEY REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		email    TEXT    NOT NULL,
+		verified INTEGER NOT NULL DEFAULT 0 -- boolean
+	);
+
+	CREATE TABLE mailtokens (
+		token    TEXT    PRIMARY KEY,
+		username TEXT    NOT NULL REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		purpose  INTEGER NOT NULL, -- mailPurpose enum
+		deadline INTEGER NOT NULL  -- unixnano
+	);
+`, `
+	ALTER TABLE posts ADD COLUMN deletedat INTEGER; -- unixnano, NULL if not deleted
+	CREATE INDEX posts_deletedat ON posts(deletedat);
+`, `
+	CREATE TABLE auditlog (
+		id     INTEGER PRIMARY KEY, -- Snowflake
+		actor  TEXT    NOT NULL,    -- not referenced to keep the history
+		action TEXT    NOT NULL,
+		target TEXT    NOT NULL,
+		detail TEXT    NOT NULL
+	);
+
+	CREATE TABLE reports (
+		id       INTEGER PRIMARY KEY, -- Snowflake
+		postid   INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		reporter TEXT    NOT NULL REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		reason     TEXT    NOT NULL,
+		resolution INTEGER NOT NULL DEFAULT 0, -- ReportAction, 0 if pending
+		-- Prevent a user from reporting the same post twice.
+		UNIQUE (postid, reporter)
+	);
+
+	CREATE INDEX reports_resolution ON reports(resolution);
+`, `
+	-- The owner's username if the session is an impersonation, else empty.
+	ALTER TABLE sessions ADD COLUMN impersonatedby TEXT NOT NULL DEFAULT '';
+`, `
+	-- Revoked sessions in JWT mode. Rows are kept until the JWT would have
+	-- expired anyway.
+	CREATE TABLE jwtrevocations (
+		jti       INTEGER NOT NULL,           -- 0 for user-wide revocations
+		username  TEXT    NOT NULL,
+		notbefore INTEGER NOT NULL DEFAULT 0, -- unixnano, user-wide only
+		keepjti   INTEGER NOT NULL DEFAULT 0, -- session kept by user-wide
+		deadline  INTEGER NOT NULL            -- unixnano
+	);
+
+	CREATE UNIQUE INDEX jwtrevocations_jti ON jwtrevocations(jti) WHERE jti != 0;
+	CREATE INDEX jwtrevocations_username ON jwtrevocations(username);
+`, `
+	-- The name that the user gave the session, else empty.
+	ALTER TABLE sessions ADD COLUMN name TEXT NOT NULL DEFAULT '';
+`, `
+	ALTER TABLE posts ADD COLUMN createdat INTEGER NOT NULL DEFAULT 0; -- unixnano
+	ALTER TABLE posts ADD COLUMN updatedat INTEGER NOT NULL DEFAULT 0; -- unixnano
+
+	-- Backfill existing posts from the millisecond timestamp in their Snowflake
+	-- IDs, which use the default Twitter epoch.
+	UPDATE posts SET createdat = ((id >> 22) + 1288834974657) * 1000000;
+	UPDATE posts SET updatedat = createdat;
+
+	CREATE INDEX posts_createdat ON posts(createdat);
+`, `
+	-- 1 if the post was uploaded without an account.
+	ALTER TABLE posts ADD COLUMN anonymous INTEGER NOT NULL DEFAULT 0; -- boolean
+`, `
+	-- Per-user overrides of the configured upload quotas.
+	CREATE TABLE quotas (
+		username TEXT PRIMARY KEY REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		maxbytes INTEGER NOT NULL, -- 0 for unlimited
+		maxposts INTEGER NOT NULL  -- 0 for unlimited
+	);
+`, `
+	ALTER TABLE users ADD COLUMN lastlogin INTEGER NOT NULL DEFAULT 0; -- unixnano, 0 if never
+`, `
+	CREATE TABLE pools (
+		id        INTEGER PRIMARY KEY,
+		owner     TEXT    NOT NULL REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		name      TEXT    NOT NULL,
+		createdat INTEGER NOT NULL -- unixnano
+	);
+
+	CREATE INDEX pools_owner ON pools(owner);
+
+	CREATE TABLE poolposts (
+		poolid   INTEGER NOT NULL REFERENCES pools(id) ON DELETE CASCADE,
+		postid   INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL, -- 0-indexed
+		-- A post can only be in the same pool once.
+		PRIMARY KEY (poolid, postid)
+	);
+
+	CREATE INDEX poolposts_position ON poolposts(poolid, position);
+`, `
+	-- A label of the device parsed from the user agent. Existing sessions are
+	-- labeled by BackfillSessionMetadata.
+	ALTER TABLE sessions ADD COLUMN device TEXT NOT NULL DEFAULT '';
+`, `
+	-- 1 if the post links to media hosted elsewhere instead of a stored file.
+	ALTER TABLE posts ADD COLUMN external INTEGER NOT NULL DEFAULT 0; -- boolean
+	ALTER TABLE posts ADD COLUMN mediaurl TEXT    NOT NULL DEFAULT ''; -- empty if not external
+`, `
+	CREATE TABLE favorites (
+		username TEXT    NOT NULL REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		postid    INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		createdat INTEGER NOT NULL, -- unixnano
+		PRIMARY KEY (username, postid)
+	);
+
+	CREATE INDEX favorites_createdat ON favorites(username, createdat);
+`, `
+	ALTER TABLE posts ADD COLUMN expiresat INTEGER; -- unixnano, NULL if never
+
+	CREATE INDEX posts_expiresat ON posts(expiresat) WHERE expiresat IS NOT NULL;
+`, `
+	-- Tags added before this was recorded have 0.
+	ALTER TABLE posttags ADD COLUMN taggedat INTEGER NOT NULL DEFAULT 0; -- unixnano
+
+	CREATE INDEX posttags_tagname ON posttags(tagname);
+`, `
+	CREATE TABLE failedsignins (
+		username TEXT PRIMARY KEY REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		failures    INTEGER NOT NULL, -- since windowstart
+		windowstart INTEGER NOT NULL, -- unixnano
+		notifiedat  INTEGER NOT NULL DEFAULT 0 -- unixnano, 0 if never
+	);
+`, `
+	ALTER TABLE posts ADD COLUMN contenthash TEXT NOT NULL DEFAULT ''; -- hex sha256, empty if unknown
+
+	CREATE INDEX posts_contenthash ON posts(contenthash) WHERE contenthash != '';
+`, `
+	CREATE TABLE apikeys (
+		id       INTEGER PRIMARY KEY,
+		username TEXT    NOT NULL REFERENCES users(username)
+			ON UPDATE CASCADE
+			ON DELETE CASCADE,
+		tokenhash TEXT    NOT NULL UNIQUE, -- hex sha256 of the key
+		scope     TEXT    NOT NULL,
+		label     TEXT    NOT NULL,
+		createdat INTEGER NOT NULL, -- unixnano
+		lastused  INTEGER NOT NULL DEFAULT 0 -- unixnano, 0 if never
+	);
+
+	CREATE INDEX apikeys_username ON apikeys(username);
+`, `
+	ALTER TABLE sessions ADD COLUMN scope TEXT NOT NULL DEFAULT 'write';
+`, `
+	-- Tags are written normalized from now on, so the existing ones are
+	-- normalized by normalizeStoredTags.
 `}
 
+// migrationHooks are run right after the migration at their index in the same
+// transaction, for changes that can't be done in SQL alone.
+var migrationHooks = map[int]func(tx *sql.Tx) error{
+	len(migrations) - 1: normalizeStoredTags,
+}
+
 type DBConfig struct {
-	Owner         string `toml:"owner"`
-	DatabasePath  string `toml:"databasePath"`
-	MaxTokenUses  int    `toml:"maxTokenUses"`
+	Owner        string `toml:"owner"`
+	DatabasePath string `toml:"databasePath"`
+	MaxTokenUses int    `toml:"maxTokenUses"`
+	// TokenLifespan is how long new sessions last if they aren't used.
 	TokenLifespan string `toml:"tokenLifespan"`
-
-	tokenLifespan time.Duration
+	// TokenRenewal is the inactivity timeout of sessions: their deadline is
+	// pushed back to this long after each use. It is empty by default, which
+	// uses TokenLifespan.
+	TokenRenewal string `toml:"tokenRenewal"`
+	// MaxSessionLifespan is the absolute timeout of sessions. Sessions expire
+	// this long after they're created, however often they're used. It is 0 by
+	// default, which doesn't cap sessions.
+	MaxSessionLifespan string `toml:"maxSessionLifespan"`
+	// TokenLength is the number of random bytes in session and mail tokens
+	// before they're encoded in base64url. It must be at least 16.
+	TokenLength int `toml:"tokenLength"`
+	// MinSessionRenewal is the minimum amount that a session's deadline must
+	// be pushed back by before the renewal is written.
+	MinSessionRenewal string `toml:"minSessionRenewal"`
+	// SessionGracePeriod is how long after its deadline a session is still
+	// accepted, so that requests made right as it expires don't fail. Such a
+	// session is always renewed. It is 0 by default, which expires sessions
+	// right at their deadline.
+	SessionGracePeriod string `toml:"sessionGracePeriod"`
+	// SessionCleanupBatch is the maximum number of expired sessions that are
+	// deleted at once. Only one batch is deleted when a session is created,
+	// and the janitor deletes the rest.
+	SessionCleanupBatch int `toml:"sessionCleanupBatch"`
+	// FailedSigninNotice is the number of failed sign ins within
+	// FailedSigninWindow after which the user is mailed a notice, if they have
+	// a verified email. At most one notice is sent per window, so that it
+	// can't be used to spam the user. It is 0 by default, which never sends
+	// notices.
+	FailedSigninNotice int    `toml:"failedSigninNotice"`
+	FailedSigninWindow string `toml:"failedSigninWindow"`
+	// MaxTrustedTokens is the maximum number of outstanding tokens that each
+	// trusted user can have. Trusted users cannot create tokens if this is 0.
+	MaxTrustedTokens int `toml:"maxTrustedTokens"`
+	// DefaultSignupPermission is the name of the permission that new users
+	// sign up with. It must be lower than Administrator. New users with the
+	// Guest permission are pending: they can sign in, but they can't upload
+	// until they are promoted.
+	DefaultSignupPermission string `toml:"defaultSignupPermission"`
+	// QueryTimeout is the maximum duration of a single query, after which
+	// the query is canceled. It can be 0 to disable the timeout. The janitor
+	// is not affected.
+	QueryTimeout string `toml:"queryTimeout"`
+	// DeletedPostLifespan is the grace period that soft-deleted posts can
+	// still be restored in before they are purged.
+	DeletedPostLifespan string `toml:"deletedPostLifespan"`
+	// SlowQueryThreshold is the duration after which a query is logged as
+	// slow. It is 0 by default, which disables the slow query log.
+	SlowQueryThreshold string `toml:"slowQueryThreshold"`
+
+	// UploadQuota and PostQuota are the default maximum total size and number
+	// of posts that each user can upload, including soft-deleted posts. They
+	// are unlimited if 0. Administrators aren't limited, and they can override
+	// the quotas of each user.
+	UploadQuota datasize.ByteSize `toml:"uploadQuota"`
+	PostQuota   int               `toml:"postQuota"`
+
+	// MaxPostTags is the maximum number of tags that each post can have. It is
+	// unlimited if 0.
+	MaxPostTags int `toml:"maxPostTags"`
+
+	// AnonymousPosting, if true, allows uploading without an account. These
+	// posts are attributed to AnonymousUsername, a reserved user that can't
+	// sign in and has the Guest permission.
+	AnonymousPosting  bool   `toml:"anonymousPosting"`
+	AnonymousUsername string `toml:"anonymousUsername"`
+	// AnonymousModeration, if true, hides anonymous posts from everyone but
+	// administrators until one of them lowers the post's permission.
+	AnonymousModeration bool `toml:"anonymousModeration"`
+
+	// ReservedUsernames are the usernames that can't be signed up with, which
+	// are compared case-insensitively. The owner's and the anonymous user's
+	// names are always reserved. If NormalizeReservedUsernames is true, then
+	// lookalikes such as "adm1n" or ones with Cyrillic letters are also caught.
+	ReservedUsernames          []string `toml:"reservedUsernames"`
+	NormalizeReservedUsernames bool     `toml:"normalizeReservedUsernames"`
+
+	// PostIDScheme is either "snowflake", which is the default, or
+	// "sequential". Snowflake IDs are sortable by time, while sequential IDs
+	// count up from the largest post ID.
+	PostIDScheme string `toml:"postIDScheme"`
+	// MachineID is the snowflake machine ID of post and session IDs, which
+	// ranges from 0 to 1023. It must be unique among all servers sharing the
+	// database or the session store, as those servers would otherwise hand
+	// out the same session IDs.
+	MachineID int64 `toml:"machineID"`
+
+	// SessionMode is either "database", which is the default, or "jwt". In JWT
+	// mode, sessions are signed tokens that are verified without looking them
+	// up, and only revoked sessions are stored.
+	SessionMode string `toml:"sessionMode"`
+	// JWTSecret is the secret used to sign session JWTs. It must be at least 32
+	// bytes long in JWT mode.
+	JWTSecret string `toml:"jwtSecret"`
+	// JWTPreviousSecrets are old JWT secrets that JWTs are still verified
+	// with, but not signed with, after jwtSecret is changed. A secret can be
+	// removed once tokenLifespan has passed since it was replaced.
+	JWTPreviousSecrets []string `toml:"jwtPreviousSecrets"`
+	// ShareSecret is the secret that post share links are signed with. It must
+	// be at least 32 bytes long, or empty to disable share links. Changing it
+	// revokes all share links.
+	ShareSecret string `toml:"shareSecret"`
+
+	// Peppers are secrets that passwords are HMAC'd with before hashing, keyed
+	// by their version. New hashes use the highest version, and the others are
+	// kept to verify old hashes, which are upgraded on sign in. They should be
+	// kept in a different config file than the database. Passwords are not
+	// peppered if this is empty.
+	Peppers map[string]string `toml:"peppers"`
+	// LegacyPasswordSchemes are the password schemes other than bcrypt and
+	// Argon2id that users can be imported and signed in with, which are
+	// "sha256" and "plaintext". These hashes are replaced on sign in, so a
+	// scheme can be removed once all of its users have signed in.
+	LegacyPasswordSchemes []string `toml:"legacyPasswordSchemes"`
+
+	// SMTP is used to create the default Mailer if Mailer is nil.
+	SMTP smtpmailer.Config `toml:"smtp"`
+	// Mailer is used to send verification and password reset emails. If nil,
+	// then an SMTP mailer is used if configured, else mails are dropped.
+	Mailer mailer.Mailer `toml:"-"`
+	// SessionStore is where sessions are kept. If nil, then it is picked
+	// according to SessionMode.
+	SessionStore SessionStore `toml:"-"`
+	// Logger receives the slow query log. If nil, then StdLogger is used.
+	Logger Logger `toml:"-"`
+
+	tokenLifespan       time.Duration
+	tokenRenewal        time.Duration
+	maxSessionLifespan  time.Duration
+	minSessionRenewal   time.Duration
+	sessionGracePeriod  time.Duration
+	queryTimeout        time.Duration
+	slowQueryThreshold  time.Duration
+	deletedPostLifespan time.Duration
+	failedSigninWindow  time.Duration
+	signupPermission    smolboard.Permission
+	peppers             peppers
+	legacySchemes       map[string]bool
+	reservedUsernames   map[string]bool
+	postIDs             IDGenerator
+	sessionIDs          IDGenerator
 }
 
+const (
+	SessionModeDatabase = "database"
+	SessionModeJWT      = "jwt"
+)
+
+// MinJWTSecretLen is the minimum length of the JWT secret in bytes.
+const MinJWTSecretLen = 32
+
+// MinTokenLength is the minimum number of random bytes in a token.
+const MinTokenLength = 16
+
 func NewConfig() DBConfig {
 	return DBConfig{
 		MaxTokenUses:  100,
 		TokenLifespan: "7d",
+		TokenLength:   32,
+		SessionMode:   SessionModeDatabase,
+		PostIDScheme:  PostIDSnowflake,
+		SMTP:          smtpmailer.NewConfig(),
+
+		MinSessionRenewal:   "1h",
+		MaxSessionLifespan:  "0s",
+		SessionGracePeriod:  "0s",
+		SessionCleanupBatch: 1000,
+		FailedSigninWindow:  "1h",
+		MaxTrustedTokens:    5,
+		QueryTimeout:        "30s",
+		SlowQueryThreshold:  "0s",
+		DeletedPostLifespan: "7d",
+		MaxPostTags:         64,
+
+		DefaultSignupPermission: "user",
+
+		AnonymousUsername:   "anonymous",
+		AnonymousModeration: true,
+
+		ReservedUsernames: append([]string(nil), DefaultReservedUsernames...),
 	}
 }
 
@@ -89,12 +437,201 @@ func (c *DBConfig) Validate() error {
 		return errors.New("missing `databasePath' value")
 	}
 
+	if c.SessionCleanupBatch < 1 {
+		return errors.New("`sessionCleanupBatch' must be positive")
+	}
+
+	if c.FailedSigninNotice < 0 {
+		return errors.New("`failedSigninNotice' must not be negative")
+	}
+
+	if c.MaxTrustedTokens < 0 {
+		return errors.New("`maxTrustedTokens' must not be negative")
+	}
+
+	if c.PostQuota < 0 {
+		return errors.New("`postQuota' must not be negative")
+	}
+
+	if c.MaxPostTags < 0 {
+		return errors.New("`maxPostTags' must not be negative")
+	}
+
+	if c.TokenLength < MinTokenLength {
+		return fmt.Errorf("`tokenLength' must be at least %d bytes", MinTokenLength)
+	}
+
 	d, err := duration.ParseDuration(c.TokenLifespan)
 	if err != nil {
 		return errors.Wrap(err, "invalid token lifespan")
 	}
 	c.tokenLifespan = time.Duration(d)
 
+	if c.TokenRenewal != "" {
+		d, err = duration.ParseDuration(c.TokenRenewal)
+		if err != nil {
+			return errors.Wrap(err, "invalid token renewal")
+		}
+		c.tokenRenewal = time.Duration(d)
+
+		if c.tokenRenewal <= 0 {
+			return errors.New("`tokenRenewal' must be positive")
+		}
+	}
+
+	d, err = duration.ParseDuration(c.MaxSessionLifespan)
+	if err != nil {
+		return errors.Wrap(err, "invalid maximum session lifespan")
+	}
+	c.maxSessionLifespan = time.Duration(d)
+
+	if c.maxSessionLifespan < 0 {
+		return errors.New("`maxSessionLifespan' must not be negative")
+	}
+
+	d, err = duration.ParseDuration(c.MinSessionRenewal)
+	if err != nil {
+		return errors.Wrap(err, "invalid minimum session renewal")
+	}
+	c.minSessionRenewal = time.Duration(d)
+
+	if c.minSessionRenewal < 0 || c.minSessionRenewal >= c.renewLifespan() {
+		return errors.New("`minSessionRenewal' must be between 0 and `tokenRenewal'")
+	}
+
+	d, err = duration.ParseDuration(c.SessionGracePeriod)
+	if err != nil {
+		return errors.Wrap(err, "invalid session grace period")
+	}
+	c.sessionGracePeriod = time.Duration(d)
+
+	if c.sessionGracePeriod < 0 || c.sessionGracePeriod >= c.tokenLifespan {
+		return errors.New("`sessionGracePeriod' must be between 0 and `tokenLifespan'")
+	}
+
+	d, err = duration.ParseDuration(c.QueryTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid query timeout")
+	}
+	c.queryTimeout = time.Duration(d)
+
+	if c.queryTimeout < 0 {
+		return errors.New("`queryTimeout' must not be negative")
+	}
+
+	d, err = duration.ParseDuration(c.SlowQueryThreshold)
+	if err != nil {
+		return errors.Wrap(err, "invalid slow query threshold")
+	}
+	c.slowQueryThreshold = time.Duration(d)
+
+	if c.slowQueryThreshold < 0 {
+		return errors.New("`slowQueryThreshold' must not be negative")
+	}
+
+	if c.Logger == nil {
+		c.Logger = StdLogger
+	}
+
+	d, err = duration.ParseDuration(c.DeletedPostLifespan)
+	if err != nil {
+		return errors.Wrap(err, "invalid deleted post lifespan")
+	}
+	c.deletedPostLifespan = time.Duration(d)
+
+	d, err = duration.ParseDuration(c.FailedSigninWindow)
+	if err != nil {
+		return errors.Wrap(err, "invalid failed sign in window")
+	}
+	c.failedSigninWindow = time.Duration(d)
+
+	if c.failedSigninWindow <= 0 {
+		return errors.New("`failedSigninWindow' must be positive")
+	}
+
+	c.signupPermission, err = smolboard.ParsePermission(c.DefaultSignupPermission)
+	if err != nil {
+		return fmt.Errorf("unknown `defaultSignupPermission' %q", c.DefaultSignupPermission)
+	}
+
+	if c.signupPermission >= smolboard.PermissionAdministrator {
+		return errors.New("`defaultSignupPermission' must be lower than administrator")
+	}
+
+	if err := smolboard.NameIsLegal(c.AnonymousUsername); err != nil {
+		return errors.Wrap(err, "invalid `anonymousUsername'")
+	}
+
+	if c.AnonymousUsername == c.Owner {
+		return errors.New("`anonymousUsername' must not be the owner")
+	}
+
+	c.reservedUsernames = c.parseReservedUsernames()
+
+	switch c.PostIDScheme {
+	case PostIDSnowflake, PostIDSequential:
+	default:
+		return fmt.Errorf("unknown `postIDScheme' %q", c.PostIDScheme)
+	}
+
+	if c.MachineID < 0 || c.MachineID > MaxMachineID {
+		return fmt.Errorf("`machineID' must be between 0 and %d", MaxMachineID)
+	}
+
+	if c.peppers, err = parsePeppers(c.Peppers); err != nil {
+		return err
+	}
+
+	c.legacySchemes = make(map[string]bool, len(c.LegacyPasswordSchemes))
+
+	for _, scheme := range c.LegacyPasswordSchemes {
+		if !isLegacyScheme(scheme) {
+			return fmt.Errorf("unknown legacy password scheme %q", scheme)
+		}
+		c.legacySchemes[scheme] = true
+	}
+
+	if c.ShareSecret != "" && len(c.ShareSecret) < MinJWTSecretLen {
+		return fmt.Errorf("`shareSecret' must be at least %d bytes long", MinJWTSecretLen)
+	}
+
+	switch c.SessionMode {
+	case SessionModeDatabase:
+		if c.SessionStore == nil {
+			c.SessionStore = SQLSessionStore{}
+		}
+	case SessionModeJWT:
+		if len(c.JWTSecret) < MinJWTSecretLen {
+			return fmt.Errorf("`jwtSecret' must be at least %d bytes long", MinJWTSecretLen)
+		}
+		var previous = make([][]byte, len(c.JWTPreviousSecrets))
+
+		for i, secret := range c.JWTPreviousSecrets {
+			if len(secret) < MinJWTSecretLen {
+				return fmt.Errorf("`jwtPreviousSecrets' must be at least %d bytes long", MinJWTSecretLen)
+			}
+			previous[i] = []byte(secret)
+		}
+
+		if c.SessionStore == nil {
+			c.SessionStore = NewJWTSessionStore([]byte(c.JWTSecret), c.maxTokenLifespan(), previous...)
+		}
+	default:
+		return fmt.Errorf("unknown `sessionMode' %q", c.SessionMode)
+	}
+
+	if err := c.SMTP.Validate(); err != nil {
+		return err
+	}
+
+	if c.Mailer == nil {
+		if c.SMTP.IsZero() {
+			c.Mailer = mailer.Noop
+		} else {
+			c.Mailer = smtpmailer.New(c.SMTP)
+		}
+	}
+
 	return nil
 }
 
@@ -112,6 +649,12 @@ func URLWithPragmas(file string) string {
 type Database struct {
 	*sqlx.DB
 	Config DBConfig
+	// Events is where post events are published to.
+	Events *EventHub
+
+	// mailing tracks the mails being sent in the background, which Close
+	// waits for.
+	mailing sync.WaitGroup
 }
 
 func NewDatabase(config DBConfig) (*Database, error) {
@@ -127,7 +670,7 @@ func NewDatabase(config DBConfig) (*Database, error) {
 	// Allow about 1024 connection? Unsure.
 	d.SetMaxOpenConns(1024)
 
-	db := &Database{d, config}
+	db := &Database{DB: d, Config: config, Events: NewEventHub()}
 
 	// Enable foreign key constraints.
 	if err := db.enableFK(); err != nil {
@@ -139,15 +682,32 @@ func NewDatabase(config DBConfig) (*Database, error) {
 		return nil, errors.Wrap(err, "Failed to get user_version pragma")
 	}
 
-	// If we're already up-to-date with all the migrations, then we're done.
-	if v >= len(migrations) {
-		return db, nil
+	// Only migrate if we're not already up-to-date with all the migrations.
+	if v < len(migrations) {
+		if err := db.migrate(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.initIDs(); err != nil {
+		return nil, err
+	}
+
+	if config.AnonymousPosting {
+		if err := db.createAnonymous(); err != nil {
+			return nil, err
+		}
 	}
 
+	return db, nil
+}
+
+// migrate applies all migrations after the given version.
+func (db *Database) migrate(v int) error {
 	// Start a transaction because yadda yadda speed.
 	tx, err := db.DB.Begin()
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to start a transaction for migrations")
+		return errors.Wrap(err, "Failed to start a transaction for migrations")
 	}
 	// Rollback in the end even if we've failed, just in case.
 	defer tx.Rollback()
@@ -157,21 +717,56 @@ func NewDatabase(config DBConfig) (*Database, error) {
 	for i := v; i < len(migrations); i++ {
 		_, err := tx.Exec(migrations[i])
 		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to migrate at step %d", i)
+			return errors.Wrapf(err, "Failed to migrate at step %d", i)
+		}
+
+		if hook, ok := migrationHooks[i]; ok {
+			if err := hook(tx); err != nil {
+				return errors.Wrapf(err, "Failed to migrate at step %d", i)
+			}
 		}
 	}
 
 	// Save the version.
 	if err := db.setUserVersion(tx, len(migrations)); err != nil {
-		return nil, errors.Wrap(err, "Failed to save user_version pragma")
+		return errors.Wrap(err, "Failed to save user_version pragma")
 	}
 
 	// Save all changes.
 	if err := tx.Commit(); err != nil {
-		return nil, errors.Wrap(err, "Failed to save migration changes")
+		return errors.Wrap(err, "Failed to save migration changes")
 	}
 
-	return db, nil
+	return nil
+}
+
+// initIDs creates the post and session ID generators. The post ID
+// generator is seeded with the largest post ID, so that new IDs stay larger
+// across restarts.
+func (db *Database) initIDs() error {
+	g, err := NewSnowflakeGenerator(db.Config.MachineID, 0)
+	if err != nil {
+		return err
+	}
+	db.Config.sessionIDs = g
+
+	var last int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM posts").Scan(&last); err != nil {
+		return errors.Wrap(err, "Failed to get the last post ID")
+	}
+
+	switch db.Config.PostIDScheme {
+	case PostIDSequential:
+		db.Config.postIDs = NewSequentialGenerator(last)
+	default:
+		g, err := NewSnowflakeGenerator(db.Config.MachineID, last)
+		if err != nil {
+			return err
+		}
+		db.Config.postIDs = g
+	}
+
+	return nil
 }
 
 // CreateOwner initializes the database once then creates the owner account.
@@ -191,7 +786,10 @@ func CreateOwner(config DBConfig, password string) error {
 	return nil
 }
 
+// Close waits for the mails being sent in the background and closes the
+// database.
 func (d *Database) Close() error {
+	d.mailing.Wait()
 	return d.DB.Close()
 }
 
@@ -217,6 +815,37 @@ func (d *Database) createOwner(password string) error {
 	})
 }
 
+// createAnonymous creates the reserved anonymous user if it doesn't exist yet.
+// The user has no password, so it can never be signed in as.
+func (d *Database) createAnonymous() error {
+	return d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		_, err := tx.Exec(
+			`INSERT OR IGNORE INTO users (username, jointime, passhash, permission)
+				VALUES (?, ?, '', ?)`,
+			d.Config.AnonymousUsername, time.Now().UnixNano(), smolboard.PermissionGuest,
+		)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create anonymous user")
+		}
+
+		// Refuse to attribute posts to someone who signed up with the name.
+		var passhash []byte
+		err = tx.
+			QueryRow("SELECT passhash FROM users WHERE username = ?", d.Config.AnonymousUsername).
+			Scan(&passhash)
+		if err != nil {
+			return errors.Wrap(err, "Failed to scan anonymous user")
+		}
+
+		if len(passhash) > 0 {
+			return fmt.Errorf(
+				"`anonymousUsername' %q is taken by an existing user", d.Config.AnonymousUsername)
+		}
+
+		return nil
+	})
+}
+
 type TxHandler = func(*Transaction) error
 
 func (d *Database) Acquire(ctx context.Context, session string, fn TxHandler) error {
@@ -237,6 +866,37 @@ func (d *Database) AcquireGuest(ctx context.Context, fn TxHandler) error {
 	return d.Acquire(ctx, "", fn)
 }
 
+// WithTransaction runs fn in a single transaction belonging to the given
+// session, which may be empty for guests. Unlike Acquire, the transaction is
+// opened even for guests, so all of fn's changes are either committed together
+// or not at all: they are rolled back if fn returns an error or panics.
+func (d *Database) WithTransaction(ctx context.Context, session string, fn TxHandler) error {
+	t, err := beginTx(ctx, d, session, true)
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+
+	var committed bool
+
+	defer func() {
+		if !committed {
+			t.Rollback()
+		}
+	}()
+
+	if err := fn(t); err != nil {
+		return err
+	}
+
+	committed = true
+
+	if err := t.Commit(); err != nil {
+		return errors.Wrap(err, "Failed to commit transaction")
+	}
+
+	return nil
+}
+
 func errIsConstraint(err error) bool {
 	if err != nil {
 		sqlerr := sqlite3.Error{}
@@ -10,11 +10,19 @@ import (
 	"time"
 
 	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
 )
 
 var _testdb uint64 = 4
 
-func newTestDatabase(t *testing.T) *Database {
+func newTestDatabase(t testing.TB) *Database {
+	t.Helper()
+	return newTestDatabaseWith(t, nil)
+}
+
+// newTestDatabaseWith creates a new test database with the config modified by
+// the given function, if any.
+func newTestDatabaseWith(t testing.TB, fn func(*DBConfig)) *Database {
 	t.Helper()
 
 	// Get the current unique index.
@@ -34,6 +42,10 @@ func newTestDatabase(t *testing.T) *Database {
 	cfg.Owner = "ひめありかわ1"
 	cfg.DatabasePath = dbpath
 
+	if fn != nil {
+		fn(&cfg)
+	}
+
 	// Start a fresh database.
 	d, err := NewDatabase(cfg)
 	if err != nil {
@@ -45,7 +57,7 @@ func newTestDatabase(t *testing.T) *Database {
 	return d
 }
 
-func testNewOwner(t *testing.T, db *Database, user, pass string) *smolboard.Session {
+func testNewOwner(t testing.TB, db *Database, user, pass string) *smolboard.Session {
 	t.Helper()
 
 	db.Config.Owner = user
@@ -114,3 +126,208 @@ func testMustOneTimeToken(t *testing.T, tx *Transaction) string {
 func TestDatabase(t *testing.T) {
 	newTestDatabase(t)
 }
+
+func TestWithTransaction(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	var errTest = errors.New("test error")
+
+	var createPost = func(tx *Transaction) (*smolboard.Post, error) {
+		p := NewEmptyPost("image/png")
+		p.Size = 1
+
+		if err := tx.SavePost(&p); err != nil {
+			return nil, err
+		}
+		if err := tx.TagPost(p.ID, "shiny"); err != nil {
+			return nil, err
+		}
+
+		return &p, nil
+	}
+
+	var expectPost = func(t *testing.T, id int64, exists bool) {
+		t.Helper()
+
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		_, err := tx.Post(id)
+		if exists && err != nil {
+			t.Fatal("Failed to get committed post:", err)
+		}
+		if !exists && !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error getting rolled back post:", err)
+		}
+	}
+
+	t.Run("Rollback", func(t *testing.T) {
+		var post *smolboard.Post
+
+		err := d.WithTransaction(context.Background(), owner.AuthToken, func(tx *Transaction) (err error) {
+			post, err = createPost(tx)
+			if err != nil {
+				t.Fatal("Failed to create post:", err)
+			}
+			return errTest
+		})
+		if !errors.Is(err, errTest) {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		expectPost(t, post.ID, false)
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		var post *smolboard.Post
+
+		func() {
+			defer func() { recover() }()
+
+			d.WithTransaction(context.Background(), owner.AuthToken, func(tx *Transaction) (err error) {
+				post, err = createPost(tx)
+				if err != nil {
+					t.Fatal("Failed to create post:", err)
+				}
+				panic(errTest)
+			})
+		}()
+
+		expectPost(t, post.ID, false)
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		var post *smolboard.Post
+
+		err := d.WithTransaction(context.Background(), owner.AuthToken, func(tx *Transaction) (err error) {
+			post, err = createPost(tx)
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to run transaction:", err)
+		}
+
+		expectPost(t, post.ID, true)
+	})
+}
+
+func TestQueryTimeout(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.QueryTimeout = "50ms"
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	// This query never ends on its own.
+	const slowQuery = `
+		WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c)
+		SELECT COUNT(*) FROM c`
+
+	t.Run("Slow", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		var start = time.Now()
+
+		err := tx.QueryRow(slowQuery).Scan(new(int))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("Unexpected error running slow query:", err)
+		}
+
+		if since := time.Since(start); since > time.Second {
+			t.Fatal("Slow query took too long to cancel:", since)
+		}
+
+		// The transaction should still be usable.
+		if _, err := tx.Me(); err != nil {
+			t.Fatal("Failed to query after a timed out query:", err)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		tx, err := BeginTx(ctx, d, "")
+		if err != nil {
+			t.Fatal("Failed to begin transaction:", err)
+		}
+		defer tx.Rollback()
+
+		// Cancel the context before the query times out.
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		err = tx.QueryRow(slowQuery).Scan(new(int))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("Unexpected error running query with a canceled context:", err)
+		}
+
+		// Fast queries should fail the same way once the context is canceled.
+		if err := tx.QueryRow("SELECT 1").Scan(new(int)); !errors.Is(err, context.Canceled) {
+			t.Fatal("Unexpected error running QueryRow with a canceled context:", err)
+		}
+		if err := tx.QueryRowx("SELECT 1").Scan(new(int)); !errors.Is(err, context.Canceled) {
+			t.Fatal("Unexpected error running QueryRowx with a canceled context:", err)
+		}
+	})
+
+	t.Run("RowsReleased", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		for i := 0; i < 100; i++ {
+			if err := tx.QueryRow("SELECT 1").Scan(new(int)); err != nil {
+				t.Fatal("Failed to query row:", err)
+			}
+		}
+
+		// Scanned rows shouldn't keep their contexts around.
+		if n := len(tx.cancels); n > 0 {
+			t.Fatal("Unexpected number of held query contexts:", n)
+		}
+	})
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	var slow = make(chan SlowQuery, 16)
+
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.SlowQueryThreshold = "10ms"
+		cfg.Logger = LoggerFunc(func(q SlowQuery) {
+			select {
+			case slow <- q:
+			default:
+			}
+		})
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+		var counts []int
+		return tx.Select(&counts, `
+			WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c LIMIT ?)
+			SELECT COUNT(*) FROM c`,
+			1000000,
+		)
+	})
+	if err != nil {
+		t.Fatal("Failed to run slow query:", err)
+	}
+
+	const template = "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c LIMIT ?) " +
+		"SELECT COUNT(*) FROM c"
+
+	for {
+		select {
+		case q := <-slow:
+			if q.Query != template {
+				continue
+			}
+			if q.Duration < 10*time.Millisecond {
+				t.Fatal("Slow query logged with a short duration:", q.Duration)
+			}
+			return
+		default:
+			t.Fatal("Slow query was not logged")
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"sync"
+	"time"
 
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/jmoiron/sqlx"
@@ -22,48 +23,100 @@ type Transaction struct {
 	closeMu sync.Mutex
 	closed  bool
 	isTx    bool
+	// cancels contains the cancel functions of the query contexts that can't
+	// be canceled until the transaction is done, since their rows may still
+	// be read.
+	cancels []context.CancelFunc
 
 	// As we acquire an entire transaction, it is safe to store our own local
 	// session state as long as we keep it up to date on our own calls.
 	Session smolboard.Session
+	// claims is non-nil if the session is a JWT.
+	claims *jwtClaims
+	// apiKey is non-nil if the transaction was authenticated with an API key
+	// instead of a session.
+	apiKey *smolboard.APIKey
+
+	// events is the database's hub, which queued events are published to once
+	// the transaction is committed.
+	events *EventHub
+	queued []smolboard.Event
+	// mails are sent once the transaction's changes are saved.
+	mails []queuedMail
+	// mailing is the database's group of mails sent in the background.
+	mailing *sync.WaitGroup
+
+	// maxPermission caps the user's permission if limited is true.
+	maxPermission smolboard.Permission
+	limited       bool
 }
 
 // BeginTx starts a new transaction belonging to the given session. If session
 // is empty, then a transaction is not opened.
 func BeginTx(ctx context.Context, db *Database, session string) (*Transaction, error) {
+	return beginTx(ctx, db, session, false)
+}
+
+// beginTx is BeginTx, except a transaction is always opened if atomic is true,
+// even if the session is empty.
+func beginTx(ctx context.Context, db *Database, session string, atomic bool) (*Transaction, error) {
 	conn, err := db.Connx(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get conn")
 	}
 
 	tx := Transaction{
-		Conn:   conn,
-		ctx:    ctx,
-		config: db.Config,
+		Conn:    conn,
+		ctx:     ctx,
+		config:  db.Config,
+		events:  db.Events,
+		mailing: &db.mailing,
 	}
 
-	if session != "" {
+	if session != "" || atomic {
 		_, err := conn.ExecContext(ctx, "BEGIN DEFERRED")
 		if err != nil {
 			conn.Close()
 			return nil, errors.Wrap(err, "failed to acquire concurrent tx")
 		}
 
-		s, err := tx.querySession(session)
+		// Mark this as a transaction early, so that the rollback below
+		// actually ends it before returning the connection.
+		tx.isTx = true
+	}
+
+	if session != "" {
+		var s *smolboard.Session
+
+		if IsAPIKey(session) {
+			s, err = tx.queryAPIKey(session)
+		} else {
+			s, err = tx.querySession(session)
+		}
+
 		if err != nil {
 			tx.Rollback()
 			return nil, err
 		}
 
-		tx.isTx = true
 		tx.Session = *s
 	}
 
 	return &tx, nil
 }
 
-// Commit commits the changes. It does not close the transaction.
+// Commit commits the changes. It does not close the transaction. Queued mails
+// are sent afterwards, once the connection is released.
 func (tx *Transaction) Commit() error {
+	if err := tx.commit(); err != nil {
+		return err
+	}
+
+	tx.sendQueuedMails()
+	return nil
+}
+
+func (tx *Transaction) commit() error {
 	tx.closeMu.Lock()
 	defer tx.closeMu.Unlock()
 
@@ -72,6 +125,7 @@ func (tx *Transaction) Commit() error {
 	}
 	tx.closed = true
 
+	defer tx.cancelQueries()
 	defer tx.Conn.Close()
 
 	if tx.isTx {
@@ -81,12 +135,29 @@ func (tx *Transaction) Commit() error {
 		}
 	}
 
+	if len(tx.queued) > 0 {
+		tx.events.Publish(tx.queued...)
+	}
+
 	return nil
 }
 
 // Rollback rolls back the transaction and closes it. This method must ALWAYS be
-// called when done.
+// called when done. Guests' changes are saved as they're made, so their queued
+// mails are still sent.
 func (tx *Transaction) Rollback() error {
+	err := tx.rollback()
+
+	if tx.isTx {
+		tx.mails = nil
+	} else {
+		tx.sendQueuedMails()
+	}
+
+	return err
+}
+
+func (tx *Transaction) rollback() error {
 	tx.closeMu.Lock()
 	defer tx.closeMu.Unlock()
 
@@ -95,6 +166,7 @@ func (tx *Transaction) Rollback() error {
 	}
 	tx.closed = true
 
+	defer tx.cancelQueries()
 	defer tx.Conn.Close()
 
 	if tx.isTx {
@@ -107,27 +179,158 @@ func (tx *Transaction) Rollback() error {
 	return nil
 }
 
+// Context returns the context that the transaction was started with.
+func (tx *Transaction) Context() context.Context {
+	return tx.ctx
+}
+
+// SessionGracePeriod returns how long after its deadline a session can still
+// be used. Session stores that expire sessions on their own must keep them
+// around for this long.
+func (tx *Transaction) SessionGracePeriod() time.Duration {
+	return tx.config.sessionGracePeriod
+}
+
+// queryContext returns the context for a single query, which times out after
+// the configured query timeout. The returned cancel function must be called
+// once the query's results are read.
+func (tx *Transaction) queryContext() (context.Context, context.CancelFunc) {
+	if tx.config.queryTimeout <= 0 {
+		return tx.ctx, func() {}
+	}
+	return context.WithTimeout(tx.ctx, tx.config.queryTimeout)
+}
+
+// deferredQueryContext is like queryContext, except the context is only
+// canceled once the transaction is done.
+func (tx *Transaction) deferredQueryContext() context.Context {
+	ctx, cancel := tx.queryContext()
+
+	tx.closeMu.Lock()
+	tx.cancels = append(tx.cancels, cancel)
+	tx.closeMu.Unlock()
+
+	return ctx
+}
+
+func (tx *Transaction) cancelQueries() {
+	for _, cancel := range tx.cancels {
+		cancel()
+	}
+	tx.cancels = nil
+}
+
 // Exec calls ExecContext.
 func (tx *Transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return tx.Conn.ExecContext(tx.ctx, query, args...)
+	// The SQLite driver only interrupts statements that are still running when
+	// the context is canceled, so fast statements of a canceled request would
+	// otherwise still go through.
+	if err := tx.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := tx.queryContext()
+	defer cancel()
+	defer tx.timeQuery(query)()
+
+	return tx.Conn.ExecContext(ctx, query, args...)
+}
+
+// Select calls SelectContext.
+func (tx *Transaction) Select(dst interface{}, query string, args ...interface{}) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := tx.queryContext()
+	defer cancel()
+	defer tx.timeQuery(query)()
+
+	return tx.Conn.SelectContext(ctx, dst, query, args...)
 }
 
 // QueryRowx calls QueryRowxContext.
-func (tx *Transaction) QueryRowx(query string, args ...interface{}) *sqlx.Row {
-	return tx.Conn.QueryRowxContext(tx.ctx, query, args...)
+func (tx *Transaction) QueryRowx(query string, args ...interface{}) *Rowx {
+	if err := tx.ctx.Err(); err != nil {
+		return &Rowx{err: err}
+	}
+
+	ctx, cancel := tx.queryContext()
+	defer tx.timeQuery(query)()
+
+	return &Rowx{row: tx.Conn.QueryRowxContext(ctx, query, args...), cancel: cancel}
 }
 
 // Queryx calls QueryxContext.
 func (tx *Transaction) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
-	return tx.Conn.QueryxContext(tx.ctx, query, args...)
+	if err := tx.ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer tx.timeQuery(query)()
+	return tx.Conn.QueryxContext(tx.deferredQueryContext(), query, args...)
 }
 
 // QueryRow calls QueryRowContext.
-func (tx *Transaction) QueryRow(query string, args ...interface{}) *sql.Row {
-	return tx.Conn.QueryRowContext(tx.ctx, query, args...)
+func (tx *Transaction) QueryRow(query string, args ...interface{}) *Row {
+	if err := tx.ctx.Err(); err != nil {
+		return &Row{err: err}
+	}
+
+	ctx, cancel := tx.queryContext()
+	defer tx.timeQuery(query)()
+
+	return &Row{row: tx.Conn.QueryRowContext(ctx, query, args...), cancel: cancel}
+}
+
+// Row is the result of QueryRow. Unlike rows from Query, its query context is
+// canceled as soon as it's scanned, so that transactions making many single-row
+// queries don't hold on to all of their contexts.
+type Row struct {
+	row    *sql.Row
+	err    error
+	cancel context.CancelFunc
+}
+
+// Scan calls sql.Row's Scan, or returns the error that the query failed early
+// with.
+func (r *Row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.cancel()
+	return r.row.Scan(dest...)
+}
+
+// Rowx is the result of QueryRowx. It is canceled like Row.
+type Rowx struct {
+	row    *sqlx.Row
+	err    error
+	cancel context.CancelFunc
+}
+
+// Scan calls sqlx.Row's Scan.
+func (r *Rowx) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.cancel()
+	return r.row.Scan(dest...)
+}
+
+// StructScan calls sqlx.Row's StructScan.
+func (r *Rowx) StructScan(dest interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.cancel()
+	return r.row.StructScan(dest)
 }
 
 // Query calls QueryContext.
 func (tx *Transaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return tx.Conn.QueryContext(tx.ctx, query, args...)
+	if err := tx.ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer tx.timeQuery(query)()
+	return tx.Conn.QueryContext(tx.deferredQueryContext(), query, args...)
 }
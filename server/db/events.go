@@ -0,0 +1,137 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/diamondburned/smolboard/smolboard"
+)
+
+// DefaultEventBuffer is the number of events that a subscription buffers if the
+// given buffer size is not positive.
+const DefaultEventBuffer = 64
+
+// EventHub fans out post events to all subscriptions. Events are published once
+// the transaction that caused them is committed. It is safe to use
+// concurrently.
+type EventHub struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// NewEventHub creates a new empty hub.
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives the events of posts that its user can see.
+type Subscription struct {
+	hub *EventHub
+	ch  chan smolboard.Event
+
+	username   string
+	permission smolboard.Permission
+
+	dropped bool
+}
+
+// Subscribe subscribes to the events of posts that the given user can see with
+// the given permission. The subscription must be closed once done.
+func (h *EventHub) Subscribe(username string, perm smolboard.Permission, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+
+	s := &Subscription{
+		hub:        h,
+		ch:         make(chan smolboard.Event, buffer),
+		username:   username,
+		permission: perm,
+	}
+
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+
+	return s
+}
+
+// Events returns the channel of events. It is closed once the subscription is
+// closed or dropped.
+func (s *Subscription) Events() <-chan smolboard.Event {
+	return s.ch
+}
+
+// Dropped returns true if the subscription was dropped for not keeping up with
+// the events. It must only be called after the events channel is closed.
+func (s *Subscription) Dropped() bool {
+	return s.dropped
+}
+
+// Close unsubscribes. It does nothing if the subscription was already closed
+// or dropped.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	s.hub.remove(s)
+}
+
+func (s *Subscription) visible(post smolboard.Post) bool {
+	return post.GetPoster() == s.username || post.Permission <= s.permission
+}
+
+// Publish sends the events to all subscriptions that can see their posts.
+// Subscriptions whose buffer is full are dropped, so that a slow client can't
+// hold up the others.
+func (h *EventHub) Publish(events ...smolboard.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs {
+		for _, ev := range events {
+			if !s.visible(ev.Post) {
+				continue
+			}
+
+			select {
+			case s.ch <- ev:
+				continue
+			default:
+			}
+
+			s.dropped = true
+			h.remove(s)
+			break
+		}
+	}
+}
+
+// remove removes the subscription and closes its channel. The mutex must be
+// held.
+func (h *EventHub) remove(s *Subscription) {
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+}
+
+// SubscribeEvents subscribes to the events of posts that the current user can
+// see. Only signed in users can do this.
+func (d *Transaction) SubscribeEvents(buffer int) (*Subscription, error) {
+	if d.Session.ID == 0 {
+		return nil, smolboard.ErrSessionNotFound
+	}
+
+	p, err := d.Permission()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.events.Subscribe(d.Session.Username, p, buffer), nil
+}
+
+// queueEvent queues the event to be published once the transaction is
+// committed.
+func (d *Transaction) queueEvent(eventType string, post smolboard.Post) {
+	d.queued = append(d.queued, smolboard.Event{Type: eventType, Post: post})
+}
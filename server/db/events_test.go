@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+func expectEvent(t *testing.T, sub *Subscription, eventType string, id int64) {
+	t.Helper()
+
+	select {
+	case ev, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("Subscription closed unexpectedly.")
+		}
+		if ev.Type != eventType || ev.Post.ID != id {
+			t.Fatalf("Unexpected event: %#v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for %s event.", eventType)
+	}
+}
+
+func expectNoEvent(t *testing.T, sub *Subscription) {
+	t.Helper()
+
+	select {
+	case ev := <-sub.Events():
+		t.Fatalf("Unexpected event: %#v", ev)
+	default:
+	}
+}
+
+func TestEvents(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやひめ", smolboard.PermissionUser)
+
+	var subscribe = func(t *testing.T, token string) *Subscription {
+		tx := testBeginTx(t, d, token)
+
+		sub, err := tx.SubscribeEvents(0)
+		if err != nil {
+			t.Fatal("Failed to subscribe:", err)
+		}
+		t.Cleanup(sub.Close)
+
+		return sub
+	}
+
+	ownerSub := subscribe(t, owner.AuthToken)
+	userSub := subscribe(t, user.AuthToken)
+
+	var post smolboard.Post
+
+	t.Run("Rollback", func(t *testing.T) {
+		var errTest = errors.New("test error")
+
+		err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+			p := NewEmptyPost("image/png")
+			p.Size = 1
+
+			if err := tx.SavePost(&p); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+			return errTest
+		})
+		if !errors.Is(err, errTest) {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		expectNoEvent(t, ownerSub)
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+			post = NewEmptyPost("image/png")
+			post.Size = 1
+			post.Permission = smolboard.PermissionAdministrator
+
+			return tx.SavePost(&post)
+		})
+		if err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+
+		expectEvent(t, ownerSub, smolboard.EventPostCreate, post.ID)
+		// The user can't see the post.
+		expectNoEvent(t, userSub)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+			return tx.DeletePost(post.ID, false)
+		})
+		if err != nil {
+			t.Fatal("Failed to delete post:", err)
+		}
+
+		expectEvent(t, ownerSub, smolboard.EventPostDelete, post.ID)
+		expectNoEvent(t, userSub)
+	})
+
+	t.Run("Guest", func(t *testing.T) {
+		tx := testBeginTx(t, d, "")
+
+		if _, err := tx.SubscribeEvents(0); !errors.Is(err, smolboard.ErrSessionNotFound) {
+			t.Fatal("Unexpected error subscribing as guest:", err)
+		}
+	})
+}
+
+func TestEventHubDrop(t *testing.T) {
+	hub := NewEventHub()
+
+	slow := hub.Subscribe("ひめありかわ", smolboard.PermissionOwner, 1)
+	fast := hub.Subscribe("かぐやひめ", smolboard.PermissionOwner, 2)
+	defer fast.Close()
+
+	var ev = smolboard.Event{Type: smolboard.EventPostCreate}
+
+	hub.Publish(ev, ev)
+
+	// The slow subscription is closed after its one buffered event.
+	if _, ok := <-slow.Events(); !ok {
+		t.Fatal("Buffered event was lost.")
+	}
+	if _, ok := <-slow.Events(); ok {
+		t.Fatal("Slow subscription was not dropped.")
+	}
+	if !slow.Dropped() {
+		t.Fatal("Slow subscription is not marked as dropped.")
+	}
+
+	// Closing a dropped subscription does nothing.
+	slow.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, ok := <-fast.Events(); !ok {
+			t.Fatal("Fast subscription was dropped.")
+		}
+	}
+}
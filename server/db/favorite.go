@@ -0,0 +1,149 @@
+package db
+
+import (
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// FavoritePosts adds all given posts to the current user's favorites in a
+// single statement. Posts that are already favorited, don't exist or can't be
+// seen by the user are skipped.
+func (d *Transaction) FavoritePosts(postIDs []int64) error {
+	if err := validFavoriteIDs(postIDs); err != nil {
+		return err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return err
+	}
+
+	p, err := d.Permission()
+	if err != nil {
+		return err
+	}
+
+	var now = time.Now().UnixNano()
+
+	q, args, err := sqlx.In(`
+		INSERT OR IGNORE INTO favorites (username, postid, createdat)
+			SELECT ?, id, ? FROM posts
+				WHERE id IN (?)
+					AND (poster = ? OR permission <= ?)
+					AND `+postLive,
+		d.Session.Username, now, postIDs, d.Session.Username, p, now,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to construct query")
+	}
+
+	if _, err := d.Exec(q, args...); err != nil {
+		return errors.Wrap(err, "Failed to insert favorites")
+	}
+
+	return nil
+}
+
+// UnfavoritePosts removes all given posts from the current user's favorites in
+// a single statement. Posts that aren't favorited are skipped.
+func (d *Transaction) UnfavoritePosts(postIDs []int64) error {
+	if err := validFavoriteIDs(postIDs); err != nil {
+		return err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return err
+	}
+
+	q, args, err := sqlx.In(
+		"DELETE FROM favorites WHERE username = ? AND postid IN (?)",
+		d.Session.Username, postIDs,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to construct query")
+	}
+
+	if _, err := d.Exec(q, args...); err != nil {
+		return errors.Wrap(err, "Failed to delete favorites")
+	}
+
+	return nil
+}
+
+func validFavoriteIDs(postIDs []int64) error {
+	if len(postIDs) == 0 {
+		return smolboard.ErrNoPostsGiven
+	}
+	if len(postIDs) > smolboard.MaxBulkPosts {
+		return smolboard.ErrTooManyPosts
+	}
+	return nil
+}
+
+// Favorites returns the current user's favorited posts from the latest
+// favorited. Posts that the user can no longer see are left out.
+func (d *Transaction) Favorites(count, page uint) (smolboard.SearchResults, error) {
+	if count > 100 {
+		return smolboard.NoResults, smolboard.ErrPageCountLimit
+	}
+
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return smolboard.NoResults, err
+	}
+
+	p, err := d.Permission()
+	if err != nil {
+		return smolboard.NoResults, err
+	}
+
+	const from = `
+		FROM favorites JOIN posts ON posts.id = favorites.postid
+			WHERE favorites.username = ?
+				AND (posts.poster = ? OR posts.permission <= ?)
+				AND ` + postLive + " "
+
+	var now = time.Now().UnixNano()
+
+	var results = smolboard.SearchResults{
+		Posts: make([]smolboard.Post, 0, count+1),
+	}
+
+	// One more post is queried to know if there's a next page.
+	var limit = count
+	if count > 0 {
+		limit++
+	}
+
+	err = d.Select(&results.Posts,
+		"SELECT posts.* "+from+
+			"ORDER BY favorites.createdat DESC, posts.id DESC LIMIT ?, ?",
+		d.Session.Username, d.Session.Username, p, now, count*page, limit,
+	)
+	if err != nil {
+		return smolboard.NoResults, errors.Wrap(err, "Failed to query favorites")
+	}
+
+	if count > 0 && len(results.Posts) > int(count) {
+		results.Posts = results.Posts[:count]
+		results.HasMore = true
+	}
+
+	results.Limit = int(count)
+	results.Offset = int(count * page)
+
+	if len(results.Posts) > 0 {
+		err = d.
+			QueryRow(
+				"SELECT COUNT(*), SUM(posts.size) "+from,
+				d.Session.Username, d.Session.Username, p, now,
+			).
+			Scan(&results.Total, &results.Sizes)
+		if err != nil {
+			return smolboard.NoResults, errors.Wrap(err, "Failed to count favorites")
+		}
+	}
+
+	return results, nil
+}
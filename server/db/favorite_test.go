@@ -0,0 +1,100 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+func TestFavoritePosts(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var posts = make([]smolboard.Post, 4)
+
+	t.Run("Setup", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+		}
+
+		// The last post can't be seen by the user.
+		posts[3].Permission = smolboard.PermissionAdministrator
+
+		for i := range posts {
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+		}
+	})
+
+	t.Run("Favorite", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		var ids = []int64{posts[0].ID, posts[1].ID, posts[3].ID, 1}
+
+		if err := tx.FavoritePosts(ids); err != nil {
+			t.Fatal("Failed to favorite posts:", err)
+		}
+
+		// Favoriting again does nothing.
+		if err := tx.FavoritePosts([]int64{posts[0].ID, posts[2].ID, posts[0].ID}); err != nil {
+			t.Fatal("Failed to favorite posts again:", err)
+		}
+
+		r, err := tx.Favorites(10, 0)
+		if err != nil {
+			t.Fatal("Failed to get favorites:", err)
+		}
+
+		if r.Total != 3 || len(r.Posts) != 3 {
+			t.Fatalf("Unexpected favorites: %#v", r)
+		}
+
+		var favorited = map[int64]bool{}
+		for _, p := range r.Posts {
+			favorited[p.ID] = true
+		}
+
+		for _, p := range posts[:3] {
+			if !favorited[p.ID] {
+				t.Fatalf("Post %d is missing from the favorites", p.ID)
+			}
+		}
+	})
+
+	t.Run("Unfavorite", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if err := tx.UnfavoritePosts([]int64{posts[0].ID, posts[1].ID, posts[3].ID}); err != nil {
+			t.Fatal("Failed to unfavorite posts:", err)
+		}
+
+		r, err := tx.Favorites(1, 0)
+		if err != nil {
+			t.Fatal("Failed to get favorites:", err)
+		}
+
+		if r.Total != 1 || r.HasMore || len(r.Posts) != 1 || r.Posts[0].ID != posts[2].ID {
+			t.Fatalf("Unexpected favorites: %#v", r)
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if err := tx.FavoritePosts(nil); !errors.Is(err, smolboard.ErrNoPostsGiven) {
+			t.Fatal("Unexpected error favoriting no posts:", err)
+		}
+
+		var ids = make([]int64, smolboard.MaxBulkPosts+1)
+		if err := tx.UnfavoritePosts(ids); !errors.Is(err, smolboard.ErrTooManyPosts) {
+			t.Fatal("Unexpected error unfavoriting too many posts:", err)
+		}
+	})
+}
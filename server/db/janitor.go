@@ -0,0 +1,220 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// PurgeDeletedPosts permanently removes all soft-deleted posts that are past
+// the grace period, as well as all expired posts. The purged posts are
+// returned, so the caller can clean up their files.
+func (d *Database) PurgeDeletedPosts(ctx context.Context) ([]smolboard.Post, error) {
+	tx, err := d.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var now = time.Now()
+	var until = now.Add(-d.Config.deletedPostLifespan).UnixNano()
+	var posts []smolboard.Post
+
+	const where = "WHERE deletedat < ? OR expiresat <= ?"
+
+	err = tx.SelectContext(ctx, &posts, "SELECT * FROM posts "+where, until, now.UnixNano())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query deleted posts")
+	}
+
+	if len(posts) == 0 {
+		return nil, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM posts "+where, until, now.UnixNano())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to purge deleted posts")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "Failed to commit purge")
+	}
+
+	return posts, nil
+}
+
+// StartJanitor starts a background routine that purges expired data every
+// interval. onPurge is called with the posts whose files should be removed. The
+// returned function stops the janitor and waits for it to exit.
+func (d *Database) StartJanitor(interval time.Duration, onPurge func([]smolboard.Post)) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+
+			if _, err := d.CleanupSessions(ctx); err != nil {
+				log.Println("Janitor failed to clean up expired sessions:", err)
+			}
+
+			posts, err := d.PurgeDeletedPosts(ctx)
+			if err != nil {
+				log.Println("Janitor failed to purge deleted posts:", err)
+				continue
+			}
+
+			if len(posts) > 0 {
+				onPurge(posts)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// CleanupSessions deletes all expired sessions kept in the database. They are
+// deleted in batches of SessionCleanupBatch, each in its own statement, so that
+// a large backlog doesn't hold the database's lock for long. The number of
+// deleted sessions is returned.
+func (d *Database) CleanupSessions(ctx context.Context) (int, error) {
+	var now = time.Now().Add(-d.Config.sessionGracePeriod).UnixNano()
+	var n int
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		r, err := d.ExecContext(ctx, cleanupSessionsQuery, now, d.Config.SessionCleanupBatch)
+		if err != nil {
+			return n, errors.Wrap(err, "Failed to cleanup expired sessions")
+		}
+
+		deleted, err := r.RowsAffected()
+		if err != nil {
+			return n, errors.Wrap(err, "Failed to get rows affected")
+		}
+
+		n += int(deleted)
+
+		if deleted < int64(d.Config.SessionCleanupBatch) {
+			return n, nil
+		}
+	}
+}
+
+// eachPostBatch is the number of posts that EachPost reads at once.
+const eachPostBatch = 256
+
+// EachPost calls fn with every post that isn't soft-deleted, from the oldest to
+// the newest, regardless of its permission. It is meant for maintenance. Posts
+// are read in batches, so fn may be slow without holding up the database. The
+// iteration stops once fn returns an error or ctx is canceled.
+func (d *Database) EachPost(ctx context.Context, fn func(smolboard.Post) error) error {
+	var after int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var posts []smolboard.Post
+
+		err := d.SelectContext(ctx, &posts,
+			"SELECT * FROM posts WHERE id > ? AND "+postLive+" ORDER BY id ASC LIMIT ?",
+			after, time.Now().UnixNano(), eachPostBatch,
+		)
+		if err != nil {
+			return errors.Wrap(err, "Failed to query posts")
+		}
+
+		for _, post := range posts {
+			if err := fn(post); err != nil {
+				return err
+			}
+		}
+
+		if len(posts) < eachPostBatch {
+			return nil
+		}
+
+		after = posts[len(posts)-1].ID
+	}
+}
+
+// backfillBatch is the number of sessions that BackfillSessionMetadata updates
+// per transaction.
+const backfillBatch = 256
+
+// BackfillSessionMetadata fills in the metadata of sessions that were created
+// before it was stored, which is currently only the device label parsed from
+// the user agent. Sessions that already have it are skipped, so this can be
+// run again after being interrupted. The number of updated sessions is
+// returned. Only sessions kept in the database are updated.
+func (d *Database) BackfillSessionMetadata(ctx context.Context) (int, error) {
+	var n int
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		updated, err := d.backfillSessions(ctx)
+		n += updated
+
+		if err != nil {
+			return n, err
+		}
+
+		if updated < backfillBatch {
+			return n, nil
+		}
+	}
+}
+
+// backfillSessions backfills a batch of sessions in a transaction.
+func (d *Database) backfillSessions(ctx context.Context) (int, error) {
+	tx, err := d.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var sessions []smolboard.Session
+
+	err = tx.SelectContext(ctx, &sessions,
+		"SELECT * FROM sessions WHERE device = '' LIMIT ?", backfillBatch)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to query sessions")
+	}
+
+	for _, s := range sessions {
+		_, err := tx.ExecContext(ctx,
+			"UPDATE sessions SET device = ? WHERE id = ?", deviceLabel(s.UserAgent), s.ID)
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to update session")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "Failed to commit backfill")
+	}
+
+	return len(sessions), nil
+}
@@ -0,0 +1,379 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// jwtLegacyHeader is the header of JWTs signed before they carried the ID of
+// their key. These are verified against all keys.
+var jwtLegacyHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// jwtKey is a secret that JWTs are signed with. Its ID is put into the header
+// of the JWTs that it signs, so they can be verified after it's rotated.
+type jwtKey struct {
+	id     string
+	secret []byte
+	header string // encoded
+}
+
+func newJWTKey(secret []byte) jwtKey {
+	var sum = sha256.Sum256(secret)
+	var id = base64.RawURLEncoding.EncodeToString(sum[:6])
+	var header = fmt.Sprintf(`{"alg":"HS256","kid":%q,"typ":"JWT"}`, id)
+
+	return jwtKey{
+		id:     id,
+		secret: secret,
+		header: base64.RawURLEncoding.EncodeToString([]byte(header)),
+	}
+}
+
+// verifies returns true if the key can verify a JWT with the given header.
+func (k jwtKey) verifies(header string) bool {
+	return header == k.header || header == jwtLegacyHeader
+}
+
+// jwtClaims are the claims inside a session JWT.
+type jwtClaims struct {
+	// ID is the session ID, which is kept across renewals.
+	ID         int64                `json:"jti"`
+	Username   string               `json:"sub"`
+	Permission smolboard.Permission `json:"perm"`
+	// Expiry is in Unix seconds, as the JWT spec requires.
+	Expiry         int64  `json:"exp"`
+	UserAgent      string `json:"ua,omitempty"`
+	ImpersonatedBy string `json:"imp,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Device         string `json:"dev,omitempty"`
+	Scope          string `json:"scope,omitempty"`
+}
+
+// issuedAt returns the time the session was first made in Unix nanoseconds.
+func (c jwtClaims) issuedAt() int64 {
+	return snowflake.ID(c.ID).Time() * int64(time.Millisecond)
+}
+
+func (c jwtClaims) session(token string) smolboard.Session {
+	return smolboard.Session{
+		ID:             c.ID,
+		Username:       c.Username,
+		AuthToken:      token,
+		Deadline:       c.Expiry * int64(time.Second),
+		UserAgent:      c.UserAgent,
+		ImpersonatedBy: c.ImpersonatedBy,
+		Name:           c.Name,
+		Device:         c.Device,
+		Scope:          c.Scope,
+	}
+}
+
+// NewJWTSession signs the given session into a JWT using HS256. The JWT carries
+// the session's username, the given permission and the session's deadline,
+// truncated to seconds. AuthToken is ignored.
+func NewJWTSession(secret []byte, s smolboard.Session, p smolboard.Permission) (string, error) {
+	return newJWTKey(secret).sign(s, p)
+}
+
+func (k jwtKey) sign(s smolboard.Session, p smolboard.Permission) (string, error) {
+	claims := jwtClaims{
+		ID:             s.ID,
+		Username:       s.Username,
+		Permission:     p,
+		Expiry:         s.Deadline / int64(time.Second),
+		UserAgent:      s.UserAgent,
+		ImpersonatedBy: s.ImpersonatedBy,
+		Name:           s.Name,
+		Device:         s.Device,
+		Scope:          s.Scope,
+	}
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to encode claims")
+	}
+
+	var payload = k.header + "." + base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + jwtSign(k.secret, payload), nil
+}
+
+func jwtSign(secret []byte, payload string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// parseJWTSession verifies the given JWT with any of the keys and returns its
+// claims. Tokens that are malformed, forged or expired are all treated as
+// expired sessions.
+func parseJWTSession(keys []jwtKey, token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	var verified bool
+
+	for _, key := range keys {
+		if !key.verifies(parts[0]) {
+			continue
+		}
+
+		var sig = jwtSign(key.secret, parts[0]+"."+parts[1])
+		if hmac.Equal([]byte(sig), []byte(parts[2])) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	var claims jwtClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	if claims.Expiry*int64(time.Second) < now.UnixNano() {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	return &claims, nil
+}
+
+// JWTSessionStore is the SessionStore used in JWT mode. Sessions are signed
+// into their AuthToken, so only revocations are stored.
+type JWTSessionStore struct {
+	keys     []jwtKey // current key first
+	lifespan time.Duration
+}
+
+var _ SessionStore = (*JWTSessionStore)(nil)
+
+// NewJWTSessionStore creates a new JWT store. The lifespan must be the same
+// as the session token lifespan, as it decides how long revocations are kept.
+// JWTs are signed with the secret, and they are also verified with the
+// previous secrets, if any, which is how the secret is rotated without signing
+// everyone out.
+func NewJWTSessionStore(secret []byte, lifespan time.Duration, previous ...[]byte) *JWTSessionStore {
+	var keys = make([]jwtKey, 0, 1+len(previous))
+	keys = append(keys, newJWTKey(secret))
+
+	for _, secret := range previous {
+		keys = append(keys, newJWTKey(secret))
+	}
+
+	return &JWTSessionStore{keys: keys, lifespan: lifespan}
+}
+
+// currentKey returns the key that new JWTs are signed with.
+func (j *JWTSessionStore) currentKey() jwtKey {
+	return j.keys[0]
+}
+
+// sign signs the session with the current key.
+func (j *JWTSessionStore) sign(s smolboard.Session, p smolboard.Permission) (string, error) {
+	return j.currentKey().sign(s, p)
+}
+
+// parse verifies the JWT with any of the keys.
+func (j *JWTSessionStore) parse(token string, now time.Time) (*jwtClaims, error) {
+	return parseJWTSession(j.keys, token, now)
+}
+
+func (j *JWTSessionStore) Create(tx *Transaction, s *smolboard.Session) error {
+	p, err := tx.permission(s.Username)
+	if err != nil {
+		return err
+	}
+
+	if s.AuthToken, err = j.sign(*s, p); err != nil {
+		return err
+	}
+
+	// Revocations are kept through the grace period of their sessions.
+	_, err = tx.Exec("DELETE FROM jwtrevocations WHERE deadline < ?", tx.sessionExpiry())
+	if err != nil {
+		return errors.Wrap(err, "Failed to cleanup expired revocations")
+	}
+
+	return nil
+}
+
+// Lookup verifies the JWT and checks it against the revocation list. The
+// permission in the JWT is replaced with the user's current one, so that
+// demotions apply right away instead of on the next renewal.
+func (j *JWTSessionStore) Lookup(tx *Transaction, token string) (*smolboard.Session, error) {
+	c, err := j.parse(token, time.Unix(0, tx.sessionExpiry()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkJWTRevoked(tx, c); err != nil {
+		return nil, err
+	}
+
+	p, err := tx.permission(c.Username)
+	if err != nil {
+		if errors.Is(err, smolboard.ErrUserNotFound) {
+			return nil, smolboard.ErrSessionExpired
+		}
+		return nil, err
+	}
+
+	c.Permission = p
+	tx.claims = c
+
+	var s = c.session(token)
+	return &s, nil
+}
+
+// LookupID only knows the current session, as other JWTs are not stored.
+func (j *JWTSessionStore) LookupID(tx *Transaction, id int64) (*smolboard.Session, error) {
+	if tx.Session.ID == 0 || tx.Session.ID != id {
+		return nil, smolboard.ErrSessionNotFound
+	}
+
+	var s = tx.Session
+	return &s, nil
+}
+
+// Renew reissues the JWT with the new deadline and an up-to-date permission.
+func (j *JWTSessionStore) Renew(tx *Transaction, s *smolboard.Session, deadline int64) error {
+	// Refresh the permission, since it might have changed since.
+	p, err := tx.permission(s.Username)
+	if err != nil {
+		if errors.Is(err, smolboard.ErrUserNotFound) {
+			return smolboard.ErrSessionExpired
+		}
+		return err
+	}
+
+	var renewed = *s
+	renewed.Deadline = deadline
+
+	if renewed.AuthToken, err = j.sign(renewed, p); err != nil {
+		return err
+	}
+
+	*s = renewed
+
+	if tx.claims != nil {
+		tx.claims.Permission = p
+		tx.claims.Expiry = deadline / int64(time.Second)
+	}
+
+	return nil
+}
+
+// Delete revokes the session. Only the current session of the transaction can
+// be revoked, since other JWTs can't be looked up to verify their owner.
+func (j *JWTSessionStore) Delete(tx *Transaction, username string, id int64) error {
+	if id != tx.Session.ID || username != tx.Session.Username {
+		return smolboard.ErrSessionNotFound
+	}
+
+	_, err := tx.Exec(
+		"INSERT OR IGNORE INTO jwtrevocations (jti, username, deadline) VALUES (?, ?, ?)",
+		id, username, tx.Session.Deadline,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to revoke session")
+	}
+	return nil
+}
+
+// Rename reissues the current session's JWT with the new name. Other sessions
+// can't be renamed, as they are not stored.
+func (j *JWTSessionStore) Rename(tx *Transaction, username string, id int64, name string) error {
+	if id != tx.Session.ID || username != tx.Session.Username || tx.claims == nil {
+		return smolboard.ErrSessionNotFound
+	}
+
+	var s = tx.Session
+	s.Name = name
+
+	token, err := j.sign(s, tx.claims.Permission)
+	if err != nil {
+		return err
+	}
+
+	s.AuthToken = token
+	tx.Session = s
+	tx.claims.Name = name
+
+	return nil
+}
+
+// DeleteByUser revokes all JWT sessions of the user issued until now.
+func (j *JWTSessionStore) DeleteByUser(tx *Transaction, username string, keep int64) error {
+	var now = time.Now()
+
+	_, err := tx.Exec(
+		`INSERT INTO jwtrevocations (jti, username, notbefore, keepjti, deadline)
+			VALUES (0, ?, ?, ?, ?)`,
+		username, now.UnixNano(), keep, now.Add(j.lifespan).UnixNano(),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to revoke sessions")
+	}
+	return nil
+}
+
+// DeleteAll revokes all JWT sessions of all users issued until now. As JWT
+// sessions are not stored, they can't be counted, so 0 is returned.
+func (j *JWTSessionStore) DeleteAll(tx *Transaction) (int, error) {
+	// The empty username marks a revocation for all users.
+	return 0, j.DeleteByUser(tx, "", 0)
+}
+
+// ListByUser returns only the current session, as JWT sessions are not stored.
+func (j *JWTSessionStore) ListByUser(tx *Transaction, username string) ([]smolboard.Session, error) {
+	if tx.Session.ID == 0 || tx.Session.Username != username {
+		return nil, nil
+	}
+	return []smolboard.Session{tx.Session}, nil
+}
+
+// checkJWTRevoked returns ErrSessionExpired if the session ID was revoked, or
+// if all of the user's or everyone's sessions issued before this one were
+// revoked.
+func checkJWTRevoked(tx *Transaction, c *jwtClaims) error {
+	var revoked bool
+
+	err := tx.
+		QueryRow(`
+			SELECT EXISTS(
+				SELECT 1 FROM jwtrevocations WHERE jti = ? OR (
+					jti = 0 AND username IN (?, '') AND notbefore > ? AND keepjti != ?
+				)
+			)`,
+			c.ID, c.Username, c.issuedAt(), c.ID,
+		).
+		Scan(&revoked)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to check revoked sessions")
+	}
+
+	if revoked {
+		return smolboard.ErrSessionExpired
+	}
+
+	return nil
+}
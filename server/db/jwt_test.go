@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+func TestJWTSession(t *testing.T) {
+	var secret = []byte(testJWTSecret)
+	var keys = []jwtKey{newJWTKey(secret)}
+	var now = time.Now()
+
+	s := smolboard.Session{
+		ID:        mustSnowflakeGenerator(0, 0).NextID(),
+		Username:  "ひめありかわ",
+		Deadline:  now.Add(time.Hour).UnixNano(),
+		UserAgent: "iOS",
+		Scope:     smolboard.ScopeRead,
+	}
+
+	token, err := NewJWTSession(secret, s, smolboard.PermissionTrusted)
+	if err != nil {
+		t.Fatal("Failed to sign JWT:", err)
+	}
+
+	c, err := parseJWTSession(keys, token, now)
+	if err != nil {
+		t.Fatal("Failed to verify JWT:", err)
+	}
+
+	if c.ID != s.ID || c.Username != s.Username || c.Permission != smolboard.PermissionTrusted ||
+		c.Scope != s.Scope {
+		t.Fatalf("Unexpected claims: %#v", c)
+	}
+
+	t.Run("Expired", func(t *testing.T) {
+		_, err := parseJWTSession(keys, token, now.Add(2*time.Hour))
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error verifying expired JWT:", err)
+		}
+	})
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		_, err := parseJWTSession([]jwtKey{newJWTKey([]byte(strings.Repeat("a", 32)))}, token, now)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error verifying JWT with wrong secret:", err)
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		// Sign a JWT with a higher permission using a different secret, then
+		// splice its payload into the original.
+		forged, _ := NewJWTSession([]byte("nope"), s, smolboard.PermissionOwner)
+
+		parts := strings.Split(token, ".")
+		parts[1] = strings.Split(forged, ".")[1]
+
+		_, err := parseJWTSession(keys, strings.Join(parts, "."), now)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error verifying tampered JWT:", err)
+		}
+	})
+}
+
+func TestJWTSessionMode(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.SessionMode = SessionModeJWT
+		cfg.JWTSecret = testJWTSecret
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	if strings.Count(owner.AuthToken, ".") != 2 {
+		t.Fatal("Session token is not a JWT:", owner.AuthToken)
+	}
+
+	var other *smolboard.Session
+
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) (err error) {
+		other, err = tx.Signin(owner.Username, "goodpassword", "Android")
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in again:", err)
+	}
+
+	t.Run("Lookup", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if tx.Session.ID != owner.ID || tx.Session.Username != owner.Username {
+			t.Fatalf("Unexpected session: %#v", tx.Session)
+		}
+
+		p, err := tx.Permission()
+		if err != nil {
+			t.Fatal("Failed to get permission:", err)
+		}
+
+		if p != smolboard.PermissionOwner {
+			t.Fatal("Unexpected permission:", p)
+		}
+
+		sessions, err := tx.Sessions()
+		if err != nil {
+			t.Fatal("Failed to get sessions:", err)
+		}
+
+		if len(sessions) != 1 || sessions[0].ID != owner.ID {
+			t.Fatalf("Unexpected sessions: %#v", sessions)
+		}
+	})
+
+	t.Run("Demoted", func(t *testing.T) {
+		user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionTrusted)
+
+		err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+			return tx.PromoteUser(user.Username, smolboard.PermissionUser)
+		})
+		if err != nil {
+			t.Fatal("Failed to demote user:", err)
+		}
+
+		// The JWT still says trusted, but the users table wins.
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		p, err := tx.Permission()
+		if err != nil {
+			t.Fatal("Failed to get permission:", err)
+		}
+
+		if p != smolboard.PermissionUser {
+			t.Fatal("Demotion not applied to the JWT session:", p)
+		}
+	})
+
+	t.Run("DeleteAll", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.DeleteAllSessions(); err != nil {
+			t.Fatal("Failed to delete all sessions:", err)
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		_, err := BeginTx(context.Background(), d, other.AuthToken)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using revoked session:", err)
+		}
+	})
+
+	t.Run("Signout", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.Signout(); err != nil {
+			t.Fatal("Failed to sign out:", err)
+		}
+	})
+
+	t.Run("SignedOut", func(t *testing.T) {
+		_, err := BeginTx(context.Background(), d, owner.AuthToken)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using signed out session:", err)
+		}
+	})
+}
+
+func TestJWTPreviousSecrets(t *testing.T) {
+	const newSecret = "fedcba9876543210fedcba9876543210"
+
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.SessionMode = SessionModeJWT
+		cfg.JWTSecret = testJWTSecret
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	t.Run("Validate", func(t *testing.T) {
+		cfg := d.Config
+		cfg.SessionStore = nil
+		cfg.JWTPreviousSecrets = []string{"short"}
+
+		if err := cfg.Validate(); err == nil {
+			t.Fatal("Unexpected nil error with a short previous secret")
+		}
+	})
+
+	// Rotate the secret as it's done in the config, which is only read on
+	// startup.
+	d.Config.SessionStore = NewJWTSessionStore(
+		[]byte(newSecret), d.Config.tokenLifespan, []byte(testJWTSecret))
+
+	var lookup = func(token string) error {
+		return d.Acquire(context.Background(), token, func(*Transaction) error { return nil })
+	}
+
+	// The token signed with the old secret still works.
+	if err := lookup(owner.AuthToken); err != nil {
+		t.Fatal("Failed to use token signed with the old secret:", err)
+	}
+
+	var renewed *smolboard.Session
+
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) (err error) {
+		renewed, err = tx.Signin(owner.Username, "goodpassword", "")
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	// New tokens are signed with the new secret only.
+	var newKeys = []jwtKey{newJWTKey([]byte(newSecret))}
+
+	if _, err := parseJWTSession(newKeys, renewed.AuthToken, time.Now()); err != nil {
+		t.Fatal("New token is not signed with the new secret:", err)
+	}
+
+	if _, err := parseJWTSession(newKeys, owner.AuthToken, time.Now()); err == nil {
+		t.Fatal("Old token is verified by the new secret")
+	}
+
+	// Once the old secret is dropped, its tokens stop working.
+	d.Config.SessionStore = NewJWTSessionStore([]byte(newSecret), d.Config.tokenLifespan)
+
+	if err := lookup(owner.AuthToken); !errors.Is(err, smolboard.ErrSessionExpired) {
+		t.Fatal("Unexpected error using token signed with a dropped secret:", err)
+	}
+
+	t.Run("Legacy", func(t *testing.T) {
+		// Tokens from before key IDs are verified with every key.
+		var store = NewJWTSessionStore([]byte(newSecret), time.Hour, []byte(testJWTSecret))
+		var now = time.Now()
+
+		claims, _ := json.Marshal(jwtClaims{ID: 1, Expiry: now.Add(time.Hour).Unix()})
+		payload := jwtLegacyHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+		token := payload + "." + jwtSign([]byte(testJWTSecret), payload)
+
+		if _, err := store.parse(token, now); err != nil {
+			t.Fatal("Failed to verify legacy token:", err)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// SlowQuery is a query that took longer than the slow query threshold.
+type SlowQuery struct {
+	// Query is the statement's template with its whitespace collapsed. The
+	// values bound to it are never included, since they may be tokens or
+	// password hashes.
+	Query string
+	// Duration is how long the statement took to run. Rows that are read after
+	// Query or QueryRow returns aren't counted.
+	Duration time.Duration
+}
+
+// Logger receives the database's slow query log. Implementations must be safe
+// to use concurrently.
+type Logger interface {
+	SlowQuery(q SlowQuery)
+}
+
+// LoggerFunc is a function that implements Logger.
+type LoggerFunc func(q SlowQuery)
+
+var _ Logger = LoggerFunc(nil)
+
+func (f LoggerFunc) SlowQuery(q SlowQuery) { f(q) }
+
+// StdLogger logs slow queries with the standard log package.
+var StdLogger Logger = LoggerFunc(func(q SlowQuery) {
+	log.Printf("Slow query (%v): %s", q.Duration, q.Query)
+})
+
+// queryTemplate collapses the whitespace of the query, so that multi-line
+// statements fit in a single log line.
+func queryTemplate(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// timeQuery returns a function that logs the query if it was called later than
+// the slow query threshold. It does nothing if the threshold is 0.
+func (tx *Transaction) timeQuery(query string) func() {
+	if tx.config.slowQueryThreshold <= 0 {
+		return func() {}
+	}
+
+	var start = time.Now()
+
+	return func() {
+		took := time.Since(start)
+		if took < tx.config.slowQueryThreshold {
+			return
+		}
+
+		tx.config.Logger.SlowQuery(SlowQuery{
+			Query:    queryTemplate(query),
+			Duration: took,
+		})
+	}
+}
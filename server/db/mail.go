@@ -0,0 +1,305 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/mail"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+type mailPurpose uint8
+
+const (
+	mailVerifyEmail mailPurpose = iota
+	mailResetPassword
+)
+
+const (
+	verifyTokenLifespan = 24 * time.Hour
+	resetTokenLifespan  = time.Hour
+)
+
+// queuedMail is a mail that is sent once its transaction is committed.
+type queuedMail struct {
+	to      string
+	subject string
+	body    string
+	status  *smolboard.MailStatus
+	// async is true if the mail is sent in the background, in which case
+	// status is nil.
+	async bool
+}
+
+// sendMail queues a mail to be sent using the configured mailer once the
+// transaction is committed. This keeps the database unlocked while the mail is
+// sent, and the mail isn't sent if the changes are rolled back. The returned
+// status is filled in once the mail is sent. Delivery failures are not fatal:
+// they are logged, and the status carries the warning.
+func (d *Transaction) sendMail(to, subject, body string) *smolboard.MailStatus {
+	s := &smolboard.MailStatus{}
+	d.mails = append(d.mails, queuedMail{to, subject, body, s, false})
+	return s
+}
+
+// sendMailAsync is sendMail, except the mail is sent in the background once
+// the transaction is committed, so the caller doesn't wait on the mailer.
+func (d *Transaction) sendMailAsync(to, subject, body string) {
+	d.mails = append(d.mails, queuedMail{to, subject, body, nil, true})
+}
+
+// sendQueuedMails sends the queued mails and fills in their statuses.
+func (d *Transaction) sendQueuedMails() {
+	for _, m := range d.mails {
+		if m.async {
+			d.mailing.Add(1)
+			go func(m queuedMail) {
+				defer d.mailing.Done()
+
+				if err := d.config.Mailer.Send(m.to, m.subject, m.body); err != nil {
+					log.Printf("Failed to send mail %q: %v", m.subject, err)
+				}
+			}(m)
+
+			continue
+		}
+
+		if err := d.config.Mailer.Send(m.to, m.subject, m.body); err != nil {
+			log.Printf("Failed to send mail %q: %v", m.subject, err)
+			*m.status = smolboard.MailStatus{Warning: "failed to send mail"}
+			continue
+		}
+
+		*m.status = smolboard.MailStatus{Sent: true}
+	}
+
+	d.mails = nil
+}
+
+// newMailToken creates a new token for the given purpose.
+func (d *Transaction) newMailToken(
+	username string, purpose mailPurpose, ttl time.Duration) (string, error) {
+
+	t, err := randToken(d.config.TokenLength)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate a token")
+	}
+
+	if err := d.cleanMailTokens(username, purpose); err != nil {
+		return "", err
+	}
+
+	_, err = d.Exec(
+		"INSERT INTO mailtokens VALUES (?, ?, ?, ?)",
+		t, username, purpose, time.Now().Add(ttl).UnixNano(),
+	)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to save token")
+	}
+
+	return t, nil
+}
+
+// cleanMailTokens deletes the user's tokens of the given purpose, so that only
+// the latest one is kept, as well as all expired tokens.
+func (d *Transaction) cleanMailTokens(username string, purpose mailPurpose) error {
+	_, err := d.Exec(
+		"DELETE FROM mailtokens WHERE (username = ? AND purpose = ?) OR deadline < ?",
+		username, purpose, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to clean up old tokens")
+	}
+
+	return nil
+}
+
+// useMailToken consumes the token and returns the username it belongs to.
+func (d *Transaction) useMailToken(token string, purpose mailPurpose) (string, error) {
+	var username string
+	var deadline int64
+
+	err := d.
+		QueryRow(
+			"SELECT username, deadline FROM mailtokens WHERE token = ? AND purpose = ?",
+			token, purpose,
+		).
+		Scan(&username, &deadline)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", smolboard.ErrUnknownMailToken
+		}
+
+		return "", errors.Wrap(err, "Failed to scan token")
+	}
+
+	if _, err := d.Exec("DELETE FROM mailtokens WHERE token = ?", token); err != nil {
+		return "", errors.Wrap(err, "Failed to delete token")
+	}
+
+	if time.Now().UnixNano() > deadline {
+		return "", smolboard.ErrUnknownMailToken
+	}
+
+	return username, nil
+}
+
+// verifiedEmail returns the verified email of the given user or an empty
+// string if there's none.
+func (d *Transaction) verifiedEmail(username string) (string, error) {
+	var email string
+
+	err := d.
+		QueryRow("SELECT email FROM emails WHERE username = ? AND verified", username).
+		Scan(&email)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+
+		return "", errors.Wrap(err, "Failed to scan email")
+	}
+
+	return email, nil
+}
+
+// SetEmail sets the current user's email and sends a verification mail to it.
+// The email stays unverified until VerifyEmail is called with the mailed
+// token. Failing to send the mail does not fail this call.
+func (d *Transaction) SetEmail(email string) (*smolboard.MailStatus, error) {
+	// Changing the email would allow taking over the account through a
+	// password reset.
+	if err := d.notImpersonating(); err != nil {
+		return nil, err
+	}
+
+	if err := d.notAPIKey(); err != nil {
+		return nil, err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return nil, err
+	}
+
+	a, err := mail.ParseAddress(email)
+	if err != nil {
+		return nil, smolboard.ErrInvalidEmail
+	}
+
+	_, err = d.Exec(
+		"REPLACE INTO emails (username, email, verified) VALUES (?, ?, 0)",
+		d.Session.Username, a.Address,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save email")
+	}
+
+	t, err := d.newMailToken(d.Session.Username, mailVerifyEmail, verifyTokenLifespan)
+	if err != nil {
+		return nil, err
+	}
+
+	body := fmt.Sprintf(
+		"Hello %s,\n\nUse the following token to verify your email:\n\n\t%s\n\n"+
+			"The token expires in %s.\n",
+		d.Session.Username, t, verifyTokenLifespan,
+	)
+
+	return d.sendMail(a.Address, "Verify your email", body), nil
+}
+
+// VerifyEmail marks the email that the token was sent to as verified.
+func (d *Transaction) VerifyEmail(token string) error {
+	u, err := d.useMailToken(token, mailVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	ch, err := d.execChanged("UPDATE emails SET verified = 1 WHERE username = ?", u)
+	if err != nil {
+		return errors.Wrap(err, "Failed to verify email")
+	}
+	if !ch {
+		return smolboard.ErrNoEmail
+	}
+
+	return nil
+}
+
+// RequestPasswordReset sends a password reset token to the given user's
+// verified email. ErrUserNotFound or ErrNoEmail is returned if there's no one
+// to send it to, but only after doing the same work as if there was, and the
+// mail is sent in the background, so that the time taken doesn't tell whether
+// the user exists. Failing to send the mail does not fail this call.
+func (d *Transaction) RequestPasswordReset(username string) error {
+	_, userErr := d.User(username)
+	if userErr != nil && !errors.Is(userErr, smolboard.ErrUserNotFound) {
+		return userErr
+	}
+
+	email, err := d.verifiedEmail(username)
+	if err != nil {
+		return err
+	}
+
+	if userErr != nil || email == "" {
+		// Generate a token that's thrown away and clean up like
+		// newMailToken would.
+		if _, err := randToken(d.config.TokenLength); err != nil {
+			return errors.Wrap(err, "Failed to generate a token")
+		}
+
+		if err := d.cleanMailTokens(username, mailResetPassword); err != nil {
+			return err
+		}
+
+		if userErr != nil {
+			return userErr
+		}
+
+		return smolboard.ErrNoEmail
+	}
+
+	t, err := d.newMailToken(username, mailResetPassword, resetTokenLifespan)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Hello %s,\n\nUse the following token to reset your password:\n\n\t%s\n\n"+
+			"The token expires in %s. If you did not request this, ignore this mail.\n",
+		username, t, resetTokenLifespan,
+	)
+
+	d.sendMailAsync(email, "Reset your password", body)
+	return nil
+}
+
+// ResetPassword sets the password of the user that the reset token belongs
+// to. All of that user's sessions are invalidated.
+func (d *Transaction) ResetPassword(token, password string) error {
+	// Check the password first so the token isn't wasted.
+	if len(password) < smolboard.MinimumPassLength {
+		return smolboard.ErrPasswordTooShort
+	}
+
+	u, err := d.useMailToken(token, mailResetPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := d.setPassword(u, password); err != nil {
+		return err
+	}
+
+	if err := d.deleteAPIKeys(u); err != nil {
+		return err
+	}
+
+	return d.config.SessionStore.DeleteByUser(d, u, 0)
+}
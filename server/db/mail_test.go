@@ -0,0 +1,336 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/mailer/mailertest"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+func testMailToken(t *testing.T, m *mailertest.Mock) string {
+	t.Helper()
+
+	mail, ok := m.Last()
+	if !ok {
+		t.Fatal("No mail sent.")
+	}
+
+	// The token is always on its own indented line.
+	for _, line := range strings.Split(mail.Body, "\n") {
+		if strings.HasPrefix(line, "\t") {
+			return strings.TrimSpace(line)
+		}
+	}
+
+	t.Fatalf("No token found in mail: %q", mail.Body)
+	return ""
+}
+
+// testVerifiedEmail sets and verifies the email of the session's user. The mail
+// is only sent once SetEmail's transaction is committed, so it's verified in
+// another.
+func testVerifiedEmail(t *testing.T, d *Database, m *mailertest.Mock, token, email string) {
+	t.Helper()
+
+	err := d.Acquire(context.Background(), token, func(tx *Transaction) error {
+		_, err := tx.SetEmail(email)
+		return err
+	})
+	if err != nil {
+		t.Fatal("Failed to set email:", err)
+	}
+
+	err = d.Acquire(context.Background(), token, func(tx *Transaction) error {
+		return tx.VerifyEmail(testMailToken(t, m))
+	})
+	if err != nil {
+		t.Fatal("Failed to verify email:", err)
+	}
+}
+
+func TestMailVerifyEmail(t *testing.T) {
+	d := newTestDatabase(t)
+
+	m := &mailertest.Mock{}
+	d.Config.Mailer = m
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	var s *smolboard.MailStatus
+
+	err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) (err error) {
+		s, err = tx.SetEmail("Hime <hime@example.com>")
+		if err != nil {
+			return err
+		}
+
+		// The mail is only sent once this is committed.
+		if len(m.Mails()) > 0 || s.Sent {
+			t.Error("Mail sent before the transaction was committed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Failed to set email:", err)
+	}
+
+	if !s.Sent {
+		t.Error("Mail not marked as sent:", s.Warning)
+	}
+
+	if mail, _ := m.Last(); mail.To != "hime@example.com" {
+		t.Fatalf("Unexpected mail recipient %q", mail.To)
+	}
+
+	token := testMailToken(t, m)
+
+	// Unverified emails can't be used for resetting.
+	err = d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		return tx.RequestPasswordReset("ひめありかわ")
+	})
+	if !errors.Is(err, smolboard.ErrNoEmail) {
+		t.Fatal("Unexpected error resetting with unverified email:", err)
+	}
+
+	err = d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		return tx.VerifyEmail(token)
+	})
+	if err != nil {
+		t.Fatal("Failed to verify email:", err)
+	}
+
+	// Tokens are one-time.
+	err = d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		return tx.VerifyEmail(token)
+	})
+	if !errors.Is(err, smolboard.ErrUnknownMailToken) {
+		t.Fatal("Unexpected error reusing verify token:", err)
+	}
+}
+
+func TestMailResetPassword(t *testing.T) {
+	d := newTestDatabase(t)
+
+	m := &mailertest.Mock{}
+	d.Config.Mailer = m
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	testVerifiedEmail(t, d, m, owner.AuthToken, "hime@example.com")
+
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		return tx.RequestPasswordReset("ひめありかわ")
+	})
+	if err != nil {
+		t.Fatal("Failed to request password reset:", err)
+	}
+
+	// The reset mail is sent in the background.
+	d.mailing.Wait()
+
+	err = d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		return tx.ResetPassword(testMailToken(t, m), "newpassword")
+	})
+	if err != nil {
+		t.Fatal("Failed to reset password:", err)
+	}
+
+	// The old session should be gone.
+	if _, err := BeginTx(context.Background(), d, owner.AuthToken); !errors.Is(err, smolboard.ErrSessionExpired) {
+		t.Fatal("Unexpected error using session after reset:", err)
+	}
+
+	err = d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		_, err := tx.Signin("ひめありかわ", "newpassword", "")
+		return err
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in with the new password:", err)
+	}
+}
+
+func TestMailFailureNonFatal(t *testing.T) {
+	d := newTestDatabase(t)
+
+	m := &mailertest.Mock{Err: errors.New("connection refused")}
+	d.Config.Mailer = m
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	var s *smolboard.MailStatus
+
+	err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) (err error) {
+		s, err = tx.SetEmail("hime@example.com")
+		return
+	})
+	if err != nil {
+		t.Fatal("Mail failure failed the operation:", err)
+	}
+
+	if s.Sent || s.Warning == "" {
+		t.Errorf("Unexpected mail status: %#v", s)
+	}
+}
+
+func TestMailRolledBack(t *testing.T) {
+	d := newTestDatabase(t)
+
+	m := &mailertest.Mock{}
+	d.Config.Mailer = m
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+		if _, err := tx.SetEmail("hime@example.com"); err != nil {
+			return err
+		}
+		return errors.New("something else failed")
+	})
+	if err == nil {
+		t.Fatal("Unexpected success")
+	}
+
+	if n := len(m.Mails()); n != 0 {
+		t.Fatalf("Unexpected %d mails sent for a rolled back transaction", n)
+	}
+}
+
+func TestMailFailedSignins(t *testing.T) {
+	d := newTestDatabaseWith(t, func(c *DBConfig) {
+		c.FailedSigninNotice = 3
+	})
+
+	m := &mailertest.Mock{}
+	d.Config.Mailer = m
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	testVerifiedEmail(t, d, m, owner.AuthToken, "hime@example.com")
+
+	var sent = len(m.Mails())
+
+	// failSignin signs in as the user with the wrong password n times.
+	var failSignin = func(t *testing.T, username string, n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+				_, err := tx.Signin(username, "badpassword", "")
+				return err
+			})
+			if !errors.Is(err, smolboard.ErrInvalidPassword) {
+				t.Fatal("Unexpected error signing in with a wrong password:", err)
+			}
+		}
+	}
+
+	t.Run("BelowThreshold", func(t *testing.T) {
+		failSignin(t, owner.Username, 2)
+
+		if n := len(m.Mails()); n != sent {
+			t.Fatal("Notice sent before the threshold:", n-sent)
+		}
+	})
+
+	t.Run("Notice", func(t *testing.T) {
+		failSignin(t, owner.Username, 1)
+
+		mail, _ := m.Last()
+		if n := len(m.Mails()); n != sent+1 || mail.To != "hime@example.com" {
+			t.Fatalf("Unexpected notices: %d, last to %q", n-sent, mail.To)
+		}
+	})
+
+	t.Run("Throttled", func(t *testing.T) {
+		failSignin(t, owner.Username, 5)
+
+		if n := len(m.Mails()); n != sent+1 {
+			t.Fatal("Unexpected notices within the same window:", n-sent)
+		}
+	})
+
+	t.Run("NextWindow", func(t *testing.T) {
+		var past = time.Now().Add(-2 * time.Hour).UnixNano()
+
+		_, err := d.Exec(
+			"UPDATE failedsignins SET windowstart = ?, notifiedat = ? WHERE username = ?",
+			past, past, owner.Username,
+		)
+		if err != nil {
+			t.Fatal("Failed to move the window back:", err)
+		}
+
+		// The old window's failures are forgotten.
+		failSignin(t, owner.Username, 2)
+
+		if n := len(m.Mails()); n != sent+1 {
+			t.Fatal("Notice sent before the threshold of the new window:", n-sent)
+		}
+
+		failSignin(t, owner.Username, 1)
+
+		if n := len(m.Mails()); n != sent+2 {
+			t.Fatal("Unexpected notices in the new window:", n-sent)
+		}
+	})
+
+	t.Run("NoEmail", func(t *testing.T) {
+		failSignin(t, user.Username, 3)
+
+		if n := len(m.Mails()); n != sent+2 {
+			t.Fatal("Notice sent to a user without an email:", n-sent)
+		}
+	})
+}
+
+// blockingMailer is a Mailer that blocks every Send until unblock is closed.
+type blockingMailer struct {
+	mailertest.Mock
+	unblock chan struct{}
+}
+
+func (m *blockingMailer) Send(to, subject, body string) error {
+	<-m.unblock
+	return m.Mock.Send(to, subject, body)
+}
+
+func TestMailResetPasswordAsync(t *testing.T) {
+	d := newTestDatabase(t)
+
+	m := &mailertest.Mock{}
+	d.Config.Mailer = m
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	testVerifiedEmail(t, d, m, owner.AuthToken, "hime@example.com")
+
+	b := &blockingMailer{unblock: make(chan struct{})}
+	d.Config.Mailer = b
+
+	// The request shouldn't wait for the mail to be sent, so that it takes as
+	// long as one for a user that doesn't exist.
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		return tx.RequestPasswordReset("ひめありかわ")
+	})
+	if err != nil {
+		t.Fatal("Failed to request password reset:", err)
+	}
+
+	err = d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		return tx.RequestPasswordReset("かぐやありかわ")
+	})
+	if !errors.Is(err, smolboard.ErrUserNotFound) {
+		t.Fatal("Unexpected error resetting an unknown user:", err)
+	}
+
+	close(b.unblock)
+	d.mailing.Wait()
+
+	if mails := b.Mails(); len(mails) != 1 || mails[0].To != "hime@example.com" {
+		t.Fatalf("Unexpected mails sent: %#v", mails)
+	}
+}
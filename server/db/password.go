@@ -0,0 +1,350 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned when verifying a password against a hash whose
+// algorithm can't be told from its prefix.
+var ErrUnknownHash = errors.New("unknown password hash algorithm")
+
+// argon2idPrefix marks an Argon2id hash in the PHC string format, which is
+// "$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>", where the
+// salt and key are unpadded base64.
+var argon2idPrefix = []byte("$argon2id$")
+
+// VerifyPassword verifies the password against the hash. The hash's algorithm
+// is told from its prefix, so bcrypt and Argon2id hashes can be mixed.
+// ErrInvalidPassword is returned if the password doesn't match.
+func VerifyPassword(hash []byte, password string) error {
+	switch {
+	case isBcryptHash(hash):
+		return verifyBcrypt(hash, password)
+	case bytes.HasPrefix(hash, argon2idPrefix):
+		return verifyArgon2id(hash, password)
+	default:
+		return ErrUnknownHash
+	}
+}
+
+// isBcryptHash returns true if the hash starts with any of the bcrypt
+// prefixes, which are "$2$", "$2a$", "$2b$" and "$2y$".
+func isBcryptHash(hash []byte) bool {
+	if !bytes.HasPrefix(hash, []byte("$2")) || len(hash) < 4 {
+		return false
+	}
+
+	switch hash[2] {
+	case '$':
+		return true
+	case 'a', 'b', 'y':
+		return hash[3] == '$'
+	default:
+		return false
+	}
+}
+
+func verifyBcrypt(hash []byte, password string) error {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+
+	// If the error is a mismatch, then we return an invalid password.
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return smolboard.ErrInvalidPassword
+	}
+
+	// Wrap will return nil if the error is nil.
+	return errors.Wrap(err, "Failed to compare password")
+}
+
+func verifyArgon2id(hash []byte, password string) error {
+	// The leading $ makes the first part empty.
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return errors.Wrap(err, "malformed argon2id version")
+	}
+	if version != argon2.Version {
+		return fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return errors.Wrap(err, "malformed argon2id parameters")
+	}
+	if time == 0 || threads == 0 {
+		return errors.New("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errors.Wrap(err, "malformed argon2id salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return errors.New("malformed argon2id key")
+	}
+
+	var actual = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return smolboard.ErrInvalidPassword
+	}
+
+	return nil
+}
+
+// MinPepperLen is the minimum length of a pepper in bytes.
+const MinPepperLen = 16
+
+// pepperPrefix marks a peppered hash, which is stored as
+// "$pepper$<version>$<bcrypt hash>". Hashes without it are plain bcrypt.
+var pepperPrefix = []byte("$pepper$")
+
+// peppers holds the parsed peppers of the config.
+type peppers struct {
+	secrets map[int][]byte
+	current int // 0 if no pepper
+}
+
+func parsePeppers(strs map[string]string) (peppers, error) {
+	var p = peppers{secrets: make(map[int][]byte, len(strs))}
+
+	for k, secret := range strs {
+		v, err := strconv.Atoi(k)
+		if err != nil || v < 1 {
+			return p, fmt.Errorf("pepper version %q is not a positive integer", k)
+		}
+
+		if len(secret) < MinPepperLen {
+			return p, fmt.Errorf("pepper %d must be at least %d bytes long", v, MinPepperLen)
+		}
+
+		p.secrets[v] = []byte(secret)
+
+		if v > p.current {
+			p.current = v
+		}
+	}
+
+	return p, nil
+}
+
+// pepper returns the password HMAC'd with the given pepper, or the password
+// itself if the version is 0. The HMAC is encoded into 44 bytes, which is
+// within bcrypt's 72-byte limit.
+func (p peppers) pepper(version int, password string) ([]byte, error) {
+	if version == 0 {
+		return []byte(password), nil
+	}
+
+	secret, ok := p.secrets[version]
+	if !ok {
+		return nil, fmt.Errorf("pepper %d is not configured", version)
+	}
+
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(password))
+
+	var sum = h.Sum(nil)
+	var enc = make([]byte, base64.StdEncoding.EncodedLen(len(sum)))
+	base64.StdEncoding.Encode(enc, sum)
+
+	return enc, nil
+}
+
+// hashPassword hashes the password using the current pepper, if any.
+func (p peppers) hashPassword(password string) ([]byte, error) {
+	peppered, err := p.pepper(p.current, password)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(peppered, smolboard.HashCost)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate password")
+	}
+
+	if p.current == 0 {
+		return hash, nil
+	}
+
+	var prefix = fmt.Sprintf("%s%d$", pepperPrefix, p.current)
+	return append([]byte(prefix), hash...), nil
+}
+
+// verifyPassword verifies the password against a hash made with any of the
+// configured peppers. It returns true if the hash should be replaced, because
+// it was not made with the current pepper.
+func (p peppers) verifyPassword(hash []byte, password string) (rehash bool, err error) {
+	var version int
+
+	if bytes.HasPrefix(hash, pepperPrefix) {
+		rest := hash[len(pepperPrefix):]
+
+		i := bytes.IndexByte(rest, '$')
+		if i < 1 {
+			return false, errors.New("malformed peppered hash")
+		}
+
+		version, err = strconv.Atoi(string(rest[:i]))
+		if err != nil {
+			return false, errors.Wrap(err, "malformed pepper version")
+		}
+
+		hash = rest[i+1:]
+	}
+
+	peppered, err := p.pepper(version, password)
+	if err != nil {
+		return false, err
+	}
+
+	if err := VerifyPassword(hash, string(peppered)); err != nil {
+		return false, err
+	}
+
+	return version != p.current, nil
+}
+
+// Password schemes that users can be imported with. Bcrypt and Argon2id
+// hashes are stored as they are. Hashes of the other schemes are stored as
+// "$legacy$<scheme>$<hash>", verified only if the scheme is enabled in the
+// config, and replaced with a bcrypt hash on the next sign in.
+const (
+	SchemeBcrypt   = "bcrypt"
+	SchemeArgon2id = "argon2id"
+	// SchemeSHA256 is an unsalted SHA-256 digest in hex.
+	SchemeSHA256 = "sha256"
+	// SchemePlaintext is a one-time password that the user signs in with.
+	SchemePlaintext = "plaintext"
+)
+
+var legacyPrefix = []byte("$legacy$")
+
+// isLegacyScheme returns true if the scheme is stored with the legacy prefix.
+func isLegacyScheme(scheme string) bool {
+	return scheme == SchemeSHA256 || scheme == SchemePlaintext
+}
+
+// importHash returns the hash to store for an imported user. It returns
+// ErrUnsupportedPasswordScheme if the scheme is unknown or not enabled.
+func (c DBConfig) importHash(hash []byte, scheme string) ([]byte, error) {
+	if isLegacyScheme(scheme) && !c.legacySchemes[scheme] {
+		return nil, smolboard.ErrUnsupportedPasswordScheme
+	}
+
+	switch scheme {
+	case SchemeBcrypt:
+		if !isBcryptHash(hash) {
+			return nil, smolboard.ErrMalformedPasswordHash
+		}
+		return hash, nil
+
+	case SchemeArgon2id:
+		if !bytes.HasPrefix(hash, argon2idPrefix) {
+			return nil, smolboard.ErrMalformedPasswordHash
+		}
+		return hash, nil
+
+	case SchemeSHA256:
+		sum, err := hex.DecodeString(string(hash))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, smolboard.ErrMalformedPasswordHash
+		}
+		// Normalize the digest to lowercase.
+		hash = []byte(hex.EncodeToString(sum))
+
+	case SchemePlaintext:
+		if len(hash) == 0 {
+			return nil, smolboard.ErrMalformedPasswordHash
+		}
+
+	default:
+		return nil, smolboard.ErrUnsupportedPasswordScheme
+	}
+
+	var prefix = fmt.Sprintf("%s%s$", legacyPrefix, scheme)
+	return append([]byte(prefix), hash...), nil
+}
+
+// verifyPassword verifies the password against any stored hash. It returns
+// true if the hash should be replaced, because it is a legacy hash or was not
+// made with the current pepper.
+func (c DBConfig) verifyPassword(hash []byte, password string) (rehash bool, err error) {
+	if !bytes.HasPrefix(hash, legacyPrefix) {
+		return c.peppers.verifyPassword(hash, password)
+	}
+
+	rest := hash[len(legacyPrefix):]
+
+	i := bytes.IndexByte(rest, '$')
+	if i < 1 {
+		return false, errors.New("malformed legacy hash")
+	}
+
+	var scheme = string(rest[:i])
+	hash = rest[i+1:]
+
+	// Schemes that were disabled after the import can't be signed in with.
+	if !c.legacySchemes[scheme] {
+		return false, smolboard.ErrUnsupportedPasswordScheme
+	}
+
+	var actual []byte
+
+	switch scheme {
+	case SchemeSHA256:
+		sum := sha256.Sum256([]byte(password))
+		actual = []byte(hex.EncodeToString(sum[:]))
+	case SchemePlaintext:
+		actual = []byte(password)
+	default:
+		return false, smolboard.ErrUnsupportedPasswordScheme
+	}
+
+	if subtle.ConstantTimeCompare(actual, hash) != 1 {
+		return false, smolboard.ErrInvalidPassword
+	}
+
+	return true, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// verifyDummyPassword verifies the password against a dummy hash, which takes
+// as long as verifying a real one. It is used when signing in as a user that
+// doesn't exist, so that the response time doesn't reveal which users do.
+func verifyDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		h, err := bcrypt.GenerateFromPassword([]byte("dummy password"), smolboard.HashCost)
+		if err != nil {
+			panic("Failed to generate dummy password hash: " + err.Error())
+		}
+		dummyHash = h
+	})
+
+	VerifyPassword(dummyHash, password)
+}
@@ -0,0 +1,364 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testPepper1 = "pepper-number-one-0123"
+	testPepper2 = "pepper-number-two-4567"
+)
+
+func mustPeppers(t *testing.T, strs map[string]string) peppers {
+	t.Helper()
+
+	p, err := parsePeppers(strs)
+	if err != nil {
+		t.Fatal("Failed to parse peppers:", err)
+	}
+	return p
+}
+
+// testArgon2idHash hashes the password into the PHC string format with cheap
+// parameters.
+func testArgon2idHash(password string) []byte {
+	var salt = []byte("0123456789abcdef")
+	var key = argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+
+	return []byte(fmt.Sprintf(
+		"$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	))
+}
+
+func TestVerifyPasswordAlgorithms(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("goodpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Failed to hash with bcrypt:", err)
+	}
+
+	var hashes = map[string][]byte{
+		"Bcrypt":   bcryptHash,
+		"Argon2id": testArgon2idHash("goodpassword"),
+	}
+
+	for name, hash := range hashes {
+		hash := hash
+
+		t.Run(name, func(t *testing.T) {
+			if err := VerifyPassword(hash, "goodpassword"); err != nil {
+				t.Fatal("Failed to verify:", err)
+			}
+
+			err := VerifyPassword(hash, "badpassword")
+			if !errors.Is(err, smolboard.ErrInvalidPassword) {
+				t.Fatal("Unexpected error verifying bad password:", err)
+			}
+		})
+	}
+
+	t.Run("Unknown", func(t *testing.T) {
+		err := VerifyPassword([]byte("$scrypt$ln=16,r=8,p=1$c2FsdA$a2V5"), "goodpassword")
+		if !errors.Is(err, ErrUnknownHash) {
+			t.Fatal("Unexpected error verifying unknown hash:", err)
+		}
+	})
+
+	t.Run("MalformedArgon2id", func(t *testing.T) {
+		var malformed = []string{
+			"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+			"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+		}
+
+		for _, hash := range malformed {
+			err := VerifyPassword([]byte(hash), "goodpassword")
+			if err == nil || errors.Is(err, smolboard.ErrInvalidPassword) {
+				t.Fatalf("Unexpected error verifying %q: %v", hash, err)
+			}
+		}
+	})
+}
+
+func TestSigninArgon2id(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.Peppers = map[string]string{"1": testPepper1}
+	})
+
+	testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	// Pretend that the owner's password was hashed with Argon2id using the
+	// pepper.
+	peppered, err := d.Config.peppers.pepper(1, "argonpassword")
+	if err != nil {
+		t.Fatal("Failed to pepper password:", err)
+	}
+
+	var hash = append([]byte("$pepper$1$"), testArgon2idHash(string(peppered))...)
+
+	_, err = d.Exec("UPDATE users SET passhash = ? WHERE username = ?", hash, "ひめありかわ")
+	if err != nil {
+		t.Fatal("Failed to set password hash:", err)
+	}
+
+	err = d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		_, err := tx.Signin("ひめありかわ", "argonpassword", "")
+		return err
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in with Argon2id hash:", err)
+	}
+}
+
+func TestPasswordPepper(t *testing.T) {
+	p := mustPeppers(t, map[string]string{"1": testPepper1})
+
+	hash, err := p.hashPassword("goodpassword")
+	if err != nil {
+		t.Fatal("Failed to hash:", err)
+	}
+
+	if !bytes.HasPrefix(hash, []byte("$pepper$1$")) {
+		t.Fatalf("Hash has no pepper version: %q", hash)
+	}
+
+	rehash, err := p.verifyPassword(hash, "goodpassword")
+	if err != nil {
+		t.Fatal("Failed to verify:", err)
+	}
+	if rehash {
+		t.Fatal("Hash with the current pepper needs rehashing")
+	}
+
+	if _, err := p.verifyPassword(hash, "badpassword"); !errors.Is(err, smolboard.ErrInvalidPassword) {
+		t.Fatal("Unexpected error verifying bad password:", err)
+	}
+
+	t.Run("WrongPepper", func(t *testing.T) {
+		p := mustPeppers(t, map[string]string{"1": testPepper2})
+
+		if _, err := p.verifyPassword(hash, "goodpassword"); !errors.Is(err, smolboard.ErrInvalidPassword) {
+			t.Fatal("Unexpected error verifying with the wrong pepper:", err)
+		}
+	})
+
+	t.Run("MissingPepper", func(t *testing.T) {
+		if _, err := (peppers{}).verifyPassword(hash, "goodpassword"); err == nil {
+			t.Fatal("Verified a peppered hash without the pepper")
+		}
+	})
+}
+
+func TestPasswordPepperRotation(t *testing.T) {
+	plain, err := (peppers{}).hashPassword("goodpassword")
+	if err != nil {
+		t.Fatal("Failed to hash without pepper:", err)
+	}
+
+	old, err := mustPeppers(t, map[string]string{"1": testPepper1}).hashPassword("goodpassword")
+	if err != nil {
+		t.Fatal("Failed to hash with old pepper:", err)
+	}
+
+	p := mustPeppers(t, map[string]string{"1": testPepper1, "2": testPepper2})
+
+	for name, hash := range map[string][]byte{"Plain": plain, "Old": old} {
+		t.Run(name, func(t *testing.T) {
+			rehash, err := p.verifyPassword(hash, "goodpassword")
+			if err != nil {
+				t.Fatal("Failed to verify:", err)
+			}
+			if !rehash {
+				t.Fatal("Outdated hash does not need rehashing")
+			}
+		})
+	}
+
+	t.Run("Signin", func(t *testing.T) {
+		d := newTestDatabase(t)
+		testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+		// Rotate the pepper, which is what a restart with a new config does.
+		d.Config.peppers = p
+
+		err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+			_, err := tx.Signin("ひめありかわ", "goodpassword", "")
+			return err
+		})
+		if err != nil {
+			t.Fatal("Failed to sign in after rotation:", err)
+		}
+
+		var hash []byte
+		err = d.
+			QueryRow("SELECT passhash FROM users WHERE username = ?", "ひめありかわ").
+			Scan(&hash)
+		if err != nil {
+			t.Fatal("Failed to get hash:", err)
+		}
+
+		if !bytes.HasPrefix(hash, []byte("$pepper$2$")) {
+			t.Fatalf("Hash not upgraded on sign in: %q", hash)
+		}
+	})
+}
+
+func TestParsePeppers(t *testing.T) {
+	var invalid = []map[string]string{
+		{"0": testPepper1},
+		{"one": testPepper1},
+		{"1": "short"},
+	}
+
+	for _, strs := range invalid {
+		if _, err := parsePeppers(strs); err == nil {
+			t.Errorf("No error parsing invalid peppers %v", strs)
+		}
+	}
+}
+
+func TestSigninTiming(t *testing.T) {
+	d := newTestDatabase(t)
+	testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	// signin measures how long a failed sign in takes.
+	signin := func(t *testing.T, username string) time.Duration {
+		t.Helper()
+
+		var start = time.Now()
+
+		err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+			_, err := tx.Signin(username, "badpassword", "")
+			return err
+		})
+		if !errors.Is(err, smolboard.ErrInvalidPassword) {
+			t.Fatal("Unexpected error signing in:", err)
+		}
+
+		return time.Since(start)
+	}
+
+	// Warm up the dummy hash.
+	signin(t, "ヒメゴト")
+
+	var existing, missing time.Duration
+	for i := 0; i < 3; i++ {
+		existing += signin(t, "ひめありかわ")
+		missing += signin(t, "ヒメゴト")
+	}
+
+	// The bcrypt cost dominates both paths, so they should be roughly the same.
+	if missing < existing/2 || missing > existing*2 {
+		t.Fatalf("Sign in timing differs: %v for existing users, %v for missing", existing, missing)
+	}
+}
+
+func TestImportUser(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.LegacyPasswordSchemes = []string{SchemeSHA256, SchemePlaintext}
+		cfg.ReservedUsernames = []string{"admin"}
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	var sum = sha256.Sum256([]byte("oldpassword"))
+
+	var imports = []struct {
+		username string
+		hash     []byte
+		scheme   string
+	}{
+		{"sha", []byte(strings.ToUpper(hex.EncodeToString(sum[:]))), SchemeSHA256},
+		{"plain", []byte("oldpassword"), SchemePlaintext},
+	}
+
+	err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+		for _, imp := range imports {
+			if err := tx.ImportUser(imp.username, imp.hash, imp.scheme); err != nil {
+				return errors.Wrapf(err, "Failed to import %s", imp.username)
+			}
+		}
+
+		err := tx.ImportUser("md5", []byte("abc"), "md5")
+		if !errors.Is(err, smolboard.ErrUnsupportedPasswordScheme) {
+			return fmt.Errorf("Unexpected error importing an unknown scheme: %v", err)
+		}
+
+		err = tx.ImportUser("bad", []byte("nothex"), SchemeSHA256)
+		if !errors.Is(err, smolboard.ErrMalformedPasswordHash) {
+			return fmt.Errorf("Unexpected error importing a malformed hash: %v", err)
+		}
+
+		err = tx.ImportUser("Admin", []byte("oldpassword"), SchemePlaintext)
+		if !errors.Is(err, smolboard.ErrUsernameReserved) {
+			return fmt.Errorf("Unexpected error importing a reserved username: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signin = func(username, password string) error {
+		return d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+			_, err := tx.Signin(username, password, "")
+			return err
+		})
+	}
+
+	for _, imp := range imports {
+		if err := signin(imp.username, "badpassword"); !errors.Is(err, smolboard.ErrInvalidPassword) {
+			t.Fatalf("Unexpected error signing in as %s with a bad password: %v", imp.username, err)
+		}
+
+		if err := signin(imp.username, "oldpassword"); err != nil {
+			t.Fatalf("Failed to sign in as %s: %v", imp.username, err)
+		}
+
+		var hash []byte
+
+		err := d.QueryRow("SELECT passhash FROM users WHERE username = ?", imp.username).Scan(&hash)
+		if err != nil {
+			t.Fatal("Failed to get password hash:", err)
+		}
+
+		if !isBcryptHash(hash) {
+			t.Fatalf("Hash of %s was not rehashed: %q", imp.username, hash)
+		}
+
+		// The new hash still works.
+		if err := signin(imp.username, "oldpassword"); err != nil {
+			t.Fatalf("Failed to sign in as %s after rehashing: %v", imp.username, err)
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+			cfg.LegacyPasswordSchemes = []string{SchemeSHA256}
+		})
+
+		owner := testNewOwner(t, d, "ひめありかわ", "password")
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		err := tx.ImportUser("plain", []byte("oldpassword"), SchemePlaintext)
+		if !errors.Is(err, smolboard.ErrUnsupportedPasswordScheme) {
+			t.Fatal("Unexpected error importing a disabled scheme:", err)
+		}
+	})
+}
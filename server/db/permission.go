@@ -30,14 +30,36 @@ func (d *Transaction) permission(user string) (perm smolboard.Permission, err er
 }
 
 // Permission scans for the permissions, or returns action not permitted if the
-// user does not exist.
+// user does not exist. The permission is capped if LimitPermission was called.
 func (d *Transaction) Permission() (perm smolboard.Permission, err error) {
 	// Zero-value; allow guests.
 	if d.Session.ID == 0 {
 		return smolboard.PermissionGuest, nil
 	}
 
-	return d.permission(d.Session.Username)
+	// JWTs carry their own permission, which is refreshed from the users table
+	// when the session is looked up.
+	if d.claims != nil {
+		perm = d.claims.Permission
+	} else {
+		perm, err = d.permission(d.Session.Username)
+		if err != nil {
+			return perm, err
+		}
+	}
+
+	if d.limited && perm > d.maxPermission {
+		perm = d.maxPermission
+	}
+
+	return perm, nil
+}
+
+// LimitPermission caps the current user's permission at max for the rest of
+// the transaction, so that they can't do anything that needs a higher one.
+func (d *Transaction) LimitPermission(max smolboard.Permission) {
+	d.maxPermission = max
+	d.limited = true
 }
 
 // HasPermission returns nil if the user has the given permission. If inclusive
@@ -51,11 +73,25 @@ func (d *Transaction) HasPermission(min smolboard.Permission, inclusive bool) er
 	return p.HasPermission(min, inclusive)
 }
 
-func (d *Transaction) IsUserOrHasPermOver(min smolboard.Permission, user string) error {
-	if d.Session.Username == user {
+// requireOwnerOrPermission returns nil if the current user is the given owner
+// of the resource being changed, or if they have at least the given minimum
+// permission and a higher permission than the owner. An empty owner, such as the
+// poster of a post whose account was deleted, never matches the current user,
+// since guests also have an empty username.
+func (d *Transaction) requireOwnerOrPermission(owner string, min smolboard.Permission) error {
+	if owner != "" && owner == d.Session.Username {
 		return nil
 	}
-	return d.HasPermOverUser(min, user)
+
+	p, err := d.Permission()
+	if err != nil {
+		return err
+	}
+
+	// Accept a -1 permission.
+	t, _ := d.permission(owner)
+
+	return p.HasPermOverUser(min, t, false)
 }
 
 // HasPermOverUser checks that the current user has at least the given minimum
@@ -38,6 +38,54 @@ func TestInclusivePermission(t *testing.T) {
 	}
 }
 
+func TestRequireOwnerOrPermission(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+	peer := newTestUser(t, d, owner.AuthToken, "いとうまお", smolboard.PermissionUser)
+	admin := newTestUser(t, d, owner.AuthToken, "とよとみヒロ", smolboard.PermissionAdministrator)
+	peerAdmin := newTestUser(t, d, owner.AuthToken, "むとうゆき", smolboard.PermissionAdministrator)
+
+	var tests = []struct {
+		name  string
+		token string
+		owner string
+		min   smolboard.Permission
+		ok    bool
+	}{
+		{"Self", user.AuthToken, user.Username, smolboard.PermissionOwner, true},
+		{"Peer", peer.AuthToken, user.Username, smolboard.PermissionAdministrator, false},
+		{"PeerLowMin", peer.AuthToken, user.Username, smolboard.PermissionUser, false},
+		{"Admin", admin.AuthToken, user.Username, smolboard.PermissionAdministrator, true},
+		{"AdminBelowMin", admin.AuthToken, user.Username, smolboard.PermissionOwner, false},
+		{"PeerAdmin", peerAdmin.AuthToken, admin.Username, smolboard.PermissionAdministrator, false},
+		{"Owner", owner.AuthToken, admin.Username, smolboard.PermissionAdministrator, true},
+		{"AdminOverOwner", admin.AuthToken, owner.Username, smolboard.PermissionAdministrator, false},
+		{"GuestNoOwner", "", "", smolboard.PermissionGuest, false},
+		{"GuestOverUser", "", user.Username, smolboard.PermissionGuest, false},
+		// Deleted users count as administrators.
+		{"AdminNoOwner", admin.AuthToken, "", smolboard.PermissionAdministrator, false},
+		{"OwnerNoOwner", owner.AuthToken, "", smolboard.PermissionAdministrator, true},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			tx := testBeginTx(t, d, test.token)
+
+			err := tx.requireOwnerOrPermission(test.owner, test.min)
+			if test.ok && err != nil {
+				t.Fatal("Unexpected error:", err)
+			}
+			if !test.ok && !errors.Is(err, smolboard.ErrActionNotPermitted) {
+				t.Fatal("Unexpected non-permission error:", err)
+			}
+		})
+	}
+}
+
 type permTest struct {
 	begin     func(t *testing.T, d *Database, owner *smolboard.Session) *smolboard.Session
 	passPerms []smolboard.Permission
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// CreatePool creates an empty pool owned by the current user.
+func (d *Transaction) CreatePool(name string) (*smolboard.Pool, error) {
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return nil, err
+	}
+
+	name, err := poolNameIsValid(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var pool = smolboard.Pool{
+		ID:        int64(poolIDGen.Generate()),
+		Owner:     d.Session.Username,
+		Name:      name,
+		CreatedAt: time.Now().UnixNano(),
+		PostIDs:   []int64{},
+	}
+
+	_, err = d.Exec(
+		"INSERT INTO pools (id, owner, name, createdat) VALUES (?, ?, ?, ?)",
+		pool.ID, pool.Owner, pool.Name, pool.CreatedAt,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save pool")
+	}
+
+	return &pool, nil
+}
+
+func poolNameIsValid(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", smolboard.ErrEmptyPoolName
+	}
+	if len(name) > smolboard.MaxPoolNameLen {
+		return "", smolboard.ErrPoolNameTooLong
+	}
+	return name, nil
+}
+
+// Pool returns the pool with the given ID along with its posts in order. Posts
+// that the current user can't see are left out of both the posts and the
+// pool's post IDs.
+func (d *Transaction) Pool(id int64) (*smolboard.Pool, []smolboard.Post, error) {
+	pool, err := d.pool(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := d.Permission()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var posts = []smolboard.Post{}
+
+	err = d.Select(&posts, `
+		SELECT posts.* FROM poolposts
+			INNER JOIN posts ON posts.id = poolposts.postid
+			WHERE poolposts.poolid = ?
+				AND (posts.poster = ? OR posts.permission <= ?)
+				AND `+postLive+`
+			ORDER BY poolposts.position ASC`,
+		id, d.Session.Username, p, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to query pool posts")
+	}
+
+	pool.PostIDs = make([]int64, len(posts))
+	for i, post := range posts {
+		pool.PostIDs[i] = post.ID
+	}
+
+	return pool, posts, nil
+}
+
+func (d *Transaction) pool(id int64) (*smolboard.Pool, error) {
+	var pool smolboard.Pool
+
+	if err := d.QueryRowx("SELECT * FROM pools WHERE id = ?", id).StructScan(&pool); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, smolboard.ErrPoolNotFound
+		}
+		return nil, errors.Wrap(err, "Failed to scan pool")
+	}
+
+	return &pool, nil
+}
+
+// canModifyPool checks that the pool exists and that the current user either
+// owns it or is an administrator over its owner.
+func (d *Transaction) canModifyPool(id int64) error {
+	pool, err := d.pool(id)
+	if err != nil {
+		return err
+	}
+
+	return d.requireOwnerOrPermission(pool.Owner, smolboard.PermissionAdministrator)
+}
+
+// DeletePool deletes the pool with the given ID. The posts in it are kept.
+func (d *Transaction) DeletePool(id int64) error {
+	if err := d.canModifyPool(id); err != nil {
+		return err
+	}
+
+	if _, err := d.Exec("DELETE FROM pools WHERE id = ?", id); err != nil {
+		return errors.Wrap(err, "Failed to delete pool")
+	}
+
+	return nil
+}
+
+// AddToPool inserts the post into the pool at the given 0-indexed position,
+// shifting the posts after it. The post is appended if the position is
+// negative or past the end. If the post is already in the pool, then it is
+// moved to the position instead.
+func (d *Transaction) AddToPool(poolID, postID int64, position int) error {
+	if err := d.canModifyPool(poolID); err != nil {
+		return err
+	}
+
+	// Only visible posts can be added.
+	if _, err := d.PostQuickGet(postID); err != nil {
+		return err
+	}
+
+	if _, err := d.removePoolPost(poolID, postID); err != nil {
+		return err
+	}
+
+	var count int
+
+	err := d.
+		QueryRow("SELECT COUNT(*) FROM poolposts WHERE poolid = ?", poolID).
+		Scan(&count)
+	if err != nil {
+		return errors.Wrap(err, "Failed to count pool posts")
+	}
+
+	if position < 0 || position > count {
+		position = count
+	}
+
+	_, err = d.Exec(
+		"UPDATE poolposts SET position = position + 1 WHERE poolid = ? AND position >= ?",
+		poolID, position,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to shift pool posts")
+	}
+
+	_, err = d.Exec(
+		"INSERT INTO poolposts (poolid, postid, position) VALUES (?, ?, ?)",
+		poolID, postID, position,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to add post to pool")
+	}
+
+	return nil
+}
+
+// RemoveFromPool removes the post from the pool. ErrPostNotFound is returned if
+// the post is not in the pool.
+func (d *Transaction) RemoveFromPool(poolID, postID int64) error {
+	if err := d.canModifyPool(poolID); err != nil {
+		return err
+	}
+
+	removed, err := d.removePoolPost(poolID, postID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return smolboard.ErrPostNotFound
+	}
+
+	return nil
+}
+
+// removePoolPost removes the post from the pool and closes the gap in the
+// positions that it leaves. False is returned if the post isn't in the pool.
+func (d *Transaction) removePoolPost(poolID, postID int64) (bool, error) {
+	var position int
+
+	err := d.
+		QueryRow("SELECT position FROM poolposts WHERE poolid = ? AND postid = ?", poolID, postID).
+		Scan(&position)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Failed to get pool post")
+	}
+
+	_, err = d.Exec("DELETE FROM poolposts WHERE poolid = ? AND postid = ?", poolID, postID)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to remove post from pool")
+	}
+
+	_, err = d.Exec(
+		"UPDATE poolposts SET position = position - 1 WHERE poolid = ? AND position > ?",
+		poolID, position,
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to shift pool posts")
+	}
+
+	return true, nil
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+)
+
+func TestPool(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	poster := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+	viewer := newTestUser(t, d, owner.AuthToken, "いとうまお", smolboard.PermissionUser)
+
+	var posts = make([]smolboard.Post, 4)
+	var pool *smolboard.Pool
+
+	t.Run("Create", func(t *testing.T) {
+		tx := testBeginTx(t, d, poster.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+			posts[i].Permission = smolboard.PermissionGuest
+		}
+
+		// Only the poster and admins can see this one.
+		posts[2].Permission = smolboard.PermissionAdministrator
+
+		for i := range posts {
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+		}
+
+		if _, err := tx.CreatePool("  "); !errors.Is(err, smolboard.ErrEmptyPoolName) {
+			t.Fatal("Unexpected error creating pool with empty name:", err)
+		}
+
+		p, err := tx.CreatePool("album")
+		if err != nil {
+			t.Fatal("Failed to create pool:", err)
+		}
+		pool = p
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		tx := testBeginTx(t, d, poster.AuthToken)
+
+		// Append 0 and 1, put 2 in front and 3 after it, then move 0 to the end.
+		var adds = []struct {
+			post int
+			pos  int
+		}{
+			{0, -1},
+			{1, 10},
+			{2, 0},
+			{3, 1},
+			{0, -1},
+		}
+
+		for _, add := range adds {
+			if err := tx.AddToPool(pool.ID, posts[add.post].ID, add.pos); err != nil {
+				t.Fatal("Failed to add post to pool:", err)
+			}
+		}
+
+		expectPool(t, tx, pool.ID, posts[2].ID, posts[3].ID, posts[1].ID, posts[0].ID)
+
+		if err := tx.RemoveFromPool(pool.ID, posts[3].ID); err != nil {
+			t.Fatal("Failed to remove post from pool:", err)
+		}
+		if err := tx.RemoveFromPool(pool.ID, posts[3].ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error removing post twice:", err)
+		}
+
+		expectPool(t, tx, pool.ID, posts[2].ID, posts[1].ID, posts[0].ID)
+
+		if err := tx.AddToPool(pool.ID, posts[3].ID, 2); err != nil {
+			t.Fatal("Failed to add post to pool:", err)
+		}
+
+		expectPool(t, tx, pool.ID, posts[2].ID, posts[1].ID, posts[3].ID, posts[0].ID)
+	})
+
+	t.Run("Visibility", func(t *testing.T) {
+		tx := testBeginTx(t, d, viewer.AuthToken)
+
+		// The hidden post is left out for other users.
+		expectPool(t, tx, pool.ID, posts[1].ID, posts[3].ID, posts[0].ID)
+
+		if err := tx.AddToPool(pool.ID, posts[0].ID, 0); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error adding to other user's pool:", err)
+		}
+		if err := tx.RemoveFromPool(pool.ID, posts[0].ID); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error removing from other user's pool:", err)
+		}
+		if err := tx.DeletePool(pool.ID); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error deleting other user's pool:", err)
+		}
+	})
+
+	t.Run("Guest", func(t *testing.T) {
+		tx := testBeginTx(t, d, "")
+
+		expectPool(t, tx, pool.ID, posts[1].ID, posts[3].ID, posts[0].ID)
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.RemoveFromPool(pool.ID, posts[1].ID); err != nil {
+			t.Fatal("Failed to remove post from pool as owner:", err)
+		}
+
+		expectPool(t, tx, pool.ID, posts[2].ID, posts[3].ID, posts[0].ID)
+
+		if err := tx.DeletePool(pool.ID); err != nil {
+			t.Fatal("Failed to delete pool as owner:", err)
+		}
+		if _, _, err := tx.Pool(pool.ID); !errors.Is(err, smolboard.ErrPoolNotFound) {
+			t.Fatal("Unexpected error getting deleted pool:", err)
+		}
+	})
+}
+
+func expectPool(t *testing.T, tx *Transaction, id int64, postIDs ...int64) {
+	t.Helper()
+
+	p, posts, err := tx.Pool(id)
+	if err != nil {
+		t.Fatal("Failed to get pool:", err)
+	}
+
+	if eq := deep.Equal(p.PostIDs, postIDs); eq != nil {
+		t.Fatal("Unexpected pool post IDs:", eq)
+	}
+
+	if len(posts) != len(postIDs) {
+		t.Fatalf("Unexpected pool posts: %#v", posts)
+	}
+	for i, post := range posts {
+		if post.ID != postIDs[i] {
+			t.Fatalf("Unexpected post %d in pool: %d", i, post.ID)
+		}
+	}
+}
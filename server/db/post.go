@@ -1,22 +1,44 @@
 package db
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
+// NewEmptyPost creates a new post with a snowflake ID from the default machine
+// ID. Use NewEmptyPostFrom to follow the configured post ID scheme.
 func NewEmptyPost(ctype string) smolboard.Post {
+	return NewEmptyPostFrom(defaultPostIDs, ctype)
+}
+
+// NewEmptyPostFrom creates a new post with an ID from the given generator.
+func NewEmptyPostFrom(ids IDGenerator, ctype string) smolboard.Post {
 	return smolboard.Post{
-		ID:          int64(postIDGen.Generate()),
+		ID:          ids.NextID(),
 		ContentType: ctype,
 		Permission:  smolboard.PermissionGuest,
 	}
 }
 
+// PostIDs returns the generator of new post IDs, which follows the configured
+// post ID scheme.
+func (d *Transaction) PostIDs() IDGenerator {
+	return d.config.postIDs
+}
+
+// postLive is the condition of posts that are neither soft-deleted nor expired
+// at the current time in Unix nanoseconds, which must be bound to it.
+const postLive = "posts.deletedat IS NULL AND (posts.expiresat IS NULL OR posts.expiresat > ?)"
+
 // PostSearch parses the query string and returns the searched posts.
 func (d *Transaction) PostSearch(q string, count, page uint) (smolboard.SearchResults, error) {
 	p, err := smolboard.ParsePostQuery(q)
@@ -24,16 +46,98 @@ func (d *Transaction) PostSearch(q string, count, page uint) (smolboard.SearchRe
 		return smolboard.NoResults, err
 	}
 
-	return d.posts(p, count, page)
+	return d.posts(p, count, page, nil)
+}
+
+// PostSearchAfter is similar to PostSearch, but it paginates using the cursor
+// returned in the last results instead of a page offset. An empty cursor
+// returns the first page.
+func (d *Transaction) PostSearchAfter(q, cursor string, count uint) (smolboard.SearchResults, error) {
+	p, err := smolboard.ParsePostQuery(q)
+	if err != nil {
+		return smolboard.NoResults, err
+	}
+
+	c, err := parsePostCursor(cursor)
+	if err != nil {
+		return smolboard.NoResults, err
+	}
+
+	return d.posts(p, count, 0, c)
 }
 
 // Posts returns the list of posts that's paginated. Count represents the limit
 // for each page and page represents the page offset 0-indexed.
 func (d *Transaction) Posts(count, page uint) (smolboard.SearchResults, error) {
-	return d.posts(smolboard.AllPosts, count, page)
+	return d.posts(smolboard.AllPosts, count, page, nil)
+}
+
+// PostsAfter returns at most limit posts after the given cursor as well as the
+// cursor for the next page. Unlike Posts, pages don't drift when posts are
+// added or deleted in between. An empty cursor returns the first page, and an
+// empty next cursor is returned on the last page.
+func (d *Transaction) PostsAfter(cursor string, limit int) ([]smolboard.Post, string, error) {
+	if limit < 0 {
+		return nil, "", smolboard.ErrPageCountLimit
+	}
+
+	c, err := parsePostCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	r, err := d.posts(smolboard.AllPosts, uint(limit), 0, c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return r.Posts, r.Cursor, nil
+}
+
+// postCursor is the position of a post in the newest-first ordering.
+type postCursor struct {
+	createdAt int64
+	id        int64
+}
+
+// parsePostCursor decodes the given cursor. A nil cursor is returned if the
+// string is empty.
+func parsePostCursor(cursor string) (*postCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, smolboard.ErrInvalidCursor
+	}
+
+	parts := strings.Split(string(b), ".")
+	if len(parts) != 2 {
+		return nil, smolboard.ErrInvalidCursor
+	}
+
+	var c postCursor
+
+	if c.createdAt, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return nil, smolboard.ErrInvalidCursor
+	}
+	if c.id, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil, smolboard.ErrInvalidCursor
+	}
+
+	return &c, nil
 }
 
-func (d *Transaction) posts(pq smolboard.Query, count, page uint) (smolboard.SearchResults, error) {
+// newPostCursor encodes the position of the given post into an opaque cursor.
+func newPostCursor(p smolboard.Post) string {
+	c := strconv.FormatInt(p.CreatedAt, 10) + "." + strconv.FormatInt(p.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(c))
+}
+
+func (d *Transaction) posts(
+	pq smolboard.Query, count, page uint, after *postCursor) (smolboard.SearchResults, error) {
+
 	p, err := d.Permission()
 	if err != nil {
 		return smolboard.NoResults, err
@@ -45,9 +149,12 @@ func (d *Transaction) posts(pq smolboard.Query, count, page uint) (smolboard.Sea
 	}
 
 	var results = smolboard.SearchResults{
-		Posts: make([]smolboard.Post, 0, count),
+		Posts: make([]smolboard.Post, 0, count+1),
 	}
 
+	// Tags are written normalized, so the searched ones must be as well.
+	pq.Tags = normalizeTags(pq.Tags)
+
 	// Get the user if any.
 	if pq.Poster != "" {
 		u, err := d.User(pq.Poster)
@@ -68,28 +175,36 @@ func (d *Transaction) posts(pq smolboard.Query, count, page uint) (smolboard.Sea
 	// always see their posts regardless of the post's permission.
 	footer := strings.Builder{}
 	footer.WriteString("WHERE (posts.poster = ? OR posts.permission <= ?) ")
+	// Never show soft-deleted or expired posts.
+	footer.WriteString("AND " + postLive + " ")
 
 	// muh optimization
-	footerArgs := make([]interface{}, 2, 6)
+	footerArgs := make([]interface{}, 3, 7)
 	footerArgs[0] = d.Session.Username
 	footerArgs[1] = p
+	footerArgs[2] = time.Now().UnixNano()
 
 	if pq.Poster != "" {
 		footer.WriteString("AND posts.poster = ? ")
 		footerArgs = append(footerArgs, pq.Poster)
 	}
 
+	// The grouping is kept separately from the footer, since the cursor
+	// condition must come before it.
+	group := strings.Builder{}
+	var groupArgs []interface{}
+
 	if len(pq.Tags) > 0 {
 		// In order to search for tags, we'll need to join these tables.
 		header.WriteString("JOIN posttags ON posttags.postid = posts.id ")
 		// Query using the above joins. The HAVING COUNT query is needed to only
 		// show posts with all the tags searched.
-		footer.WriteString(`
-			AND posttags.tagname IN (?)
-			GROUP BY posts.id HAVING COUNT(posttags.tagname) = ? `)
+		footer.WriteString("AND posttags.tagname IN (?) ")
+		footerArgs = append(footerArgs, pq.Tags)
 		// There used to be a GROUP BY here. However, the GROUP BY messes up the
 		// COUNT and SUM functions.
-		footerArgs = append(footerArgs, pq.Tags, len(pq.Tags))
+		group.WriteString("GROUP BY posts.id HAVING COUNT(posttags.tagname) = ? ")
+		groupArgs = append(groupArgs, len(pq.Tags))
 	}
 
 	// Build the paginated query.
@@ -97,13 +212,33 @@ func (d *Transaction) posts(pq smolboard.Query, count, page uint) (smolboard.Sea
 	query.WriteString("SELECT posts.* ")
 	query.WriteString(header.String())
 	query.WriteString(footer.String())
-	// Sort the ID decrementally, which is latest first.
-	query.WriteString("ORDER BY posts.id DESC ")
+
+	queryargs := append([]interface{}{}, footerArgs...)
+
+	// Only get the posts that come after the cursor in the ordering below.
+	if after != nil {
+		query.WriteString(`
+			AND (posts.createdat < ? OR (posts.createdat = ? AND posts.id < ?)) `)
+		queryargs = append(queryargs, after.createdAt, after.createdAt, after.id)
+	}
+
+	query.WriteString(group.String())
+	queryargs = append(queryargs, groupArgs...)
+
+	// Sort by the creation time decrementally, which is latest first. The ID
+	// breaks ties.
+	query.WriteString("ORDER BY posts.createdat DESC, posts.id DESC ")
 
 	// Append the final pagination query. SQL is dumb and wants LIMIT (offset),
 	// (count) for some reason.
+	// One more post is queried to know if there's a next page.
+	var limit = count
+	if count > 0 {
+		limit++
+	}
+
 	query.WriteString("LIMIT ?, ?")
-	queryargs := append(footerArgs, count*page, count)
+	queryargs = append(queryargs, count*page, limit)
 
 	qstring, inargs, err := sqlx.In(query.String(), queryargs...)
 	if err != nil {
@@ -127,6 +262,18 @@ func (d *Transaction) posts(pq smolboard.Query, count, page uint) (smolboard.Sea
 		results.Posts = append(results.Posts, p)
 	}
 
+	// Drop the extra post, which only tells that there are more posts.
+	if count > 0 && len(results.Posts) > int(count) {
+		results.Posts = results.Posts[:count]
+		results.HasMore = true
+		results.Cursor = newPostCursor(results.Posts[len(results.Posts)-1])
+	}
+
+	results.Limit = int(count)
+	if after == nil {
+		results.Offset = int(count * page)
+	}
+
 	// Save the sum count query up if there's no posts found.
 	if len(results.Posts) > 0 {
 		// Build the sum count query.
@@ -138,9 +285,12 @@ func (d *Transaction) posts(pq smolboard.Query, count, page uint) (smolboard.Sea
 					SUM(posts.size) * COUNT(DISTINCT posts.id) / COUNT(posts.id) AS postsize `)
 		countq.WriteString(header.String())
 		countq.WriteString(footer.String())
+		countq.WriteString(group.String())
 		countq.WriteString(")")
 
-		cstring, inargs, err := sqlx.In(countq.String(), footerArgs...)
+		countargs := append(footerArgs, groupArgs...)
+
+		cstring, inargs, err := sqlx.In(countq.String(), countargs...)
 		if err != nil {
 			return smolboard.NoResults, errors.Wrap(err, "Failed to construct SQL IN query")
 		}
@@ -153,6 +303,25 @@ func (d *Transaction) posts(pq smolboard.Query, count, page uint) (smolboard.Sea
 	return results, nil
 }
 
+// PostCount returns the number of the current user's posts, excluding the
+// soft-deleted ones.
+func (d *Transaction) PostCount() (int, error) {
+	var count int
+
+	err := d.
+		QueryRow(
+			"SELECT COUNT(*) FROM posts WHERE poster = ? AND deletedat IS NULL",
+			d.Session.Username,
+		).
+		Scan(&count)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to count posts")
+	}
+
+	return count, nil
+}
+
 // PostQuickGet gets a normal post instance. This function is used primarily
 // internally, but exported for local use.
 func (d *Transaction) PostQuickGet(id int64) (*smolboard.Post, error) {
@@ -167,9 +336,11 @@ func (d *Transaction) PostQuickGet(id int64) (*smolboard.Post, error) {
 	}
 
 	// Check if the post is there with the given constraints.
-	r := d.QueryRowx(
-		"SELECT * FROM posts WHERE id = ? AND (poster = ? OR permission <= ?) LIMIT 1",
-		id, d.Session.Username, p,
+	r := d.QueryRowx(`
+		SELECT * FROM posts
+			WHERE id = ? AND (poster = ? OR permission <= ?) AND `+postLive+`
+			LIMIT 1`,
+		id, d.Session.Username, p, time.Now().UnixNano(),
 	)
 
 	var post smolboard.Post
@@ -200,8 +371,10 @@ func (d *Transaction) Post(id int64) (*smolboard.PostExtended, error) {
 	r := d.QueryRowx(
 		// Select the post only when the current user is the poster OR the
 		// user's permission is less than or equal to the post's.
-		"SELECT * FROM posts WHERE id = ? AND (poster = ? OR permission <= ?) LIMIT 1",
-		id, d.Session.Username, p,
+		`SELECT * FROM posts
+			WHERE id = ? AND (poster = ? OR permission <= ?) AND `+postLive+`
+			LIMIT 1`,
+		id, d.Session.Username, p, time.Now().UnixNano(),
 	)
 
 	var post smolboard.Post
@@ -231,10 +404,11 @@ func (d *Transaction) Post(id int64) (*smolboard.PostExtended, error) {
 	t, err := d.Queryx(`
 		SELECT COUNT(1), posttags.tagname FROM posttags
 		JOIN   posttags AS posttags2 ON posttags2.tagname = posttags.tagname
-		WHERE  posttags2.postid = ?
+		JOIN   posts ON posts.id = posttags.postid
+		WHERE  posttags2.postid = ? AND `+postLive+`
 		GROUP  BY posttags.tagname
 		ORDER  BY posttags.tagname ASC`,
-		id,
+		id, time.Now().UnixNano(),
 	)
 	if err != nil {
 		// If we have no rows, then just return the post only.
@@ -261,33 +435,178 @@ func (d *Transaction) Post(id int64) (*smolboard.PostExtended, error) {
 }
 
 func (d *Transaction) SavePost(post *smolboard.Post) error {
-	if post.ID == 0 || post.ContentType == "" || post.Size == 0 {
+	// External posts have no file, so they're the only ones that can be empty.
+	if post.ID == 0 || post.ContentType == "" || (post.Size == 0 && !post.External) {
 		return errors.New("cannot use empty post")
 	}
 
-	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+	if post.External {
+		if err := smolboard.ValidateMediaURL(post.MediaURL); err != nil {
+			return err
+		}
+	}
+
+	if post.ExpiresAt != nil && *post.ExpiresAt <= time.Now().UnixNano() {
+		return smolboard.ErrInvalidPostExpiry
+	}
+
+	if post.ContentHash != "" && !validContentHash(post.ContentHash) {
+		return smolboard.ErrInvalidContentHash
+	}
+
+	switch err := d.HasPermission(smolboard.PermissionUser, true); {
+	case err == nil:
+		// Set the post's username to the current user.
+		post.SetPoster(d.Session.Username)
+
+	case d.Session.Username == "" && d.config.AnonymousPosting:
+		// Anonymous uploaders are the lowest tier, so they can't pick who can
+		// see their posts.
+		post.SetPoster(d.config.AnonymousUsername)
+		post.Anonymous = true
+		post.Permission = smolboard.PermissionGuest
+
+		if d.config.AnonymousModeration {
+			post.Permission = smolboard.PermissionAdministrator
+		}
+
+	default:
+		// Tell pending users why they can't upload.
+		if d.Session.Username != "" {
+			if p, _ := d.Permission(); p == smolboard.PermissionGuest {
+				return smolboard.ErrUserPending
+			}
+		}
+		return err
+	}
+
+	if err := d.checkQuota(post.GetPoster(), post.Size); err != nil {
 		return err
 	}
 
-	// Set the post's username to the current user.
-	post.SetPoster(d.Session.Username)
+	// The timestamps are set by the server, not the client.
+	post.CreatedAt = time.Now().UnixNano()
+	post.UpdatedAt = post.CreatedAt
 
 	_, err := d.Exec(
-		"INSERT INTO posts VALUES (?, ?, ?, ?, ?, ?)",
+		`INSERT INTO posts
+			(id, size, poster, contenttype, permission, attributes, createdat, updatedat, anonymous,
+				external, mediaurl, expiresat, contenthash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		post.ID, post.Size, post.Poster, post.ContentType, post.Permission, post.Attributes,
+		post.CreatedAt, post.UpdatedAt, post.Anonymous, post.External, post.MediaURL, post.ExpiresAt,
+		post.ContentHash,
 	)
 
-	if err != nil && errIsConstraint(err) {
-		return smolboard.ErrUserNotFound
+	if err != nil {
+		if errIsConstraint(err) {
+			return smolboard.ErrUserNotFound
+		}
+		return err
+	}
+
+	d.queueEvent(smolboard.EventPostCreate, *post)
+	return nil
+}
+
+// PostByHash returns the oldest post visible to the current user whose file
+// has the given content hash, which is its hex SHA-256 digest. Clients can use
+// this to skip uploading files that are already on the server.
+func (d *Transaction) PostByHash(hash string) (*smolboard.Post, error) {
+	if !validContentHash(hash) {
+		return nil, smolboard.ErrInvalidContentHash
 	}
 
-	return err
+	p, err := d.Permission()
+	if err != nil {
+		return nil, err
+	}
+
+	var post smolboard.Post
+
+	err = d.
+		QueryRowx(`
+			SELECT * FROM posts
+				WHERE contenthash = ? AND (poster = ? OR permission <= ?) AND `+postLive+`
+				ORDER BY createdat ASC LIMIT 1`,
+			hash, d.Session.Username, p, time.Now().UnixNano(),
+		).
+		StructScan(&post)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, smolboard.ErrPostNotFound
+		}
+		return nil, errors.Wrap(err, "Failed to scan post")
+	}
+
+	return &post, nil
+}
+
+// validContentHash returns true if the hash is a lower-case hex SHA-256 digest.
+func validContentHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+
+	for _, r := range hash {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// postIDChunk is the number of post IDs looked up per query. It is kept well
+// below SQLite's variable limit.
+const postIDChunk = 256
+
+// MissingPostIDs returns the given IDs that no post has, including soft-deleted
+// posts. It is used to find files left behind without a post. Only
+// administrators can do this.
+func (d *Transaction) MissingPostIDs(ids []int64) ([]int64, error) {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return nil, err
+	}
+
+	var missing []int64
+
+	for len(ids) > 0 {
+		var chunk = ids
+		if len(chunk) > postIDChunk {
+			chunk = chunk[:postIDChunk]
+		}
+		ids = ids[len(chunk):]
+
+		q, args, err := sqlx.In("SELECT id FROM posts WHERE id IN (?)", chunk)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to build query")
+		}
+
+		var found []int64
+		if err := d.Select(&found, q, args...); err != nil {
+			return nil, errors.Wrap(err, "Failed to query post IDs")
+		}
+
+		var exists = make(map[int64]struct{}, len(found))
+		for _, id := range found {
+			exists[id] = struct{}{}
+		}
+
+		for _, id := range chunk {
+			if _, ok := exists[id]; !ok {
+				missing = append(missing, id)
+			}
+		}
+	}
+
+	return missing, nil
 }
 
 // canChangePost returns an error if the user cannot change this post. This
 // includes deleting and tagging.
 func (d *Transaction) canChangePost(postID int64) error {
-	q := d.QueryRow("SELECT poster FROM posts WHERE id = ?", postID)
+	q := d.QueryRow("SELECT poster FROM posts WHERE id = ? AND "+postLive, postID, time.Now().UnixNano())
 
 	var u *string
 	if err := q.Scan(&u); err != nil {
@@ -301,20 +620,152 @@ func (d *Transaction) canChangePost(postID int64) error {
 
 	// Make sure the user performing this action is either the poster of the
 	// post being deleted or an administrator.
-	if err := d.IsUserOrHasPermOver(smolboard.PermissionAdministrator, user); err != nil {
+	return d.requireOwnerOrPermission(user, smolboard.PermissionAdministrator)
+}
+
+// DeletePost deletes the post with the given ID. If hard is false, then the
+// post is only marked as deleted and hidden, and it can be restored using
+// RestorePost until the janitor purges it after the configured grace period.
+// If hard is true, the post is removed immediately the same way PurgePost does.
+func (d *Transaction) DeletePost(id int64, hard bool) error {
+	if hard {
+		_, err := d.PurgePost(id)
+		return err
+	}
+
+	if err := d.canChangePost(id); err != nil {
 		return err
 	}
 
+	var post smolboard.Post
+
+	if err := d.QueryRowx("SELECT * FROM posts WHERE id = ?", id).StructScan(&post); err != nil {
+		return wrapPostErr(nil, err, "Failed to scan post")
+	}
+
+	r, err := d.Exec(
+		"UPDATE posts SET deletedat = ? WHERE id = ? AND deletedat IS NULL",
+		time.Now().UnixNano(), id,
+	)
+	if err := wrapPostErr(r, err, "Failed to execute soft delete"); err != nil {
+		return err
+	}
+
+	d.queueEvent(smolboard.EventPostDelete, post)
 	return nil
 }
 
-func (d *Transaction) DeletePost(id int64) error {
-	if err := d.canChangePost(id); err != nil {
-		return err
+// PurgePost hard-deletes the post with the given ID and returns it. Unlike
+// soft deletion, this also works on posts that are already soft-deleted or
+// expired, so those can be purged before the janitor gets to them. The caller
+// is responsible for cleaning up the file.
+func (d *Transaction) PurgePost(id int64) (*smolboard.Post, error) {
+	var post smolboard.Post
+
+	if err := d.QueryRowx("SELECT * FROM posts WHERE id = ?", id).StructScan(&post); err != nil {
+		return nil, wrapPostErr(nil, err, "Failed to scan post")
+	}
+
+	var user = ""
+	if post.Poster != nil {
+		user = *post.Poster
+	}
+
+	if err := d.requireOwnerOrPermission(user, smolboard.PermissionAdministrator); err != nil {
+		return nil, err
 	}
 
 	r, err := d.Exec("DELETE FROM posts WHERE id = ?", id)
-	return wrapPostErr(r, err, "Failed to execute delete")
+	if err := wrapPostErr(r, err, "Failed to execute delete"); err != nil {
+		return nil, err
+	}
+
+	d.queueEvent(smolboard.EventPostDelete, post)
+	return &post, nil
+}
+
+// DeletePosts deletes all given posts the same way DeletePost does. A post that
+// can't be deleted doesn't fail the whole operation; instead, its error is put
+// into its result. The results are in the same order as the given IDs. The
+// posts that were deleted are also returned, so that their files can be
+// cleaned up if hard is true.
+func (d *Transaction) DeletePosts(
+	ids []int64, hard bool) ([]smolboard.BulkPostResult, []*smolboard.Post, error) {
+
+	if len(ids) == 0 {
+		return nil, nil, smolboard.ErrNoPostsGiven
+	}
+	if len(ids) > smolboard.MaxBulkPosts {
+		return nil, nil, smolboard.ErrTooManyPosts
+	}
+
+	var results = make([]smolboard.BulkPostResult, len(ids))
+	var deleted = make([]*smolboard.Post, 0, len(ids))
+
+	for i, id := range ids {
+		results[i].ID = id
+
+		var p *smolboard.Post
+		var err error
+
+		if hard {
+			p, err = d.PurgePost(id)
+		} else {
+			p, err = d.PostQuickGet(id)
+			if err == nil {
+				err = d.DeletePost(id, false)
+			}
+		}
+
+		if err != nil {
+			// Bail on unexpected errors, as the transaction is probably
+			// broken at that point.
+			if httperr.ErrCode(err) >= 500 {
+				return nil, nil, err
+			}
+
+			results[i].Error = err.Error()
+			results[i].Slug = httperr.ErrSlug(err)
+			continue
+		}
+
+		deleted = append(deleted, p)
+	}
+
+	return results, deleted, nil
+}
+
+// RestorePost restores a soft-deleted post. Only the poster or an
+// administrator can restore a post, and only while it is still within the
+// grace period.
+func (d *Transaction) RestorePost(id int64) error {
+	var poster *string
+	var deletedAt int64
+
+	err := d.
+		QueryRow("SELECT poster, deletedat FROM posts WHERE id = ? AND deletedat IS NOT NULL", id).
+		Scan(&poster, &deletedAt)
+	if err != nil {
+		return wrapPostErr(nil, err, "Failed to scan deleted post")
+	}
+
+	var user = ""
+	if poster != nil {
+		user = *poster
+	}
+
+	if err := d.requireOwnerOrPermission(user, smolboard.PermissionAdministrator); err != nil {
+		return err
+	}
+
+	// Posts past the grace period are as good as gone, even if the janitor
+	// hasn't purged them yet.
+	if time.Now().UnixNano() > deletedAt+int64(d.config.deletedPostLifespan) {
+		return smolboard.ErrPostNotFound
+	}
+
+	r, err := d.Exec("UPDATE posts SET deletedat = NULL WHERE id = ?", id)
+	return wrapPostErr(r, err, "Failed to execute restore")
 }
 
 // SetPostPermission sets the post's permission. The current user can set the
@@ -324,7 +775,9 @@ func (d *Transaction) SetPostPermission(id int64, target smolboard.Permission) e
 	// Get the post's owner.
 	var poster string
 
-	err := d.QueryRow("SELECT poster FROM posts WHERE id = ?", id).Scan(&poster)
+	err := d.
+		QueryRow("SELECT poster FROM posts WHERE id = ? AND "+postLive, id, time.Now().UnixNano()).
+		Scan(&poster)
 	if err != nil {
 		return wrapPostErr(nil, err, "Failed to scan for poster")
 	}
@@ -336,10 +789,160 @@ func (d *Transaction) SetPostPermission(id int64, target smolboard.Permission) e
 		return err
 	}
 
-	r, err := d.Exec("UPDATE posts SET permission = ? WHERE id = ?", target, id)
+	r, err := d.Exec(
+		"UPDATE posts SET permission = ?, updatedat = ? WHERE id = ?",
+		target, time.Now().UnixNano(), id,
+	)
+	return wrapPostErr(r, err, "Failed to execute update")
+}
+
+// SetPostExpiry sets the time that the post expires at, after which it is
+// hidden and then purged by the janitor. A zero time makes the post never
+// expire. Only the poster or an administrator over them can do this.
+func (d *Transaction) SetPostExpiry(id int64, at time.Time) error {
+	var expiresAt *int64
+
+	if !at.IsZero() {
+		if !at.After(time.Now()) {
+			return smolboard.ErrInvalidPostExpiry
+		}
+
+		n := at.UnixNano()
+		expiresAt = &n
+	}
+
+	if err := d.canChangePost(id); err != nil {
+		return err
+	}
+
+	r, err := d.Exec(
+		"UPDATE posts SET expiresat = ?, updatedat = ? WHERE id = ?",
+		expiresAt, time.Now().UnixNano(), id,
+	)
 	return wrapPostErr(r, err, "Failed to execute update")
 }
 
+// TransferPost makes the given user the post's poster. The post keeps its tags.
+// Only administrators can do this, and only if they outrank both the current
+// poster and the new one, so that posts can't be taken from or pushed onto
+// users that they couldn't otherwise change.
+func (d *Transaction) TransferPost(id int64, toUsername string) error {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	// Make sure that the new poster exists.
+	if _, err := d.User(toUsername); err != nil {
+		return err
+	}
+
+	var poster *string
+
+	err := d.
+		QueryRow("SELECT poster FROM posts WHERE id = ? AND "+postLive, id, time.Now().UnixNano()).
+		Scan(&poster)
+	if err != nil {
+		return wrapPostErr(nil, err, "Failed to scan for poster")
+	}
+
+	var from = ""
+	if poster != nil {
+		from = *poster
+	}
+
+	if err := d.canTransferPosts(from, toUsername); err != nil {
+		return err
+	}
+
+	r, err := d.Exec(
+		"UPDATE posts SET poster = ?, updatedat = ? WHERE id = ?",
+		toUsername, time.Now().UnixNano(), id,
+	)
+	if err := wrapPostErr(r, err, "Failed to execute transfer"); err != nil {
+		return err
+	}
+
+	if from == "" {
+		from = "nobody"
+	}
+
+	return d.auditf("post.transfer", strconv.FormatInt(id, 10), "from %s to %s", from, toUsername)
+}
+
+// canTransferPosts returns an error if the current user can't move posts from
+// the given poster to the given user. Posts without a poster can only be moved
+// by administrators.
+func (d *Transaction) canTransferPosts(fromUsername, toUsername string) error {
+	if err := d.requireOwnerOrPermission(fromUsername, smolboard.PermissionAdministrator); err != nil {
+		return err
+	}
+
+	return d.HasPermOverUser(smolboard.PermissionAdministrator, toUsername)
+}
+
+// TransferUserPosts makes the given user the poster of all posts of another
+// user, including the soft-deleted ones, such as to keep the posts of a user
+// that's about to be deleted. The number of transferred posts is returned. Only
+// administrators can do this, with the same restrictions as TransferPost.
+func (d *Transaction) TransferUserPosts(fromUsername, toUsername string) (int, error) {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return 0, err
+	}
+
+	if fromUsername == toUsername {
+		return 0, smolboard.ErrActionNotPermitted
+	}
+
+	if _, err := d.User(fromUsername); err != nil {
+		return 0, err
+	}
+
+	if _, err := d.User(toUsername); err != nil {
+		return 0, err
+	}
+
+	if err := d.canTransferPosts(fromUsername, toUsername); err != nil {
+		return 0, err
+	}
+
+	r, err := d.Exec(
+		"UPDATE posts SET poster = ?, updatedat = ? WHERE poster = ?",
+		toUsername, time.Now().UnixNano(), fromUsername,
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to transfer posts")
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get transferred posts")
+	}
+
+	err = d.auditf("user.transfer-posts", fromUsername, "%d posts to %s", n, toUsername)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// normalizeTags returns the normalized tags without duplicates.
+func normalizeTags(tags []string) []string {
+	var normalized = make([]string, 0, len(tags))
+	var seen = make(map[string]struct{}, len(tags))
+
+	for _, tag := range tags {
+		tag = smolboard.NormalizeTag(tag)
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		normalized = append(normalized, tag)
+	}
+
+	return normalized
+}
+
 func validTag(tag string) error {
 	return smolboard.TagIsValid(tag)
 }
@@ -355,12 +958,12 @@ func (d *Transaction) SearchTag(part string) ([]smolboard.PostTag, error) {
 	// SQL queries like these aren't the brightest idea.
 	t, err := d.Queryx(`
 		SELECT COUNT(1), posttags.tagname FROM posttags
-		JOIN   posttags AS posttags2 ON posttags2.tagname = posttags.tagname
-		WHERE  posttags2.tagname LIKE ? || '%'
+		JOIN   posts ON posts.id = posttags.postid
+		WHERE  posttags.tagname LIKE ? || '%' AND `+postLive+`
 		GROUP  BY posttags.tagname
 		ORDER  BY COUNT(1) DESC
 		LIMIT  25`,
-		part,
+		part, time.Now().UnixNano(),
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to query tags")
@@ -383,7 +986,54 @@ func (d *Transaction) SearchTag(part string) ([]smolboard.PostTag, error) {
 	return tags, nil
 }
 
+// TagPost adds the tag to the post. The tag is normalized first.
+// MaxTagStats is the maximum number of tags that TagStats returns.
+const MaxTagStats = 100
+
+// TagStats returns the tags used by the most posts that are visible to the
+// current user, along with their counts, from most to least used. Counts are
+// taken live, since they differ by who's looking. At most limit tags are
+// returned; limit is defaulted to 25.
+func (d *Transaction) TagStats(limit int) ([]smolboard.TagStat, error) {
+	if limit > MaxTagStats {
+		return nil, smolboard.ErrPageCountLimit
+	}
+	if limit <= 0 {
+		limit = 25
+	}
+
+	p, err := d.Permission()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats = []smolboard.TagStat{}
+
+	// Tags from before taggedat was recorded fall back to their post's time.
+	err = d.Select(&stats, `
+		SELECT
+			posttags.tagname AS tagname,
+			COUNT(*)         AS count,
+			MAX(CASE WHEN posttags.taggedat > 0
+				THEN posttags.taggedat ELSE posts.createdat END) AS lastused
+		FROM  posttags
+		JOIN  posts ON posts.id = posttags.postid
+		WHERE (posts.poster = ? OR posts.permission <= ?) AND `+postLive+`
+		GROUP BY posttags.tagname
+		ORDER BY count DESC, posttags.tagname ASC
+		LIMIT ?`,
+		d.Session.Username, p, time.Now().UnixNano(), limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query tag stats")
+	}
+
+	return stats, nil
+}
+
 func (d *Transaction) TagPost(postID int64, tag string) error {
+	tag = smolboard.NormalizeTag(tag)
+
 	if err := validTag(tag); err != nil {
 		return err
 	}
@@ -392,13 +1042,240 @@ func (d *Transaction) TagPost(postID int64, tag string) error {
 		return err
 	}
 
-	r, err := d.Exec("INSERT INTO posttags VALUES (?, ?)", postID, tag)
+	if d.config.MaxPostTags > 0 {
+		var count int
+
+		// The tag itself isn't counted, so adding a duplicate still errors out
+		// with ErrTagAlreadyAdded.
+		err := d.
+			QueryRow("SELECT COUNT(*) FROM posttags WHERE postid = ? AND tagname != ?", postID, tag).
+			Scan(&count)
+		if err != nil {
+			return errors.Wrap(err, "Failed to count tags")
+		}
+
+		if count >= d.config.MaxPostTags {
+			return smolboard.ErrTooManyTags
+		}
+	}
+
+	r, err := d.Exec(
+		"INSERT INTO posttags (postid, tagname, taggedat) VALUES (?, ?, ?)",
+		postID, tag, time.Now().UnixNano(),
+	)
 	if err != nil {
 		if errIsConstraint(err) {
 			return smolboard.ErrTagAlreadyAdded
 		}
 	}
-	return wrapPostErr(r, err, "Failed to execute insert tag")
+	if err := wrapPostErr(r, err, "Failed to execute insert tag"); err != nil {
+		return err
+	}
+
+	return d.touchPosts(postID)
+}
+
+// touchPosts bumps the update time of the given posts to now.
+func (d *Transaction) touchPosts(postIDs ...int64) error {
+	q, args, err := sqlx.In(
+		"UPDATE posts SET updatedat = ? WHERE id IN (?)",
+		time.Now().UnixNano(), postIDs,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to construct query")
+	}
+
+	if _, err := d.Exec(q, args...); err != nil {
+		return errors.Wrap(err, "Failed to update posts")
+	}
+
+	return nil
+}
+
+// bulkTagChunk is the number of rows inserted per statement. It is kept well
+// below SQLite's variable limit.
+const bulkTagChunk = 256
+
+// AddTagToPosts adds the tag to all given posts that the user can change.
+// Posts that don't exist, can't be changed by the user or already have the
+// maximum number of tags are skipped instead of failing the whole operation.
+// The tag is normalized first. The number of posts that were tagged is
+// returned.
+func (d *Transaction) AddTagToPosts(postIDs []int64, tag string) (int, error) {
+	tag = smolboard.NormalizeTag(tag)
+
+	if err := validTag(tag); err != nil {
+		return 0, err
+	}
+
+	ids, err := d.editablePosts(postIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err = d.postsUnderTagLimit(ids, tag)
+	if err != nil {
+		return 0, err
+	}
+
+	var updated int64
+
+	for len(ids) > 0 {
+		var chunk = ids
+		if len(chunk) > bulkTagChunk {
+			chunk = chunk[:bulkTagChunk]
+		}
+		ids = ids[len(chunk):]
+
+		var query strings.Builder
+		var args = make([]interface{}, 0, len(chunk)*3)
+		var now = time.Now().UnixNano()
+
+		query.WriteString("INSERT OR IGNORE INTO posttags (postid, tagname, taggedat) VALUES ")
+
+		for i, id := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(?, ?, ?)")
+			args = append(args, id, tag, now)
+		}
+
+		r, err := d.Exec(query.String(), args...)
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to insert tags")
+		}
+
+		n, err := r.RowsAffected()
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to get inserted tags")
+		}
+
+		// Only bump the chunk if any of its posts got the tag.
+		if n > 0 {
+			if err := d.touchPosts(chunk...); err != nil {
+				return 0, err
+			}
+		}
+
+		updated += n
+	}
+
+	return int(updated), nil
+}
+
+// postsUnderTagLimit filters the given post IDs down to the ones that can have
+// the tag added without going over MaxPostTags.
+func (d *Transaction) postsUnderTagLimit(postIDs []int64, tag string) ([]int64, error) {
+	if d.config.MaxPostTags == 0 || len(postIDs) == 0 {
+		return postIDs, nil
+	}
+
+	q, args, err := sqlx.In(`
+		SELECT postid FROM posttags
+			WHERE postid IN (?) AND tagname != ?
+			GROUP BY postid
+			HAVING COUNT(*) >= ?`,
+		postIDs, tag, d.config.MaxPostTags,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to construct query")
+	}
+
+	var full []int64
+
+	if err := d.Select(&full, q, args...); err != nil {
+		return nil, errors.Wrap(err, "Failed to count tags")
+	}
+
+	if len(full) == 0 {
+		return postIDs, nil
+	}
+
+	var isFull = make(map[int64]struct{}, len(full))
+	for _, id := range full {
+		isFull[id] = struct{}{}
+	}
+
+	var ids = postIDs[:0]
+	for _, id := range postIDs {
+		if _, ok := isFull[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// editablePosts filters the given post IDs down to the ones that the current
+// user can change. IDs of posts that don't exist are dropped.
+func (d *Transaction) editablePosts(postIDs []int64) ([]int64, error) {
+	if len(postIDs) == 0 {
+		return nil, smolboard.ErrNoPostsGiven
+	}
+	if len(postIDs) > smolboard.MaxBulkPosts {
+		return nil, smolboard.ErrTooManyPosts
+	}
+
+	p, err := d.Permission()
+	if err != nil {
+		return nil, err
+	}
+
+	q, args, err := sqlx.In(
+		"SELECT id, poster FROM posts WHERE id IN (?) AND "+postLive,
+		postIDs, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to construct query")
+	}
+
+	r, err := d.Queryx(q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query posts")
+	}
+
+	var posts []smolboard.Post
+
+	for r.Next() {
+		var post smolboard.Post
+
+		if err := r.Scan(&post.ID, &post.Poster); err != nil {
+			r.Close()
+			return nil, errors.Wrap(err, "Failed to scan post")
+		}
+
+		posts = append(posts, post)
+	}
+
+	r.Close()
+
+	// Cache the permissions of each poster, since the same posters often
+	// appear many times.
+	var perms = map[string]smolboard.Permission{}
+	var editable = make([]int64, 0, len(posts))
+
+	for _, post := range posts {
+		poster := post.GetPoster()
+
+		target, ok := perms[poster]
+		if !ok {
+			// Accept a -1 permission for deleted users.
+			target, _ = d.permission(poster)
+			perms[poster] = target
+		}
+
+		// Guests have an empty username, which would otherwise match posts
+		// from deleted users.
+		var isSelf = poster != "" && poster == d.Session.Username
+
+		err := p.IsUserOrHasPermOver(smolboard.PermissionAdministrator, target, isSelf)
+		if err == nil {
+			editable = append(editable, post.ID)
+		}
+	}
+
+	return editable, nil
 }
 
 func (d *Transaction) UntagPost(postID int64, tag string) error {
@@ -415,7 +1292,199 @@ func (d *Transaction) UntagPost(postID int64, tag string) error {
 		postID, tag,
 	)
 
-	return wrapPostErr(r, err, "Failed to execute delete tag")
+	if err := wrapPostErr(r, err, "Failed to execute delete tag"); err != nil {
+		return err
+	}
+
+	return d.touchPosts(postID)
+}
+
+// RenameTag renames the tag on all posts. Posts that already have the new tag
+// keep only one of them. Only administrators can do this.
+func (d *Transaction) RenameTag(from, to string) error {
+	if err := validTag(from); err != nil {
+		return err
+	}
+	if err := validTag(to); err != nil {
+		return err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	// The rename below would delete the tag otherwise.
+	if from == to {
+		return nil
+	}
+
+	n, err := d.mergeTag(from, to)
+	if err != nil {
+		return err
+	}
+
+	return d.auditf("tag.rename", from, "to %s on %d posts", to, n)
+}
+
+// NormalizeTags renames every tag that isn't in its normalized form, merging
+// it into the normalized tag if that already exists. Posts end up with only one
+// of each. Tags that would be invalid once normalized are left as they are. The
+// number of tags that were normalized is returned. Only administrators can do
+// this.
+func (d *Transaction) NormalizeTags() (int, error) {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return 0, err
+	}
+
+	var names []string
+
+	if err := d.Select(&names, "SELECT DISTINCT tagname FROM posttags"); err != nil {
+		return 0, errors.Wrap(err, "Failed to query tags")
+	}
+
+	var normalized int
+
+	for _, name := range names {
+		to := smolboard.NormalizeTag(name)
+		if to == name || validTag(to) != nil {
+			continue
+		}
+
+		if _, err := d.mergeTag(name, to); err != nil {
+			return 0, err
+		}
+
+		normalized++
+	}
+
+	if normalized == 0 {
+		return 0, nil
+	}
+
+	if err := d.auditf("tag.normalize", "", "%d tags", normalized); err != nil {
+		return 0, err
+	}
+
+	return normalized, nil
+}
+
+// normalizeStoredTags normalizes all tags like NormalizeTags, except posts are
+// not touched and nothing is audited. It is run once as a migration, so that
+// tags stored before they were normalized on write can still be searched for.
+func normalizeStoredTags(tx *sql.Tx) error {
+	r, err := tx.Query("SELECT DISTINCT tagname FROM posttags")
+	if err != nil {
+		return errors.Wrap(err, "Failed to query tags")
+	}
+
+	var names []string
+
+	for r.Next() {
+		var name string
+		if err := r.Scan(&name); err != nil {
+			r.Close()
+			return errors.Wrap(err, "Failed to scan tag")
+		}
+		names = append(names, name)
+	}
+
+	r.Close()
+
+	if err := r.Err(); err != nil {
+		return errors.Wrap(err, "Failed to query tags")
+	}
+
+	for _, name := range names {
+		to := smolboard.NormalizeTag(name)
+		if to == name || validTag(to) != nil {
+			continue
+		}
+
+		// Same as mergeTag.
+		_, err := tx.Exec("UPDATE OR IGNORE posttags SET tagname = ? WHERE tagname = ?", to, name)
+		if err != nil {
+			return errors.Wrap(err, "Failed to rename tag")
+		}
+
+		if _, err := tx.Exec("DELETE FROM posttags WHERE tagname = ?", name); err != nil {
+			return errors.Wrap(err, "Failed to delete merged tags")
+		}
+	}
+
+	return nil
+}
+
+// mergeTag renames the tag on all posts to another, bumping their update time.
+// The number of posts is returned. ErrTagNotFound is returned if no post has
+// the tag.
+func (d *Transaction) mergeTag(from, to string) (int64, error) {
+	n, err := d.touchTagged(from)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rows that would become duplicates are skipped, then deleted along with
+	// the rest of the old tag.
+	_, err = d.Exec(
+		"UPDATE OR IGNORE posttags SET tagname = ? WHERE tagname = ?",
+		to, from,
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to rename tag")
+	}
+
+	_, err = d.Exec("DELETE FROM posttags WHERE tagname = ?", from)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to delete merged tags")
+	}
+
+	return n, nil
+}
+
+// DeleteTagEverywhere removes the tag from all posts. Only administrators can
+// do this.
+func (d *Transaction) DeleteTagEverywhere(tag string) error {
+	if err := validTag(tag); err != nil {
+		return err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	n, err := d.touchTagged(tag)
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.Exec("DELETE FROM posttags WHERE tagname = ?", tag); err != nil {
+		return errors.Wrap(err, "Failed to delete tag")
+	}
+
+	return d.auditf("tag.delete", tag, "from %d posts", n)
+}
+
+// touchTagged bumps the update time of all posts with the tag to now. The
+// number of posts is returned. ErrTagNotFound is returned if there's none.
+func (d *Transaction) touchTagged(tag string) (int64, error) {
+	r, err := d.Exec(
+		`UPDATE posts SET updatedat = ?
+			WHERE id IN (SELECT postid FROM posttags WHERE tagname = ?)`,
+		time.Now().UnixNano(), tag,
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to update posts")
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get updated posts")
+	}
+	if n == 0 {
+		return 0, smolboard.ErrTagNotFound
+	}
+
+	return n, nil
 }
 
 func wrapPostErr(r sql.Result, err error, wrap string) error {
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/go-test/deep"
@@ -176,6 +178,14 @@ func TestNormalUploadedPosts(t *testing.T) {
 			if err := tx.SetPostPermission(post.ID, post.Permission); err != nil {
 				t.Fatal("Failed to set post to admin:", err)
 			}
+
+			// Fetch the bumped update time.
+			q, err := tx.Post(post.ID)
+			if err != nil {
+				t.Fatal("Failed to query post:", err)
+			}
+
+			posts[i].UpdatedAt = q.UpdatedAt
 		}
 	})
 
@@ -267,7 +277,7 @@ func TestPostPermissions(t *testing.T) {
 			t.Run("DeleteSelfPost", func(t *testing.T) {
 				tx := testBeginTx(t, d, authToken)
 
-				if err := tx.DeletePost(p.ID); err != nil {
+				if err := tx.DeletePost(p.ID, false); err != nil {
 					t.Fatal("Failed to delete post:", err)
 				}
 			})
@@ -347,50 +357,50 @@ var _testPostTags = []string{
 	":o",
 	"armband",
 	"bangs",
-	"blue eyes",
+	"blue_eyes",
 	"blush",
 	"bow",
 	"bowtie",
-	"brown sweater",
+	"brown_sweater",
 	"buttons",
-	"collared shirt",
-	"dress shirt",
-	"eyebrows visible through hair",
-	"finger to cheek",
-	"grey skirt",
-	"hair between eyes",
-	"hair ribbon",
-	"long hair",
-	"long sleeves",
-	"looking at viewer",
-	"male focus",
-	"otoko no ko",
-	"parted bangs",
-	"pink background",
-	"pink hair",
+	"collared_shirt",
+	"dress_shirt",
+	"eyebrows_visible_through_hair",
+	"finger_to_cheek",
+	"grey_skirt",
+	"hair_between_eyes",
+	"hair_ribbon",
+	"long_hair",
+	"long_sleeves",
+	"looking_at_viewer",
+	"male_focus",
+	"otoko_no_ko",
+	"parted_bangs",
+	"pink_background",
+	"pink_hair",
 	"plaid",
-	"plaid skirt",
-	"pleated skirt",
-	"red bow",
-	"red neckwear",
-	"red ribbon",
+	"plaid_skirt",
+	"pleated_skirt",
+	"red_bow",
+	"red_neckwear",
+	"red_ribbon",
 	"ribbon",
-	"school uniform",
+	"school_uniform",
 	"shiny",
-	"shiny hair",
+	"shiny_hair",
 	"shirt",
 	"sidelocks",
 	"skirt",
 	"solo",
-	"sparkle background",
+	"sparkle_background",
 	"standing",
 	"sweater",
-	"sweater vest",
-	"two side up",
+	"sweater_vest",
+	"two_side_up",
 	"v-neck",
-	"white background",
-	"white shirt",
-	"wing collar",
+	"white_background",
+	"white_shirt",
+	"wing_collar",
 }
 
 func TestPostTags(t *testing.T) {
@@ -423,6 +433,11 @@ func TestPostTags(t *testing.T) {
 		t.Fatal("Failed to query post:", err)
 	}
 
+	if q.UpdatedAt <= p.UpdatedAt {
+		t.Fatal("Tagging did not bump the post's update time")
+	}
+	p.UpdatedAt = q.UpdatedAt
+
 	if eq := deep.Equal(q.Post, p); eq != nil {
 		t.Fatal("Post mismatch:", eq)
 	}
@@ -452,7 +467,7 @@ func TestPostTags(t *testing.T) {
 	}
 
 Search:
-	for _, tag := range []string{"shiny", "shiny hair", "shirt"} {
+	for _, tag := range []string{"shiny", "shiny_hair", "shirt"} {
 		for _, search := range s {
 			if search.TagName == tag {
 				continue Search
@@ -489,6 +504,178 @@ Search:
 	}
 }
 
+func TestPostTagBulk(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var ownerPosts = make([]smolboard.Post, 3)
+	var userPosts = make([]smolboard.Post, 2)
+
+	var savePosts = func(t *testing.T, token string, posts []smolboard.Post) {
+		tx := testBeginTx(t, d, token)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+		}
+	}
+
+	t.Run("CreateOwnerPosts", func(t *testing.T) {
+		savePosts(t, owner.AuthToken, ownerPosts)
+	})
+
+	t.Run("CreateUserPosts", func(t *testing.T) {
+		savePosts(t, user.AuthToken, userPosts)
+	})
+
+	var ids []int64
+	for _, post := range append(ownerPosts, userPosts...) {
+		ids = append(ids, post.ID)
+	}
+	// Throw in a post that doesn't exist.
+	ids = append(ids, 1)
+
+	t.Run("Partial", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		// The user can only tag their own posts; the rest are skipped.
+		n, err := tx.AddTagToPosts(ids, "bulk")
+		if err != nil {
+			t.Fatal("Failed to bulk tag:", err)
+		}
+
+		if n != len(userPosts) {
+			t.Fatal("Unexpected updated count:", n)
+		}
+
+		for _, post := range userPosts {
+			if err := tx.TagPost(post.ID, "bulk"); !errors.Is(err, smolboard.ErrTagAlreadyAdded) {
+				t.Fatal("User post not tagged:", err)
+			}
+		}
+	})
+
+	t.Run("Owner", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		// User posts already have the tag, so only the owner's are counted.
+		n, err := tx.AddTagToPosts(ids, "bulk")
+		if err != nil {
+			t.Fatal("Failed to bulk tag:", err)
+		}
+
+		if n != len(ownerPosts) {
+			t.Fatal("Unexpected updated count:", n)
+		}
+
+		r, err := tx.SearchTag("bulk")
+		if err != nil {
+			t.Fatal("Failed to search tag:", err)
+		}
+
+		if len(r) != 1 || r[0].Count != len(ownerPosts)+len(userPosts) {
+			t.Fatalf("Unexpected tag search result: %#v", r)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if _, err := tx.AddTagToPosts(nil, "bulk"); !errors.Is(err, smolboard.ErrNoPostsGiven) {
+			t.Fatal("Unexpected error tagging no posts:", err)
+		}
+
+		var many = make([]int64, smolboard.MaxBulkPosts+1)
+		if _, err := tx.AddTagToPosts(many, "bulk"); !errors.Is(err, smolboard.ErrTooManyPosts) {
+			t.Fatal("Unexpected error tagging too many posts:", err)
+		}
+
+		if _, err := tx.AddTagToPosts(ids, ""); !errors.Is(err, smolboard.ErrEmptyTag) {
+			t.Fatal("Unexpected error tagging with an empty tag:", err)
+		}
+	})
+}
+
+func TestPostDeleteBulk(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var ownerPost = NewEmptyPost("image/png")
+	ownerPost.Size = 1
+	var userPost = NewEmptyPost("image/png")
+	userPost.Size = 1
+
+	t.Run("CreateOwnerPost", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.SavePost(&ownerPost); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+	})
+
+	t.Run("CreateUserPost", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if err := tx.SavePost(&userPost); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		var ids = []int64{ownerPost.ID, userPost.ID, 1}
+
+		r, deleted, err := tx.DeletePosts(ids, false)
+		if err != nil {
+			t.Fatal("Failed to bulk delete:", err)
+		}
+
+		var expect = []smolboard.BulkPostResult{
+			{ID: ownerPost.ID, Error: "action not permitted", Slug: "action-not-permitted"},
+			{ID: userPost.ID},
+			{ID: 1, Error: "post not found", Slug: "post-not-found"},
+		}
+
+		if eq := deep.Equal(r, expect); eq != nil {
+			t.Fatal("Unexpected results:", eq)
+		}
+
+		if len(deleted) != 1 || deleted[0].ID != userPost.ID {
+			t.Fatalf("Unexpected deleted posts: %#v", deleted)
+		}
+
+		if _, err := tx.PostQuickGet(userPost.ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Deleted post is still visible:", err)
+		}
+
+		if _, _, err := tx.DeletePosts(nil, false); !errors.Is(err, smolboard.ErrNoPostsGiven) {
+			t.Fatal("Unexpected error deleting no posts:", err)
+		}
+	})
+
+	t.Run("Owner", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		r, _, err := tx.DeletePosts([]int64{ownerPost.ID}, true)
+		if err != nil {
+			t.Fatal("Failed to bulk delete:", err)
+		}
+
+		if len(r) != 1 || !r[0].OK() {
+			t.Fatalf("Unexpected results: %#v", r)
+		}
+	})
+}
+
 func TestPostSearch(t *testing.T) {
 	d := newTestDatabase(t)
 
@@ -513,6 +700,13 @@ func TestPostSearch(t *testing.T) {
 		}
 	}
 
+	// Fetch the bumped update time.
+	q, err := tx.Post(p.ID)
+	if err != nil {
+		t.Fatal("Failed to query post:", err)
+	}
+	p.UpdatedAt = q.UpdatedAt
+
 	sliceEq := func(t *testing.T, s smolboard.SearchResults) {
 		t.Helper()
 
@@ -569,3 +763,1259 @@ func TestPostSearch(t *testing.T) {
 		sliceEq(t, s)
 	})
 }
+
+func TestPostSoftDelete(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	s := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var posts = make([]smolboard.Post, 3)
+
+	t.Run("CreatePosts", func(t *testing.T) {
+		tx := testBeginTx(t, d, s.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+			if err := tx.TagPost(posts[i].ID, "soft"); err != nil {
+				t.Fatal("Failed to tag post:", err)
+			}
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		tx := testBeginTx(t, d, s.AuthToken)
+
+		if err := tx.DeletePost(posts[0].ID, false); err != nil {
+			t.Fatal("Failed to soft-delete post:", err)
+		}
+		if err := tx.DeletePost(posts[1].ID, false); err != nil {
+			t.Fatal("Failed to soft-delete post:", err)
+		}
+
+		if _, err := tx.Post(posts[0].ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error getting deleted post:", err)
+		}
+
+		r, err := tx.PostSearch("soft", 100, 0)
+		if err != nil {
+			t.Fatal("Failed to search posts:", err)
+		}
+		if r.Total != 1 || len(r.Posts) != 1 || r.Posts[0].ID != posts[2].ID {
+			t.Fatalf("Unexpected search results after deleting: %#v", r)
+		}
+
+		// The tag count should not include deleted posts.
+		tags, err := tx.SearchTag("soft")
+		if err != nil {
+			t.Fatal("Failed to search tags:", err)
+		}
+		if len(tags) != 1 || tags[0].Count != 1 {
+			t.Fatalf("Unexpected tags after deleting: %#v", tags)
+		}
+	})
+
+	t.Run("RestoreDenied", func(t *testing.T) {
+		u := newTestUser(t, d, owner.AuthToken, "いとうまお", smolboard.PermissionTrusted)
+		tx := testBeginTx(t, d, u.AuthToken)
+
+		if err := tx.RestorePost(posts[0].ID); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error restoring someone else's post:", err)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		tx := testBeginTx(t, d, s.AuthToken)
+
+		if err := tx.RestorePost(posts[0].ID); err != nil {
+			t.Fatal("Failed to restore post:", err)
+		}
+
+		if _, err := tx.Post(posts[0].ID); err != nil {
+			t.Fatal("Failed to get restored post:", err)
+		}
+
+		if err := tx.RestorePost(posts[0].ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error restoring a non-deleted post:", err)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		d.Config.deletedPostLifespan = 0
+
+		purged, err := d.PurgeDeletedPosts(context.Background())
+		if err != nil {
+			t.Fatal("Failed to purge posts:", err)
+		}
+
+		if len(purged) != 1 || purged[0].ID != posts[1].ID {
+			t.Fatalf("Unexpected purged posts: %#v", purged)
+		}
+
+		tx := testBeginTx(t, d, s.AuthToken)
+
+		if err := tx.RestorePost(posts[1].ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error restoring purged post:", err)
+		}
+	})
+
+	t.Run("HardDelete", func(t *testing.T) {
+		tx := testBeginTx(t, d, s.AuthToken)
+
+		if err := tx.DeletePost(posts[2].ID, true); err != nil {
+			t.Fatal("Failed to hard-delete post:", err)
+		}
+
+		if err := tx.RestorePost(posts[2].ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error restoring hard-deleted post:", err)
+		}
+	})
+
+	t.Run("PurgeSoftDeleted", func(t *testing.T) {
+		tx := testBeginTx(t, d, s.AuthToken)
+
+		var post = NewEmptyPost("image/png")
+		post.Size = 1
+
+		if err := tx.SavePost(&post); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+		if err := tx.DeletePost(post.ID, false); err != nil {
+			t.Fatal("Failed to soft-delete post:", err)
+		}
+
+		p, err := tx.PurgePost(post.ID)
+		if err != nil {
+			t.Fatal("Failed to purge soft-deleted post:", err)
+		}
+		if p.ID != post.ID || p.DeletedAt == nil {
+			t.Fatalf("Unexpected purged post: %#v", p)
+		}
+
+		if err := tx.RestorePost(post.ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error restoring purged post:", err)
+		}
+	})
+}
+
+func TestPostExpiry(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var posts = make([]smolboard.Post, 2)
+	var ttl = 200 * time.Millisecond
+
+	t.Run("Create", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+		}
+
+		var expiresAt = time.Now().Add(ttl).UnixNano()
+		posts[0].ExpiresAt = &expiresAt
+
+		for i := range posts {
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+		}
+
+		r, err := tx.Posts(25, 0)
+		if err != nil {
+			t.Fatal("Failed to list posts:", err)
+		}
+
+		if len(r.Posts) != 2 {
+			t.Fatalf("Unexpected posts before expiry: %#v", r.Posts)
+		}
+	})
+
+	t.Run("NotOwner", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if err := tx.SetPostExpiry(posts[1].ID, time.Now().Add(time.Hour)); err == nil {
+			t.Fatal("Unexpected success setting the expiry of another user's post")
+		}
+	})
+
+	t.Run("Set", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.SetPostExpiry(posts[1].ID, time.Now().Add(-time.Hour)); !errors.Is(err, smolboard.ErrInvalidPostExpiry) {
+			t.Fatal("Unexpected error setting an expiry in the past:", err)
+		}
+
+		if err := tx.SetPostExpiry(posts[1].ID, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal("Failed to set post expiry:", err)
+		}
+
+		if err := tx.SetPostExpiry(posts[1].ID, time.Time{}); err != nil {
+			t.Fatal("Failed to clear post expiry:", err)
+		}
+
+		p, err := tx.Post(posts[1].ID)
+		if err != nil {
+			t.Fatal("Failed to get post:", err)
+		}
+
+		if p.ExpiresAt != nil {
+			t.Fatal("Post still expires at", *p.ExpiresAt)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		<-time.After(ttl)
+
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		r, err := tx.Posts(25, 0)
+		if err != nil {
+			t.Fatal("Failed to list posts:", err)
+		}
+
+		if len(r.Posts) != 1 || r.Posts[0].ID != posts[1].ID {
+			t.Fatalf("Unexpected posts after expiry: %#v", r.Posts)
+		}
+
+		if _, err := tx.Post(posts[0].ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error getting expired post:", err)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		purged, err := d.PurgeDeletedPosts(context.Background())
+		if err != nil {
+			t.Fatal("Failed to purge posts:", err)
+		}
+
+		if len(purged) != 1 || purged[0].ID != posts[0].ID {
+			t.Fatalf("Unexpected purged posts: %#v", purged)
+		}
+
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		missing, err := tx.MissingPostIDs([]int64{posts[0].ID, posts[1].ID})
+		if err != nil {
+			t.Fatal("Failed to get missing posts:", err)
+		}
+
+		if len(missing) != 1 || missing[0] != posts[0].ID {
+			t.Fatalf("Unexpected missing posts after purge: %v", missing)
+		}
+	})
+}
+
+func TestPostTimestamps(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	var posts = make([]smolboard.Post, 2)
+
+	for i := range posts {
+		posts[i] = NewEmptyPost("image/png")
+		posts[i].Size = 1
+
+		if err := tx.SavePost(&posts[i]); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+
+		if posts[i].CreatedAt == 0 || posts[i].UpdatedAt != posts[i].CreatedAt {
+			t.Fatalf("Unexpected timestamps on new post: %#v", posts[i])
+		}
+	}
+
+	var p = posts[0]
+
+	// expectBumped checks that the post's update time moved forward while its
+	// creation time stayed the same.
+	expectBumped := func(t *testing.T) {
+		t.Helper()
+
+		q, err := tx.Post(p.ID)
+		if err != nil {
+			t.Fatal("Failed to query post:", err)
+		}
+
+		if q.CreatedAt != p.CreatedAt {
+			t.Fatalf("Creation time changed from %d to %d", p.CreatedAt, q.CreatedAt)
+		}
+
+		if q.UpdatedAt <= p.UpdatedAt {
+			t.Fatalf("Update time not bumped from %d, got %d", p.UpdatedAt, q.UpdatedAt)
+		}
+
+		p.UpdatedAt = q.UpdatedAt
+	}
+
+	t.Run("SetPermission", func(t *testing.T) {
+		if err := tx.SetPostPermission(p.ID, smolboard.PermissionTrusted); err != nil {
+			t.Fatal("Failed to set permission:", err)
+		}
+		expectBumped(t)
+	})
+
+	t.Run("Tag", func(t *testing.T) {
+		if err := tx.TagPost(p.ID, "shiny"); err != nil {
+			t.Fatal("Failed to tag post:", err)
+		}
+		expectBumped(t)
+	})
+
+	t.Run("TagBulk", func(t *testing.T) {
+		if _, err := tx.AddTagToPosts([]int64{p.ID}, "shirt"); err != nil {
+			t.Fatal("Failed to bulk tag post:", err)
+		}
+		expectBumped(t)
+	})
+
+	t.Run("Untag", func(t *testing.T) {
+		if err := tx.UntagPost(p.ID, "shiny"); err != nil {
+			t.Fatal("Failed to untag post:", err)
+		}
+		expectBumped(t)
+	})
+
+	t.Run("NewestFirst", func(t *testing.T) {
+		r, err := tx.Posts(25, 0)
+		if err != nil {
+			t.Fatal("Failed to get posts:", err)
+		}
+
+		if len(r.Posts) != 2 || r.Posts[0].ID != posts[1].ID || r.Posts[1].ID != p.ID {
+			t.Fatalf("Unexpected posts order: %#v", r.Posts)
+		}
+	})
+}
+
+func TestPostsAfter(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	newPost := func(t *testing.T) smolboard.Post {
+		t.Helper()
+
+		p := NewEmptyPost("image/png")
+		p.Size = 1
+
+		if err := tx.SavePost(&p); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+
+		return p
+	}
+
+	var posts = map[int64]bool{}
+	for i := 0; i < 10; i++ {
+		posts[newPost(t).ID] = false
+	}
+
+	var cursor string
+	var pages int
+
+	for {
+		p, next, err := tx.PostsAfter(cursor, 3)
+		if err != nil {
+			t.Fatal("Failed to get posts:", err)
+		}
+
+		for _, post := range p {
+			seen, ok := posts[post.ID]
+			if !ok {
+				t.Fatal("Unexpected post inserted after the first page:", post.ID)
+			}
+			if seen {
+				t.Fatal("Duplicate post:", post.ID)
+			}
+			posts[post.ID] = true
+		}
+
+		// Insert a new post in the middle of the pagination. An offset
+		// would've shifted the next page by one.
+		if pages++; pages == 1 {
+			newPost(t)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	for id, seen := range posts {
+		if !seen {
+			t.Error("Skipped post:", id)
+		}
+	}
+
+	if pages != 4 {
+		t.Fatal("Unexpected page count:", pages)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, cursor := range []string{"!!", "bm9wZQ"} {
+			_, _, err := tx.PostsAfter(cursor, 3)
+			if !errors.Is(err, smolboard.ErrInvalidCursor) {
+				t.Fatalf("Unexpected error for cursor %q: %v", cursor, err)
+			}
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		r, err := tx.Posts(25, 0)
+		if err != nil {
+			t.Fatal("Failed to get posts:", err)
+		}
+
+		var ids = make([]int64, len(r.Posts))
+		for i, post := range r.Posts {
+			ids[i] = post.ID
+		}
+
+		if _, err := tx.AddTagToPosts(ids, "shiny"); err != nil {
+			t.Fatal("Failed to tag posts:", err)
+		}
+
+		r, err = tx.PostSearchAfter("shiny", "", 6)
+		if err != nil {
+			t.Fatal("Failed to search:", err)
+		}
+
+		if len(r.Posts) != 6 || r.Cursor == "" {
+			t.Fatalf("Unexpected first page: %d posts", len(r.Posts))
+		}
+
+		r, err = tx.PostSearchAfter("shiny", r.Cursor, 6)
+		if err != nil {
+			t.Fatal("Failed to search:", err)
+		}
+
+		// The total still counts the posts before the cursor.
+		if len(r.Posts) != 5 || r.Total != 11 || r.Cursor != "" {
+			t.Fatalf("Unexpected last page: %d posts, %d total", len(r.Posts), r.Total)
+		}
+	})
+}
+
+func TestPostPages(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	for i := 0; i < 6; i++ {
+		p := NewEmptyPost("image/png")
+		p.Size = 1
+
+		if err := tx.SavePost(&p); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+	}
+
+	// The second page is exactly full, which must not be mistaken for there
+	// being more posts.
+	var pages = []smolboard.Page{
+		{Total: 6, Offset: 0, Limit: 3, HasMore: true},
+		{Total: 6, Offset: 3, Limit: 3, HasMore: false},
+	}
+
+	for i, expect := range pages {
+		r, err := tx.Posts(3, uint(i))
+		if err != nil {
+			t.Fatal("Failed to get posts:", err)
+		}
+
+		if len(r.Posts) != 3 {
+			t.Fatalf("Unexpected post count on page %d: %d", i, len(r.Posts))
+		}
+
+		if diff := deep.Equal(r.Page, expect); diff != nil {
+			t.Fatalf("Unexpected page %d: %v", i, diff)
+		}
+
+		if (r.Cursor != "") != expect.HasMore {
+			t.Fatalf("Unexpected cursor on page %d: %q", i, r.Cursor)
+		}
+	}
+}
+
+func TestPostTagLimit(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.MaxPostTags = 2
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	var posts = make([]smolboard.Post, 2)
+	for i := range posts {
+		posts[i] = NewEmptyPost("image/png")
+		posts[i].Size = 1
+
+		if err := tx.SavePost(&posts[i]); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+	}
+
+	for _, tag := range []string{"shiny", "shirt"} {
+		if err := tx.TagPost(posts[0].ID, tag); err != nil {
+			t.Fatalf("Failed to tag %q post: %v", tag, err)
+		}
+	}
+
+	if err := tx.TagPost(posts[0].ID, "hair"); !errors.Is(err, smolboard.ErrTooManyTags) {
+		t.Fatal("Unexpected error tagging over the limit:", err)
+	}
+
+	// Existing tags are still reported as duplicates.
+	if err := tx.TagPost(posts[0].ID, "shiny"); !errors.Is(err, smolboard.ErrTagAlreadyAdded) {
+		t.Fatal("Unexpected error adding duplicate tag:", err)
+	}
+
+	// The full post is skipped.
+	n, err := tx.AddTagToPosts([]int64{posts[0].ID, posts[1].ID}, "hair")
+	if err != nil {
+		t.Fatal("Failed to bulk tag:", err)
+	}
+	if n != 1 {
+		t.Fatal("Unexpected updated count:", n)
+	}
+
+	p, err := tx.Post(posts[0].ID)
+	if err != nil {
+		t.Fatal("Failed to get post:", err)
+	}
+	if len(p.Tags) != 2 {
+		t.Fatal("Unexpected tags on full post:", p.Tags)
+	}
+
+	var illegal = map[string]error{
+		"":          smolboard.ErrEmptyTag,
+		"@hime":     smolboard.ErrIllegalTag,
+		"new\nline": smolboard.ErrIllegalTag,
+		strings.Repeat("a", smolboard.MaxTagLen+1): smolboard.ErrTagTooLong,
+	}
+
+	for tag, expect := range illegal {
+		if err := tx.TagPost(posts[1].ID, tag); !errors.Is(err, expect) {
+			t.Errorf("Unexpected error tagging %q: %v", tag, err)
+		}
+	}
+}
+
+func TestPostTagRename(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionTrusted)
+
+	var posts = make([]smolboard.Post, 3)
+
+	// tags returns the sorted tags of the post.
+	var tags = func(t *testing.T, tx *Transaction, id int64) []string {
+		t.Helper()
+
+		var tags []string
+		err := tx.Select(&tags, "SELECT tagname FROM posttags WHERE postid = ? ORDER BY tagname", id)
+		if err != nil {
+			t.Fatal("Failed to get tags:", err)
+		}
+		return tags
+	}
+
+	t.Run("CreatePosts", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		// The first post only has the typo, the second has both tags, and the
+		// third only has the right one.
+		var postTags = [][]string{
+			{"ひめ", "catgril"},
+			{"catgril", "catgirl"},
+			{"catgirl"},
+		}
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+
+			for _, tag := range postTags[i] {
+				if err := tx.TagPost(posts[i].ID, tag); err != nil {
+					t.Fatal("Failed to tag post:", err)
+				}
+			}
+		}
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if err := tx.RenameTag("catgril", "catgirl"); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error renaming as a trusted user:", err)
+		}
+		if err := tx.DeleteTagEverywhere("catgril"); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error deleting as a trusted user:", err)
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.RenameTag("catgril", "catgirl"); err != nil {
+			t.Fatal("Failed to rename tag:", err)
+		}
+
+		var expect = [][]string{
+			{"catgirl", "ひめ"},
+			{"catgirl"},
+			{"catgirl"},
+		}
+
+		for i, post := range posts {
+			if eq := deep.Equal(tags(t, tx, post.ID), expect[i]); eq != nil {
+				t.Errorf("Unexpected tags on post %d: %v", i, eq)
+			}
+		}
+
+		if err := tx.RenameTag("catgril", "catgirl"); !errors.Is(err, smolboard.ErrTagNotFound) {
+			t.Fatal("Unexpected error renaming a tag that's gone:", err)
+		}
+
+		entries, err := tx.AuditLog(0, 1)
+		if err != nil {
+			t.Fatal("Failed to get audit log:", err)
+		}
+		if len(entries) != 1 || entries[0].Action != "tag.rename" || entries[0].Target != "catgril" {
+			t.Fatalf("Unexpected audit log: %#v", entries)
+		}
+	})
+
+	t.Run("Case", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		// Renaming to a different case must not drop the tag.
+		if err := tx.RenameTag("catgirl", "Catgirl"); err != nil {
+			t.Fatal("Failed to rename tag:", err)
+		}
+
+		for _, post := range posts {
+			if tags := tags(t, tx, post.ID); tags[0] != "Catgirl" {
+				t.Fatalf("Unexpected tags on post %d: %v", post.ID, tags)
+			}
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.DeleteTagEverywhere("Catgirl"); err != nil {
+			t.Fatal("Failed to delete tag:", err)
+		}
+
+		if eq := deep.Equal(tags(t, tx, posts[0].ID), []string{"ひめ"}); eq != nil {
+			t.Error("Unexpected tags on the first post:", eq)
+		}
+
+		for _, post := range posts[1:] {
+			if tags := tags(t, tx, post.ID); len(tags) > 0 {
+				t.Errorf("Unexpected tags on post %d: %v", post.ID, tags)
+			}
+		}
+
+		entries, err := tx.AuditLog(0, 1)
+		if err != nil {
+			t.Fatal("Failed to get audit log:", err)
+		}
+		if len(entries) != 1 || entries[0].Action != "tag.delete" {
+			t.Fatalf("Unexpected audit log: %#v", entries)
+		}
+	})
+}
+
+func TestPostTagNormalize(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionTrusted)
+
+	var posts = make([]smolboard.Post, 3)
+
+	// tags returns the sorted tags of the post.
+	var tags = func(t *testing.T, tx *Transaction, id int64) []string {
+		t.Helper()
+
+		var tags []string
+		err := tx.Select(&tags, "SELECT tagname FROM posttags WHERE postid = ? ORDER BY tagname", id)
+		if err != nil {
+			t.Fatal("Failed to get tags:", err)
+		}
+		return tags
+	}
+
+	t.Run("Write", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+		}
+
+		if err := tx.TagPost(posts[0].ID, "  Cat   Ears "); err != nil {
+			t.Fatal("Failed to tag post:", err)
+		}
+
+		if err := tx.TagPost(posts[0].ID, "CAT EARS"); !errors.Is(err, smolboard.ErrTagAlreadyAdded) {
+			t.Fatal("Unexpected error adding tag differing by case:", err)
+		}
+
+		if _, err := tx.AddTagToPosts([]int64{posts[0].ID, posts[1].ID}, "Shiny "); err != nil {
+			t.Fatal("Failed to bulk tag posts:", err)
+		}
+
+		if eq := deep.Equal(tags(t, tx, posts[0].ID), []string{"cat_ears", "shiny"}); eq != nil {
+			t.Fatal("Unexpected normalized tags:", eq)
+		}
+
+		if err := tx.TagPost(posts[0].ID, "new \nline"); !errors.Is(err, smolboard.ErrIllegalTag) {
+			t.Fatal("Unexpected error tagging with a newline:", err)
+		}
+
+		s, err := tx.PostSearch(`"Cat Ears" SHINY shiny`, 25, 0)
+		if err != nil {
+			t.Fatal("Failed to search posts:", err)
+		}
+
+		if len(s.Posts) != 1 || s.Posts[0].ID != posts[0].ID {
+			t.Fatalf("Unexpected search results: %#v", s.Posts)
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		// Insert tags from before they were normalized. The second post has
+		// two duplicates of the same tag.
+		var rows = [][2]interface{}{
+			{posts[1].ID, "Cat"},
+			{posts[1].ID, "cat "},
+			{posts[2].ID, "cat"},
+			{posts[2].ID, "Blue  Eyes"},
+		}
+
+		for _, row := range rows {
+			if _, err := tx.Exec("INSERT INTO posttags (postid, tagname) VALUES (?, ?)", row[0], row[1]); err != nil {
+				t.Fatal("Failed to insert tag:", err)
+			}
+		}
+
+		n, err := tx.NormalizeTags()
+		if err != nil {
+			t.Fatal("Failed to normalize tags:", err)
+		}
+
+		if n != 3 {
+			t.Fatalf("Unexpected number of normalized tags: %d", n)
+		}
+
+		if eq := deep.Equal(tags(t, tx, posts[1].ID), []string{"cat", "shiny"}); eq != nil {
+			t.Error("Unexpected tags on the second post:", eq)
+		}
+
+		if eq := deep.Equal(tags(t, tx, posts[2].ID), []string{"blue_eyes", "cat"}); eq != nil {
+			t.Error("Unexpected tags on the third post:", eq)
+		}
+
+		n, err = tx.NormalizeTags()
+		if err != nil {
+			t.Fatal("Failed to normalize tags again:", err)
+		}
+
+		if n != 0 {
+			t.Fatalf("Unexpected number of tags normalized again: %d", n)
+		}
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if _, err := tx.NormalizeTags(); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error normalizing as a trusted user:", err)
+		}
+	})
+}
+
+func TestMigrateNormalizeTags(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	var post = NewEmptyPost("image/png")
+	post.Size = 1
+
+	err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+		if err := tx.SavePost(&post); err != nil {
+			return err
+		}
+
+		// Tags from before they were normalized on write.
+		for _, tag := range []string{"Blue  Eyes", "Cat"} {
+			_, err := tx.Exec("INSERT INTO posttags (postid, tagname) VALUES (?, ?)", post.ID, tag)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Failed to create post:", err)
+	}
+
+	if err := d.migrate(len(migrations) - 1); err != nil {
+		t.Fatal("Failed to migrate:", err)
+	}
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	s, err := tx.PostSearch(`"Blue Eyes" Cat`, 25, 0)
+	if err != nil {
+		t.Fatal("Failed to search posts:", err)
+	}
+
+	if len(s.Posts) != 1 || s.Posts[0].ID != post.ID {
+		t.Fatalf("Unexpected search results after migrating: %#v", s.Posts)
+	}
+}
+
+func TestPostByHash(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var public = strings.Repeat("a", 64)
+	var private = strings.Repeat("b", 64)
+
+	var first smolboard.Post
+
+	t.Run("Setup", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		for _, hash := range []string{public, public, private} {
+			p := NewEmptyPost("image/png")
+			p.Size = 1
+			p.ContentHash = hash
+
+			if hash == private {
+				p.Permission = smolboard.PermissionAdministrator
+			}
+
+			if err := tx.SavePost(&p); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+
+			if first.ID == 0 {
+				first = p
+			}
+		}
+
+		p := NewEmptyPost("image/png")
+		p.Size = 1
+		p.ContentHash = "ひめ"
+
+		if err := tx.SavePost(&p); !errors.Is(err, smolboard.ErrInvalidContentHash) {
+			t.Fatal("Unexpected error saving post with an invalid hash:", err)
+		}
+	})
+
+	t.Run("Found", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		p, err := tx.PostByHash(public)
+		if err != nil {
+			t.Fatal("Failed to get post by hash:", err)
+		}
+
+		if p.ID != first.ID || p.ContentHash != public {
+			t.Fatalf("Unexpected post: %#v", p)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if _, err := tx.PostByHash(private); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error getting an invisible post by hash:", err)
+		}
+
+		if _, err := tx.PostByHash(strings.ToUpper(public)); !errors.Is(err, smolboard.ErrInvalidContentHash) {
+			t.Fatal("Unexpected error getting a post by an invalid hash:", err)
+		}
+	})
+}
+
+func TestTagStats(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	var posts = make([]smolboard.Post, 3)
+
+	t.Run("Setup", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+		}
+
+		// The last post can't be seen by the user.
+		posts[2].Permission = smolboard.PermissionAdministrator
+
+		for i := range posts {
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+			if err := tx.TagPost(posts[i].ID, "ひめ"); err != nil {
+				t.Fatal("Failed to tag post:", err)
+			}
+		}
+
+		if err := tx.TagPost(posts[2].ID, "secret"); err != nil {
+			t.Fatal("Failed to tag post:", err)
+		}
+	})
+
+	var first int64
+
+	t.Run("Visible", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		s, err := tx.TagStats(0)
+		if err != nil {
+			t.Fatal("Failed to get tag stats:", err)
+		}
+
+		if len(s) != 1 || s[0].TagName != "ひめ" || s[0].Count != 2 || s[0].LastUsed == 0 {
+			t.Fatalf("Unexpected tag stats: %#v", s)
+		}
+
+		first = s[0].LastUsed
+
+		if _, err := tx.TagStats(MaxTagStats + 1); !errors.Is(err, smolboard.ErrPageCountLimit) {
+			t.Fatal("Unexpected error getting too many tag stats:", err)
+		}
+	})
+
+	t.Run("Owner", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		s, err := tx.TagStats(0)
+		if err != nil {
+			t.Fatal("Failed to get tag stats:", err)
+		}
+
+		if len(s) != 2 || s[0].TagName != "ひめ" || s[0].Count != 3 || s[1].TagName != "secret" {
+			t.Fatalf("Unexpected tag stats: %#v", s)
+		}
+	})
+
+	t.Run("Tagged", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.TagPost(posts[0].ID, "Secret"); err != nil {
+			t.Fatal("Failed to tag post:", err)
+		}
+		if _, err := tx.AddTagToPosts([]int64{posts[1].ID}, "ひめ2"); err != nil {
+			t.Fatal("Failed to tag posts:", err)
+		}
+	})
+
+	t.Run("Updated", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		s, err := tx.TagStats(1)
+		if err != nil {
+			t.Fatal("Failed to get tag stats:", err)
+		}
+
+		if len(s) != 1 || s[0].TagName != "ひめ" {
+			t.Fatalf("Unexpected tag stats: %#v", s)
+		}
+
+		s, err = tx.TagStats(0)
+		if err != nil {
+			t.Fatal("Failed to get tag stats:", err)
+		}
+
+		var counts = map[string]int{}
+		for _, stat := range s {
+			counts[stat.TagName] = stat.Count
+		}
+
+		if counts["secret"] != 1 || counts["ひめ2"] != 1 {
+			t.Fatalf("Unexpected tag stats: %#v", s)
+		}
+
+		for _, stat := range s {
+			if stat.TagName != "ひめ" && stat.LastUsed < first {
+				t.Fatalf("Tag %q was last used before the first tag: %d", stat.TagName, stat.LastUsed)
+			}
+		}
+	})
+}
+
+func TestPostTransfer(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	from := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+	newTestUser(t, d, owner.AuthToken, "ヒメゴト", smolboard.PermissionUser)
+
+	var posts = make([]smolboard.Post, 3)
+
+	t.Run("CreatePosts", func(t *testing.T) {
+		tx := testBeginTx(t, d, from.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+			if err := tx.TagPost(posts[i].ID, "ひめ"); err != nil {
+				t.Fatal("Failed to tag post:", err)
+			}
+		}
+
+		// Soft-deleted posts should be transferred in bulk as well.
+		if err := tx.DeletePost(posts[2].ID, false); err != nil {
+			t.Fatal("Failed to delete post:", err)
+		}
+	})
+
+	// posterPosts returns the IDs of the posts listed under the poster.
+	var posterPosts = func(t *testing.T, tx *Transaction, poster string) []int64 {
+		t.Helper()
+
+		r, err := tx.PostSearch("@"+poster, 100, 0)
+		if err != nil {
+			t.Fatal("Failed to search posts:", err)
+		}
+
+		var ids = make([]int64, len(r.Posts))
+		for i, post := range r.Posts {
+			ids[i] = post.ID
+		}
+		return ids
+	}
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		tx := testBeginTx(t, d, from.AuthToken)
+
+		if err := tx.TransferPost(posts[0].ID, "ヒメゴト"); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error transferring as a user:", err)
+		}
+	})
+
+	t.Run("Single", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		err := tx.TransferPost(posts[0].ID, "ななし")
+		if !errors.Is(err, smolboard.ErrUserNotFound) {
+			t.Fatal("Unexpected error transferring to an unknown user:", err)
+		}
+
+		if err := tx.TransferPost(posts[0].ID, "ヒメゴト"); err != nil {
+			t.Fatal("Failed to transfer post:", err)
+		}
+
+		if eq := deep.Equal(posterPosts(t, tx, "ヒメゴト"), []int64{posts[0].ID}); eq != nil {
+			t.Fatal("Unexpected posts of the new poster:", eq)
+		}
+
+		p, err := tx.Post(posts[0].ID)
+		if err != nil {
+			t.Fatal("Failed to get post:", err)
+		}
+		if len(p.Tags) != 1 || p.Tags[0].TagName != "ひめ" {
+			t.Fatalf("Unexpected tags after transfer: %#v", p.Tags)
+		}
+
+		entries, err := tx.AuditLog(0, 1)
+		if err != nil {
+			t.Fatal("Failed to get audit log:", err)
+		}
+		if len(entries) != 1 || entries[0].Action != "post.transfer" {
+			t.Fatalf("Unexpected audit log: %#v", entries)
+		}
+	})
+
+	t.Run("Outranked", func(t *testing.T) {
+		var post = NewEmptyPost("image/png")
+		post.Size = 1
+
+		err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+			return tx.SavePost(&post)
+		})
+		if err != nil {
+			t.Fatal("Failed to save owner's post:", err)
+		}
+
+		admin := newTestUser(t, d, owner.AuthToken, "いとうまお", smolboard.PermissionAdministrator)
+		tx := testBeginTx(t, d, admin.AuthToken)
+
+		// Admins can't take posts from users that they don't outrank.
+		if err := tx.TransferPost(post.ID, admin.Username); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error transferring the owner's post:", err)
+		}
+
+		_, err = tx.TransferUserPosts(owner.Username, admin.Username)
+		if !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error transferring the owner's posts:", err)
+		}
+
+		// Nor can they push posts onto them.
+		if err := tx.TransferPost(posts[1].ID, owner.Username); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error transferring a post to the owner:", err)
+		}
+
+		_, err = tx.TransferUserPosts("ななし", admin.Username)
+		if !errors.Is(err, smolboard.ErrUserNotFound) {
+			t.Fatal("Unexpected error transferring from an unknown user:", err)
+		}
+	})
+
+	t.Run("All", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		n, err := tx.TransferUserPosts("かぐやありかわ", "ヒメゴト")
+		if err != nil {
+			t.Fatal("Failed to transfer posts:", err)
+		}
+		if n != 2 {
+			t.Fatal("Unexpected number of transferred posts:", n)
+		}
+
+		if ids := posterPosts(t, tx, "かぐやありかわ"); len(ids) > 0 {
+			t.Fatal("Posts left under the old poster:", ids)
+		}
+
+		// The soft-deleted post isn't listed, but it should be restorable by
+		// the new poster.
+		if eq := deep.Equal(posterPosts(t, tx, "ヒメゴト"), []int64{posts[1].ID, posts[0].ID}); eq != nil {
+			t.Fatal("Unexpected posts of the new poster:", eq)
+		}
+
+		var poster string
+		if err := tx.QueryRow("SELECT poster FROM posts WHERE id = ?", posts[2].ID).Scan(&poster); err != nil {
+			t.Fatal("Failed to get poster:", err)
+		}
+		if poster != "ヒメゴト" {
+			t.Fatal("Soft-deleted post not transferred:", poster)
+		}
+	})
+}
+
+func TestAnonymousPosting(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		d := newTestDatabase(t)
+		tx := testBeginTx(t, d, "")
+
+		p := NewEmptyPost("image/png")
+		p.Size = 1
+
+		if err := tx.SavePost(&p); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error uploading anonymously:", err)
+		}
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+			cfg.AnonymousPosting = true
+		})
+
+		owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+		p := NewEmptyPost("image/png")
+		p.Size = 1
+		p.Permission = smolboard.PermissionGuest
+
+		err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+			return tx.SavePost(&p)
+		})
+		if err != nil {
+			t.Fatal("Failed to upload anonymously:", err)
+		}
+
+		if p.GetPoster() != "anonymous" || !p.Anonymous {
+			t.Fatalf("Unexpected anonymous post: %#v", p)
+		}
+
+		t.Run("Moderated", func(t *testing.T) {
+			tx := testBeginTx(t, d, "")
+
+			if _, err := tx.Post(p.ID); !errors.Is(err, smolboard.ErrPostNotFound) {
+				t.Fatal("Unexpected error getting a moderated post as a guest:", err)
+			}
+		})
+
+		t.Run("Admin", func(t *testing.T) {
+			tx := testBeginTx(t, d, owner.AuthToken)
+
+			e, err := tx.Post(p.ID)
+			if err != nil {
+				t.Fatal("Failed to get anonymous post:", err)
+			}
+			if !e.Anonymous {
+				t.Fatal("Anonymous post not flagged.")
+			}
+
+			pending, err := tx.PendingUsers()
+			if err != nil {
+				t.Fatal("Failed to get pending users:", err)
+			}
+			if len(pending) > 0 {
+				t.Fatal("Unexpected pending users:", pending)
+			}
+		})
+
+		t.Run("Reserved", func(t *testing.T) {
+			tx := testBeginTx(t, d, "")
+
+			_, err := tx.Signin("anonymous", "", "")
+			if !errors.Is(err, smolboard.ErrInvalidPassword) {
+				t.Fatal("Unexpected error signing in as anonymous:", err)
+			}
+
+			err = tx.createUser("anonymous", "password", smolboard.PermissionUser)
+			if !errors.Is(err, smolboard.ErrUsernameTaken) {
+				t.Fatal("Unexpected error signing up as anonymous:", err)
+			}
+		})
+	})
+}
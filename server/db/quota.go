@@ -0,0 +1,137 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// Quota returns the upload quota of the given user. Users can only get their
+// own quota, unless they're an administrator.
+func (d *Transaction) Quota(username string) (*smolboard.UserQuota, error) {
+	if err := d.requireOwnerOrPermission(username, smolboard.PermissionAdministrator); err != nil {
+		return nil, err
+	}
+
+	// Make sure the user exists, since unknown users would otherwise just have
+	// the default quota.
+	if _, err := d.User(username); err != nil {
+		return nil, err
+	}
+
+	return d.quota(username)
+}
+
+func (d *Transaction) quota(username string) (*smolboard.UserQuota, error) {
+	var q = smolboard.UserQuota{
+		MaxBytes: int64(d.config.UploadQuota),
+		MaxPosts: d.config.PostQuota,
+	}
+
+	err := d.
+		QueryRow("SELECT maxbytes, maxposts FROM quotas WHERE username = ?", username).
+		Scan(&q.MaxBytes, &q.MaxPosts)
+
+	switch {
+	case err == nil:
+		q.Override = true
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, errors.Wrap(err, "Failed to scan quota")
+	}
+
+	err = d.
+		QueryRow("SELECT COALESCE(SUM(size), 0), COUNT(1) FROM posts WHERE poster = ?", username).
+		Scan(&q.UsedBytes, &q.UsedPosts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to scan quota usage")
+	}
+
+	return &q, nil
+}
+
+// checkQuota returns ErrQuotaExceeded if the user can't upload another post of
+// the given size. Administrators are never limited.
+func (d *Transaction) checkQuota(username string, size int64) error {
+	p, err := d.permission(username)
+	if err != nil {
+		return err
+	}
+	if p >= smolboard.PermissionAdministrator {
+		return nil
+	}
+
+	// Skip counting the posts if there's no quota at all.
+	if d.config.UploadQuota == 0 && d.config.PostQuota == 0 {
+		var overridden bool
+
+		err := d.
+			QueryRow("SELECT EXISTS(SELECT 1 FROM quotas WHERE username = ?)", username).
+			Scan(&overridden)
+		if err != nil {
+			return errors.Wrap(err, "Failed to scan quota override")
+		}
+
+		if !overridden {
+			return nil
+		}
+	}
+
+	q, err := d.quota(username)
+	if err != nil {
+		return err
+	}
+
+	if q.MaxBytes > 0 && q.UsedBytes+size > q.MaxBytes {
+		return smolboard.ErrQuotaExceeded
+	}
+	if q.MaxPosts > 0 && q.UsedPosts+1 > q.MaxPosts {
+		return smolboard.ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// SetUserQuota overrides the upload quota of the given user. Limits of 0 are
+// unlimited. Only administrators can do this.
+func (d *Transaction) SetUserQuota(username string, maxBytes int64, maxPosts int) error {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	if maxBytes < 0 || maxPosts < 0 {
+		return smolboard.ErrInvalidQuota
+	}
+
+	if _, err := d.User(username); err != nil {
+		return err
+	}
+
+	_, err := d.Exec(
+		"INSERT OR REPLACE INTO quotas VALUES (?, ?, ?)",
+		username, maxBytes, maxPosts,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to set quota")
+	}
+
+	return d.auditf("user.quota", username, "%d bytes, %d posts", maxBytes, maxPosts)
+}
+
+// ResetUserQuota removes the given user's quota override, so that the defaults
+// apply again. Only administrators can do this.
+func (d *Transaction) ResetUserQuota(username string) error {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	if _, err := d.User(username); err != nil {
+		return err
+	}
+
+	if _, err := d.Exec("DELETE FROM quotas WHERE username = ?", username); err != nil {
+		return errors.Wrap(err, "Failed to reset quota")
+	}
+
+	return d.audit("user.quota", username, "reset")
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-test/deep"
+)
+
+func TestQuota(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.UploadQuota = 10
+		cfg.PostQuota = 3
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	// upload uploads a post of the given size as the user.
+	var upload = func(t *testing.T, size int64) error {
+		t.Helper()
+
+		return d.Acquire(context.Background(), user.AuthToken, func(tx *Transaction) error {
+			p := NewEmptyPost("image/png")
+			p.Size = size
+
+			return tx.SavePost(&p)
+		})
+	}
+
+	t.Run("Bytes", func(t *testing.T) {
+		if err := upload(t, 4); err != nil {
+			t.Fatal("Failed to upload under the quota:", err)
+		}
+		if err := upload(t, 6); err != nil {
+			t.Fatal("Failed to upload up to the quota:", err)
+		}
+		if err := upload(t, 1); !errors.Is(err, smolboard.ErrQuotaExceeded) {
+			t.Fatal("Unexpected error uploading over the quota:", err)
+		}
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		err := d.Acquire(context.Background(), owner.AuthToken, func(tx *Transaction) error {
+			return tx.SetUserQuota(user.Username, 0, 3)
+		})
+		if err != nil {
+			t.Fatal("Failed to override quota:", err)
+		}
+
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if err := tx.SetUserQuota(user.Username, 0, 0); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error overriding own quota:", err)
+		}
+
+		q, err := tx.Quota(user.Username)
+		if err != nil {
+			t.Fatal("Failed to get quota:", err)
+		}
+
+		expect := smolboard.UserQuota{
+			MaxBytes:  0,
+			MaxPosts:  3,
+			UsedBytes: 10,
+			UsedPosts: 2,
+			Override:  true,
+		}
+
+		if eq := deep.Equal(*q, expect); eq != nil {
+			t.Fatal("Unexpected quota:", eq)
+		}
+	})
+
+	t.Run("Posts", func(t *testing.T) {
+		if err := upload(t, 100); err != nil {
+			t.Fatal("Failed to upload up to the overridden quota:", err)
+		}
+		if err := upload(t, 1); !errors.Is(err, smolboard.ErrQuotaExceeded) {
+			t.Fatal("Unexpected error uploading over the post quota:", err)
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.ResetUserQuota(user.Username); err != nil {
+			t.Fatal("Failed to reset quota:", err)
+		}
+
+		q, err := tx.Quota(user.Username)
+		if err != nil {
+			t.Fatal("Failed to get quota:", err)
+		}
+		if q.Override || q.MaxBytes != 10 || q.MaxPosts != 3 {
+			t.Fatalf("Unexpected quota after reset: %#v", q)
+		}
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		p := NewEmptyPost("image/png")
+		p.Size = 100
+
+		if err := tx.SavePost(&p); err != nil {
+			t.Fatal("Failed to upload as an administrator:", err)
+		}
+	})
+}
@@ -0,0 +1,479 @@
+// Package redisstore provides a SessionStore that keeps sessions in Redis.
+// Sessions are keys with native TTLs, so Redis expires them on its own, which
+// also lets multiple instances share sessions.
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	// Address is the host:port of the Redis server. The store is not used if
+	// this is empty.
+	Address  string `toml:"address"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+	// Prefix is prepended to all keys.
+	Prefix string `toml:"prefix"`
+	// PoolSize is the maximum number of idle connections kept around.
+	PoolSize int `toml:"poolSize"`
+}
+
+func NewConfig() Config {
+	return Config{
+		Prefix:   "smolboard:",
+		PoolSize: 8,
+	}
+}
+
+// IsZero returns true if the config does not have an address, which means that
+// Redis should not be used.
+func (c Config) IsZero() bool {
+	return c.Address == ""
+}
+
+func (c *Config) Validate() error {
+	if c.IsZero() {
+		return nil
+	}
+
+	if c.DB < 0 {
+		return errors.New("redis `db' must not be negative")
+	}
+
+	if c.PoolSize < 1 {
+		return errors.New("redis `poolSize' must be at least 1")
+	}
+
+	return nil
+}
+
+// Store is a SessionStore backed by Redis. Each session is stored as JSON under
+// its token, and each user has a set of their session tokens. Session IDs are
+// mapped to tokens by keys that expire along with the sessions.
+type Store struct {
+	client *client
+	prefix string
+}
+
+var _ db.SessionStore = (*Store)(nil)
+var _ db.SessionRotator = (*Store)(nil)
+
+// New creates a new Redis store. Connections are made lazily.
+func New(cfg Config) *Store {
+	return &Store{
+		client: newClient(cfg),
+		prefix: cfg.Prefix,
+	}
+}
+
+// Close closes all idle connections.
+func (s *Store) Close() error {
+	s.client.close()
+	return nil
+}
+
+func (s *Store) sessionKey(token string) string {
+	return s.prefix + "session:" + token
+}
+
+func (s *Store) userKey(username string) string {
+	return s.prefix + "user:" + username
+}
+
+func (s *Store) idKey(id int64) string {
+	return s.prefix + "id:" + strconv.FormatInt(id, 10)
+}
+
+// ttl returns the remaining time until the deadline plus the transaction's
+// session grace period in milliseconds, so that Redis keeps sessions for as
+// long as they can still be used.
+func ttl(tx *db.Transaction, deadline int64) (string, bool) {
+	deadline += int64(tx.SessionGracePeriod())
+	ms := (deadline - time.Now().UnixNano()) / int64(time.Millisecond)
+	return strconv.FormatInt(ms, 10), ms > 0
+}
+
+func (s *Store) Create(tx *db.Transaction, session *smolboard.Session) error {
+	ms, ok := ttl(tx, session.Deadline)
+	if !ok {
+		return smolboard.ErrSessionExpired
+	}
+
+	b, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode session")
+	}
+
+	// Claim the token on its own first, so that a taken token doesn't end up
+	// in this user's set.
+	if err := s.claim(tx.Context(), session.AuthToken, b, ms); err != nil {
+		return err
+	}
+
+	_, err = s.client.pipeline(tx.Context(), [][]string{
+		{"MULTI"},
+		{"SET", s.idKey(session.ID), session.AuthToken, "PX", ms},
+		{"SADD", s.userKey(session.Username), session.AuthToken},
+		{"EXEC"},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to save session")
+	}
+
+	return nil
+}
+
+// claim saves the encoded session under the token only if no other session has
+// it. ErrTokenTaken is returned otherwise.
+func (s *Store) claim(ctx context.Context, token string, b []byte, ms string) error {
+	r, err := s.client.do(ctx, "SET", s.sessionKey(token), string(b), "PX", ms, "NX")
+	if err != nil {
+		return errors.Wrap(err, "Failed to save session")
+	}
+
+	// NX makes SET return nil if the key already exists.
+	if r == nil {
+		return db.ErrTokenTaken
+	}
+
+	return nil
+}
+
+func (s *Store) Lookup(tx *db.Transaction, token string) (*smolboard.Session, error) {
+	r, err := s.client.do(tx.Context(), "GET", s.sessionKey(token))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get session")
+	}
+
+	if r == nil {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	return decodeSession(r)
+}
+
+func (s *Store) LookupID(tx *db.Transaction, id int64) (*smolboard.Session, error) {
+	r, err := s.client.do(tx.Context(), "GET", s.idKey(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get session token")
+	}
+
+	token, ok := r.(string)
+	if !ok {
+		return nil, smolboard.ErrSessionNotFound
+	}
+
+	session, err := s.Lookup(tx, token)
+	if err != nil {
+		if errors.Is(err, smolboard.ErrSessionExpired) {
+			return nil, smolboard.ErrSessionNotFound
+		}
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Renew replaces the session and resets its TTL in a single transaction, so
+// the deadline and the TTL can never disagree. The session must still exist.
+func (s *Store) Renew(tx *db.Transaction, session *smolboard.Session, deadline int64) error {
+	var renewed = *session
+	renewed.Deadline = deadline
+
+	if err := s.replace(tx, &renewed); err != nil {
+		return err
+	}
+
+	*session = renewed
+	return nil
+}
+
+// replace overwrites an existing session and resets its TTL from its deadline.
+func (s *Store) replace(tx *db.Transaction, session *smolboard.Session) error {
+	ms, ok := ttl(tx, session.Deadline)
+	if !ok {
+		return smolboard.ErrSessionExpired
+	}
+
+	b, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode session")
+	}
+
+	replies, err := s.client.pipeline(tx.Context(), [][]string{
+		{"MULTI"},
+		{"SET", s.sessionKey(session.AuthToken), string(b), "PX", ms, "XX"},
+		{"PEXPIRE", s.idKey(session.ID), ms},
+		{"EXEC"},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to save session")
+	}
+
+	exec, ok := replies[3].([]interface{})
+	if !ok || len(exec) != 2 {
+		return errors.New("unexpected redis EXEC reply")
+	}
+
+	// XX makes SET return nil if the session expired in the meantime.
+	if exec[0] == nil {
+		return smolboard.ErrSessionExpired
+	}
+
+	return nil
+}
+
+// Rotate claims the new token, then moves the rest of the session over in a
+// single transaction. If the old token was already gone by then, the new one is
+// deleted again.
+func (s *Store) Rotate(tx *db.Transaction, session *smolboard.Session, token string) error {
+	var rotated = *session
+	rotated.AuthToken = token
+
+	ms, ok := ttl(tx, rotated.Deadline)
+	if !ok {
+		return smolboard.ErrSessionExpired
+	}
+
+	b, err := json.Marshal(rotated)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode session")
+	}
+
+	if err := s.claim(tx.Context(), token, b, ms); err != nil {
+		return err
+	}
+
+	replies, err := s.client.pipeline(tx.Context(), [][]string{
+		{"MULTI"},
+		{"DEL", s.sessionKey(session.AuthToken)},
+		{"SET", s.idKey(session.ID), token, "PX", ms},
+		{"SREM", s.userKey(session.Username), session.AuthToken},
+		{"SADD", s.userKey(session.Username), token},
+		{"EXEC"},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to rotate session")
+	}
+
+	exec, ok := replies[5].([]interface{})
+	if !ok || len(exec) != 4 {
+		return errors.New("unexpected redis EXEC reply")
+	}
+
+	if deleted, _ := exec[0].(int64); deleted == 0 {
+		if err := s.delete(tx.Context(), session.Username, []smolboard.Session{rotated}); err != nil {
+			return err
+		}
+		return smolboard.ErrSessionExpired
+	}
+
+	*session = rotated
+	return nil
+}
+
+func (s *Store) Delete(tx *db.Transaction, username string, id int64) error {
+	sessions, err := s.ListByUser(tx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == id {
+			return s.delete(tx.Context(), username, []smolboard.Session{session})
+		}
+	}
+
+	return smolboard.ErrSessionNotFound
+}
+
+// Rename replaces the session with the renamed one, keeping its deadline.
+func (s *Store) Rename(tx *db.Transaction, username string, id int64, name string) error {
+	sessions, err := s.ListByUser(tx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == id {
+			session.Name = name
+			return s.replace(tx, &session)
+		}
+	}
+
+	return smolboard.ErrSessionNotFound
+}
+
+func (s *Store) DeleteByUser(tx *db.Transaction, username string, keep int64) error {
+	sessions, err := s.ListByUser(tx, username)
+	if err != nil {
+		return err
+	}
+
+	var deleted = sessions[:0]
+	for _, session := range sessions {
+		if session.ID != keep {
+			deleted = append(deleted, session)
+		}
+	}
+
+	return s.delete(tx.Context(), username, deleted)
+}
+
+func (s *Store) delete(ctx context.Context, username string, sessions []smolboard.Session) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	var del = make([]string, 0, 2*len(sessions)+1)
+	del = append(del, "DEL")
+	for _, session := range sessions {
+		del = append(del, s.sessionKey(session.AuthToken), s.idKey(session.ID))
+	}
+
+	var srem = make([]string, 0, len(sessions)+2)
+	srem = append(srem, "SREM", s.userKey(username))
+	for _, session := range sessions {
+		srem = append(srem, session.AuthToken)
+	}
+
+	_, err := s.client.pipeline(ctx, [][]string{{"MULTI"}, del, srem, {"EXEC"}})
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete sessions")
+	}
+
+	return nil
+}
+
+// DeleteAll deletes the sessions of every user in the database. Redis is not
+// scanned for keys, so sessions of users that no longer exist are left to
+// expire on their own.
+func (s *Store) DeleteAll(tx *db.Transaction) (int, error) {
+	var usernames []string
+
+	if err := tx.Select(&usernames, "SELECT username FROM users"); err != nil {
+		return 0, errors.Wrap(err, "Failed to get usernames")
+	}
+
+	var n int
+
+	for _, username := range usernames {
+		sessions, err := s.ListByUser(tx, username)
+		if err != nil {
+			return n, err
+		}
+
+		if err := s.delete(tx.Context(), username, sessions); err != nil {
+			return n, err
+		}
+
+		n += len(sessions)
+	}
+
+	return n, nil
+}
+
+// ListByUser returns the user's sessions. Tokens of sessions that Redis has
+// expired are removed from the user's set along the way.
+func (s *Store) ListByUser(tx *db.Transaction, username string) ([]smolboard.Session, error) {
+	var ctx = tx.Context()
+
+	r, err := s.client.do(ctx, "SMEMBERS", s.userKey(username))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get user sessions")
+	}
+
+	tokens, err := stringArray(r)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+
+	var mget = make([]string, 0, len(tokens)+1)
+	mget = append(mget, "MGET")
+	for _, token := range tokens {
+		mget = append(mget, s.sessionKey(token))
+	}
+
+	r, err = s.client.do(ctx, mget...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get sessions")
+	}
+
+	values, ok := r.([]interface{})
+	if !ok || len(values) != len(tokens) {
+		return nil, errors.New("unexpected redis MGET reply")
+	}
+
+	var sessions = make([]smolboard.Session, 0, len(tokens))
+	var expired []string
+
+	for i, v := range values {
+		if v == nil {
+			expired = append(expired, tokens[i])
+			continue
+		}
+
+		session, err := decodeSession(v)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, *session)
+	}
+
+	if len(expired) > 0 {
+		var srem = append([]string{"SREM", s.userKey(username)}, expired...)
+		if _, err := s.client.do(ctx, srem...); err != nil {
+			return nil, errors.Wrap(err, "Failed to remove expired sessions")
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID > sessions[j].ID
+	})
+
+	return sessions, nil
+}
+
+func decodeSession(r interface{}) (*smolboard.Session, error) {
+	b, ok := r.(string)
+	if !ok {
+		return nil, errors.New("unexpected redis session reply")
+	}
+
+	var session smolboard.Session
+	if err := json.Unmarshal([]byte(b), &session); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode session")
+	}
+
+	return &session, nil
+}
+
+func stringArray(r interface{}) ([]string, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	values, ok := r.([]interface{})
+	if !ok {
+		return nil, errors.New("unexpected redis array reply")
+	}
+
+	var strs = make([]string, len(values))
+	for i, v := range values {
+		if strs[i], ok = v.(string); !ok {
+			return nil, errors.New("unexpected redis array element")
+		}
+	}
+
+	return strs, nil
+}
@@ -0,0 +1,243 @@
+//go:build redis
+// +build redis
+
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// newTestStore connects to the Redis server in $SMOLBOARD_TEST_REDIS, or the
+// default local one. Each test gets its own key prefix.
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	cfg := NewConfig()
+	cfg.Address = os.Getenv("SMOLBOARD_TEST_REDIS")
+	cfg.Prefix = fmt.Sprintf("smolboard-test-%d:", time.Now().UnixNano())
+
+	if cfg.Address == "" {
+		cfg.Address = "localhost:6379"
+	}
+
+	s := New(cfg)
+	t.Cleanup(func() { s.Close() })
+
+	if _, err := s.client.do(context.Background(), "PING"); err != nil {
+		t.Fatal("Failed to ping redis:", err)
+	}
+
+	return s
+}
+
+func newTestDatabase(t *testing.T, store *Store) *db.Database {
+	t.Helper()
+
+	var dbpath = filepath.Join(
+		os.TempDir(),
+		fmt.Sprintf("smolboard-redisstore-test-%d", time.Now().UnixNano()),
+	)
+
+	t.Cleanup(func() { os.Remove(dbpath) })
+
+	cfg := db.NewConfig()
+	cfg.Owner = "ひめありかわ"
+	cfg.DatabasePath = dbpath
+	cfg.SessionStore = store
+
+	if err := db.CreateOwner(cfg, "password"); err != nil {
+		t.Fatal("Failed to create owner:", err)
+	}
+
+	d, err := db.NewDatabase(cfg)
+	if err != nil {
+		t.Fatal("Failed to create a database:", err)
+	}
+
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+func testSignin(t *testing.T, d *db.Database) *smolboard.Session {
+	t.Helper()
+
+	var s *smolboard.Session
+
+	err := d.AcquireGuest(context.Background(), func(tx *db.Transaction) (err error) {
+		s, err = tx.Signin(d.Config.Owner, "password", "iOS")
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	return s
+}
+
+func (s *Store) pttl(t *testing.T, token string) time.Duration {
+	t.Helper()
+	return s.pttlKey(t, s.sessionKey(token))
+}
+
+func (s *Store) pttlKey(t *testing.T, key string) time.Duration {
+	t.Helper()
+
+	r, err := s.client.do(context.Background(), "PTTL", key)
+	if err != nil {
+		t.Fatal("Failed to get TTL:", err)
+	}
+
+	return time.Duration(r.(int64)) * time.Millisecond
+}
+
+func TestStore(t *testing.T) {
+	store := newTestStore(t)
+	d := newTestDatabase(t, store)
+
+	s1 := testSignin(t, d)
+	s2 := testSignin(t, d)
+
+	if ttl := store.pttl(t, s1.AuthToken); ttl <= 0 {
+		t.Fatal("Session key has no TTL:", ttl)
+	}
+
+	err := d.Acquire(context.Background(), s1.AuthToken, func(tx *db.Transaction) error {
+		export, err := tx.SessionByID(s2.ID)
+		if err != nil {
+			return err
+		}
+
+		if export.ID != s2.ID || export.Username != s2.Username {
+			t.Fatalf("Unexpected session export: %#v", export)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal("Failed to look up session by ID:", err)
+	}
+
+	err = d.Acquire(context.Background(), s1.AuthToken, func(tx *db.Transaction) error {
+		sessions, err := tx.Sessions()
+		if err != nil {
+			return err
+		}
+
+		if len(sessions) != 2 || sessions[0].ID != s2.ID || sessions[1].ID != s1.ID {
+			t.Fatalf("Unexpected sessions: %#v", sessions)
+		}
+
+		// Deleting the other session should leave the current one.
+		return tx.DeleteAllSessions()
+	})
+
+	if err != nil {
+		t.Fatal("Failed to delete sessions:", err)
+	}
+
+	if _, err := d.SessionUsername(context.Background(), s2.AuthToken); !errors.Is(err, smolboard.ErrSessionExpired) {
+		t.Fatal("Unexpected error looking up deleted session:", err)
+	}
+
+	t.Run("Renew", func(t *testing.T) {
+		tx, err := db.BeginTx(context.Background(), d, "")
+		if err != nil {
+			t.Fatal("Failed to begin transaction:", err)
+		}
+		defer tx.Rollback()
+
+		var session = *s1
+		var deadline = time.Now().Add(30 * 24 * time.Hour).UnixNano()
+
+		if err := store.Renew(tx, &session, deadline); err != nil {
+			t.Fatal("Failed to renew:", err)
+		}
+
+		if ttl := store.pttl(t, s1.AuthToken); ttl < 29*24*time.Hour {
+			t.Fatal("TTL not reset on renewal:", ttl)
+		}
+
+		if ttl := store.pttlKey(t, store.idKey(s1.ID)); ttl < 29*24*time.Hour {
+			t.Fatal("ID key TTL not reset on renewal:", ttl)
+		}
+
+		renewed, err := store.Lookup(tx, s1.AuthToken)
+		if err != nil {
+			t.Fatal("Failed to look up renewed session:", err)
+		}
+		if renewed.Deadline != deadline {
+			t.Fatal("Deadline not renewed:", renewed.Deadline)
+		}
+
+		// Renewing a session that is gone must not recreate it.
+		var gone = *s2
+		if err := store.Renew(tx, &gone, deadline); !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error renewing deleted session:", err)
+		}
+	})
+
+	t.Run("TokenTaken", func(t *testing.T) {
+		tx, err := db.BeginTx(context.Background(), d, "")
+		if err != nil {
+			t.Fatal("Failed to begin transaction:", err)
+		}
+		defer tx.Rollback()
+
+		var other = *s1
+		other.ID++
+		other.Username = "かぐやありかわ"
+
+		if err := store.Create(tx, &other); !errors.Is(err, db.ErrTokenTaken) {
+			t.Fatal("Unexpected error creating session with a taken token:", err)
+		}
+
+		other.AuthToken = "redisstore-test-token"
+		if err := store.Create(tx, &other); err != nil {
+			t.Fatal("Failed to create session:", err)
+		}
+
+		// Rotating onto a taken token must not touch either session.
+		if err := store.Rotate(tx, &other, s1.AuthToken); !errors.Is(err, db.ErrTokenTaken) {
+			t.Fatal("Unexpected error rotating onto a taken token:", err)
+		}
+
+		for _, token := range []string{s1.AuthToken, other.AuthToken} {
+			if _, err := store.Lookup(tx, token); err != nil {
+				t.Fatal("Failed to look up session after failed rotation:", err)
+			}
+		}
+
+		owned, err := store.Lookup(tx, s1.AuthToken)
+		if err != nil {
+			t.Fatal("Failed to look up session:", err)
+		}
+		if owned.Username != s1.Username {
+			t.Fatal("Taken session was overwritten by", owned.Username)
+		}
+	})
+
+	t.Run("Signout", func(t *testing.T) {
+		err := d.Acquire(context.Background(), s1.AuthToken, func(tx *db.Transaction) error {
+			return tx.Signout()
+		})
+		if err != nil {
+			t.Fatal("Failed to sign out:", err)
+		}
+
+		_, err = db.BeginTx(context.Background(), d, s1.AuthToken)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using signed out session:", err)
+		}
+	})
+}
@@ -0,0 +1,243 @@
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// client is a minimal RESP2 client with a small pool of connections. Replies
+// are decoded into string, int64, []interface{} or nil.
+type client struct {
+	cfg  Config
+	pool chan *conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newClient(cfg Config) *client {
+	return &client{
+		cfg:  cfg,
+		pool: make(chan *conn, cfg.PoolSize),
+	}
+}
+
+func (c *client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+
+	var dialer net.Dialer
+
+	nc, err := dialer.DialContext(ctx, "tcp", c.cfg.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to dial redis")
+	}
+
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+
+	var setup [][]string
+	if c.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", c.cfg.Password})
+	}
+	if c.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.cfg.DB)})
+	}
+
+	if len(setup) > 0 {
+		if _, err := cn.pipeline(ctx, setup); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+func (c *client) put(cn *conn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// do runs a single command.
+func (c *client) do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.pipeline(ctx, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends all commands at once and returns their replies. The first
+// error reply is returned as the error.
+func (c *client) pipeline(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.pipeline(ctx, cmds)
+	if err != nil {
+		// Only reuse the connection if the protocol is still in a sane state.
+		if _, ok := err.(redisError); ok {
+			c.put(cn)
+		} else {
+			cn.Close()
+		}
+		return nil, err
+	}
+
+	c.put(cn)
+	return replies, nil
+}
+
+func (c *client) close() {
+	for {
+		select {
+		case cn := <-c.pool:
+			cn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (cn *conn) pipeline(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	var deadline time.Time
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	}
+	cn.SetDeadline(deadline)
+
+	var w = bufio.NewWriter(cn.Conn)
+
+	for _, args := range cmds {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, errors.Wrap(err, "Failed to write to redis")
+	}
+
+	var replies = make([]interface{}, len(cmds))
+	var replyErr error
+
+	// All replies must be read, even after an error, to keep the connection
+	// usable.
+	for i := range replies {
+		r, err := cn.readReply()
+		if err != nil {
+			if rerr, ok := err.(redisError); ok {
+				if replyErr == nil {
+					replyErr = rerr
+				}
+				continue
+			}
+			return nil, err
+		}
+		replies[i] = r
+	}
+
+	if replyErr != nil {
+		return nil, replyErr
+	}
+
+	return replies, nil
+}
+
+func (cn *conn) readReply() (interface{}, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read from redis")
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed redis reply")
+	}
+
+	var body = line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed redis bulk length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		var b = make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, b); err != nil {
+			return nil, errors.Wrap(err, "Failed to read from redis")
+		}
+		return string(b[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed redis array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		var array = make([]interface{}, n)
+		var arrayErr error
+
+		for i := range array {
+			r, err := cn.readReply()
+			if err != nil {
+				// Errors inside EXEC replies are still part of the array.
+				if rerr, ok := err.(redisError); ok {
+					if arrayErr == nil {
+						arrayErr = rerr
+					}
+					continue
+				}
+				return nil, err
+			}
+			array[i] = r
+		}
+
+		if arrayErr != nil {
+			return nil, arrayErr
+		}
+
+		return array, nil
+
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", line[0])
+	}
+}
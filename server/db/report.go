@@ -0,0 +1,117 @@
+package db
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// ReportPost reports the post with the given ID. A user can only report the
+// same post once.
+func (d *Transaction) ReportPost(id int64, reason string) error {
+	if err := d.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return err
+	}
+
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return smolboard.ErrEmptyReportReason
+	}
+	if len(reason) > smolboard.MaxReportReasonLen {
+		return smolboard.ErrReportReasonTooLong
+	}
+
+	// Only visible posts can be reported.
+	if _, err := d.PostQuickGet(id); err != nil {
+		return err
+	}
+
+	_, err := d.Exec(
+		"INSERT INTO reports (id, postid, reporter, reason) VALUES (?, ?, ?, ?)",
+		int64(reportIDGen.Generate()), id, d.Session.Username, reason,
+	)
+	if err != nil {
+		if errIsConstraint(err) {
+			return smolboard.ErrAlreadyReported
+		}
+		return errors.Wrap(err, "Failed to save report")
+	}
+
+	return nil
+}
+
+// PendingReports returns the unresolved reports from oldest to newest. Only
+// administrators and higher can see reports.
+func (d *Transaction) PendingReports(offset, limit int) ([]smolboard.Report, error) {
+	// SQLite treats a negative limit as no limit at all.
+	if limit < 0 || limit > 100 || offset < 0 {
+		return nil, smolboard.ErrPageCountLimit
+	}
+
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return nil, err
+	}
+
+	var reports = []smolboard.Report{}
+
+	err := d.Select(&reports,
+		"SELECT * FROM reports WHERE resolution = ? ORDER BY id ASC LIMIT ?, ?",
+		smolboard.ReportPending, offset, limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query reports")
+	}
+
+	return reports, nil
+}
+
+// ResolveReport resolves a pending report with the given action. Deleting the
+// post resolves all other pending reports on the same post as well.
+func (d *Transaction) ResolveReport(reportID int64, action smolboard.ReportAction) error {
+	if !action.IsValid() {
+		return smolboard.ErrInvalidReportAction
+	}
+
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	var report smolboard.Report
+
+	err := d.
+		QueryRowx("SELECT * FROM reports WHERE id = ? AND resolution = ?",
+			reportID, smolboard.ReportPending).
+		StructScan(&report)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return smolboard.ErrReportNotFound
+		}
+		return errors.Wrap(err, "Failed to scan report")
+	}
+
+	switch action {
+	case smolboard.ReportDismiss:
+		_, err = d.Exec("UPDATE reports SET resolution = ? WHERE id = ?", action, reportID)
+	case smolboard.ReportDelete:
+		if err := d.DeletePost(report.PostID, false); err != nil {
+			return errors.Wrap(err, "Failed to delete reported post")
+		}
+
+		_, err = d.Exec(
+			"UPDATE reports SET resolution = ? WHERE postid = ? AND resolution = ?",
+			action, report.PostID, smolboard.ReportPending,
+		)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to resolve report")
+	}
+
+	return d.auditf(
+		"report.resolve", strconv.FormatInt(report.PostID, 10),
+		"%s report %d by %s: %s", action, report.ID, report.Reporter, report.Reason,
+	)
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+func TestReport(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	poster := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+	reporter := newTestUser(t, d, owner.AuthToken, "いとうまお", smolboard.PermissionUser)
+
+	var posts = make([]smolboard.Post, 2)
+
+	t.Run("CreatePosts", func(t *testing.T) {
+		tx := testBeginTx(t, d, poster.AuthToken)
+
+		for i := range posts {
+			posts[i] = NewEmptyPost("image/png")
+			posts[i].Size = 1
+
+			if err := tx.SavePost(&posts[i]); err != nil {
+				t.Fatal("Failed to save post:", err)
+			}
+		}
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		tx := testBeginTx(t, d, reporter.AuthToken)
+
+		for _, post := range posts {
+			if err := tx.ReportPost(post.ID, "bad post"); err != nil {
+				t.Fatal("Failed to report post:", err)
+			}
+		}
+
+		if err := tx.ReportPost(posts[0].ID, "bad post again"); !errors.Is(err, smolboard.ErrAlreadyReported) {
+			t.Fatal("Unexpected error reporting twice:", err)
+		}
+
+		if err := tx.ReportPost(posts[0].ID, "  "); !errors.Is(err, smolboard.ErrEmptyReportReason) {
+			t.Fatal("Unexpected error reporting with empty reason:", err)
+		}
+	})
+
+	t.Run("ListDenied", func(t *testing.T) {
+		tx := testBeginTx(t, d, reporter.AuthToken)
+
+		if _, err := tx.PendingReports(0, 10); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error listing reports as normal user:", err)
+		}
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		reports, err := tx.PendingReports(0, 10)
+		if err != nil {
+			t.Fatal("Failed to list reports:", err)
+		}
+		if len(reports) != 2 {
+			t.Fatalf("Unexpected reports: %#v", reports)
+		}
+
+		if err := tx.ResolveReport(reports[0].ID, smolboard.ReportDelete); err != nil {
+			t.Fatal("Failed to resolve report with delete:", err)
+		}
+		if err := tx.ResolveReport(reports[1].ID, smolboard.ReportDismiss); err != nil {
+			t.Fatal("Failed to dismiss report:", err)
+		}
+		if err := tx.ResolveReport(reports[1].ID, smolboard.ReportDismiss); !errors.Is(err, smolboard.ErrReportNotFound) {
+			t.Fatal("Unexpected error resolving resolved report:", err)
+		}
+
+		if _, err := tx.Post(reports[0].PostID); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error getting deleted reported post:", err)
+		}
+		if _, err := tx.Post(reports[1].PostID); err != nil {
+			t.Fatal("Failed to get dismissed reported post:", err)
+		}
+
+		reports, err = tx.PendingReports(0, 10)
+		if err != nil {
+			t.Fatal("Failed to list reports:", err)
+		}
+		if len(reports) != 0 {
+			t.Fatalf("Unexpected reports after resolving: %#v", reports)
+		}
+
+		entries, err := tx.AuditLog(0, 10)
+		if err != nil {
+			t.Fatal("Failed to get audit log:", err)
+		}
+		if len(entries) != 2 || entries[1].Action != "report.resolve" {
+			t.Fatalf("Unexpected audit log: %#v", entries)
+		}
+	})
+
+	t.Run("NegativeLimit", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if _, err := tx.PendingReports(0, -1); !errors.Is(err, smolboard.ErrPageCountLimit) {
+			t.Fatal("Unexpected error listing reports with a negative limit:", err)
+		}
+		if _, err := tx.PendingReports(-1, 10); !errors.Is(err, smolboard.ErrPageCountLimit) {
+			t.Fatal("Unexpected error listing reports with a negative offset:", err)
+		}
+		if _, err := tx.AuditLog(0, -1); !errors.Is(err, smolboard.ErrPageCountLimit) {
+			t.Fatal("Unexpected error getting audit log with a negative limit:", err)
+		}
+		if _, err := tx.AuditLog(-1, 10); !errors.Is(err, smolboard.ErrPageCountLimit) {
+			t.Fatal("Unexpected error getting audit log with a negative offset:", err)
+		}
+	})
+}
@@ -1,137 +1,379 @@
 package db
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/pkg/errors"
+
+	ua "github.com/mileusna/useragent"
 )
 
 // querysmolboard.Session searches for a session..
 func (d *Transaction) querySession(token string) (*smolboard.Session, error) {
-	var s smolboard.Session
-
-	err := d.
-		QueryRowx("SELECT * FROM sessions WHERE authtoken = ?", token).
-		StructScan(&s)
-
+	s, err := d.config.SessionStore.Lookup(d, token)
 	if err != nil {
-		// Treat session not found errors as expired to make them the same as
-		// actual expired (and deleted) tokens.
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, smolboard.ErrSessionExpired
-		}
+		return nil, err
+	}
 
-		return nil, errors.Wrap(err, "Failed to scan session")
+	// Impersonation sessions have a fixed lifespan and are never renewed.
+	if s.IsImpersonation() {
+		return s, nil
 	}
 
 	var now = time.Now()
 
-	// If the token is expired, then (try to) delete it and return the expired
-	// error.
-	if now.UnixNano() > s.Deadline {
+	// The absolute timeout is a hard cap, so the grace period doesn't apply.
+	if max, ok := d.config.sessionMaxDeadline(s); ok && now.UnixNano() >= max {
 		return nil, smolboard.ErrSessionExpired
 	}
 
-	// If the token has just been renewed within an hour, then we probably don't
-	// need to do anything.
+	// Bump up the expiration time, but only write it if it would be pushed
+	// back by enough. This prevents bursts of requests from each writing a
+	// nearly identical deadline.
+	var deadline = d.config.sessionDeadline(s, now, d.config.renewLifespan())
 
-	// This comparison subtracts the current time by an hour, then compare it to
-	// the time the token was made. If the subtracted time is still before the
-	// time the token was made, then that means it was made within an hour.
-	var madeTime = s.Deadline - int64(d.config.tokenLifespan)
+	// Sessions within the grace period are always renewed, so that they're
+	// valid again.
+	if s.Deadline >= now.UnixNano() && deadline-s.Deadline <= int64(d.config.minSessionRenewal) {
+		return s, nil
+	}
 
-	if now.Add(-time.Hour).UnixNano() < madeTime {
-		return &s, nil
+	if err := d.config.SessionStore.Renew(d, s, deadline); err != nil {
+		return nil, err
 	}
 
-	// Bump up the expiration time.
-	now = now.Add(d.config.tokenLifespan)
-	s.Deadline = now.UnixNano()
+	return s, nil
+}
 
-	_, err = d.Exec(
-		"UPDATE sessions SET deadline = ? WHERE authtoken = ?",
-		s.Deadline, s.AuthToken,
-	)
+// sessionDeadline returns the deadline of the session if it's extended by the
+// TTL at the given time. This is capped to the absolute timeout.
+func (c DBConfig) sessionDeadline(s *smolboard.Session, now time.Time, ttl time.Duration) int64 {
+	var deadline = now.Add(ttl).UnixNano()
 
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to renew token")
+	if max, ok := c.sessionMaxDeadline(s); ok && max < deadline {
+		deadline = max
 	}
 
-	return &s, nil
+	return deadline
 }
 
-func (d *Transaction) cleanupSession(now int64) error {
-	// Execute cleanup of expired sessions.
-	_, err := d.Exec(
-		"DELETE FROM sessions WHERE deadline < ?",
-		time.Now().UnixNano(),
-	)
+// renewLifespan returns how long sessions are extended by on each use.
+func (c DBConfig) renewLifespan() time.Duration {
+	if c.tokenRenewal == 0 {
+		return c.tokenLifespan
+	}
+	return c.tokenRenewal
+}
 
-	if err != nil {
-		return errors.Wrap(err, "Faield to cleanup expired sessions")
+// maxTokenLifespan returns the longest that a session can last without being
+// used, which is the longer of the initial and renewal lifespans.
+func (c DBConfig) maxTokenLifespan() time.Duration {
+	if r := c.renewLifespan(); r > c.tokenLifespan {
+		return r
 	}
+	return c.tokenLifespan
+}
 
-	return nil
+// sessionMaxDeadline returns the absolute deadline of the session, which can't
+// be renewed past. False is returned if sessions don't have one.
+func (c DBConfig) sessionMaxDeadline(s *smolboard.Session) (int64, bool) {
+	if c.maxSessionLifespan == 0 {
+		return 0, false
+	}
+	return s.CreatedAt().Add(c.maxSessionLifespan).UnixNano(), true
 }
 
-func (d *Transaction) newSession(username, userAgent string) (*smolboard.Session, error) {
-	t, err := randToken()
+// sessionExpiry returns the time in Unix nanoseconds that sessions with an
+// earlier deadline are expired at. This is behind the current time by the
+// grace period.
+func (d *Transaction) sessionExpiry() int64 {
+	return time.Now().Add(-d.config.sessionGracePeriod).UnixNano()
+}
+
+// SessionUsername returns the username of the session with the given token
+// without renewing it. It is meant for cheap lookups outside of transactions.
+func (d *Database) SessionUsername(ctx context.Context, token string) (string, error) {
+	t, err := BeginTx(ctx, d, "")
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to generate a token")
+		return "", err
 	}
 
-	var now = time.Now()
+	defer t.Rollback()
 
+	if IsAPIKey(token) {
+		k, err := t.lookupAPIKey(token)
+		if err != nil {
+			return "", err
+		}
+		return k.Username, nil
+	}
+
+	s, err := d.Config.SessionStore.Lookup(t, token)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Username, nil
+}
+
+func (d *Transaction) newSession(username, userAgent, scope string) (*smolboard.Session, error) {
 	s := &smolboard.Session{
-		ID:        int64(sessionIDGen.Generate()),
+		ID:        d.config.sessionIDs.NextID(),
 		Username:  username,
-		AuthToken: t,
-		Deadline:  now.Add(d.config.tokenLifespan).UnixNano(),
 		UserAgent: userAgent,
+		Device:    deviceLabel(userAgent),
+		Scope:     scope,
 	}
+	s.Deadline = d.config.sessionDeadline(s, time.Now(), d.config.tokenLifespan)
 
-	_, err = d.Exec(
-		"INSERT INTO sessions VALUES (?, ?, ?, ?, ?)",
-		s.ID, s.Username, s.AuthToken, s.Deadline, s.UserAgent,
-	)
+	if err := d.createSession(s); err != nil {
+		return nil, err
+	}
 
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to save session")
+	return s, nil
+}
+
+// maxTokenAttempts is the number of tokens that createSession and RotateToken
+// generate before giving up. A single collision is already astronomically unlikely.
+const maxTokenAttempts = 3
+
+// createSession generates the session's token and saves it, regenerating the
+// token if another session already has it.
+func (d *Transaction) createSession(s *smolboard.Session) error {
+	for i := 0; ; i++ {
+		t, err := randToken(d.config.TokenLength)
+		if err != nil {
+			return errors.Wrap(err, "Failed to generate a token")
+		}
+
+		s.AuthToken = t
+
+		err = d.config.SessionStore.Create(d, s)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, ErrTokenTaken) || i == maxTokenAttempts-1 {
+			return err
+		}
+	}
+}
+
+// UnknownDevice is the device label of sessions without a user agent.
+const UnknownDevice = "Unknown device"
+
+// deviceLabel returns a short label of the device that the user agent belongs
+// to, such as "Firefox on Linux".
+func deviceLabel(userAgent string) string {
+	if userAgent == "" {
+		return UnknownDevice
+	}
+
+	var u = ua.Parse(userAgent)
+
+	var name = u.Name
+	if name == "" {
+		name = "Unknown browser"
+	}
+
+	switch {
+	case u.Device != "":
+		return name + " on " + u.Device
+	case u.OS != "":
+		return name + " on " + u.OS
+	default:
+		return name
+	}
+}
+
+// ImpersonationLifespan is the fixed lifespan of an impersonation session.
+const ImpersonationLifespan = time.Hour
+
+// ImpersonateUser issues a short-lived session of the given user. Only the
+// owner can do this, and the action is always logged. The returned session is
+// not renewed and cannot be used to escalate further.
+func (d *Transaction) ImpersonateUser(username string) (*smolboard.Session, error) {
+	if err := d.notImpersonating(); err != nil {
+		return nil, err
+	}
+
+	if err := d.notAPIKey(); err != nil {
+		return nil, err
+	}
+
+	if err := d.HasPermission(smolboard.PermissionOwner, true); err != nil {
+		return nil, err
+	}
+
+	// Impersonating oneself is pointless.
+	if username == d.Session.Username {
+		return nil, smolboard.ErrActionNotPermitted
 	}
 
-	// Execute cleanup of expired sessions.
-	return s, d.cleanupSession(now.UnixNano())
+	// Ensure that the user exists.
+	if _, err := d.permission(username); err != nil {
+		return nil, err
+	}
+
+	s := &smolboard.Session{
+		ID:             d.config.sessionIDs.NextID(),
+		Username:       username,
+		Deadline:       time.Now().Add(ImpersonationLifespan).UnixNano(),
+		UserAgent:      d.Session.UserAgent,
+		Device:         d.Session.Device,
+		ImpersonatedBy: d.Session.Username,
+		Scope:          smolboard.ScopeWrite,
+	}
+
+	if err := d.createSession(s); err != nil {
+		return nil, err
+	}
+
+	if err := d.auditf("user.impersonate", username, "session %d", s.ID); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// notImpersonating returns ErrImpersonating if the current session is an
+// impersonation. It guards actions that could be used to take over the user or
+// escalate permissions.
+func (d *Transaction) notImpersonating() error {
+	if d.Session.IsImpersonation() {
+		return smolboard.ErrImpersonating
+	}
+	return nil
 }
 
 // Signin creates a new session using the given username and password. The
 // UserAgent will be used for listing sessions. This function returns an
 // authenticate token.
 func (d *Transaction) Signin(user, pass, UA string) (*smolboard.Session, error) {
+	return d.SigninScoped(user, pass, UA, smolboard.ScopeWrite)
+}
+
+// SigninScoped is Signin with the scope of the new session, such as ScopeRead
+// for a session on a shared computer.
+func (d *Transaction) SigninScoped(user, pass, UA, scope string) (*smolboard.Session, error) {
+	if err := smolboard.ValidScope(scope); err != nil {
+		return nil, err
+	}
+
 	if err := smolboard.NameIsLegal(user); err != nil {
 		return nil, err
 	}
 
+	// The anonymous user has no password.
+	if user == d.config.AnonymousUsername {
+		verifyDummyPassword(pass)
+		return nil, smolboard.ErrInvalidPassword
+	}
+
 	r := d.QueryRowx("SELECT passhash FROM users WHERE username = ?", user)
 
 	var passhash []byte
 	if err := r.Scan(&passhash); err != nil {
-		// Return an invalid password for a non-existent user.
+		// Return an invalid password for a non-existent user. The password is
+		// still verified to take as long as a wrong password.
 		if errors.Is(err, sql.ErrNoRows) {
+			verifyDummyPassword(pass)
 			return nil, smolboard.ErrInvalidPassword
 		}
 
 		return nil, errors.Wrap(err, "Failed to scan for password")
 	}
 
-	if err := VerifyPassword(passhash, pass); err != nil {
+	rehash, err := d.config.verifyPassword(passhash, pass)
+	if err != nil {
+		if errors.Is(err, smolboard.ErrInvalidPassword) {
+			if err := d.recordFailedSignin(user); err != nil {
+				return nil, err
+			}
+		}
 		return nil, err
 	}
 
-	return d.newSession(user, UA)
+	// Upgrade legacy hashes and hashes with old peppers now that we have the
+	// password.
+	if rehash {
+		p, err := d.config.peppers.hashPassword(pass)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = d.Exec("UPDATE users SET passhash = ? WHERE username = ?", p, user)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to upgrade password hash")
+		}
+	}
+
+	_, err = d.Exec(
+		"UPDATE users SET lastlogin = ? WHERE username = ?", time.Now().UnixNano(), user)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save last login")
+	}
+
+	return d.newSession(user, UA, scope)
+}
+
+// recordFailedSignin counts a failed sign in of the user and mails them a
+// notice once there are FailedSigninNotice failures within the window. This
+// only sticks for guests, whose transactions are never rolled back, but only
+// guests can sign in anyway.
+func (d *Transaction) recordFailedSignin(username string) error {
+	if d.config.FailedSigninNotice == 0 {
+		return nil
+	}
+
+	var now = time.Now()
+	var windowStart = now.Add(-d.config.failedSigninWindow).UnixNano()
+
+	// Failures from before the window are forgotten.
+	_, err := d.Exec(`
+		INSERT INTO failedsignins (username, failures, windowstart) VALUES (?, 1, ?)
+			ON CONFLICT (username) DO UPDATE SET
+				failures    = CASE WHEN windowstart < ? THEN 1 ELSE failures + 1 END,
+				windowstart = CASE WHEN windowstart < ? THEN ? ELSE windowstart END`,
+		username, now.UnixNano(), windowStart, windowStart, now.UnixNano(),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save failed sign in")
+	}
+
+	// Claim the notice of this window, if it's due and not yet sent.
+	ch, err := d.execChanged(
+		"UPDATE failedsignins SET notifiedat = ?"+
+			" WHERE username = ? AND failures >= ? AND notifiedat < ?",
+		now.UnixNano(), username, d.config.FailedSigninNotice, windowStart,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save failed sign in notice")
+	}
+	if !ch {
+		return nil
+	}
+
+	email, err := d.verifiedEmail(username)
+	if err != nil || email == "" {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Hello %s,\n\nThe wrong password was entered for your account %d times "+
+			"within %s. If this was not you, consider changing your password.\n",
+		username, d.config.FailedSigninNotice, d.config.failedSigninWindow,
+	)
+
+	d.sendMail(email, "Suspicious sign in attempts", body)
+	return nil
 }
 
 func (d *Transaction) Signup(user, pass, token, UA string) (*smolboard.Session, error) {
@@ -140,121 +382,375 @@ func (d *Transaction) Signup(user, pass, token, UA string) (*smolboard.Session,
 		return nil, err
 	}
 
-	if err := d.createUser(user, pass, smolboard.PermissionUser); err != nil {
+	if err := d.createUser(user, pass, d.config.signupPermission); err != nil {
 		return nil, err
 	}
 
-	return d.newSession(user, UA)
+	return d.newSession(user, UA, smolboard.ScopeWrite)
 }
 
 func (d *Transaction) Signout() error {
-	c, err := d.execChanged(
-		"DELETE FROM sessions WHERE authtoken = ?",
-		d.Session.AuthToken,
-	)
-	if err != nil {
-		return errors.Wrap(err, "Failed to delete token")
-	}
-	if !c {
-		return smolboard.ErrSessionNotFound
-	}
-	return err
+	return d.config.SessionStore.Delete(d, d.Session.Username, d.Session.ID)
 }
 
 // SessionFromID returns a queried session from the database. It returns the
-// current session state if the ID matches.
-func (d *Transaction) SessionFromID(id int64) (s *smolboard.Session, err error) {
+// current session state if the ID matches. Only the user's own sessions can be
+// queried, and they will not have an AuthToken.
+func (d *Transaction) SessionFromID(id int64) (*smolboard.Session, error) {
 	if id == d.Session.ID {
 		return &d.Session, nil
 	}
 
-	err = d.
-		QueryRowx("SELECT * FROM sessions WHERE id = ?", id).
-		StructScan(&s)
-
+	sessions, err := d.config.SessionStore.ListByUser(d, d.Session.Username)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, smolboard.ErrSessionNotFound
+		return nil, err
+	}
+
+	for _, s := range sessions {
+		if s.ID == id {
+			s.AuthToken = ""
+			return &s, nil
 		}
-		err = errors.Wrap(err, "Failed to query session")
 	}
 
+	return nil, smolboard.ErrSessionNotFound
+}
+
+// SessionByID returns the metadata of any user's session. Only administrators
+// and higher can do this, and each lookup is logged.
+func (d *Transaction) SessionByID(id int64) (*smolboard.SessionExport, error) {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return nil, err
+	}
+
+	s, err := d.config.SessionStore.LookupID(d, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.auditf("session.lookup", s.Username, "session %d", s.ID); err != nil {
+		return nil, err
+	}
+
+	var export = s.Export()
+	return &export, nil
+}
+
+// AdminDeleteSession deletes any user's session with the given ID. Only
+// administrators who outrank the session's owner can do this. Use
+// DeleteSessionID to delete the current user's own sessions.
+func (d *Transaction) AdminDeleteSession(id int64) error {
+	// Check this early to not leak which session IDs exist.
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	s, err := d.config.SessionStore.LookupID(d, id)
+	if err != nil {
+		return err
+	}
+
+	if err := d.requireOwnerOrPermission(s.Username, smolboard.PermissionAdministrator); err != nil {
+		return err
+	}
+
+	if err := d.config.SessionStore.Delete(d, s.Username, s.ID); err != nil {
+		return err
+	}
+
+	return d.auditf("session.delete", s.Username, "session %d", s.ID)
+}
+
+// RevokeUserSessions deletes all of the given user's sessions and API keys and
+// returns how many sessions were deleted. Only administrators who outrank the
+// user can do this. Unlike a ban, the user can sign in again afterwards.
+func (d *Transaction) RevokeUserSessions(username string) (int, error) {
+	// Revoking one's own sessions this way would also revoke the current one.
+	if username == d.Session.Username {
+		return 0, smolboard.ErrActionNotPermitted
+	}
+
+	if err := d.HasPermOverUser(smolboard.PermissionAdministrator, username); err != nil {
+		return 0, err
+	}
+
+	sessions, err := d.config.SessionStore.ListByUser(d, username)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.config.SessionStore.DeleteByUser(d, username, 0); err != nil {
+		return 0, err
+	}
+
+	// API keys would otherwise outlive the sessions of a compromised user.
+	if err := d.deleteAPIKeys(username); err != nil {
+		return 0, err
+	}
+
+	if err := d.auditf("user.revoke-sessions", username, "%d sessions", len(sessions)); err != nil {
+		return 0, err
+	}
+
+	return len(sessions), nil
+}
+
+// ExpireAllSessions deletes the sessions and API keys of all users, including
+// the current one, and returns how many sessions were deleted. JWT sessions
+// can't be counted, but all JWTs issued until now are revoked. Only the owner
+// can do this.
+func (d *Transaction) ExpireAllSessions() (int, error) {
+	if err := d.HasPermission(smolboard.PermissionOwner, true); err != nil {
+		return 0, err
+	}
+
+	return d.expireAllSessions()
+}
+
+func (d *Transaction) expireAllSessions() (int, error) {
+	n, err := d.config.SessionStore.DeleteAll(d)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := d.Exec("DELETE FROM apikeys"); err != nil {
+		return 0, errors.Wrap(err, "Failed to delete API keys")
+	}
+
+	if err := d.auditf("session.expire-all", "", "%d sessions", n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// ExpireAllSessions is Transaction's ExpireAllSessions for the command line,
+// which skips the permission check. The audit entry has no actor.
+func (d *Database) ExpireAllSessions(ctx context.Context) (n int, err error) {
+	err = d.AcquireGuest(ctx, func(tx *Transaction) error {
+		n, err = tx.expireAllSessions()
+		return err
+	})
 	return
 }
 
+// sessionCountChunk is the number of usernames counted per query. It is kept
+// well below SQLite's variable limit.
+const sessionCountChunk = 256
+
+// SessionCountsByUsers returns the number of active sessions of each given user
+// without querying once per user. Users without sessions are left out. Only
+// administrators can do this.
+func (d *Transaction) SessionCountsByUsers(usernames []string) (map[string]int, error) {
+	p, err := d.Permission()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return nil, err
+	}
+
+	return d.sessionCountsByUsers(usernames)
+}
+
+func (d *Transaction) sessionCountsByUsers(usernames []string) (map[string]int, error) {
+	var counts = make(map[string]int, len(usernames))
+
+	counter, ok := d.config.SessionStore.(SessionCounter)
+	if !ok {
+		// The store can't count, so fall back to listing each user's sessions.
+		for _, username := range usernames {
+			sessions, err := d.config.SessionStore.ListByUser(d, username)
+			if err != nil {
+				return nil, err
+			}
+			if len(sessions) > 0 {
+				counts[username] = len(sessions)
+			}
+		}
+
+		return counts, nil
+	}
+
+	for len(usernames) > 0 {
+		var chunk = usernames
+		if len(chunk) > sessionCountChunk {
+			chunk = chunk[:sessionCountChunk]
+		}
+		usernames = usernames[len(chunk):]
+
+		c, err := counter.CountByUsers(d, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		for username, count := range c {
+			counts[username] = count
+		}
+	}
+
+	return counts, nil
+}
+
+// KeepAlive returns the current session after it was renewed when the
+// transaction was started, so its deadline is the new one. The token may have
+// changed as well, depending on the session store.
+func (d *Transaction) KeepAlive() (*smolboard.Session, error) {
+	if d.Session.ID == 0 {
+		return nil, smolboard.ErrSessionNotFound
+	}
+
+	var s = d.Session
+	return &s, nil
+}
+
+// RotateToken replaces the current session's token with a new one, keeping its
+// ID and deadline, and returns the session with the new token. The old token
+// stops working immediately. ErrRotateUnsupported is returned if the session
+// store can't do this.
+func (d *Transaction) RotateToken() (*smolboard.Session, error) {
+	if d.Session.ID == 0 {
+		return nil, smolboard.ErrSessionNotFound
+	}
+
+	// API keys are revoked and created instead.
+	if err := d.notAPIKey(); err != nil {
+		return nil, err
+	}
+
+	rotator, ok := d.config.SessionStore.(SessionRotator)
+	if !ok {
+		return nil, smolboard.ErrRotateUnsupported
+	}
+
+	var s = d.Session
+
+	for i := 0; ; i++ {
+		t, err := randToken(d.config.TokenLength)
+		if err != nil {
+			return nil, err
+		}
+
+		err = rotator.Rotate(d, &s, t)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, ErrTokenTaken) || i == maxTokenAttempts-1 {
+			return nil, err
+		}
+	}
+
+	d.Session = s
+	return &s, nil
+}
+
 // Sessions returns a list of sessions. The sessions will not have an AuthToken
 // unless it is the current session. The sessions will be sorted from newest to
 // oldest.
 func (d *Transaction) Sessions() ([]smolboard.Session, error) {
-	// Get any sessions with the deadline before now.
-	var now = time.Now().UnixNano()
-
-	r, err := d.Queryx(
-		"SELECT * FROM sessions WHERE username = ? AND deadline > ? ORDER BY id DESC",
-		d.Session.Username, now,
-	)
+	sessions, err := d.config.SessionStore.ListByUser(d, d.Session.Username)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to query for sessions")
+		return nil, err
+	}
+
+	for i, s := range sessions {
+		if s.ID != d.Session.ID {
+			sessions[i].AuthToken = ""
+		}
 	}
 
-	defer r.Close()
+	return sessions, nil
+}
 
-	var sessions []smolboard.Session
+// SessionList returns a page of the current user's sessions, like Sessions. All
+// sessions are returned if count is 0.
+func (d *Transaction) SessionList(count, page uint) (smolboard.SessionList, error) {
+	if count > 100 {
+		return smolboard.SessionList{}, smolboard.ErrPageCountLimit
+	}
 
-	for r.Next() {
-		var s smolboard.Session
+	sessions, err := d.Sessions()
+	if err != nil {
+		return smolboard.SessionList{}, err
+	}
 
-		if err := r.StructScan(&s); err != nil {
-			return nil, errors.Wrap(err, "Failed to scan to a session")
+	var list = smolboard.SessionList{Sessions: sessions}
+
+	if count > 0 {
+		var start = int(count * page)
+		if start > len(sessions) {
+			start = len(sessions)
 		}
 
-		if s.ID != d.Session.ID {
-			s.AuthToken = ""
+		var end = start + int(count)
+		if end > len(sessions) {
+			end = len(sessions)
 		}
 
-		sessions = append(sessions, s)
+		list.Sessions = sessions[start:end]
+		list.Page = smolboard.NewPage(len(sessions), start, int(count), len(list.Sessions))
+	} else {
+		list.Page = smolboard.NewPage(len(sessions), 0, 0, len(sessions))
 	}
 
-	return sessions, nil
+	return list, nil
 }
 
-// DeleteSessionID deletes the person's own session ID.
-func (d *Transaction) DeleteSessionID(id int64) error {
-	// Prevent deleting the same session without properly signing out.
-	if d.Session.ID == id {
-		return d.Signout()
+// SessionCount returns the number of the person's active sessions.
+func (d *Transaction) SessionCount() (int, error) {
+	if counter, ok := d.config.SessionStore.(SessionCounter); ok {
+		return counter.CountByUser(d, d.Session.Username)
 	}
 
+	sessions, err := d.config.SessionStore.ListByUser(d, d.Session.Username)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(sessions), nil
+}
+
+// DeleteSessionID deletes the person's own session ID.
+func (d *Transaction) DeleteSessionID(id int64) error {
 	// Ensure that we are deleting only this user's token.
-	c, err := d.execChanged(
-		"DELETE FROM sessions WHERE id = ? AND username = ?",
-		id, d.Session.Username,
-	)
+	return d.config.SessionStore.Delete(d, d.Session.Username, id)
+}
+
+// RenameSession sets the name of one of the person's own sessions. Control
+// characters are stripped from the name, and an empty name clears it.
+func (d *Transaction) RenameSession(id int64, name string) error {
+	name, err := smolboard.CleanSessionName(name)
 	if err != nil {
-		return errors.Wrap(err, "Failed to delete token with ID")
+		return err
+	}
+
+	if err := d.config.SessionStore.Rename(d, d.Session.Username, id, name); err != nil {
+		return err
 	}
-	if !c {
-		return smolboard.ErrSessionNotFound
+
+	if id == d.Session.ID {
+		d.Session.Name = name
 	}
+
 	return nil
 }
 
 // DeleteAllSessions deletes all sessions except the current one.
 func (d *Transaction) DeleteAllSessions() error {
-	_, err := d.Exec(
-		"DELETE FROM sessions WHERE username = ? AND id != ?",
-		d.Session.Username, d.Session.ID,
-	)
-	if err != nil {
-		return errors.Wrap(err, "Failed to delete sessions")
-	}
-	return nil
+	return d.config.SessionStore.DeleteByUser(d, d.Session.Username, d.Session.ID)
 }
 
-func randToken() (string, error) {
-	var token = make([]byte, 32)
+// tokenRand is the source of session and mail tokens. It is only replaced in
+// tests.
+var tokenRand io.Reader = rand.Reader
+
+// randToken generates a base64url token from n random bytes.
+func randToken(n int) (string, error) {
+	var token = make([]byte, n)
 
-	if _, err := rand.Read(token); err != nil {
+	if _, err := io.ReadFull(tokenRand, token); err != nil {
 		return "", errors.Wrap(err, "Failed to generate randomness")
 	}
 
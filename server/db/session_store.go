@@ -0,0 +1,327 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// ErrTokenTaken is returned by SessionStore.Create if another session already
+// has the new session's token. A new token is then generated.
+var ErrTokenTaken = errors.New("session token is already taken")
+
+// SessionStore persists sessions. All methods are called with the transaction
+// of the current request, which stores may use or ignore.
+type SessionStore interface {
+	// Create saves the new session. The store may replace the session's
+	// AuthToken. ErrTokenTaken should be returned if the token isn't unique.
+	Create(tx *Transaction, s *smolboard.Session) error
+	// Lookup returns the session with the given token. ErrSessionExpired is
+	// returned if the session doesn't exist or is expired.
+	Lookup(tx *Transaction, token string) (*smolboard.Session, error)
+	// LookupID returns the session with the given ID regardless of its owner.
+	// ErrSessionNotFound is returned if the session doesn't exist or is
+	// expired.
+	LookupID(tx *Transaction, id int64) (*smolboard.Session, error)
+	// Renew sets the session's deadline to the given time in Unix nanoseconds.
+	// The store may replace the session's AuthToken.
+	Renew(tx *Transaction, s *smolboard.Session, deadline int64) error
+	// Delete deletes the session with the given ID, but only if it belongs to
+	// the given user. ErrSessionNotFound is returned otherwise.
+	Delete(tx *Transaction, username string, id int64) error
+	// Rename sets the name of the session with the given ID, but only if it
+	// belongs to the given user. ErrSessionNotFound is returned otherwise.
+	Rename(tx *Transaction, username string, id int64, name string) error
+	// DeleteByUser deletes all sessions of the given user except for the one
+	// with the keep ID, which can be 0.
+	DeleteByUser(tx *Transaction, username string, keep int64) error
+	// ListByUser returns all active sessions of the given user from newest to
+	// oldest.
+	ListByUser(tx *Transaction, username string) ([]smolboard.Session, error)
+	// DeleteAll deletes the sessions of all users and returns how many were
+	// deleted. Stores that don't keep track of sessions return 0.
+	DeleteAll(tx *Transaction) (int, error)
+}
+
+// SessionCounter is an optional interface that a SessionStore may implement to
+// count sessions without listing them.
+type SessionCounter interface {
+	// CountByUser returns the number of active sessions of the given user.
+	CountByUser(tx *Transaction, username string) (int, error)
+	// CountByUsers returns the number of active sessions of each given user in
+	// a single query. Users without sessions may be left out.
+	CountByUsers(tx *Transaction, usernames []string) (map[string]int, error)
+}
+
+// SessionRotator is an optional interface that a SessionStore may implement to
+// replace the tokens of sessions. Stores that can't invalidate old tokens, such
+// as the JWT store, must not implement it.
+type SessionRotator interface {
+	// Rotate replaces the session's token with the given one, keeping
+	// everything else. The old token must stop working immediately.
+	// ErrSessionExpired is returned if the session no longer exists, and
+	// ErrTokenTaken is returned if the new token isn't unique.
+	Rotate(tx *Transaction, s *smolboard.Session, token string) error
+}
+
+// SQLSessionStore is the default SessionStore, which keeps sessions in the
+// sessions table.
+type SQLSessionStore struct{}
+
+var _ SessionStore = SQLSessionStore{}
+var _ SessionCounter = SQLSessionStore{}
+var _ SessionRotator = SQLSessionStore{}
+
+func (SQLSessionStore) Create(tx *Transaction, s *smolboard.Session) error {
+	_, err := tx.Exec(
+		`INSERT INTO sessions
+			(id, username, authtoken, deadline, useragent, impersonatedby, name, device, scope)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.Username, s.AuthToken, s.Deadline,
+		s.UserAgent, s.ImpersonatedBy, s.Name, s.Device, s.Scope,
+	)
+
+	if err != nil {
+		if errIsUnique(err, "sessions.authtoken") {
+			return ErrTokenTaken
+		}
+		return errors.Wrap(err, "Failed to save session")
+	}
+
+	// Execute cleanup of expired sessions.
+	return tx.cleanupSession(tx.sessionExpiry())
+}
+
+func (SQLSessionStore) Lookup(tx *Transaction, token string) (*smolboard.Session, error) {
+	var s smolboard.Session
+
+	err := tx.
+		QueryRowx("SELECT * FROM sessions WHERE authtoken = ?", token).
+		StructScan(&s)
+
+	if err != nil {
+		// Treat session not found errors as expired to make them the same as
+		// actual expired (and deleted) tokens.
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, smolboard.ErrSessionExpired
+		}
+
+		return nil, errors.Wrap(err, "Failed to scan session")
+	}
+
+	// Expired sessions are deleted on the next cleanup. The cutoff must be the
+	// same as the other queries, so that a session is either usable and
+	// listed, or neither.
+	if s.Deadline < tx.sessionExpiry() {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	return &s, nil
+}
+
+func (SQLSessionStore) LookupID(tx *Transaction, id int64) (*smolboard.Session, error) {
+	var s smolboard.Session
+
+	err := tx.
+		QueryRowx("SELECT * FROM sessions WHERE id = ? AND deadline >= ?", id, tx.sessionExpiry()).
+		StructScan(&s)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, smolboard.ErrSessionNotFound
+		}
+		return nil, errors.Wrap(err, "Failed to scan session")
+	}
+
+	return &s, nil
+}
+
+func (SQLSessionStore) Renew(tx *Transaction, s *smolboard.Session, deadline int64) error {
+	_, err := tx.Exec("UPDATE sessions SET deadline = ? WHERE id = ?", deadline, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to renew token")
+	}
+
+	s.Deadline = deadline
+	return nil
+}
+
+func (SQLSessionStore) Rotate(tx *Transaction, s *smolboard.Session, token string) error {
+	c, err := tx.execChanged(
+		"UPDATE sessions SET authtoken = ? WHERE id = ? AND authtoken = ?",
+		token, s.ID, s.AuthToken,
+	)
+	if err != nil {
+		if errIsUnique(err, "sessions.authtoken") {
+			return ErrTokenTaken
+		}
+		return errors.Wrap(err, "Failed to rotate token")
+	}
+	if !c {
+		return smolboard.ErrSessionExpired
+	}
+
+	s.AuthToken = token
+	return nil
+}
+
+func (SQLSessionStore) Delete(tx *Transaction, username string, id int64) error {
+	c, err := tx.execChanged(
+		"DELETE FROM sessions WHERE id = ? AND username = ?",
+		id, username,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete token")
+	}
+	if !c {
+		return smolboard.ErrSessionNotFound
+	}
+	return nil
+}
+
+func (SQLSessionStore) DeleteAll(tx *Transaction) (int, error) {
+	r, err := tx.Exec("DELETE FROM sessions")
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to delete sessions")
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get rows affected")
+	}
+
+	return int(n), nil
+}
+
+func (SQLSessionStore) Rename(tx *Transaction, username string, id int64, name string) error {
+	c, err := tx.execChanged(
+		"UPDATE sessions SET name = ? WHERE id = ? AND username = ?",
+		name, id, username,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to rename session")
+	}
+	if !c {
+		return smolboard.ErrSessionNotFound
+	}
+	return nil
+}
+
+func (SQLSessionStore) DeleteByUser(tx *Transaction, username string, keep int64) error {
+	_, err := tx.Exec(
+		"DELETE FROM sessions WHERE username = ? AND id != ?",
+		username, keep,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete sessions")
+	}
+	return nil
+}
+
+func (SQLSessionStore) ListByUser(tx *Transaction, username string) ([]smolboard.Session, error) {
+	r, err := tx.Queryx(
+		"SELECT * FROM sessions WHERE username = ? AND deadline >= ? ORDER BY id DESC",
+		username, tx.sessionExpiry(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query for sessions")
+	}
+
+	defer r.Close()
+
+	var sessions []smolboard.Session
+
+	for r.Next() {
+		var s smolboard.Session
+
+		if err := r.StructScan(&s); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan to a session")
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	return sessions, nil
+}
+
+func (SQLSessionStore) CountByUser(tx *Transaction, username string) (int, error) {
+	var count int
+
+	err := tx.
+		QueryRow(
+			"SELECT COUNT(*) FROM sessions WHERE username = ? AND deadline >= ?",
+			username, tx.sessionExpiry(),
+		).
+		Scan(&count)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to count sessions")
+	}
+
+	return count, nil
+}
+
+func (SQLSessionStore) CountByUsers(tx *Transaction, usernames []string) (map[string]int, error) {
+	q, args, err := sqlx.In(
+		`SELECT username, COUNT(*) FROM sessions
+			WHERE username IN (?) AND deadline >= ? GROUP BY username`,
+		usernames, tx.sessionExpiry(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to construct query")
+	}
+
+	r, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to count sessions")
+	}
+
+	defer r.Close()
+
+	var counts = make(map[string]int, len(usernames))
+
+	for r.Next() {
+		var username string
+		var count int
+
+		if err := r.Scan(&username, &count); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan session count")
+		}
+
+		counts[username] = count
+	}
+
+	return counts, r.Err()
+}
+
+// cleanupSession deletes up to one batch of expired sessions, so that creating
+// a session never waits on a large backlog. The janitor deletes the rest.
+func (d *Transaction) cleanupSession(now int64) error {
+	_, err := d.Exec(cleanupSessionsQuery, now, d.config.SessionCleanupBatch)
+	if err != nil {
+		return errors.Wrap(err, "Faield to cleanup expired sessions")
+	}
+	return nil
+}
+
+// cleanupSessionsQuery deletes a batch of expired sessions. SQLite is usually
+// built without DELETE ... LIMIT, so the batch is picked in a subquery.
+const cleanupSessionsQuery = `
+	DELETE FROM sessions WHERE id IN (
+		SELECT id FROM sessions WHERE deadline < ? LIMIT ?
+	)`
+
+// errIsUnique returns true if the error is from a unique constraint failing on
+// the given table column, such as "sessions.authtoken".
+func errIsUnique(err error, column string) bool {
+	var sqlerr sqlite3.Error
+	if !errors.As(err, &sqlerr) || sqlerr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return false
+	}
+
+	return strings.Contains(sqlerr.Error(), column)
+}
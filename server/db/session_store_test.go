@@ -0,0 +1,262 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// memorySessionStore is a SessionStore that keeps sessions in a map.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]smolboard.Session // token -> session
+}
+
+var _ SessionStore = (*memorySessionStore)(nil)
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: map[string]smolboard.Session{}}
+}
+
+func (m *memorySessionStore) Create(_ *Transaction, s *smolboard.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[s.AuthToken] = *s
+	return nil
+}
+
+func (m *memorySessionStore) Lookup(_ *Transaction, token string) (*smolboard.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[token]
+	if !ok || time.Now().UnixNano() > s.Deadline {
+		return nil, smolboard.ErrSessionExpired
+	}
+
+	return &s, nil
+}
+
+func (m *memorySessionStore) LookupID(_ *Transaction, id int64) (*smolboard.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		if s.ID == id && time.Now().UnixNano() < s.Deadline {
+			return &s, nil
+		}
+	}
+
+	return nil, smolboard.ErrSessionNotFound
+}
+
+func (m *memorySessionStore) Renew(_ *Transaction, s *smolboard.Session, deadline int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.Deadline = deadline
+	m.sessions[s.AuthToken] = *s
+	return nil
+}
+
+func (m *memorySessionStore) Rotate(_ *Transaction, s *smolboard.Session, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[s.AuthToken]; !ok {
+		return smolboard.ErrSessionExpired
+	}
+
+	delete(m.sessions, s.AuthToken)
+	s.AuthToken = token
+	m.sessions[token] = *s
+	return nil
+}
+
+func (m *memorySessionStore) Delete(_ *Transaction, username string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, s := range m.sessions {
+		if s.ID == id && s.Username == username {
+			delete(m.sessions, token)
+			return nil
+		}
+	}
+
+	return smolboard.ErrSessionNotFound
+}
+
+func (m *memorySessionStore) Rename(_ *Transaction, username string, id int64, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, s := range m.sessions {
+		if s.ID == id && s.Username == username {
+			s.Name = name
+			m.sessions[token] = s
+			return nil
+		}
+	}
+
+	return smolboard.ErrSessionNotFound
+}
+
+func (m *memorySessionStore) DeleteByUser(_ *Transaction, username string, keep int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, s := range m.sessions {
+		if s.Username == username && s.ID != keep {
+			delete(m.sessions, token)
+		}
+	}
+
+	return nil
+}
+
+func (m *memorySessionStore) DeleteAll(_ *Transaction) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n = len(m.sessions)
+	m.sessions = map[string]smolboard.Session{}
+
+	return n, nil
+}
+
+func (m *memorySessionStore) ListByUser(_ *Transaction, username string) ([]smolboard.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []smolboard.Session
+
+	for _, s := range m.sessions {
+		if s.Username == username {
+			sessions = append(sessions, s)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID > sessions[j].ID
+	})
+
+	return sessions, nil
+}
+
+func TestSessionStore(t *testing.T) {
+	var store = newMemorySessionStore()
+
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.SessionStore = store
+	})
+
+	s := testNewOwner(t, d, "ひめありかわ", "password")
+
+	if _, err := store.Lookup(nil, s.AuthToken); err != nil {
+		t.Fatal("Session not created in the store:", err)
+	}
+
+	// The SQL table should not be touched.
+	var count int
+	if err := d.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count); err != nil {
+		t.Fatal("Failed to count sessions:", err)
+	}
+	if count != 0 {
+		t.Fatal("Unexpected sessions in the database:", count)
+	}
+
+	username, err := d.SessionUsername(context.Background(), s.AuthToken)
+	if err != nil {
+		t.Fatal("Failed to get session username:", err)
+	}
+	if username != s.Username {
+		t.Fatalf("Unexpected session username: %q", username)
+	}
+
+	err = d.Acquire(context.Background(), s.AuthToken, func(tx *Transaction) error {
+		if tx.Session.ID != s.ID {
+			t.Fatalf("Unexpected session ID %d, expected %d", tx.Session.ID, s.ID)
+		}
+
+		sessions, err := tx.Sessions()
+		if err != nil {
+			return errors.Wrap(err, "Failed to list sessions")
+		}
+		if len(sessions) != 1 {
+			t.Fatalf("Unexpected sessions: %#v", sessions)
+		}
+
+		return tx.Signout()
+	})
+
+	if err != nil {
+		t.Fatal("Failed to sign out:", err)
+	}
+
+	_, err = BeginTx(context.Background(), d, s.AuthToken)
+	if !errors.Is(err, smolboard.ErrSessionExpired) {
+		t.Fatal("Unexpected error using signed out session:", err)
+	}
+}
+
+// countingSessionStore counts the renewals written to the wrapped store.
+type countingSessionStore struct {
+	SQLSessionStore
+	renewals int
+}
+
+func (c *countingSessionStore) Renew(tx *Transaction, s *smolboard.Session, deadline int64) error {
+	c.renewals++
+	return c.SQLSessionStore.Renew(tx, s, deadline)
+}
+
+// BenchmarkSessionRenewBurst measures the number of renewals written when a
+// burst of requests arrives for a session that is due for renewal.
+func BenchmarkSessionRenewBurst(b *testing.B) {
+	const burst = 50
+
+	for _, min := range []string{"0s", "1m"} {
+		b.Run("min="+min, func(b *testing.B) {
+			var store = &countingSessionStore{}
+
+			d := newTestDatabaseWith(b, func(cfg *DBConfig) {
+				cfg.MinSessionRenewal = min
+				cfg.SessionStore = store
+			})
+
+			s := testNewOwner(b, d, "ひめありかわ", "password")
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// Make the session due for renewal again.
+				_, err := d.Exec(
+					"UPDATE sessions SET deadline = deadline - ? WHERE id = ?",
+					int64(time.Hour), s.ID,
+				)
+				if err != nil {
+					b.Fatal("Failed to age session:", err)
+				}
+
+				for j := 0; j < burst; j++ {
+					tx, err := BeginTx(context.Background(), d, s.AuthToken)
+					if err != nil {
+						b.Fatal("Failed to begin transaction:", err)
+					}
+					if err := tx.Commit(); err != nil {
+						b.Fatal("Failed to commit:", err)
+					}
+				}
+			}
+
+			b.ReportMetric(float64(store.renewals)/float64(b.N), "renewals/op")
+		})
+	}
+}
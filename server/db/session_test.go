@@ -2,11 +2,18 @@ package db
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-test/deep"
 	"github.com/pkg/errors"
 )
 
@@ -165,6 +172,295 @@ func TestSessionDeleteAll(t *testing.T) {
 	}
 }
 
+func TestSessionRename(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやひめ", smolboard.PermissionUser)
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	if err := tx.RenameSession(owner.ID, " My\x00 laptop\n"); err != nil {
+		t.Fatal("Failed to rename session:", err)
+	}
+
+	if tx.Session.Name != "My laptop" {
+		t.Fatalf("Unexpected current session name: %q", tx.Session.Name)
+	}
+
+	sessions, err := tx.Sessions()
+	if err != nil {
+		t.Fatal("Failed to get sessions:", err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Name != "My laptop" {
+		t.Fatalf("Unexpected sessions: %#v", sessions)
+	}
+
+	var long = strings.Repeat("a", smolboard.MaxSessionNameLen+1)
+	if err := tx.RenameSession(owner.ID, long); !errors.Is(err, smolboard.ErrSessionNameTooLong) {
+		t.Fatal("Unexpected error renaming with a long name:", err)
+	}
+
+	// Other users' sessions are treated as nonexistent.
+	if err := tx.RenameSession(user.ID, "mine"); !errors.Is(err, smolboard.ErrSessionNotFound) {
+		t.Fatal("Unexpected error renaming another user's session:", err)
+	}
+}
+
+func TestSessionScope(t *testing.T) {
+	d := newTestDatabase(t)
+
+	testNewOwner(t, d, "ひめありかわ", "password")
+
+	var s *smolboard.Session
+
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) (err error) {
+		if _, err := tx.SigninScoped("ひめありかわ", "password", "iOS", "admin"); !errors.Is(err, smolboard.ErrInvalidScope) {
+			t.Fatal("Unexpected error signing in with an invalid scope:", err)
+		}
+
+		s, err = tx.SigninScoped("ひめありかわ", "password", "iOS", smolboard.ScopeRead)
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	tx := testBeginTx(t, d, s.AuthToken)
+
+	if !tx.Session.ReadOnly() {
+		t.Fatalf("Unexpected scope of the current session: %q", tx.Session.Scope)
+	}
+
+	sessions, err := tx.Sessions()
+	if err != nil {
+		t.Fatal("Failed to get sessions:", err)
+	}
+
+	var scopes = map[int64]string{}
+	for _, s := range sessions {
+		scopes[s.ID] = s.Scope
+	}
+
+	if len(scopes) != 2 || scopes[s.ID] != smolboard.ScopeRead {
+		t.Fatalf("Unexpected sessions: %#v", sessions)
+	}
+
+	for id, scope := range scopes {
+		if id != s.ID && scope != smolboard.ScopeWrite {
+			t.Fatalf("Unexpected scope of the owner's other session: %q", scope)
+		}
+	}
+}
+
+func TestSessionByID(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやひめ", smolboard.PermissionUser)
+
+	t.Run("Admin", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		export, err := tx.SessionByID(user.ID)
+		if err != nil {
+			t.Fatal("Failed to look up session:", err)
+		}
+
+		if eq := deep.Equal(*export, user.Export()); eq != nil {
+			t.Fatal("Unexpected session export:", eq)
+		}
+
+		if _, err := tx.SessionByID(1); !errors.Is(err, smolboard.ErrSessionNotFound) {
+			t.Fatal("Unexpected error looking up unknown session:", err)
+		}
+	})
+
+	t.Run("Normal", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if _, err := tx.SessionByID(owner.ID); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error looking up session as a normal user:", err)
+		}
+	})
+}
+
+func TestSessionAdminDelete(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	admin1 := newTestUser(t, d, owner.AuthToken, "admin1", smolboard.PermissionAdministrator)
+	admin2 := newTestUser(t, d, owner.AuthToken, "admin2", smolboard.PermissionAdministrator)
+	user := newTestUser(t, d, owner.AuthToken, "かぐやひめ", smolboard.PermissionUser)
+
+	t.Run("Normal", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		err := tx.AdminDeleteSession(admin1.ID)
+		if !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error deleting session as a normal user:", err)
+		}
+
+		// The self-scoped version still can't delete others' sessions.
+		err = tx.DeleteSessionID(admin1.ID)
+		if !errors.Is(err, smolboard.ErrSessionNotFound) {
+			t.Fatal("Unexpected error deleting another user's session:", err)
+		}
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		tx := testBeginTx(t, d, admin1.AuthToken)
+
+		err := tx.AdminDeleteSession(admin2.ID)
+		if !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error deleting another admin's session:", err)
+		}
+
+		if err := tx.AdminDeleteSession(user.ID); err != nil {
+			t.Fatal("Failed to delete user's session:", err)
+		}
+
+		err = tx.AdminDeleteSession(user.ID)
+		if !errors.Is(err, smolboard.ErrSessionNotFound) {
+			t.Fatal("Unexpected error deleting a deleted session:", err)
+		}
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		_, err := BeginTx(context.Background(), d, user.AuthToken)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using deleted session:", err)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		entries, err := tx.AuditLog(0, 10)
+		if err != nil {
+			t.Fatal("Failed to get audit log:", err)
+		}
+
+		if len(entries) == 0 || entries[0].Action != "session.delete" {
+			t.Fatalf("Unexpected audit log: %#v", entries)
+		}
+
+		if entries[0].Actor != admin1.Username || entries[0].Target != user.Username {
+			t.Fatalf("Unexpected audit entry: %#v", entries[0])
+		}
+	})
+}
+
+func TestSessionRevokeUser(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	admin1 := newTestUser(t, d, owner.AuthToken, "admin1", smolboard.PermissionAdministrator)
+	admin2 := newTestUser(t, d, owner.AuthToken, "admin2", smolboard.PermissionAdministrator)
+	user := newTestUser(t, d, owner.AuthToken, "かぐやひめ", smolboard.PermissionUser)
+
+	t.Run("Normal", func(t *testing.T) {
+		tx := testBeginTx(t, d, admin1.AuthToken)
+
+		n, err := tx.RevokeUserSessions(user.Username)
+		if err != nil {
+			t.Fatal("Failed to revoke user's sessions:", err)
+		}
+		if n != 1 {
+			t.Fatal("Unexpected revoked session count:", n)
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		_, err := BeginTx(context.Background(), d, user.AuthToken)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using revoked session:", err)
+		}
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		tx := testBeginTx(t, d, admin1.AuthToken)
+
+		_, err := tx.RevokeUserSessions(admin2.Username)
+		if !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error revoking another admin's sessions:", err)
+		}
+	})
+
+	t.Run("Owner", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if _, err := tx.RevokeUserSessions(admin2.Username); err != nil {
+			t.Fatal("Owner failed to revoke admin's sessions:", err)
+		}
+	})
+}
+
+func TestSessionExpireAll(t *testing.T) {
+	var modes = map[string]func(*DBConfig){
+		"Database": nil,
+		"JWT": func(cfg *DBConfig) {
+			cfg.SessionMode = SessionModeJWT
+			cfg.JWTSecret = testJWTSecret
+		},
+	}
+
+	for name, mode := range modes {
+		mode := mode
+
+		t.Run(name, func(t *testing.T) {
+			d := newTestDatabaseWith(t, mode)
+
+			owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+			admin := newTestUser(t, d, owner.AuthToken, "とよとみヒロ", smolboard.PermissionAdministrator)
+			user := newTestUser(t, d, owner.AuthToken, "かぐやひめ", smolboard.PermissionUser)
+
+			t.Run("Admin", func(t *testing.T) {
+				tx := testBeginTx(t, d, admin.AuthToken)
+
+				if _, err := tx.ExpireAllSessions(); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+					t.Fatal("Unexpected error expiring sessions as admin:", err)
+				}
+			})
+
+			t.Run("Owner", func(t *testing.T) {
+				tx := testBeginTx(t, d, owner.AuthToken)
+
+				n, err := tx.ExpireAllSessions()
+				if err != nil {
+					t.Fatal("Failed to expire all sessions:", err)
+				}
+
+				// JWT sessions can't be counted.
+				if name == "Database" && n != 3 {
+					t.Fatal("Unexpected expired session count:", n)
+				}
+
+				entries, err := tx.AuditLog(0, 1)
+				if err != nil {
+					t.Fatal("Failed to get audit log:", err)
+				}
+				if len(entries) != 1 || entries[0].Action != "session.expire-all" {
+					t.Fatalf("Unexpected audit log: %#v", entries)
+				}
+			})
+
+			t.Run("Expired", func(t *testing.T) {
+				for _, s := range []*smolboard.Session{owner, admin, user} {
+					_, err := BeginTx(context.Background(), d, s.AuthToken)
+					if !errors.Is(err, smolboard.ErrSessionExpired) {
+						t.Fatalf("Unexpected error using %s's expired session: %v", s.Username, err)
+					}
+					if code := httperr.ErrCode(err); code != 410 {
+						t.Fatal("Unexpected status code for expired session:", code)
+					}
+				}
+			})
+		})
+	}
+}
+
 func TestSessionExpiry(t *testing.T) {
 	d := newTestDatabase(t)
 	d.Config.tokenLifespan = 200 * time.Millisecond
@@ -173,7 +469,7 @@ func TestSessionExpiry(t *testing.T) {
 
 	tx := testBeginTx(t, d, owner.AuthToken)
 
-	s, err := tx.newSession("ひめありかわ", "A")
+	s, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
 	if err != nil {
 		t.Fatal("Failed to create session:", err)
 	}
@@ -211,3 +507,817 @@ func TestSessionExpiry(t *testing.T) {
 		t.Fatal("Unexpected error while deleting expired session:", err)
 	}
 }
+
+func TestSessionList(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	// There are 3 sessions including the owner's own.
+	for i := 0; i < 2; i++ {
+		if _, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite); err != nil {
+			t.Fatal("Failed to create session:", err)
+		}
+	}
+
+	var pages = []struct {
+		count, page uint
+		sessions    int
+		expect      smolboard.Page
+	}{
+		{2, 0, 2, smolboard.Page{Total: 3, Offset: 0, Limit: 2, HasMore: true}},
+		{2, 1, 1, smolboard.Page{Total: 3, Offset: 2, Limit: 2, HasMore: false}},
+		{2, 2, 0, smolboard.Page{Total: 3, Offset: 3, Limit: 2, HasMore: false}},
+		{0, 0, 3, smolboard.Page{Total: 3, Offset: 0, Limit: 0, HasMore: false}},
+	}
+
+	for _, test := range pages {
+		l, err := tx.SessionList(test.count, test.page)
+		if err != nil {
+			t.Fatal("Failed to list sessions:", err)
+		}
+
+		if len(l.Sessions) != test.sessions {
+			t.Fatalf("Unexpected session count on page %d: %d", test.page, len(l.Sessions))
+		}
+
+		if diff := deep.Equal(l.Page, test.expect); diff != nil {
+			t.Fatalf("Unexpected page %d: %v", test.page, diff)
+		}
+	}
+}
+
+func TestSessionGracePeriod(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	// query creates a new session, moves its deadline to the given duration
+	// ago, then queries it.
+	query := func(t *testing.T, ago time.Duration) (*smolboard.Session, error) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		s, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+		if err != nil {
+			t.Fatal("Failed to create session:", err)
+		}
+
+		var deadline = time.Now().Add(-ago).UnixNano()
+
+		_, err = tx.Exec("UPDATE sessions SET deadline = ? WHERE id = ?", deadline, s.ID)
+		if err != nil {
+			t.Fatal("Failed to age session:", err)
+		}
+
+		return tx.querySession(s.AuthToken)
+	}
+
+	t.Run("Strict", func(t *testing.T) {
+		if _, err := query(t, time.Second); !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error querying expired session:", err)
+		}
+	})
+
+	d.Config.sessionGracePeriod = time.Minute
+
+	t.Run("Within", func(t *testing.T) {
+		s, err := query(t, time.Minute-time.Second)
+		if err != nil {
+			t.Fatal("Failed to query session within the grace period:", err)
+		}
+
+		if s.Deadline <= time.Now().UnixNano() {
+			t.Fatal("Session within the grace period not renewed:", s.Deadline)
+		}
+	})
+
+	t.Run("Beyond", func(t *testing.T) {
+		if _, err := query(t, time.Minute+time.Second); !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error querying session beyond the grace period:", err)
+		}
+	})
+
+	// Sessions that can still be used must also be listed and counted, and
+	// the other way around.
+	t.Run("Listed", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		var ages = []time.Duration{time.Minute - time.Second, time.Minute + time.Second}
+		var ids = make([]int64, len(ages))
+
+		for i, ago := range ages {
+			s, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+			if err != nil {
+				t.Fatal("Failed to create session:", err)
+			}
+
+			var deadline = time.Now().Add(-ago).UnixNano()
+
+			_, err = tx.Exec("UPDATE sessions SET deadline = ? WHERE id = ?", deadline, s.ID)
+			if err != nil {
+				t.Fatal("Failed to age session:", err)
+			}
+
+			ids[i] = s.ID
+		}
+
+		var store = SQLSessionStore{}
+
+		if _, err := store.LookupID(tx, ids[0]); err != nil {
+			t.Fatal("Failed to look up session within the grace period:", err)
+		}
+		if _, err := store.LookupID(tx, ids[1]); !errors.Is(err, smolboard.ErrSessionNotFound) {
+			t.Fatal("Unexpected error looking up session beyond the grace period:", err)
+		}
+
+		sessions, err := store.ListByUser(tx, "ひめありかわ")
+		if err != nil {
+			t.Fatal("Failed to list sessions:", err)
+		}
+
+		count, err := store.CountByUser(tx, "ひめありかわ")
+		if err != nil {
+			t.Fatal("Failed to count sessions:", err)
+		}
+		if count != len(sessions) {
+			t.Fatalf("Counted %d sessions, but listed %d", count, len(sessions))
+		}
+
+		var listed = map[int64]bool{}
+		for _, s := range sessions {
+			listed[s.ID] = true
+		}
+
+		if !listed[ids[0]] || listed[ids[1]] {
+			t.Fatalf("Unexpected sessions listed: %v", listed)
+		}
+	})
+}
+
+func TestSessionMaxLifespan(t *testing.T) {
+	d := newTestDatabase(t)
+	d.Config.tokenLifespan = 30 * time.Minute
+	d.Config.minSessionRenewal = time.Minute
+	d.Config.maxSessionLifespan = 8 * time.Hour
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	// query creates a new session that was created the given duration ago and
+	// expires in the given duration, then queries it.
+	query := func(t *testing.T, age, left time.Duration) (*smolboard.Session, error) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		s, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+		if err != nil {
+			t.Fatal("Failed to create session:", err)
+		}
+
+		var id = NewZeroID(time.Now().Add(-age)) | s.ID&(1<<22-1)
+		var deadline = time.Now().Add(left).UnixNano()
+
+		_, err = tx.Exec(
+			"UPDATE sessions SET id = ?, deadline = ? WHERE id = ?",
+			id, deadline, s.ID,
+		)
+		if err != nil {
+			t.Fatal("Failed to age session:", err)
+		}
+
+		return tx.querySession(s.AuthToken)
+	}
+
+	// expectDeadline checks that the session expires in about the given
+	// duration.
+	expectDeadline := func(t *testing.T, s *smolboard.Session, left time.Duration) {
+		t.Helper()
+
+		if r := s.Remaining(); r < left-time.Second || r > left {
+			t.Fatalf("Session expires in %v, expected %v", r, left)
+		}
+	}
+
+	t.Run("New", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		s, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+		if err != nil {
+			t.Fatal("Failed to create session:", err)
+		}
+
+		expectDeadline(t, s, 30*time.Minute)
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		if _, err := query(t, time.Hour, -time.Second); !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error querying idle session:", err)
+		}
+	})
+
+	t.Run("Active", func(t *testing.T) {
+		s, err := query(t, time.Hour, 10*time.Minute)
+		if err != nil {
+			t.Fatal("Failed to query active session:", err)
+		}
+
+		expectDeadline(t, s, 30*time.Minute)
+	})
+
+	t.Run("NearMax", func(t *testing.T) {
+		s, err := query(t, 8*time.Hour-10*time.Minute, 5*time.Minute)
+		if err != nil {
+			t.Fatal("Failed to query session near its absolute timeout:", err)
+		}
+
+		// The renewal stops at the absolute timeout.
+		expectDeadline(t, s, 10*time.Minute)
+	})
+
+	t.Run("PastMax", func(t *testing.T) {
+		_, err := query(t, 8*time.Hour+time.Second, 10*time.Minute)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error querying session past its absolute timeout:", err)
+		}
+	})
+
+	t.Run("GracePeriod", func(t *testing.T) {
+		d.Config.sessionGracePeriod = 5 * time.Minute
+		defer func() { d.Config.sessionGracePeriod = 0 }()
+
+		// The grace period doesn't extend the absolute timeout.
+		_, err := query(t, 8*time.Hour+time.Second, -time.Second)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error querying session past its absolute timeout:", err)
+		}
+	})
+
+	t.Run("ShortMax", func(t *testing.T) {
+		d.Config.maxSessionLifespan = 10 * time.Minute
+		defer func() { d.Config.maxSessionLifespan = 8 * time.Hour }()
+
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		s, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+		if err != nil {
+			t.Fatal("Failed to create session:", err)
+		}
+
+		expectDeadline(t, s, 10*time.Minute)
+	})
+}
+
+func TestSessionRenewal(t *testing.T) {
+	d := newTestDatabaseWith(t, func(c *DBConfig) {
+		c.TokenLifespan = "1h"
+		c.TokenRenewal = "30m"
+		c.MinSessionRenewal = "0s"
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	s, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+	if err != nil {
+		t.Fatal("Failed to create session:", err)
+	}
+
+	if r := s.Remaining(); r < time.Hour-time.Second || r > time.Hour {
+		t.Fatalf("New session expires in %v, expected the initial lifespan", r)
+	}
+
+	_, err = tx.Exec(
+		"UPDATE sessions SET deadline = ? WHERE id = ?",
+		time.Now().Add(10*time.Minute).UnixNano(), s.ID,
+	)
+	if err != nil {
+		t.Fatal("Failed to age session:", err)
+	}
+
+	s, err = tx.querySession(s.AuthToken)
+	if err != nil {
+		t.Fatal("Failed to query session:", err)
+	}
+
+	if r := s.Remaining(); r < 30*time.Minute-time.Second || r > 30*time.Minute {
+		t.Fatalf("Renewed session expires in %v, expected the renewal lifespan", r)
+	}
+}
+
+// collidingReader reads zeros for the given number of reads, then random bytes.
+type collidingReader struct {
+	zeros int
+}
+
+func (r *collidingReader) Read(b []byte) (int, error) {
+	if r.zeros == 0 {
+		return rand.Read(b)
+	}
+
+	r.zeros--
+
+	for i := range b {
+		b[i] = 0
+	}
+
+	return len(b), nil
+}
+
+func TestSessionTokenCollision(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	// The first session takes the zero token, then the second session gets
+	// the same token before a random one.
+	tokenRand = &collidingReader{zeros: 2}
+	t.Cleanup(func() { tokenRand = rand.Reader })
+
+	first, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+	if err != nil {
+		t.Fatal("Failed to create session:", err)
+	}
+
+	second, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite)
+	if err != nil {
+		t.Fatal("Failed to create colliding session:", err)
+	}
+
+	if first.AuthToken == second.AuthToken {
+		t.Fatal("Colliding token wasn't regenerated")
+	}
+
+	for _, s := range []*smolboard.Session{first, second} {
+		q, err := tx.querySession(s.AuthToken)
+		if err != nil {
+			t.Fatal("Failed to query session:", err)
+		}
+		if q.ID != s.ID {
+			t.Fatalf("Token of session %d belongs to session %d", s.ID, q.ID)
+		}
+	}
+
+	// Rotating onto the first session's token should also regenerate it.
+	tokenRand = &collidingReader{zeros: 1}
+
+	rotated, err := tx.RotateToken()
+	if err != nil {
+		t.Fatal("Failed to rotate onto a colliding token:", err)
+	}
+	if rotated.AuthToken == first.AuthToken {
+		t.Fatal("Colliding rotated token wasn't regenerated")
+	}
+
+	// Give up if the token keeps colliding.
+	tokenRand = &collidingReader{zeros: maxTokenAttempts}
+
+	if _, err := tx.newSession("ひめありかわ", "A", smolboard.ScopeWrite); !errors.Is(err, ErrTokenTaken) {
+		t.Fatal("Unexpected error creating session with only colliding tokens:", err)
+	}
+}
+
+func TestSessionTokenLength(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.TokenLength = 24
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	b, err := base64.RawURLEncoding.DecodeString(owner.AuthToken)
+	if err != nil {
+		t.Fatal("Token is not URL-safe base64:", err)
+	}
+
+	if len(b) != 24 {
+		t.Fatal("Unexpected decoded token length:", len(b))
+	}
+
+	if url.QueryEscape(owner.AuthToken) != owner.AuthToken {
+		t.Fatal("Token is not URL-safe:", owner.AuthToken)
+	}
+
+	t.Run("TooShort", func(t *testing.T) {
+		cfg := NewConfig()
+		cfg.Owner = "ひめありかわ"
+		cfg.DatabasePath = "/dev/null"
+		cfg.TokenLength = MinTokenLength - 1
+
+		if err := cfg.Validate(); err == nil {
+			t.Fatal("Unexpected nil error validating a short token length")
+		}
+	})
+}
+
+func TestSessionCanceled(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	token := testOneTimeToken(t, d, owner.AuthToken)
+
+	// countSessions counts all sessions in the database.
+	countSessions := func(t *testing.T) (n int) {
+		t.Helper()
+
+		if err := d.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&n); err != nil {
+			t.Fatal("Failed to count sessions:", err)
+		}
+		return
+	}
+
+	var sessions = countSessions(t)
+
+	t.Run("Signin", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		err := d.AcquireGuest(ctx, func(tx *Transaction) error {
+			// Cancel the request while the password is being hashed, which
+			// takes a while.
+			time.AfterFunc(10*time.Millisecond, cancel)
+
+			_, err := tx.Signin(owner.Username, "goodpassword", "iOS")
+			return err
+		})
+
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("Unexpected error signing in with a canceled context:", err)
+		}
+	})
+
+	t.Run("Signup", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := d.AcquireGuest(ctx, func(tx *Transaction) error {
+			_, err := tx.Signup("かぐやありかわ", "goodpassword", token, "iOS")
+			return err
+		})
+
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("Unexpected error signing up with a canceled context:", err)
+		}
+	})
+
+	if n := countSessions(t); n != sessions {
+		t.Fatalf("Sessions were created: expected %d, got %d", sessions, n)
+	}
+
+	// The token should not have been used up.
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		_, err := tx.Signup("かぐやありかわ", "goodpassword", token, "iOS")
+		return err
+	})
+	if err != nil {
+		t.Fatal("Failed to sign up after a canceled signup:", err)
+	}
+}
+
+func TestSessionImpersonate(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	admin := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionAdministrator)
+	user := newTestUser(t, d, owner.AuthToken, "いとうまお", smolboard.PermissionUser)
+
+	t.Run("Denied", func(t *testing.T) {
+		for _, s := range []*smolboard.Session{admin, user} {
+			tx := testBeginTx(t, d, s.AuthToken)
+
+			_, err := tx.ImpersonateUser(owner.Username)
+			if !errors.Is(err, smolboard.ErrActionNotPermitted) {
+				t.Fatalf("Unexpected error impersonating as %s: %v", s.Username, err)
+			}
+		}
+	})
+
+	var imp *smolboard.Session
+
+	t.Run("Owner", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if _, err := tx.ImpersonateUser(owner.Username); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error impersonating self:", err)
+		}
+
+		if _, err := tx.ImpersonateUser("nobody"); !errors.Is(err, smolboard.ErrUserNotFound) {
+			t.Fatal("Unexpected error impersonating unknown user:", err)
+		}
+
+		s, err := tx.ImpersonateUser(admin.Username)
+		if err != nil {
+			t.Fatal("Failed to impersonate:", err)
+		}
+
+		if s.ImpersonatedBy != owner.Username {
+			t.Fatal("Unexpected impersonator:", s.ImpersonatedBy)
+		}
+
+		if s.Deadline > time.Now().Add(ImpersonationLifespan).UnixNano() {
+			t.Fatal("Impersonation session outlives its lifespan.")
+		}
+
+		log, err := tx.AuditLog(0, 10)
+		if err != nil {
+			t.Fatal("Failed to get audit log:", err)
+		}
+
+		if len(log) == 0 || log[0].Action != "user.impersonate" || log[0].Target != admin.Username {
+			t.Fatalf("Impersonation is not audited: %#v", log)
+		}
+
+		imp = s
+	})
+
+	t.Run("Impersonating", func(t *testing.T) {
+		tx := testBeginTx(t, d, imp.AuthToken)
+
+		if tx.Session.Username != admin.Username || !tx.Session.IsImpersonation() {
+			t.Fatalf("Unexpected impersonation session: %#v", tx.Session)
+		}
+
+		sessions, err := tx.Sessions()
+		if err != nil {
+			t.Fatal("Failed to get sessions:", err)
+		}
+
+		var found bool
+		for _, s := range sessions {
+			if s.ID == imp.ID {
+				found = s.ImpersonatedBy == owner.Username
+			}
+		}
+
+		if !found {
+			t.Fatalf("Impersonation session not distinguishable: %#v", sessions)
+		}
+
+		if _, err := tx.ImpersonateUser(user.Username); !errors.Is(err, smolboard.ErrImpersonating) {
+			t.Fatal("Unexpected error impersonating while impersonating:", err)
+		}
+
+		err = tx.PromoteUser(user.Username, smolboard.PermissionTrusted)
+		if !errors.Is(err, smolboard.ErrImpersonating) {
+			t.Fatal("Unexpected error promoting while impersonating:", err)
+		}
+
+		if err := tx.ChangePassword("newpassword"); !errors.Is(err, smolboard.ErrImpersonating) {
+			t.Fatal("Unexpected error changing password while impersonating:", err)
+		}
+	})
+}
+
+func TestSessionKeepAlive(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	// Pretend the session is about to expire.
+	var aged = time.Now().Add(time.Minute).UnixNano()
+
+	_, err := d.Exec("UPDATE sessions SET deadline = ? WHERE id = ?", aged, owner.ID)
+	if err != nil {
+		t.Fatal("Failed to age session:", err)
+	}
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	s, err := tx.KeepAlive()
+	if err != nil {
+		t.Fatal("Failed to keep session alive:", err)
+	}
+
+	if s.ID != owner.ID || s.AuthToken != owner.AuthToken {
+		t.Fatalf("Unexpected session: %#v", s)
+	}
+	if s.Deadline <= aged {
+		t.Fatal("Session deadline not extended:", s.Deadline)
+	}
+
+	var deadline int64
+	if err := tx.QueryRow("SELECT deadline FROM sessions WHERE id = ?", s.ID).Scan(&deadline); err != nil {
+		t.Fatal("Failed to get deadline:", err)
+	}
+	if deadline != s.Deadline {
+		t.Fatalf("Stored deadline %d differs from returned deadline %d", deadline, s.Deadline)
+	}
+
+	t.Run("Guest", func(t *testing.T) {
+		err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+			_, err := tx.KeepAlive()
+			return err
+		})
+		if !errors.Is(err, smolboard.ErrSessionNotFound) {
+			t.Fatal("Unexpected error keeping a guest alive:", err)
+		}
+	})
+}
+
+func TestSessionRotateToken(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	var rotated *smolboard.Session
+
+	t.Run("Rotate", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		s, err := tx.RotateToken()
+		if err != nil {
+			t.Fatal("Failed to rotate token:", err)
+		}
+
+		if s.AuthToken == owner.AuthToken {
+			t.Fatal("Token was not rotated.")
+		}
+		if s.ID != owner.ID || s.Deadline != owner.Deadline {
+			t.Fatalf("Rotated session changed: %#v", s)
+		}
+		if tx.Session.AuthToken != s.AuthToken {
+			t.Fatal("Transaction session was not updated.")
+		}
+
+		rotated = s
+	})
+
+	t.Run("OldToken", func(t *testing.T) {
+		_, err := BeginTx(context.Background(), d, owner.AuthToken)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using the old token:", err)
+		}
+		if code := httperr.ErrCode(err); code != 410 {
+			t.Fatal("Unexpected status code for the old token:", code)
+		}
+	})
+
+	t.Run("NewToken", func(t *testing.T) {
+		tx := testBeginTx(t, d, rotated.AuthToken)
+
+		if tx.Session.ID != owner.ID {
+			t.Fatal("Unexpected session ID with the new token:", tx.Session.ID)
+		}
+	})
+
+	t.Run("Guest", func(t *testing.T) {
+		tx := testBeginTx(t, d, "")
+
+		if _, err := tx.RotateToken(); !errors.Is(err, smolboard.ErrSessionNotFound) {
+			t.Fatal("Unexpected error rotating as guest:", err)
+		}
+	})
+
+	t.Run("JWT", func(t *testing.T) {
+		d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+			cfg.SessionMode = SessionModeJWT
+			cfg.JWTSecret = testJWTSecret
+		})
+
+		owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if _, err := tx.RotateToken(); !errors.Is(err, smolboard.ErrRotateUnsupported) {
+			t.Fatal("Unexpected error rotating a JWT session:", err)
+		}
+	})
+}
+
+func TestBackfillSessionMetadata(t *testing.T) {
+	d := newTestDatabase(t)
+	testNewOwner(t, d, "ひめありかわ", "password")
+
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0"
+
+	var agents = []string{firefox, ""}
+
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		for _, agent := range agents {
+			if _, err := tx.Signin("ひめありかわ", "password", agent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	// Pretend that all sessions were made before devices were stored.
+	if _, err := d.Exec("UPDATE sessions SET device = ''"); err != nil {
+		t.Fatal("Failed to clear devices:", err)
+	}
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := d.BackfillSessionMetadata(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatal("Unexpected error backfilling with a canceled context:", err)
+		}
+	})
+
+	n, err := d.BackfillSessionMetadata(context.Background())
+	if err != nil {
+		t.Fatal("Failed to backfill:", err)
+	}
+
+	// The owner's first session from testNewOwner is included.
+	if n != 3 {
+		t.Fatal("Unexpected number of backfilled sessions:", n)
+	}
+
+	var devices = map[string]string{}
+
+	rows, err := d.Query("SELECT useragent, device FROM sessions")
+	if err != nil {
+		t.Fatal("Failed to query sessions:", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var agent, device string
+		if err := rows.Scan(&agent, &device); err != nil {
+			t.Fatal("Failed to scan session:", err)
+		}
+		devices[agent] = device
+	}
+
+	if device := devices[firefox]; device != "Firefox on Linux" {
+		t.Fatalf("Unexpected device of Firefox: %q", device)
+	}
+	if device := devices[""]; device != UnknownDevice {
+		t.Fatalf("Unexpected device without a user agent: %q", device)
+	}
+
+	// Running it again does nothing.
+	n, err = d.BackfillSessionMetadata(context.Background())
+	if err != nil {
+		t.Fatal("Failed to backfill again:", err)
+	}
+	if n != 0 {
+		t.Fatal("Unexpected number of sessions backfilled again:", n)
+	}
+}
+
+func TestCleanupSessions(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.SessionCleanupBatch = 7
+	})
+	testNewOwner(t, d, "ひめありかわ", "password")
+
+	const expired = 50
+
+	var deadline = time.Now().Add(-time.Hour).UnixNano()
+
+	for i := 0; i < expired; i++ {
+		_, err := d.Exec(
+			`INSERT INTO sessions (id, username, authtoken, deadline, useragent)
+				VALUES (?, ?, ?, ?, '')`,
+			i+1, "ひめありかわ", "expired-"+strconv.Itoa(i), deadline,
+		)
+		if err != nil {
+			t.Fatal("Failed to insert expired session:", err)
+		}
+	}
+
+	var countExpired = func() (n int) {
+		t.Helper()
+
+		err := d.QueryRow("SELECT COUNT(*) FROM sessions WHERE deadline < ?", time.Now().UnixNano()).Scan(&n)
+		if err != nil {
+			t.Fatal("Failed to count expired sessions:", err)
+		}
+		return
+	}
+
+	// Signing in only cleans up a single batch.
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		_, err := tx.Signin("ひめありかわ", "password", "")
+		return err
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	if n := countExpired(); n != expired-7 {
+		t.Fatalf("Unexpected expired sessions after signing in: %d", n)
+	}
+
+	n, err := d.CleanupSessions(context.Background())
+	if err != nil {
+		t.Fatal("Failed to clean up sessions:", err)
+	}
+	if n != expired-7 {
+		t.Fatalf("Unexpected number of cleaned up sessions: %d", n)
+	}
+
+	if n := countExpired(); n != 0 {
+		t.Fatalf("Unexpected expired sessions after cleaning up: %d", n)
+	}
+
+	// The live sessions of both sign ins are kept.
+	var live int
+	if err := d.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&live); err != nil {
+		t.Fatal("Failed to count sessions:", err)
+	}
+	if live != 2 {
+		t.Fatalf("Unexpected live sessions: %d", live)
+	}
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// MaxShareLinkTTL is the longest that share links can last.
+const MaxShareLinkTTL = 30 * 24 * time.Hour
+
+// CreateShareLink creates a signed token that lets anyone with it see the post
+// until the TTL passes, regardless of the post's permission. Only the poster and
+// administrators over them can do this. The token is not stored: it stops
+// working once the post is deleted or ShareSecret is changed.
+func (d *Transaction) CreateShareLink(postID int64, ttl time.Duration) (*smolboard.ShareLink, error) {
+	if len(d.config.ShareSecret) == 0 {
+		return nil, smolboard.ErrShareLinksDisabled
+	}
+
+	if ttl <= 0 || ttl > MaxShareLinkTTL {
+		return nil, smolboard.ErrInvalidShareLinkTTL
+	}
+
+	post, err := d.PostQuickGet(postID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.requireOwnerOrPermission(post.GetPoster(), smolboard.PermissionAdministrator); err != nil {
+		return nil, err
+	}
+
+	// The token only has second precision.
+	var expires = time.Now().Add(ttl).Truncate(time.Second)
+
+	return &smolboard.ShareLink{
+		Token:     signShareLink([]byte(d.config.ShareSecret), postID, expires),
+		ExpiresAt: expires.UnixNano(),
+	}, nil
+}
+
+// SharedPost returns the post that the share link token was made for. Neither
+// the session nor the post's permission is checked. ErrInvalidShareLink is
+// returned if the token is malformed or wasn't signed with the current secret,
+// and ErrShareLinkExpired is returned if it's past its TTL.
+func (d *Transaction) SharedPost(token string) (*smolboard.Post, error) {
+	if len(d.config.ShareSecret) == 0 {
+		return nil, smolboard.ErrShareLinksDisabled
+	}
+
+	postID, expires, err := parseShareLink([]byte(d.config.ShareSecret), token)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(expires) {
+		return nil, smolboard.ErrShareLinkExpired
+	}
+
+	var post smolboard.Post
+
+	err = d.
+		QueryRowx("SELECT * FROM posts WHERE id = ? AND "+postLive, postID, time.Now().UnixNano()).
+		StructScan(&post)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, smolboard.ErrPostNotFound
+		}
+		return nil, errors.Wrap(err, "Failed to scan shared post")
+	}
+
+	return &post, nil
+}
+
+// signShareLink makes a share link token, which is the post ID and the expiry
+// in Unix seconds, followed by their signature.
+func signShareLink(secret []byte, postID int64, expires time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(postID))
+	binary.BigEndian.PutUint64(b[8:], uint64(expires.Unix()))
+
+	var payload = base64.RawURLEncoding.EncodeToString(b[:])
+	return payload + "." + jwtSign(secret, payload)
+}
+
+func parseShareLink(secret []byte, token string) (postID int64, expires time.Time, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, time.Time{}, smolboard.ErrInvalidShareLink
+	}
+
+	if !hmac.Equal([]byte(jwtSign(secret, parts[0])), []byte(parts[1])) {
+		return 0, time.Time{}, smolboard.ErrInvalidShareLink
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(b) != 16 {
+		return 0, time.Time{}, smolboard.ErrInvalidShareLink
+	}
+
+	postID = int64(binary.BigEndian.Uint64(b[:8]))
+	expires = time.Unix(int64(binary.BigEndian.Uint64(b[8:])), 0)
+
+	return postID, expires, nil
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+const testShareSecret = "ひめありかわ's very secret share key"
+
+func TestShareLink(t *testing.T) {
+	d := newTestDatabaseWith(t, func(c *DBConfig) {
+		c.ShareSecret = testShareSecret
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+
+	p := NewEmptyPost("image/png")
+	p.Size = 1
+	p.Permission = smolboard.PermissionAdministrator
+
+	var link *smolboard.ShareLink
+
+	t.Run("Create", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.SavePost(&p); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+
+		l, err := tx.CreateShareLink(p.ID, time.Hour)
+		if err != nil {
+			t.Fatal("Failed to create share link:", err)
+		}
+
+		if exp := time.Unix(0, l.ExpiresAt); time.Until(exp) > time.Hour || time.Until(exp) < 59*time.Minute {
+			t.Fatal("Unexpected expiry:", exp)
+		}
+
+		link = l
+
+		if _, err := tx.CreateShareLink(p.ID, MaxShareLinkTTL+time.Hour); !errors.Is(err, smolboard.ErrInvalidShareLinkTTL) {
+			t.Fatal("Unexpected error creating share link with a long TTL:", err)
+		}
+	})
+
+	t.Run("NotOwner", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if _, err := tx.CreateShareLink(p.ID, time.Hour); err == nil {
+			t.Fatal("Unexpected success creating share link of an invisible post")
+		}
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		tx := testBeginTx(t, d, "")
+
+		s, err := tx.SharedPost(link.Token)
+		if err != nil {
+			t.Fatal("Failed to get shared post:", err)
+		}
+
+		if s.ID != p.ID {
+			t.Fatalf("Unexpected shared post ID: %d", s.ID)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		tx := testBeginTx(t, d, "")
+
+		token := signShareLink([]byte(testShareSecret), p.ID, time.Now().Add(-time.Second))
+
+		if _, err := tx.SharedPost(token); !errors.Is(err, smolboard.ErrShareLinkExpired) {
+			t.Fatal("Unexpected error getting expired share link:", err)
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		tx := testBeginTx(t, d, "")
+
+		// Point the token to another post without resigning it.
+		var other = signShareLink([]byte(testShareSecret), p.ID+1, time.Now().Add(time.Hour))
+		var token = strings.Split(other, ".")[0] + "." + strings.Split(link.Token, ".")[1]
+
+		if _, err := tx.SharedPost(token); !errors.Is(err, smolboard.ErrInvalidShareLink) {
+			t.Fatal("Unexpected error getting tampered share link:", err)
+		}
+
+		if _, err := tx.SharedPost("ひめ"); !errors.Is(err, smolboard.ErrInvalidShareLink) {
+			t.Fatal("Unexpected error getting malformed share link:", err)
+		}
+	})
+
+	t.Run("Rotated", func(t *testing.T) {
+		tx := testBeginTx(t, d, "")
+
+		tx.config.ShareSecret = strings.Repeat("a", MinJWTSecretLen)
+
+		if _, err := tx.SharedPost(link.Token); !errors.Is(err, smolboard.ErrInvalidShareLink) {
+			t.Fatal("Unexpected error getting share link after rotation:", err)
+		}
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if err := tx.DeletePost(p.ID, false); err != nil {
+			t.Fatal("Failed to delete post:", err)
+		}
+
+		if _, err := tx.SharedPost(link.Token); !errors.Is(err, smolboard.ErrPostNotFound) {
+			t.Fatal("Unexpected error getting deleted shared post:", err)
+		}
+	})
+}
+
+func TestShareLinkDisabled(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	if _, err := tx.CreateShareLink(1, time.Hour); !errors.Is(err, smolboard.ErrShareLinksDisabled) {
+		t.Fatal("Unexpected error creating share link:", err)
+	}
+}
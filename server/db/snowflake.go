@@ -1,21 +1,32 @@
 package db
 
 import (
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/snowflake"
+	"github.com/pkg/errors"
 )
 
 const (
 	postIDNode int64 = iota
-	sessionIDNode
+	_                // sessions, which use the configured machine ID
+	auditIDNode
+	reportIDNode
+	poolIDNode
+	apiKeyIDNode
 )
 
 var (
-	postIDGen    = mustSnowflake(postIDNode)
-	sessionIDGen = mustSnowflake(sessionIDNode)
+	auditIDGen  = mustSnowflake(auditIDNode)
+	reportIDGen = mustSnowflake(reportIDNode)
+	poolIDGen   = mustSnowflake(poolIDNode)
+	apiKeyIDGen = mustSnowflake(apiKeyIDNode)
 )
 
+// defaultPostIDs is the generator used by NewEmptyPost.
+var defaultPostIDs = mustSnowflakeGenerator(postIDNode, 0)
+
 func mustSnowflake(node int64) *snowflake.Node {
 	n, err := snowflake.NewNode(node)
 	if err != nil {
@@ -31,3 +42,94 @@ func NewZeroID(t time.Time) int64 {
 
 	return epoch << 22
 }
+
+// IDGenerator generates post IDs. Implementations must be safe to use
+// concurrently.
+type IDGenerator interface {
+	// NextID returns a new ID that is larger than all IDs returned before.
+	NextID() int64
+}
+
+const (
+	PostIDSnowflake  = "snowflake"
+	PostIDSequential = "sequential"
+)
+
+// MaxMachineID is the largest machine ID that a snowflake generator can have.
+const MaxMachineID = -1 ^ (-1 << 10)
+
+// SnowflakeGenerator generates time-sortable snowflake IDs. Unlike a plain
+// snowflake node, it never returns an ID smaller than the last one, even if
+// the clock goes backwards.
+type SnowflakeGenerator struct {
+	node    *snowflake.Node
+	machine int64
+
+	mu   sync.Mutex
+	last int64
+}
+
+var _ IDGenerator = (*SnowflakeGenerator)(nil)
+
+// NewSnowflakeGenerator creates a new snowflake generator with the given
+// machine ID, which must be unique among all generators making IDs for the same
+// table. Last is the largest ID that was generated before, such as on a
+// previous run, and it can be 0.
+func NewSnowflakeGenerator(machineID, last int64) (*SnowflakeGenerator, error) {
+	n, err := snowflake.NewNode(machineID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create snowflake node")
+	}
+
+	return &SnowflakeGenerator{node: n, machine: machineID, last: last}, nil
+}
+
+func mustSnowflakeGenerator(machineID, last int64) *SnowflakeGenerator {
+	g, err := NewSnowflakeGenerator(machineID, last)
+	if err != nil {
+		panic(err)
+	}
+
+	return g
+}
+
+func (g *SnowflakeGenerator) NextID() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var id = int64(g.node.Generate())
+
+	// The clock is behind the last ID, so move on to the millisecond after it.
+	// The machine ID is kept, so IDs of other machines are never taken.
+	if id <= g.last {
+		const timeShift = 10 + 12 // node and step bits
+		const nodeShift = 12
+
+		id = ((g.last>>timeShift)+1)<<timeShift | g.machine<<nodeShift
+	}
+
+	g.last = id
+	return id
+}
+
+// SequentialGenerator generates IDs that count up from the last one.
+type SequentialGenerator struct {
+	mu   sync.Mutex
+	last int64
+}
+
+var _ IDGenerator = (*SequentialGenerator)(nil)
+
+// NewSequentialGenerator creates a new sequential generator that starts after
+// the given last ID.
+func NewSequentialGenerator(last int64) *SequentialGenerator {
+	return &SequentialGenerator{last: last}
+}
+
+func (g *SequentialGenerator) NextID() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.last++
+	return g.last
+}
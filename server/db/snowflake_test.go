@@ -1,6 +1,7 @@
 package db
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -19,3 +20,134 @@ func TestSnowflake(t *testing.T) {
 		t.Fatalf("Unequal time: %d != %d", s, m)
 	}
 }
+
+// testIDGenerator generates IDs in parallel and checks that they're unique and
+// increasing in each goroutine.
+func testIDGenerator(t *testing.T, g IDGenerator) {
+	const workers = 8
+	const perWorker = 5000
+
+	var results = make([][]int64, workers)
+	var wg sync.WaitGroup
+
+	for i := range results {
+		i := i
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ids := make([]int64, perWorker)
+			for j := range ids {
+				ids[j] = g.NextID()
+			}
+			results[i] = ids
+		}()
+	}
+
+	wg.Wait()
+
+	var seen = make(map[int64]struct{}, workers*perWorker)
+
+	for _, ids := range results {
+		for j, id := range ids {
+			if j > 0 && id <= ids[j-1] {
+				t.Fatalf("ID %d is not larger than the previous %d", id, ids[j-1])
+			}
+			if _, ok := seen[id]; ok {
+				t.Fatal("Duplicate ID:", id)
+			}
+			seen[id] = struct{}{}
+		}
+	}
+}
+
+func TestSnowflakeGenerator(t *testing.T) {
+	g, err := NewSnowflakeGenerator(42, 0)
+	if err != nil {
+		t.Fatal("Failed to create generator:", err)
+	}
+
+	testIDGenerator(t, g)
+
+	t.Run("ClockBehind", func(t *testing.T) {
+		// Pretend that the last run's clock was an hour ahead.
+		var last = NewZeroID(time.Now().Add(time.Hour))
+
+		g, err := NewSnowflakeGenerator(42, last)
+		if err != nil {
+			t.Fatal("Failed to create generator:", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			id := g.NextID()
+			if id <= last {
+				t.Fatalf("ID %d is not larger than the last %d", id, last)
+			}
+			if node := snowflake.ParseInt64(id).Node(); node != 42 {
+				t.Fatal("Unexpected machine ID:", node)
+			}
+			last = id
+		}
+	})
+
+	t.Run("InvalidMachineID", func(t *testing.T) {
+		if _, err := NewSnowflakeGenerator(MaxMachineID+1, 0); err == nil {
+			t.Fatal("Unexpected success with an invalid machine ID")
+		}
+	})
+}
+
+func TestSequentialGenerator(t *testing.T) {
+	g := NewSequentialGenerator(0)
+	testIDGenerator(t, g)
+
+	if id := g.NextID(); id != 8*5000+1 {
+		t.Fatal("Unexpected next ID:", id)
+	}
+}
+
+func TestSequentialPostIDs(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.PostIDScheme = PostIDSequential
+	})
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	for i := int64(1); i <= 3; i++ {
+		p := NewEmptyPostFrom(tx.PostIDs(), "image/png")
+		p.Size = 1
+
+		if err := tx.SavePost(&p); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+		if p.ID != i {
+			t.Fatalf("Unexpected post ID %d, expected %d", p.ID, i)
+		}
+	}
+
+	tx.Commit()
+
+	// Reopening the database should continue after the last post.
+	if err := d.initIDs(); err != nil {
+		t.Fatal("Failed to reinitialize IDs:", err)
+	}
+
+	tx = testBeginTx(t, d, owner.AuthToken)
+
+	if id := tx.PostIDs().NextID(); id != 4 {
+		t.Fatal("Unexpected post ID after reopening:", id)
+	}
+}
+
+func TestSessionMachineID(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.MachineID = 42
+	})
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+
+	if node := snowflake.ParseInt64(owner.ID).Node(); node != 42 {
+		t.Fatal("Unexpected session machine ID:", node)
+	}
+}
@@ -17,14 +17,14 @@ func (d *Transaction) ListTokens() (*smolboard.TokenList, error) {
 		return nil, err
 	}
 
-	// Exit if the user isn't at least an administrator.
-	if p < smolboard.PermissionAdministrator {
+	// Exit if the user isn't at least trusted.
+	if p < smolboard.PermissionTrusted {
 		return nil, smolboard.ErrActionNotPermitted
 	}
 
 	var q *sqlx.Rows
-	// Allow only the owner to see all tokens. Administrators can only see
-	// their own tokens.
+	// Allow only the owner to see all tokens. Administrators and trusted users
+	// can only see their own tokens.
 	if p == smolboard.PermissionOwner {
 		q, err = d.Queryx("SELECT * FROM tokens")
 	} else {
@@ -84,8 +84,8 @@ func (d *Transaction) DeleteToken(token string) error {
 	}
 
 	// A user can always revoke their own token, but they should at least be
-	// an admin.
-	if err := d.HasPermOverUser(smolboard.PermissionAdministrator, creator); err != nil {
+	// trusted.
+	if err := d.HasPermOverUser(smolboard.PermissionTrusted, creator); err != nil {
 		return err
 	}
 
@@ -108,17 +108,37 @@ func (d *Transaction) CreateToken(uses int) (*smolboard.Token, error) {
 	}
 
 	// Check the minimum required permission to make the token.
-	var perm = smolboard.PermissionAdministrator
+	var perm = smolboard.PermissionTrusted
 	// Is the user requesting for an unlimited use token?
 	if uses == -1 {
 		perm = smolboard.PermissionOwner
 	}
 
 	// Check permission.
-	if err := d.HasPermission(perm, true); err != nil {
+	p, err := d.Permission()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.HasPermission(perm, true); err != nil {
 		return nil, err
 	}
 
+	// Trusted users can only have a few outstanding tokens.
+	if p == smolboard.PermissionTrusted {
+		var outstanding int
+
+		err := d.
+			QueryRow("SELECT COUNT(*) FROM tokens WHERE creator = ?", d.Session.Username).
+			Scan(&outstanding)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to count outstanding tokens")
+		}
+
+		if outstanding >= d.config.MaxTrustedTokens {
+			return nil, smolboard.ErrTooManyTokens
+		}
+	}
+
 	// Generate a short random string.
 	var r = make([]byte, 16)
 	if _, err := rand.Read(r); err != nil {
@@ -131,7 +151,7 @@ func (d *Transaction) CreateToken(uses int) (*smolboard.Token, error) {
 		Remaining: uses,
 	}
 
-	_, err := d.Exec(
+	_, err = d.Exec(
 		"INSERT INTO tokens VALUES (?, ?, ?)",
 		t.Token, d.Session.Username, t.Remaining)
 	if err != nil {
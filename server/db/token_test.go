@@ -150,8 +150,8 @@ func TestTokenCreateDeny(t *testing.T) {
 				}
 			})
 
-			// Skip owner and admin.
-			if perm == smolboard.PermissionAdministrator {
+			// Skip owner, admin and trusted.
+			if perm >= smolboard.PermissionTrusted {
 				return
 			}
 
@@ -165,6 +165,58 @@ func TestTokenCreateDeny(t *testing.T) {
 	}
 }
 
+func TestTokenTrustedCreate(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+	trusted := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionTrusted)
+	user := newTestUser(t, d, owner.AuthToken, "いとうまお", smolboard.PermissionUser)
+
+	t.Run("Normal", func(t *testing.T) {
+		tx := testBeginTx(t, d, user.AuthToken)
+
+		if _, err := tx.CreateToken(1); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error creating token as normal user:", err)
+		}
+	})
+
+	var tokens []smolboard.Token
+
+	t.Run("Trusted", func(t *testing.T) {
+		tx := testBeginTx(t, d, trusted.AuthToken)
+
+		for i := 0; i < d.Config.MaxTrustedTokens; i++ {
+			k, err := tx.CreateToken(1)
+			if err != nil {
+				t.Fatal("Failed to create token as trusted user:", err)
+			}
+			tokens = append(tokens, *k)
+		}
+
+		if _, err := tx.CreateToken(1); !errors.Is(err, smolboard.ErrTooManyTokens) {
+			t.Fatal("Unexpected error creating token over the cap:", err)
+		}
+
+		list, err := tx.ListTokens()
+		if err != nil {
+			t.Fatal("Failed to list tokens as trusted user:", err)
+		}
+
+		if eq := deep.Equal(list.Tokens, tokens); eq != nil {
+			t.Fatal("Unexpected token list returned:", eq)
+		}
+
+		// Revoking a token should free up a slot.
+		if err := tx.DeleteToken(tokens[0].Token); err != nil {
+			t.Fatal("Failed to delete own token:", err)
+		}
+
+		if _, err := tx.CreateToken(1); err != nil {
+			t.Fatal("Failed to create token after revoking one:", err)
+		}
+	})
+}
+
 func TestTokenTrustedDelete(t *testing.T) {
 	d := newTestDatabase(t)
 
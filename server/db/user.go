@@ -1,46 +1,82 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
+	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func VerifyPassword(hash []byte, password string) error {
-	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+// createUser creates a new user in the database with the given username. The
+// username that's inserted into the database is guaranteed to be the same as
+// the argument.
+func (d *Transaction) createUser(username, password string, perm smolboard.Permission) error {
+	var verr = httperr.NewValidationError()
+	verr.Add("username", smolboard.NameIsLegal(username))
+
+	if len(password) < smolboard.MinimumPassLength {
+		verr.Add("password", smolboard.ErrPasswordTooShort)
+	}
+
+	if err := verr.Err(); err != nil {
+		return err
+	}
 
-	// If the error is a mismatch, then we return an invalid password.
-	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-		return smolboard.ErrInvalidPassword
+	// The anonymous user's name is reserved even if anonymous posting is off,
+	// so that it can be turned on later.
+	if username == d.config.AnonymousUsername {
+		return smolboard.ErrUsernameTaken
 	}
 
-	// Wrap will return nil if the error is nil.
-	return errors.Wrap(err, "Failed to compare password")
+	if d.config.usernameIsReserved(username) {
+		return smolboard.ErrUsernameReserved
+	}
+
+	p, err := d.config.peppers.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return d.insertUser(username, p, perm)
 }
 
-// createUser creates a new user in the database with the given username. The
-// username that's inserted into the database is guaranteed to be the same as
-// the argument.
-func (d *Transaction) createUser(username, password string, perm smolboard.Permission) error {
+// ImportUser creates a user with a password hash imported from another board,
+// so that they can sign in with their old password. The scheme is one of the
+// Scheme constants, and schemes other than bcrypt and Argon2id must be enabled
+// in LegacyPasswordSchemes. Only the owner can import users, and they join with
+// the User permission.
+func (d *Transaction) ImportUser(username string, legacyHash []byte, scheme string) error {
+	if err := d.HasPermission(smolboard.PermissionOwner, true); err != nil {
+		return err
+	}
+
 	if err := smolboard.NameIsLegal(username); err != nil {
 		return err
 	}
 
-	if len(password) < smolboard.MinimumPassLength {
-		return smolboard.ErrPasswordTooShort
+	if username == d.config.AnonymousUsername {
+		return smolboard.ErrUsernameTaken
 	}
 
-	p, err := bcrypt.GenerateFromPassword([]byte(password), smolboard.HashCost)
+	if d.config.usernameIsReserved(username) {
+		return smolboard.ErrUsernameReserved
+	}
+
+	hash, err := d.config.importHash(legacyHash, scheme)
 	if err != nil {
-		return errors.Wrap(err, "Failed to generate password")
+		return err
 	}
 
-	_, err = d.Exec(
-		"INSERT INTO users VALUES (?, ?, ?, ?)",
-		username, time.Now().UnixNano(), p, perm,
+	return d.insertUser(username, hash, smolboard.PermissionUser)
+}
+
+func (d *Transaction) insertUser(username string, passhash []byte, perm smolboard.Permission) error {
+	_, err := d.Exec(
+		"INSERT INTO users (username, jointime, passhash, permission) VALUES (?, ?, ?, ?)",
+		username, time.Now().UnixNano(), passhash, perm,
 	)
 
 	if err != nil {
@@ -117,9 +153,30 @@ func (d *Transaction) SearchUsers(qs string, count, page uint) (smolboard.UserLi
 			u.Permission = smolboard.PermissionOwner
 		}
 
+		u.Pending = u.Permission == smolboard.PermissionGuest
+
 		list.Users = append(list.Users, u.UserPart)
 	}
 
+	// Close early, since the connection is reused for counting.
+	q.Close()
+
+	list.Page = smolboard.NewPage(list.Total, int(count*page), int(count), len(list.Users))
+
+	var usernames = make([]string, len(list.Users))
+	for i, u := range list.Users {
+		usernames[i] = u.Username
+	}
+
+	counts, err := d.sessionCountsByUsers(usernames)
+	if err != nil {
+		return smolboard.NoUsers, errors.Wrap(err, "Failed to count sessions")
+	}
+
+	for i, u := range list.Users {
+		list.Users[i].SessionCount = counts[u.Username]
+	}
+
 	return list, nil
 }
 
@@ -131,9 +188,9 @@ func (d *Transaction) User(username string) (*smolboard.UserPart, error) {
 	}
 
 	u := smolboard.UserPart{Username: username}
-	r := d.QueryRowx("SELECT jointime, permission FROM users WHERE username = ?", username)
+	r := d.QueryRowx("SELECT jointime, permission, lastlogin FROM users WHERE username = ?", username)
 
-	if err := r.Scan(&u.JoinTime, &u.Permission); err != nil {
+	if err := r.Scan(&u.JoinTime, &u.Permission, &u.LastLogin); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, smolboard.ErrUserNotFound
 		}
@@ -147,15 +204,43 @@ func (d *Transaction) User(username string) (*smolboard.UserPart, error) {
 		u.Permission = smolboard.PermissionOwner
 	}
 
+	u.Pending = u.Permission == smolboard.PermissionGuest
+
+	// The last login is only shown to the user themselves and to
+	// administrators.
+	if u.LastLogin > 0 && username != d.Session.Username {
+		if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+			u.LastLogin = 0
+		}
+	}
+
 	return &u, nil
 }
 
+// Me returns the current user along with their session and post counts.
 func (d *Transaction) Me() (*smolboard.UserPart, error) {
-	return d.User(d.Session.Username)
+	u, err := d.User(d.Session.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.SessionCount, err = d.SessionCount(); err != nil {
+		return nil, err
+	}
+
+	if u.PostCount, err = d.PostCount(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
 }
 
 // PromoteUser promotes or demotes someone else.
 func (d *Transaction) PromoteUser(username string, p smolboard.Permission) error {
+	if err := d.notImpersonating(); err != nil {
+		return err
+	}
+
 	// You can't change your own permission.
 	if d.Session.Username == username {
 		return smolboard.ErrActionNotPermitted
@@ -183,25 +268,134 @@ func (d *Transaction) PromoteUser(username string, p smolboard.Permission) error
 	return nil
 }
 
-func (d *Transaction) ChangePassword(password string) error {
-	if len(password) < smolboard.MinimumPassLength {
-		return smolboard.ErrPasswordTooShort
+// PendingUsers returns all users awaiting approval from oldest to newest. Only
+// administrators and higher can list them.
+func (d *Transaction) PendingUsers() ([]smolboard.UserPart, error) {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return nil, err
 	}
 
-	p, err := bcrypt.GenerateFromPassword([]byte(password), smolboard.HashCost)
+	r, err := d.Queryx(
+		"SELECT username, jointime, permission FROM users"+
+			" WHERE permission = ? AND username NOT IN (?, ?) ORDER BY jointime ASC",
+		smolboard.PermissionGuest, d.config.Owner, d.config.AnonymousUsername,
+	)
 	if err != nil {
-		return errors.Wrap(err, "Failed to generate password")
+		return nil, errors.Wrap(err, "Failed to query pending users")
 	}
 
-	_, err = d.Exec("UPDATE users SET passhash = ? WHERE username = ?", p, d.Session.Username)
+	defer r.Close()
+
+	var users = []smolboard.UserPart{}
+
+	for r.Next() {
+		var u smolboard.UserPart
+
+		if err := r.StructScan(&u); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan user")
+		}
+
+		u.Pending = true
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+// ApproveUser promotes a pending user to the User permission. Only
+// administrators and higher can do this.
+func (d *Transaction) ApproveUser(username string) error {
+	if err := d.pendingUser(username); err != nil {
+		return err
+	}
+
+	_, err := d.Exec(
+		"UPDATE users SET permission = ? WHERE username = ?",
+		smolboard.PermissionUser, username,
+	)
 	if err != nil {
-		return errors.Wrap(err, "Failed to change password")
+		return errors.Wrap(err, "Failed to approve user")
+	}
+
+	return d.audit("user.approve", username, "")
+}
+
+// RejectUser deletes a pending user. Only administrators and higher can do
+// this.
+func (d *Transaction) RejectUser(username string) error {
+	if err := d.pendingUser(username); err != nil {
+		return err
+	}
+
+	if err := d.DeleteUser(username); err != nil {
+		return err
+	}
+
+	return d.audit("user.reject", username, "")
+}
+
+// pendingUser returns an error if the current user is not an administrator or
+// if the given user is not pending.
+func (d *Transaction) pendingUser(username string) error {
+	if err := d.HasPermission(smolboard.PermissionAdministrator, true); err != nil {
+		return err
+	}
+
+	u, err := d.User(username)
+	if err != nil {
+		return err
+	}
+
+	if !u.Pending {
+		return smolboard.ErrUserNotPending
+	}
+
+	return nil
+}
+
+func (d *Transaction) ChangePassword(password string) error {
+	if err := d.notImpersonating(); err != nil {
+		return err
+	}
+
+	if err := d.notAPIKey(); err != nil {
+		return err
+	}
+
+	if err := d.setPassword(d.Session.Username, password); err != nil {
+		return err
 	}
 
 	if err := d.DeleteAllSessions(); err != nil {
 		return errors.Wrap(err, "Failed to invalidate other sessions")
 	}
 
+	if err := d.deleteAPIKeys(d.Session.Username); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setPassword hashes and sets the password of the given user. It does not
+// invalidate any session.
+func (d *Transaction) setPassword(username, password string) error {
+	if len(password) < smolboard.MinimumPassLength {
+		var verr = httperr.NewValidationError()
+		verr.Add("password", smolboard.ErrPasswordTooShort)
+		return verr
+	}
+
+	p, err := d.config.peppers.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Exec("UPDATE users SET passhash = ? WHERE username = ?", p, username)
+	if err != nil {
+		return errors.Wrap(err, "Failed to change password")
+	}
+
 	return nil
 }
 
@@ -215,7 +409,7 @@ func (d *Transaction) DeleteUser(username string) error {
 	//    Current Trusted, target user -> no
 	//    Current Trusted, target Trusted -> no
 	//    Current Trusted, target is self and Trusted -> delete
-	if err := d.IsUserOrHasPermOver(smolboard.PermissionAdministrator, username); err != nil {
+	if err := d.requireOwnerOrPermission(username, smolboard.PermissionAdministrator); err != nil {
 		return err
 	}
 
@@ -226,5 +420,82 @@ func (d *Transaction) DeleteUser(username string) error {
 	}
 
 	_, err := d.Exec("DELETE FROM users WHERE username = ?", username)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Not all stores delete sessions along with the user.
+	return d.config.SessionStore.DeleteByUser(d, username, 0)
+}
+
+// MinPruneAge is the shortest window that PruneInactiveUsers accepts, so that
+// users who have just signed up aren't pruned.
+const MinPruneAge = 24 * time.Hour
+
+// PruneInactiveUsers deletes users who have no posts and who haven't signed in
+// or signed up within olderThan, along with their sessions. Administrators,
+// the owner and the anonymous user are never pruned. If dryRun is true,
+// nothing is deleted. The usernames of the affected users are returned. Only
+// the owner can do this.
+func (d *Transaction) PruneInactiveUsers(olderThan time.Duration, dryRun bool) ([]string, error) {
+	if err := d.HasPermission(smolboard.PermissionOwner, true); err != nil {
+		return nil, err
+	}
+
+	return d.pruneInactiveUsers(olderThan, dryRun)
+}
+
+func (d *Transaction) pruneInactiveUsers(olderThan time.Duration, dryRun bool) ([]string, error) {
+	if olderThan < MinPruneAge {
+		return nil, smolboard.ErrPruneAgeTooShort
+	}
+
+	var usernames = []string{}
+
+	// Soft-deleted posts still count, since they may be restored.
+	err := d.Select(&usernames, `
+		SELECT username FROM users
+			WHERE permission < ? AND username NOT IN (?, ?)
+				AND MAX(lastlogin, jointime) < ?
+				AND NOT EXISTS (SELECT 1 FROM posts WHERE posts.poster = users.username)
+			ORDER BY username ASC`,
+		smolboard.PermissionAdministrator, d.config.Owner, d.config.AnonymousUsername,
+		time.Now().Add(-olderThan).UnixNano(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query inactive users")
+	}
+
+	if dryRun {
+		return usernames, nil
+	}
+
+	for _, username := range usernames {
+		if _, err := d.Exec("DELETE FROM users WHERE username = ?", username); err != nil {
+			return nil, errors.Wrapf(err, "Failed to delete user %q", username)
+		}
+
+		// Not all stores delete sessions along with the user.
+		if err := d.config.SessionStore.DeleteByUser(d, username, 0); err != nil {
+			return nil, err
+		}
+
+		if err := d.audit("user.prune", username, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return usernames, nil
+}
+
+// PruneInactiveUsers is Transaction's PruneInactiveUsers for the command line,
+// which skips the permission check. The audit entries have no actor.
+func (d *Database) PruneInactiveUsers(
+	ctx context.Context, olderThan time.Duration, dryRun bool) (usernames []string, err error) {
+
+	err = d.AcquireGuest(ctx, func(tx *Transaction) error {
+		usernames, err = tx.pruneInactiveUsers(olderThan, dryRun)
+		return err
+	})
+	return
 }
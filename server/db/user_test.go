@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/pkg/errors"
 )
@@ -308,6 +310,23 @@ func TestIllegalUser(t *testing.T) {
 	}
 }
 
+func TestInvalidUserFields(t *testing.T) {
+	tx := (*Transaction)(nil)
+
+	err := tx.createUser("ひめ　ありかわ", "b", smolboard.PermissionUser)
+	if httperr.ErrCode(err) != 422 {
+		t.Fatal("Unexpected error while creating an invalid user:", err)
+	}
+
+	fields := httperr.ErrFields(err)
+	if _, ok := fields["username"]; !ok {
+		t.Fatal("Missing username error:", fields)
+	}
+	if _, ok := fields["password"]; !ok {
+		t.Fatal("Missing password error:", fields)
+	}
+}
+
 func TestShortPassword(t *testing.T) {
 	tx := (*Transaction)(nil)
 
@@ -316,3 +335,563 @@ func TestShortPassword(t *testing.T) {
 		t.Fatal("Unexpected error while creating a password too short:", err)
 	}
 }
+
+func TestSignupPermission(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.DefaultSignupPermission = "Guest"
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	token := testOneTimeToken(t, d, owner.AuthToken)
+
+	var s *smolboard.Session
+
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) (err error) {
+		s, err = tx.Signup("かぐやありかわ", "password", token, "iOS")
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to sign up:", err)
+	}
+
+	tx := testBeginTx(t, d, s.AuthToken)
+
+	p, err := tx.Permission()
+	if err != nil {
+		t.Fatal("Failed to get permission:", err)
+	}
+	if p != smolboard.PermissionGuest {
+		t.Fatal("Unexpected signup permission:", p)
+	}
+
+	post := NewEmptyPost("image/png")
+	post.Size = 1
+
+	if err := tx.SavePost(&post); !errors.Is(err, smolboard.ErrUserPending) {
+		t.Fatal("Unexpected error uploading as a pending user:", err)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, perm := range []string{"administrator", "owner", "pending"} {
+			cfg := NewConfig()
+			cfg.Owner = "ひめありかわ"
+			cfg.DatabasePath = "/dev/null"
+			cfg.DefaultSignupPermission = perm
+
+			if err := cfg.Validate(); err == nil {
+				t.Fatalf("Unexpected nil error validating %q", perm)
+			}
+		}
+	})
+}
+
+func TestUserApproval(t *testing.T) {
+	d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+		cfg.DefaultSignupPermission = "guest"
+	})
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	admin := newTestUser(t, d, owner.AuthToken, "とよとみヒロ", smolboard.PermissionAdministrator)
+
+	signup := func(t *testing.T, name string) *smolboard.Session {
+		t.Helper()
+
+		token := testOneTimeToken(t, d, owner.AuthToken)
+
+		var s *smolboard.Session
+
+		err := d.AcquireGuest(context.Background(), func(tx *Transaction) (err error) {
+			s, err = tx.Signup(name, "password", token, "iOS")
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to sign up:", err)
+		}
+
+		return s
+	}
+
+	approved := signup(t, "かぐやありかわ")
+	rejected := signup(t, "ヒメゴト")
+
+	t.Run("Me", func(t *testing.T) {
+		tx := testBeginTx(t, d, approved.AuthToken)
+
+		u, err := tx.Me()
+		if err != nil {
+			t.Fatal("Failed to get self:", err)
+		}
+		if !u.Pending {
+			t.Fatal("User is not pending after signing up")
+		}
+
+		if _, err := tx.PendingUsers(); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error listing pending users as a pending user:", err)
+		}
+		if err := tx.ApproveUser(rejected.Username); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error approving as a pending user:", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		tx := testBeginTx(t, d, admin.AuthToken)
+
+		users, err := tx.PendingUsers()
+		if err != nil {
+			t.Fatal("Failed to list pending users:", err)
+		}
+
+		if len(users) != 2 || users[0].Username != approved.Username || users[1].Username != rejected.Username {
+			t.Fatalf("Unexpected pending users: %#v", users)
+		}
+	})
+
+	t.Run("Approve", func(t *testing.T) {
+		tx := testBeginTx(t, d, admin.AuthToken)
+
+		if err := tx.ApproveUser(approved.Username); err != nil {
+			t.Fatal("Failed to approve user:", err)
+		}
+
+		err := tx.ApproveUser(approved.Username)
+		if !errors.Is(err, smolboard.ErrUserNotPending) {
+			t.Fatal("Unexpected error approving an approved user:", err)
+		}
+	})
+
+	t.Run("Approved", func(t *testing.T) {
+		tx := testBeginTx(t, d, approved.AuthToken)
+
+		u, err := tx.Me()
+		if err != nil {
+			t.Fatal("Failed to get self:", err)
+		}
+		if u.Pending || u.Permission != smolboard.PermissionUser {
+			t.Fatalf("Unexpected approved user: %#v", u)
+		}
+
+		post := NewEmptyPost("image/png")
+		post.Size = 1
+
+		if err := tx.SavePost(&post); err != nil {
+			t.Fatal("Failed to upload as an approved user:", err)
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		tx := testBeginTx(t, d, admin.AuthToken)
+
+		err := tx.RejectUser(approved.Username)
+		if !errors.Is(err, smolboard.ErrUserNotPending) {
+			t.Fatal("Unexpected error rejecting an approved user:", err)
+		}
+
+		if err := tx.RejectUser(rejected.Username); err != nil {
+			t.Fatal("Failed to reject user:", err)
+		}
+
+		if _, err := tx.User(rejected.Username); !errors.Is(err, smolboard.ErrUserNotFound) {
+			t.Fatal("Unexpected error getting a rejected user:", err)
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		_, err := BeginTx(context.Background(), d, rejected.AuthToken)
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using a rejected user's session:", err)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		entries, err := tx.AuditLog(0, 2)
+		if err != nil {
+			t.Fatal("Failed to get audit log:", err)
+		}
+
+		if len(entries) != 2 ||
+			entries[0].Action != "user.reject" || entries[0].Target != rejected.Username ||
+			entries[1].Action != "user.approve" || entries[1].Target != approved.Username {
+
+			t.Fatalf("Unexpected audit log: %#v", entries)
+		}
+	})
+}
+
+func TestMeCounts(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	// Sign in again for a second session.
+	err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+		_, err := tx.Signin(owner.Username, "goodpassword", "Android")
+		return err
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in again:", err)
+	}
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	var posts = make([]smolboard.Post, 3)
+	for i := range posts {
+		posts[i] = NewEmptyPost("image/png")
+		posts[i].Size = 1
+
+		if err := tx.SavePost(&posts[i]); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+	}
+
+	// Soft-deleted posts shouldn't be counted.
+	if err := tx.DeletePost(posts[0].ID, false); err != nil {
+		t.Fatal("Failed to delete post:", err)
+	}
+
+	u, err := tx.Me()
+	if err != nil {
+		t.Fatal("Failed to get self:", err)
+	}
+
+	if u.SessionCount != 2 {
+		t.Error("Unexpected session count:", u.SessionCount)
+	}
+	if u.PostCount != 2 {
+		t.Error("Unexpected post count:", u.PostCount)
+	}
+
+	// Other users don't get counts.
+	other, err := tx.User(owner.Username)
+	if err != nil {
+		t.Fatal("Failed to get user:", err)
+	}
+	if other.SessionCount != 0 || other.PostCount != 0 {
+		t.Fatalf("Unexpected counts in user: %#v", other)
+	}
+}
+
+func TestSessionCountsByUsers(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "goodpassword")
+
+	var users = map[string]int{
+		"かぐやありかわ": 1,
+		"ヒメゴト":    3,
+		"さくら":     0,
+	}
+
+	for name, sessions := range users {
+		s := newTestUser(t, d, owner.AuthToken, name, smolboard.PermissionUser)
+
+		// newTestUser signs up, which makes the first session.
+		for i := 1; i < sessions; i++ {
+			err := d.AcquireGuest(context.Background(), func(tx *Transaction) error {
+				_, err := tx.Signin(name, "password", "")
+				return err
+			})
+			if err != nil {
+				t.Fatal("Failed to sign in:", err)
+			}
+		}
+
+		if sessions == 0 {
+			err := d.Acquire(context.Background(), s.AuthToken, func(tx *Transaction) error {
+				return tx.Signout()
+			})
+			if err != nil {
+				t.Fatal("Failed to sign out:", err)
+			}
+		}
+	}
+
+	trusted := newTestUser(t, d, owner.AuthToken, "ななし", smolboard.PermissionTrusted)
+
+	tx := testBeginTx(t, d, owner.AuthToken)
+
+	var names = []string{"かぐやありかわ", "ヒメゴト", "さくら", "ななし", owner.Username}
+
+	counts, err := tx.SessionCountsByUsers(names)
+	if err != nil {
+		t.Fatal("Failed to count sessions:", err)
+	}
+
+	// Compare against the sessions counted one by one.
+	for _, name := range names {
+		sessions, err := d.Config.SessionStore.ListByUser(tx, name)
+		if err != nil {
+			t.Fatal("Failed to list sessions:", err)
+		}
+
+		if counts[name] != len(sessions) {
+			t.Errorf("User %q has %d sessions, counted %d", name, len(sessions), counts[name])
+		}
+	}
+
+	if counts["さくら"] != 0 || counts["ヒメゴト"] != 3 {
+		t.Fatalf("Unexpected counts: %v", counts)
+	}
+
+	t.Run("UserList", func(t *testing.T) {
+		list, err := tx.Users(100, 0)
+		if err != nil {
+			t.Fatal("Failed to list users:", err)
+		}
+
+		for _, u := range list.Users {
+			if u.SessionCount != counts[u.Username] {
+				t.Errorf("User %q listed with %d sessions, expected %d",
+					u.Username, u.SessionCount, counts[u.Username])
+			}
+		}
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		tx := testBeginTx(t, d, trusted.AuthToken)
+
+		_, err := tx.SessionCountsByUsers([]string{owner.Username})
+		if !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error counting sessions as a trusted user:", err)
+		}
+	})
+}
+
+func TestLastLogin(t *testing.T) {
+	d := newTestDatabase(t)
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	user := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionUser)
+	other := newTestUser(t, d, owner.AuthToken, "ヒメゴト", smolboard.PermissionUser)
+
+	// lastLogin returns the last login of the user as seen by the session.
+	var lastLogin = func(t *testing.T, token, username string) int64 {
+		t.Helper()
+
+		var u *smolboard.UserPart
+
+		err := d.Acquire(context.Background(), token, func(tx *Transaction) (err error) {
+			u, err = tx.User(username)
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to get user:", err)
+		}
+
+		return u.LastLogin
+	}
+
+	// signin signs in as the user and returns the new session's token.
+	var signin = func(t *testing.T, pass string) (string, error) {
+		t.Helper()
+
+		var s *smolboard.Session
+
+		err := d.AcquireGuest(context.Background(), func(tx *Transaction) (err error) {
+			s, err = tx.Signin(user.Username, pass, "")
+			return
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return s.AuthToken, nil
+	}
+
+	// Signing up is not signing in.
+	if last := lastLogin(t, user.AuthToken, user.Username); last != 0 {
+		t.Fatal("Unexpected last login after signing up:", last)
+	}
+
+	token, err := signin(t, "password")
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	var first = lastLogin(t, token, user.Username)
+	if first == 0 {
+		t.Fatal("Last login not set after signing in")
+	}
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		if _, err := signin(t, "badpassword"); !errors.Is(err, smolboard.ErrInvalidPassword) {
+			t.Fatal("Unexpected error signing in with a wrong password:", err)
+		}
+
+		if last := lastLogin(t, token, user.Username); last != first {
+			t.Fatal("Last login changed after a failed sign in:", last)
+		}
+	})
+
+	t.Run("Renewal", func(t *testing.T) {
+		// Starting a transaction renews the session.
+		if last := lastLogin(t, token, user.Username); last != first {
+			t.Fatal("Last login changed after a session renewal:", last)
+		}
+	})
+
+	t.Run("Advance", func(t *testing.T) {
+		if _, err := signin(t, "password"); err != nil {
+			t.Fatal("Failed to sign in:", err)
+		}
+
+		if last := lastLogin(t, token, user.Username); last <= first {
+			t.Fatalf("Last login %d did not advance after %d", last, first)
+		}
+	})
+
+	t.Run("Visibility", func(t *testing.T) {
+		if last := lastLogin(t, owner.AuthToken, user.Username); last == 0 {
+			t.Fatal("Last login hidden from the owner")
+		}
+		if last := lastLogin(t, other.AuthToken, user.Username); last != 0 {
+			t.Fatal("Last login shown to another user:", last)
+		}
+	})
+}
+
+func TestPruneInactiveUsers(t *testing.T) {
+	d := newTestDatabase(t)
+
+	owner := testNewOwner(t, d, "ひめありかわ", "password")
+	admin := newTestUser(t, d, owner.AuthToken, "かぐやありかわ", smolboard.PermissionAdministrator)
+	poster := newTestUser(t, d, owner.AuthToken, "ヒメゴト", smolboard.PermissionUser)
+	idle := newTestUser(t, d, owner.AuthToken, "idle", smolboard.PermissionUser)
+	recent := newTestUser(t, d, owner.AuthToken, "recent", smolboard.PermissionTrusted)
+
+	const age = 30 * 24 * time.Hour
+
+	t.Run("Setup", func(t *testing.T) {
+		tx := testBeginTx(t, d, poster.AuthToken)
+
+		p := NewEmptyPost("image/png")
+		p.Size = 1
+
+		if err := tx.SavePost(&p); err != nil {
+			t.Fatal("Failed to save post:", err)
+		}
+
+		// Everyone but recent signed up and last signed in long ago.
+		var old = time.Now().Add(-2 * age).UnixNano()
+
+		_, err := tx.Exec(
+			"UPDATE users SET jointime = ?, lastlogin = CASE WHEN username = ? THEN ? ELSE ? END",
+			old, recent.Username, time.Now().UnixNano(), old,
+		)
+		if err != nil {
+			t.Fatal("Failed to backdate users:", err)
+		}
+	})
+
+	t.Run("NotOwner", func(t *testing.T) {
+		tx := testBeginTx(t, d, admin.AuthToken)
+
+		if _, err := tx.PruneInactiveUsers(age, true); !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error pruning as an administrator:", err)
+		}
+	})
+
+	t.Run("TooShort", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		if _, err := tx.PruneInactiveUsers(time.Hour, true); !errors.Is(err, smolboard.ErrPruneAgeTooShort) {
+			t.Fatal("Unexpected error pruning with a short age:", err)
+		}
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		u, err := tx.PruneInactiveUsers(age, true)
+		if err != nil {
+			t.Fatal("Failed to dry-run prune:", err)
+		}
+
+		if len(u) != 1 || u[0] != idle.Username {
+			t.Fatalf("Unexpected users to prune: %q", u)
+		}
+
+		if _, err := tx.User(idle.Username); err != nil {
+			t.Fatal("User deleted in a dry run:", err)
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		tx := testBeginTx(t, d, owner.AuthToken)
+
+		u, err := tx.PruneInactiveUsers(age, false)
+		if err != nil {
+			t.Fatal("Failed to prune:", err)
+		}
+
+		if len(u) != 1 || u[0] != idle.Username {
+			t.Fatalf("Unexpected pruned users: %q", u)
+		}
+
+		if _, err := tx.User(idle.Username); !errors.Is(err, smolboard.ErrUserNotFound) {
+			t.Fatal("Unexpected error getting pruned user:", err)
+		}
+
+		for _, s := range []*smolboard.Session{owner, admin, poster, recent} {
+			if _, err := tx.User(s.Username); err != nil {
+				t.Fatalf("User %q was pruned: %v", s.Username, err)
+			}
+		}
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		err := d.Acquire(context.Background(), idle.AuthToken, func(tx *Transaction) error {
+			return nil
+		})
+		if !errors.Is(err, smolboard.ErrSessionExpired) {
+			t.Fatal("Unexpected error using the pruned user's session:", err)
+		}
+	})
+}
+
+func TestReservedUsernames(t *testing.T) {
+	var modes = map[string]bool{
+		"Exact":      false,
+		"Normalized": true,
+	}
+
+	for name, normalize := range modes {
+		normalize := normalize
+
+		t.Run(name, func(t *testing.T) {
+			d := newTestDatabaseWith(t, func(cfg *DBConfig) {
+				cfg.NormalizeReservedUsernames = normalize
+			})
+
+			testNewOwner(t, d, "ひめありかわ", "password")
+
+			var tests = []struct {
+				name     string
+				reserved bool
+			}{
+				{"admin", true},
+				{"Admin", true},
+				{"ROOT", true},
+				{"ヒメアリカワ", false},
+				{"ひめありかわ2", false},
+				{"admins", false},
+				{"badmin", false},
+				{"adm1n", normalize},
+				{"аdmin", normalize}, // Cyrillic а
+				{"sys_tem", normalize},
+				{"ＡＤＭＩＮ", normalize},
+			}
+
+			for _, test := range tests {
+				tx := testBeginTx(t, d, "")
+
+				err := tx.createUser(test.name, "password", smolboard.PermissionUser)
+
+				if test.reserved && !errors.Is(err, smolboard.ErrUsernameReserved) {
+					t.Errorf("Unexpected error signing up as %q: %v", test.name, err)
+				}
+				if !test.reserved && err != nil {
+					t.Errorf("Failed to sign up as %q: %v", test.name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"strings"
+	"unicode"
+)
+
+// DefaultReservedUsernames are the usernames that can't be signed up with by
+// default.
+var DefaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "moderator", "mod", "staff",
+	"support", "anonymous", "smolboard",
+}
+
+// confusables maps runes that look like ASCII letters to them. It only covers
+// the common lookalikes that NameIsLegal allows.
+var confusables = map[rune]rune{
+	// Digits.
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't',
+	// Letters that look alike in most fonts.
+	'l': 'i', 'ı': 'i',
+	// Cyrillic.
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i',
+	'ї': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	// Greek.
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// foldUsername returns the form of the username that reserved usernames are
+// compared in. Usernames are always compared case-insensitively. If
+// NormalizeReservedUsernames is true, then lookalike letters are also replaced
+// with the ASCII letters that they look like, and underscores are dropped.
+func (c DBConfig) foldUsername(name string) string {
+	name = strings.ToLower(name)
+
+	if !c.NormalizeReservedUsernames {
+		return name
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '_' {
+			return -1
+		}
+
+		// Fullwidth letters and digits.
+		if r >= '！' && r <= '～' {
+			r = unicode.ToLower(r - '！' + '!')
+		}
+
+		if folded, ok := confusables[r]; ok {
+			return folded
+		}
+
+		return r
+	}, name)
+}
+
+// usernameIsReserved returns true if the username can't be signed up with.
+// The owner can always use their own name.
+func (c DBConfig) usernameIsReserved(name string) bool {
+	return name != c.Owner && c.reservedUsernames[c.foldUsername(name)]
+}
+
+// parseReservedUsernames folds the reserved usernames for usernameIsReserved.
+// The owner's and the anonymous user's names are always reserved.
+func (c DBConfig) parseReservedUsernames() map[string]bool {
+	var reserved = make(map[string]bool, len(c.ReservedUsernames)+2)
+
+	for _, name := range c.ReservedUsernames {
+		reserved[c.foldUsername(name)] = true
+	}
+
+	reserved[c.foldUsername(c.Owner)] = true
+	reserved[c.foldUsername(c.AnonymousUsername)] = true
+
+	return reserved
+}
@@ -0,0 +1,91 @@
+// Package events serves live post events as server-sent events.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/http/internal/limit"
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+)
+
+// HeartbeatInterval is how often a comment is sent while there are no events,
+// so that proxies don't close the idle connection.
+const HeartbeatInterval = 30 * time.Second
+
+func Mount(m tx.Middlewarer) http.Handler {
+	mux := chi.NewMux()
+	mux.Use(limit.RateLimit(1))
+	mux.Get("/", m(Stream))
+
+	return mux
+}
+
+// Stream streams the events of posts that the current user can see until the
+// client disconnects. Each event's name is its type, and its data is the event
+// as JSON. Clients that can't keep up are disconnected, after which they can
+// reconnect and refetch the posts that they missed.
+func Stream(r tx.Request) (interface{}, error) {
+	sub, err := r.Tx.SubscribeEvents(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// The renderer is called after the transaction is done, so the stream
+	// doesn't hold onto it.
+	var ctx = r.Context()
+
+	return func(w http.ResponseWriter) error {
+		defer sub.Close()
+
+		f, ok := w.(http.Flusher)
+		if !ok {
+			return errors.New("streaming is not supported")
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Stop nginx from buffering the stream.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		f.Flush()
+
+		var heartbeat = time.NewTicker(HeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			// Write errors mean that the client is gone, and the response
+			// can't carry an error anymore anyway.
+			select {
+			case ev, ok := <-sub.Events():
+				if !ok {
+					return nil
+				}
+
+				b, err := json.Marshal(ev)
+				if err != nil {
+					return nil
+				}
+
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b); err != nil {
+					return nil
+				}
+
+			case <-heartbeat.C:
+				if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+					return nil
+				}
+
+			case <-ctx.Done():
+				return nil
+			}
+
+			f.Flush()
+		}
+	}, nil
+}
@@ -1,41 +1,208 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/c2h5oh/datasize"
+	"github.com/diamondburned/duration"
 	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/http/events"
+	"github.com/diamondburned/smolboard/server/http/internal/form"
+	"github.com/diamondburned/smolboard/server/http/internal/ipfilter"
 	"github.com/diamondburned/smolboard/server/http/internal/limit"
 	"github.com/diamondburned/smolboard/server/http/internal/limread"
+	"github.com/diamondburned/smolboard/server/http/internal/readonly"
+	"github.com/diamondburned/smolboard/server/http/internal/timeout"
 	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/http/pool"
 	"github.com/diamondburned/smolboard/server/http/post"
+	"github.com/diamondburned/smolboard/server/http/report"
 	"github.com/diamondburned/smolboard/server/http/token"
 	"github.com/diamondburned/smolboard/server/http/upload"
 	"github.com/diamondburned/smolboard/server/http/upload/imgsrv"
 	"github.com/diamondburned/smolboard/server/http/user"
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
 )
 
 type HTTPConfig struct {
 	MaxBodySize datasize.ByteSize `toml:"maxBodySize"`
+	RateLimit   RateLimitConfig   `toml:"rateLimit"`
+	Concurrency ConcurrencyConfig `toml:"concurrency"`
+	// CookieName is the name of the session token cookie. The frontend must
+	// use the same name.
+	CookieName string `toml:"cookieName"`
+	// RequestTimeout is the maximum duration of a request, after which its
+	// context is canceled and its body can't be read anymore. It can be 0 to
+	// disable the timeout.
+	RequestTimeout string `toml:"requestTimeout"`
+	// UploadTimeout replaces RequestTimeout for uploads, which can take
+	// minutes for large files.
+	UploadTimeout string `toml:"uploadTimeout"`
+	// AdminAllowlist and AdminDenylist restrict the networks that
+	// administrators and the owner can use their permission from, in CIDR
+	// notation or as plain IPs. Elsewhere, they are treated as trusted users,
+	// so administrative actions fail with 403. Denied networks take
+	// precedence, and both are empty by default, which doesn't restrict
+	// anything. The client IP is resolved through TrustedProxies.
+	AdminAllowlist []string `toml:"adminAllowlist"`
+	AdminDenylist  []string `toml:"adminDenylist"`
+	// TrustedProxies are the networks of the reverse proxies in front of the
+	// server, in CIDR notation or as plain IPs. Only requests from them have
+	// their X-Forwarded-For or X-Real-IP header believed, and the client IP
+	// is the rightmost forwarded address that isn't a trusted proxy. It is
+	// empty by default, which uses the TCP peer as the client IP. This IP is
+	// used by AdminAllowlist and the per-IP rate limits.
+	TrustedProxies []string `toml:"trustedProxies"`
+	// ReadOnly starts the server in read-only mode, in which all writes except
+	// signing in and out fail with 503. The owner can change it at runtime.
+	ReadOnly bool `toml:"readOnly"`
 	// inherit upload's config
 	upload.UploadConfig
+
+	requestTimeout time.Duration
+	uploadTimeout  time.Duration
+	adminFilter    *ipfilter.Filter
+	proxies        *ipfilter.Proxies
 }
 
 func NewConfig() HTTPConfig {
 	return HTTPConfig{
 		MaxBodySize:  1 * datasize.GB,
+		RateLimit:    NewRateLimitConfig(),
+		CookieName:   smolboard.DefaultCookieName,
 		UploadConfig: upload.NewConfig(),
+
+		RequestTimeout: "1m",
+		UploadTimeout:  "10m",
 	}
 }
 
 func (c *HTTPConfig) Validate() error {
+	if c.CookieName == "" {
+		return fmt.Errorf("missing `cookieName' value")
+	}
+
+	d, err := duration.ParseDuration(c.RequestTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid request timeout")
+	}
+	c.requestTimeout = time.Duration(d)
+
+	d, err = duration.ParseDuration(c.UploadTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid upload timeout")
+	}
+	c.uploadTimeout = time.Duration(d)
+
+	if c.requestTimeout < 0 || c.uploadTimeout < 0 {
+		return errors.New("`requestTimeout' and `uploadTimeout' must not be negative")
+	}
+
+	f, err := ipfilter.New(c.AdminAllowlist, c.AdminDenylist)
+	if err != nil {
+		return errors.Wrap(err, "invalid `adminAllowlist' or `adminDenylist'")
+	}
+	c.adminFilter = f
+
+	p, err := ipfilter.NewProxies(c.TrustedProxies)
+	if err != nil {
+		return errors.Wrap(err, "invalid `trustedProxies'")
+	}
+	c.proxies = p
+
+	if err := c.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Concurrency.Validate(); err != nil {
+		return err
+	}
 	return c.UploadConfig.Validate()
 }
 
+// ConcurrencyConfig configures the maximum number of requests of each route
+// group that are handled at once, across all users. Requests over the limit
+// fail with 503 right away instead of waiting. A group isn't limited if its
+// limit is 0, which is the default.
+type ConcurrencyConfig struct {
+	// Upload limits uploading posts, which is the most expensive in memory
+	// and disk.
+	Upload int `toml:"upload"`
+	// Write limits all other non-GET requests.
+	Write int `toml:"write"`
+	// Read limits all GET requests except for event streams, which last until
+	// the client leaves.
+	Read int `toml:"read"`
+}
+
+func (c *ConcurrencyConfig) Validate() error {
+	if c.Upload < 0 || c.Write < 0 || c.Read < 0 {
+		return errors.New("`concurrency' limits must not be negative")
+	}
+	return nil
+}
+
+// RateLimitConfig configures the per-user rate limits of each route group.
+// Requests are limited by the username if the request is authenticated, or by
+// the IP otherwise.
+type RateLimitConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Auth limits signing in, signing up and other account recovery routes.
+	Auth limit.Rate `toml:"auth"`
+	// Upload limits uploading posts.
+	Upload limit.Rate `toml:"upload"`
+	// AnonymousUpload limits uploading posts without an account.
+	AnonymousUpload limit.Rate `toml:"anonymousUpload"`
+	// Write limits all other non-GET requests.
+	Write limit.Rate `toml:"write"`
+	// Read limits all GET requests.
+	Read limit.Rate `toml:"read"`
+}
+
+func NewRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Enabled: false,
+		Auth:    limit.Rate{PerSecond: 0.2, Burst: 5},
+		Upload:  limit.Rate{PerSecond: 0.5, Burst: 10},
+		Write:   limit.Rate{PerSecond: 5, Burst: 20},
+		Read:    limit.Rate{PerSecond: 50, Burst: 200},
+
+		AnonymousUpload: limit.Rate{PerSecond: 0.02, Burst: 3},
+	}
+}
+
+func (c *RateLimitConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	var rates = map[string]limit.Rate{
+		"auth":            c.Auth,
+		"upload":          c.Upload,
+		"anonymousUpload": c.AnonymousUpload,
+		"write":           c.Write,
+		"read":            c.Read,
+	}
+
+	for name, rate := range rates {
+		if rate.PerSecond <= 0 || rate.Burst < 1 {
+			return fmt.Errorf("invalid rateLimit.%s: perSecond and burst must be positive", name)
+		}
+	}
+
+	return nil
+}
+
 func GetTypes(cfg HTTPConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -46,46 +213,285 @@ func GetTypes(cfg HTTPConfig) http.HandlerFunc {
 	}
 }
 
+// NotFound renders the JSON not found error. It can be used for paths that are
+// meant for the API but outside of where the routes are mounted, such as other
+// API versions, so that clients can always parse the error.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	tx.NotFound(w, r)
+}
+
+// GetVersion writes the server's version. It does not need a session.
+func GetVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	v := smolboard.VersionInfo{
+		Version:    smolboard.Version,
+		APIVersion: smolboard.APIVersion,
+	}
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Encode failed:", err)
+	}
+}
+
 type Routes struct {
 	http.Handler
+	db  *db.Database
 	mw  tx.Middleware
 	cfg HTTPConfig
+
+	authLimit   *limit.Limiter
+	uploadLimit *limit.Limiter
+	writeLimit  *limit.Limiter
+	readLimit   *limit.Limiter
+
+	anonUploadLimit *limit.Limiter
+
+	uploadSlots *limit.Semaphore
+	writeSlots  *limit.Semaphore
+	readSlots   *limit.Semaphore
+
+	readOnly *readonly.Mode
 }
 
 func New(db *db.Database, cfg HTTPConfig) (*Routes, error) {
 	mux := chi.NewMux()
 	rts := &Routes{
 		Handler: mux,
-		mw:      tx.NewMiddleware(db, cfg.UploadConfig),
+		db:      db,
+		mw:      tx.NewMiddleware(db, cfg.UploadConfig, cfg.CookieName, cfg.adminFilter),
 		cfg:     cfg,
+
+		readOnly: readonly.NewMode(cfg.ReadOnly),
+	}
+
+	if cfg.RateLimit.Enabled {
+		rts.authLimit = limit.NewLimiter(cfg.RateLimit.Auth, rts.rateLimitKey)
+		rts.uploadLimit = limit.NewLimiter(cfg.RateLimit.Upload, rts.rateLimitKey)
+		rts.writeLimit = limit.NewLimiter(cfg.RateLimit.Write, rts.rateLimitKey)
+		rts.readLimit = limit.NewLimiter(cfg.RateLimit.Read, rts.rateLimitKey)
+		rts.anonUploadLimit = limit.NewLimiter(cfg.RateLimit.AnonymousUpload, rts.rateLimitKey)
+	}
+
+	if n := cfg.Concurrency.Upload; n > 0 {
+		rts.uploadSlots = limit.NewSemaphore(n)
+	}
+	if n := cfg.Concurrency.Write; n > 0 {
+		rts.writeSlots = limit.NewSemaphore(n)
+	}
+	if n := cfg.Concurrency.Read; n > 0 {
+		rts.readSlots = limit.NewSemaphore(n)
 	}
 
 	// Alias the middleware function.
 	m := rts.mw.M
 
 	mux.Use(
-		middleware.RealIP,
-		middleware.Recoverer,
+		cfg.proxies.RealIP,
+		cacheRateLimitKey,
+		limit.KeyBy(rts.rateLimitKey),
+		middleware.RequestID,
+		tx.Recoverer,
+		timeout.Timeout(rts.timeout),
 		middleware.Compress(5),
 		limread.LimitBody(cfg.MaxBodySize),
 	)
 
+	// Render all errors as JSON, including ones from the router. These are
+	// inherited by the mounted routers.
+	mux.NotFound(tx.NotFound)
+	mux.MethodNotAllowed(tx.MethodNotAllowed)
+
+	// Writes are guarded against read-only mode, except for signing in and
+	// out, so that the owner can still turn it off.
+	guard := rts.readOnly.Guard
+	owner := tx.RequirePermission(m, smolboard.PermissionOwner)
+
 	mux.Group(func(mux chi.Router) {
 		mux.Use(limit.RateLimit(2))
+		mux.Use(limit.NewGroupLimiter(rts.authRateLimiter).Middleware())
 		mux.Post("/signin", m(user.Signin))
-		mux.Post("/signup", m(user.Signup))
-		mux.Post("/signout", m(user.Signout))
+		mux.With(guard).Post("/signup", m(user.Signup))
+		mux.With(tx.AllowReadOnly).Post("/signout", m(user.Signout))
+		mux.With(guard).Post("/verify-email", m(user.VerifyEmail))
+		mux.With(guard).Post("/reset-password", m(user.RequestPasswordReset))
+		mux.With(guard).Post("/reset-password/confirm", m(user.ResetPassword))
 	})
 
 	mux.Group(func(mux chi.Router) {
-		mux.Use(limit.RateLimit(64))
-		mux.Get("/filetypes", GetTypes(cfg))
+		mux.Use(limit.RateLimit(2))
+		mux.Get("/read-only", m(rts.getReadOnly))
+		mux.Post("/read-only", owner(rts.setReadOnly))
 	})
 
-	mux.Mount("/tokens", token.Mount(m))
-	mux.Mount("/images", imgsrv.Mount(m))
-	mux.Mount("/posts", post.Mount(m))
-	mux.Mount("/users", user.Mount(m))
+	mux.Group(func(mux chi.Router) {
+		mux.Use(guard)
+		mux.Use(limit.NewGroupLimiter(rts.rateLimiter).Middleware())
+		mux.Use(limit.NewGroupSemaphore(rts.semaphore).Middleware())
+
+		mux.With(limit.RateLimit(64)).Get("/filetypes", GetTypes(cfg))
+		mux.With(limit.RateLimit(64)).Get("/version", GetVersion)
+
+		mux.Mount("/tokens", token.Mount(m))
+		mux.Mount("/images", imgsrv.Mount(m))
+		mux.Mount("/posts", post.Mount(m))
+		mux.Mount("/users", user.Mount(m))
+		mux.Mount("/sessions", user.MountSessions(m))
+		mux.Mount("/reports", report.Mount(m))
+		mux.Mount("/pools", pool.Mount(m))
+		mux.Mount("/events", events.Mount(m))
+	})
 
 	return rts, nil
 }
+
+func (rts *Routes) getReadOnly(r tx.Request) (interface{}, error) {
+	return smolboard.ReadOnlyState{Enabled: rts.readOnly.Enabled()}, nil
+}
+
+type ReadOnlyParams struct {
+	Enabled bool `schema:"enabled,required"`
+}
+
+// setReadOnly enables or disables read-only mode. Only the owner can do this,
+// which is checked by the route.
+func (rts *Routes) setReadOnly(r tx.Request) (interface{}, error) {
+	var params ReadOnlyParams
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	rts.readOnly.Set(params.Enabled)
+	return smolboard.ReadOnlyState{Enabled: params.Enabled}, nil
+}
+
+type ctxKey uint8
+
+const keyRateLimitKey ctxKey = iota
+
+// cachedKey is the rate limit key of a request, which is resolved at most once
+// no matter how many limiters ask for it.
+type cachedKey struct {
+	once sync.Once
+	key  string
+}
+
+// cacheRateLimitKey is a middleware that makes rateLimitKey look the
+// request's session up only once.
+func cacheRateLimitKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), keyRateLimitKey, &cachedKey{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rateLimitKey returns the username of the request's session if there's a
+// valid one. Otherwise, the IP is returned. The key is cached for the rest of
+// the request if cacheRateLimitKey was used.
+func (rts *Routes) rateLimitKey(r *http.Request) string {
+	c, ok := r.Context().Value(keyRateLimitKey).(*cachedKey)
+	if !ok {
+		return rts.resolveRateLimitKey(r)
+	}
+
+	c.once.Do(func() { c.key = rts.resolveRateLimitKey(r) })
+	return c.key
+}
+
+func (rts *Routes) resolveRateLimitKey(r *http.Request) string {
+	if token, _ := tx.SessionToken(r, rts.cfg.CookieName); token != "" {
+		u, err := rts.db.SessionUsername(r.Context(), token)
+		if err == nil {
+			return "user:" + u
+		}
+	}
+
+	return limit.IPKey(r)
+}
+
+func (rts *Routes) authRateLimiter(r *http.Request) *limit.Limiter {
+	return rts.authLimit
+}
+
+// rateLimiter returns the limiter for the route group of the given request.
+func (rts *Routes) rateLimiter(r *http.Request) *limit.Limiter {
+	if !rts.cfg.RateLimit.Enabled {
+		return nil
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return rts.readLimit
+	case http.MethodPost:
+		if isUpload(r) {
+			// Uploads keyed by the IP are done without an account.
+			if !strings.HasPrefix(rts.rateLimitKey(r), "user:") {
+				return rts.anonUploadLimit
+			}
+			return rts.uploadLimit
+		}
+	}
+
+	return rts.writeLimit
+}
+
+// semaphore returns the concurrency limit for the route group of the given
+// request, or nil if the group isn't limited.
+func (rts *Routes) semaphore(r *http.Request) *limit.Semaphore {
+	if isEventStream(r) {
+		return nil
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return rts.readSlots
+	case http.MethodPost:
+		if isUpload(r) {
+			return rts.uploadSlots
+		}
+	}
+
+	return rts.writeSlots
+}
+
+// timeout returns the timeout of the given request. Uploads get their own
+// timeout instead of one on top of the request timeout, so that they aren't cut
+// short by it. Event streams last until the client leaves, so they have none.
+func (rts *Routes) timeout(r *http.Request) time.Duration {
+	if isUpload(r) {
+		return rts.cfg.uploadTimeout
+	}
+	if isEventStream(r) {
+		return 0
+	}
+	return rts.cfg.requestTimeout
+}
+
+// isEventStream returns true if the request streams events.
+func isEventStream(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.TrimSuffix(routePath(r), "/") == "/events"
+}
+
+// isUpload returns true if the request uploads posts, which includes external
+// posts, whose media may be fetched.
+func isUpload(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+
+	switch strings.TrimSuffix(routePath(r), "/") {
+	case "/posts", "/posts/external":
+		return true
+	default:
+		return false
+	}
+}
+
+// routePath returns the path relative to where the routes are mounted.
+func routePath(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		return rctx.RoutePath
+	}
+	return r.URL.Path
+}
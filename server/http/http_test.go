@@ -0,0 +1,1001 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/client"
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/http/upload"
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-chi/chi"
+	"github.com/go-test/deep"
+)
+
+func newTestRoutes(t *testing.T) *Routes {
+	t.Helper()
+	return newTestRoutesWith(t, func(*HTTPConfig) {})
+}
+
+// newTestRoutesWith is newTestRoutes with the config changed by fn before it's
+// validated.
+func newTestRoutesWith(t *testing.T, fn func(*HTTPConfig)) *Routes {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "smolboard-http-test-")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dbcfg := db.NewConfig()
+	dbcfg.Owner = "ひめありかわ"
+	dbcfg.DatabasePath = filepath.Join(dir, "smolboard.db")
+
+	if err := db.CreateOwner(dbcfg, "password"); err != nil {
+		t.Fatal("Failed to create owner:", err)
+	}
+
+	d, err := db.NewDatabase(dbcfg)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	cfg := NewConfig()
+	cfg.FileDirectory = filepath.Join(dir, "files")
+	fn(&cfg)
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("Invalid config:", err)
+	}
+
+	rts, err := New(d, cfg)
+	if err != nil {
+		t.Fatal("Failed to create routes:", err)
+	}
+
+	return rts
+}
+
+func TestUnknownRoutes(t *testing.T) {
+	rts := newTestRoutes(t)
+
+	var tests = []struct {
+		method string
+		path   string
+		err    error
+	}{
+		{"GET", "/bogus", tx.ErrNotFound},
+		{"GET", "/posts/1/bogus", tx.ErrNotFound},
+		{"GET", "/users/@me/sessions/bogus", tx.ErrNotFound},
+		{"POST", "/images/1.png/bogus", tx.ErrNotFound},
+		{"DELETE", "/version", tx.ErrMethodNotAllowed},
+		{"PUT", "/posts/tags/rename", tx.ErrMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rts.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+			if w.Code != httperr.ErrCode(test.err) {
+				t.Fatal("Unexpected status code:", w.Code)
+			}
+
+			if ctype := w.Header().Get("Content-Type"); ctype != "application/json" {
+				t.Fatal("Unexpected content type:", ctype)
+			}
+
+			var resp smolboard.ErrResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal("Failed to decode error response:", err)
+			}
+
+			expect := smolboard.ErrResponse{
+				Error:     test.err.Error(),
+				Slug:      httperr.ErrSlug(test.err),
+				RequestID: w.Header().Get("X-Request-Id"),
+			}
+
+			if diff := deep.Equal(resp, expect); diff != nil {
+				t.Fatalf("Unexpected error response: %v", diff)
+			}
+		})
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	NotFound(w, httptest.NewRequest("GET", "/api/v2/posts", nil))
+
+	if w.Code != 404 || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response %d with type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var resp smolboard.ErrResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal("Failed to decode error response:", err)
+	}
+
+	if resp.Slug != httperr.ErrSlug(tx.ErrNotFound) {
+		t.Fatal("Unexpected slug:", resp.Slug)
+	}
+}
+
+func TestJSONBody(t *testing.T) {
+	rts := newTestRoutes(t)
+
+	mux := chi.NewMux()
+	mux.Mount("/api/v1", rts)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, err := client.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	c.Tries = 1
+
+	var auth = map[string]string{
+		"username": "ひめありかわ",
+		"password": "password",
+	}
+
+	var s smolboard.Session
+	if err := c.RequestJSON(context.Background(), "POST", "/signin", auth, &s); err != nil {
+		t.Fatal("Failed to sign in with a JSON body:", err)
+	}
+
+	if s.Username != "ひめありかわ" || s.AuthToken == "" {
+		t.Fatalf("Unexpected session: %#v", s)
+	}
+
+	t.Run("Nested", func(t *testing.T) {
+		var nested = map[string]interface{}{
+			"username": map[string]string{"ひめ": "ありかわ"},
+		}
+
+		err := c.RequestJSON(context.Background(), "POST", "/signup", nested, nil)
+		if client.ErrGetStatusCode(err, 0) != 400 {
+			t.Fatal("Unexpected error sending a nested object:", err)
+		}
+	})
+}
+
+// slowReader reads the body in small chunks with a delay before each one, like
+// a slow client would send it.
+type slowReader struct {
+	body  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if len(r.body) == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(r.delay)
+
+	if len(b) > 64 {
+		b = b[:64]
+	}
+
+	n := copy(b, r.body)
+	r.body = r.body[n:]
+	return n, nil
+}
+
+func TestUploadTimeout(t *testing.T) {
+	var body bytes.Buffer
+
+	w := multipart.NewWriter(&body)
+	w.WriteField("p", "0")
+	f, _ := w.CreateFormFile("file", "slow.txt")
+	f.Write(bytes.Repeat([]byte("slow "), 128))
+	w.Close()
+
+	// The whole body takes around 200ms to be sent.
+	var delay = 200 * time.Millisecond / time.Duration(body.Len()/64+1)
+
+	upload := func(rts *Routes) int {
+		r := httptest.NewRequest("POST", "/posts", &slowReader{body.Bytes(), delay})
+		r.Header.Set("Content-Type", w.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec.Code
+	}
+
+	t.Run("Exceeded", func(t *testing.T) {
+		rts := newTestRoutesWith(t, func(cfg *HTTPConfig) {
+			cfg.RequestTimeout = "10s"
+			cfg.UploadTimeout = "50ms"
+		})
+
+		if code := upload(rts); code != 408 {
+			t.Fatal("Unexpected status code:", code)
+		}
+	})
+
+	t.Run("Independent", func(t *testing.T) {
+		rts := newTestRoutesWith(t, func(cfg *HTTPConfig) {
+			cfg.RequestTimeout = "50ms"
+			cfg.UploadTimeout = "10s"
+		})
+
+		// The text file is rejected, which means that the whole body was read.
+		if code := upload(rts); code != 415 {
+			t.Fatal("Upload timed out with the request timeout:", code)
+		}
+	})
+}
+
+func TestUploadConcurrency(t *testing.T) {
+	const limit = 2
+
+	rts := newTestRoutesWith(t, func(cfg *HTTPConfig) {
+		cfg.Concurrency.Upload = limit
+	})
+
+	upload := func(body io.Reader) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/posts", body)
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=hime")
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	// Start uploads whose bodies never finish until the pipes are closed.
+	var pipes = make([]*io.PipeWriter, limit)
+	var done = make(chan struct{}, limit)
+
+	for i := range pipes {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+
+		go func() {
+			upload(pr)
+			done <- struct{}{}
+		}()
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); rts.uploadSlots.InFlight() < limit; {
+		if time.Now().After(deadline) {
+			t.Fatal("Uploads never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := upload(strings.NewReader(""))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatal("Unexpected status code of the upload over the limit:", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Missing Retry-After on the upload over the limit")
+	}
+
+	// Other route groups aren't limited by uploads.
+	r := httptest.NewRequest("GET", "/version", nil)
+	rec = httptest.NewRecorder()
+	rts.ServeHTTP(rec, r)
+
+	if rec.Code != 200 {
+		t.Fatal("Unexpected status code of a read during uploads:", rec.Code)
+	}
+
+	for _, pw := range pipes {
+		pw.CloseWithError(io.ErrUnexpectedEOF)
+	}
+	for range pipes {
+		<-done
+	}
+
+	if rec := upload(strings.NewReader("")); rec.Code == http.StatusServiceUnavailable {
+		t.Fatal("Upload is still limited after the others finished")
+	}
+}
+
+// testSignin signs in as the owner.
+func testSignin(t *testing.T, rts *Routes) smolboard.Session {
+	t.Helper()
+
+	var auth = url.Values{
+		"username": {"ひめありかわ"},
+		"password": {"password"},
+	}
+
+	r := httptest.NewRequest("POST", "/signin", strings.NewReader(auth.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rec := httptest.NewRecorder()
+	rts.ServeHTTP(rec, r)
+
+	var s smolboard.Session
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	return s
+}
+
+func TestAdminAllowlist(t *testing.T) {
+	rts := newTestRoutesWith(t, func(cfg *HTTPConfig) {
+		cfg.AdminAllowlist = []string{"10.0.0.0/8", "192.0.2.1"}
+		cfg.AdminDenylist = []string{"10.0.0.1"}
+		cfg.TrustedProxies = []string{"198.51.100.1"}
+	})
+
+	s := testSignin(t, rts)
+
+	var request = func(path, peer, forwarded string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = peer + ":1234"
+		r.Header.Set("Authorization", "Bearer "+s.AuthToken)
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec.Code
+	}
+
+	const proxy = "198.51.100.1"
+
+	var tests = []struct {
+		peer      string
+		forwarded string
+		path      string
+		code      int
+	}{
+		{proxy, "10.1.2.3", "/users", 200},
+		{proxy, "192.0.2.1", "/users", 200},
+		{"10.1.2.3", "", "/users", 200},
+		{proxy, "192.0.2.2", "/users", 403},
+		{proxy, "10.0.0.1", "/users", 403},
+		{proxy, "203.0.113.1", "/users", 403},
+		// The header is only believed from the trusted proxy.
+		{"203.0.113.1", "10.1.2.3", "/users", 403},
+		// Hops to the left of the client can be sent by the client itself.
+		{proxy, "10.1.2.3, 203.0.113.1", "/users", 403},
+		// Other routes still work outside of the allowed networks.
+		{proxy, "203.0.113.1", "/posts", 200},
+	}
+
+	for _, test := range tests {
+		if code := request(test.path, test.peer, test.forwarded); code != test.code {
+			t.Errorf("Unexpected status code for %s from %s forwarding %q: %d",
+				test.path, test.peer, test.forwarded, code)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	rts := newTestRoutes(t)
+	s := testSignin(t, rts)
+
+	srv := httptest.NewServer(rts)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+	r.Header.Set("Authorization", "Bearer "+s.AuthToken)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("Unexpected content type:", ct)
+	}
+
+	// The subscription exists once the headers are sent.
+	var post = db.NewEmptyPost("image/png")
+	post.Size = 1
+
+	err = rts.db.Acquire(ctx, s.AuthToken, func(tx *db.Transaction) error {
+		return tx.SavePost(&post)
+	})
+	if err != nil {
+		t.Fatal("Failed to save post:", err)
+	}
+
+	var lines = bufio.NewScanner(resp.Body)
+
+	for _, expect := range []string{"event: " + smolboard.EventPostCreate, "data: "} {
+		if !lines.Scan() {
+			t.Fatal("Stream ended early:", lines.Err())
+		}
+		if !strings.HasPrefix(lines.Text(), expect) {
+			t.Fatalf("Unexpected line %q, expected %q", lines.Text(), expect)
+		}
+	}
+
+	var ev smolboard.Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines.Text(), "data: ")), &ev); err != nil {
+		t.Fatal("Failed to decode event:", err)
+	}
+
+	if ev.Type != smolboard.EventPostCreate || ev.Post.ID != post.ID {
+		t.Fatalf("Unexpected event: %#v", ev)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	rts := newTestRoutes(t)
+	s := testSignin(t, rts)
+
+	var request = func(method, path, token string, body url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	var setReadOnly = func(t *testing.T, enabled string) {
+		t.Helper()
+
+		rec := request("POST", "/read-only", s.AuthToken, url.Values{"enabled": {enabled}})
+		if rec.Code != 200 {
+			t.Fatalf("Failed to set read-only mode to %s: %d", enabled, rec.Code)
+		}
+	}
+
+	// Only the owner can toggle it.
+	if rec := request("POST", "/read-only", "", url.Values{"enabled": {"true"}}); rec.Code != 403 {
+		t.Fatal("Unexpected status code enabling read-only mode as guest:", rec.Code)
+	}
+
+	setReadOnly(t, "true")
+
+	t.Run("Blocked", func(t *testing.T) {
+		var tests = []struct {
+			method string
+			path   string
+		}{
+			{"POST", "/signup"},
+			{"POST", "/posts"},
+			{"PATCH", "/posts/1/permission"},
+			{"DELETE", "/posts/1"},
+		}
+
+		for _, test := range tests {
+			rec := request(test.method, test.path, s.AuthToken, nil)
+			if rec.Code != 503 {
+				t.Errorf("Unexpected status code for %s %s: %d", test.method, test.path, rec.Code)
+				continue
+			}
+
+			var resp smolboard.ErrResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+
+			if resp.Slug != httperr.ErrSlug(smolboard.ErrReadOnly) {
+				t.Errorf("Unexpected slug for %s %s: %q", test.method, test.path, resp.Slug)
+			}
+		}
+	})
+
+	t.Run("Allowed", func(t *testing.T) {
+		if rec := request("GET", "/posts", s.AuthToken, nil); rec.Code != 200 {
+			t.Fatal("Unexpected status code listing posts:", rec.Code)
+		}
+
+		var state smolboard.ReadOnlyState
+
+		rec := request("GET", "/read-only", "", nil)
+		if err := json.NewDecoder(rec.Body).Decode(&state); err != nil || !state.Enabled {
+			t.Fatalf("Unexpected read-only state %#v: %v", state, err)
+		}
+
+		// Signing in still works, so the owner can turn it off.
+		testSignin(t, rts)
+	})
+
+	setReadOnly(t, "false")
+
+	if rec := request("DELETE", "/posts/1", s.AuthToken, nil); rec.Code != 404 {
+		t.Fatal("Unexpected status code deleting after read-only mode:", rec.Code)
+	}
+}
+
+func TestDeleteCurrentSessionCookie(t *testing.T) {
+	rts := newTestRoutes(t)
+	s := testSignin(t, rts)
+
+	r := httptest.NewRequest("DELETE", "/users/@me/sessions/@this", nil)
+	r.AddCookie(&http.Cookie{Name: smolboard.DefaultCookieName, Value: s.AuthToken})
+
+	rec := httptest.NewRecorder()
+	rts.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected status code: %d: %s", rec.Code, rec.Body)
+	}
+
+	var cookies = rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != "" {
+		t.Fatalf("Cookie was not cleared: %#v", cookies)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	rts := newTestRoutes(t)
+	owner := testSignin(t, rts)
+
+	var request = func(method, path, token string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	rec := request("POST", "/tokens", owner.AuthToken, url.Values{"uses": {"1"}})
+	if rec.Code != 200 {
+		t.Fatalf("Failed to create token: %d: %s", rec.Code, rec.Body)
+	}
+
+	var token smolboard.Token
+	if err := json.NewDecoder(rec.Body).Decode(&token); err != nil {
+		t.Fatal("Failed to decode token:", err)
+	}
+
+	rec = request("POST", "/signup", "", url.Values{
+		"username": {"user"},
+		"password": {"password"},
+		"token":    {token.Token},
+	})
+	if rec.Code != 200 {
+		t.Fatalf("Failed to sign up: %d: %s", rec.Code, rec.Body)
+	}
+
+	var user smolboard.Session
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatal("Failed to decode session:", err)
+	}
+
+	var tests = []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/users"},
+		{"GET", "/reports"},
+		{"POST", "/posts/tags/rename"},
+		{"POST", "/posts/tags/normalize"},
+		{"POST", "/sessions/expire-all"},
+		{"POST", "/read-only"},
+	}
+
+	for _, test := range tests {
+		for _, token := range []string{user.AuthToken, ""} {
+			rec := request(test.method, test.path, token, nil)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("Unexpected status code for %s %s: %d", test.method, test.path, rec.Code)
+			}
+		}
+	}
+
+	// Routes without a requirement still work for normal users.
+	if rec := request("GET", "/posts", user.AuthToken, nil); rec.Code != 200 {
+		t.Fatalf("Unexpected status code for GET /posts: %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := request("GET", "/users", owner.AuthToken, nil); rec.Code != 200 {
+		t.Fatalf("Unexpected status code for the owner: %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestExternalPost(t *testing.T) {
+	var media bytes.Buffer
+	png.Encode(&media, image.NewRGBA(image.Rect(0, 0, 64, 32)))
+
+	mediaSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(media.Bytes())
+	}))
+	defer mediaSrv.Close()
+
+	rts := newTestRoutesWith(t, func(cfg *HTTPConfig) {
+		cfg.ExternalPosts = true
+		cfg.ExternalThumbnails = true
+		// The media server is on loopback.
+		cfg.ExternalPrivateAddresses = true
+	})
+	owner := testSignin(t, rts)
+
+	var request = func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+owner.AuthToken)
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	for _, invalid := range []string{"ftp://example.com/a.png", "javascript:alert(1)", "/a.png", "https://"} {
+		rec := request("POST", "/posts/external", url.Values{"url": {invalid}})
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Unexpected status code for URL %q: %d: %s", invalid, rec.Code, rec.Body)
+		}
+	}
+
+	var mediaURL = mediaSrv.URL + "/hime.png"
+
+	rec := request("POST", "/posts/external", url.Values{"url": {mediaURL}})
+	if rec.Code != 200 {
+		t.Fatalf("Failed to create external post: %d: %s", rec.Code, rec.Body)
+	}
+
+	var post smolboard.Post
+	if err := json.NewDecoder(rec.Body).Decode(&post); err != nil {
+		t.Fatal("Failed to decode post:", err)
+	}
+
+	if !post.External || post.MediaURL != mediaURL || post.ContentType != "image/png" {
+		t.Fatalf("Unexpected external post: %#v", post)
+	}
+	if post.Attributes.Width != 64 || post.Attributes.Height != 32 {
+		t.Fatalf("Unexpected fetched attributes: %#v", post.Attributes)
+	}
+
+	rec = request("GET", "/posts", nil)
+	if rec.Code != 200 {
+		t.Fatalf("Failed to list posts: %d: %s", rec.Code, rec.Body)
+	}
+
+	var results smolboard.SearchResults
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal("Failed to decode posts:", err)
+	}
+
+	if len(results.Posts) != 1 || results.Posts[0].ID != post.ID || !results.Posts[0].External {
+		t.Fatalf("Unexpected posts: %#v", results.Posts)
+	}
+
+	// The original is never stored, so it's redirected to.
+	rec = request("GET", "/images/"+post.Filename(), nil)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != mediaURL {
+		t.Fatalf("Unexpected original response: %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// The thumbnail was fetched, though.
+	rec = request("GET", "/images/"+post.Filename()+"/thumb.jpeg", nil)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Unexpected thumbnail response: %d: %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestExternalPostProxy(t *testing.T) {
+	mediaSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("not really a video"))
+	}))
+	defer mediaSrv.Close()
+
+	rts := newTestRoutesWith(t, func(cfg *HTTPConfig) {
+		cfg.ExternalPosts = true
+		cfg.ExternalProxy = true
+		cfg.ExternalPrivateAddresses = true
+	})
+	owner := testSignin(t, rts)
+
+	var request = func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+owner.AuthToken)
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	// The type can't be guessed without an extension.
+	rec := request("POST", "/posts/external", url.Values{"url": {mediaSrv.URL + "/video"}})
+	if rec.Code != 400 {
+		t.Fatalf("Unexpected status code without a type: %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = request("POST", "/posts/external", url.Values{
+		"url":  {mediaSrv.URL + "/video"},
+		"type": {"video/mp4"},
+	})
+	if rec.Code != 200 {
+		t.Fatalf("Failed to create external post: %d: %s", rec.Code, rec.Body)
+	}
+
+	var post smolboard.Post
+	if err := json.NewDecoder(rec.Body).Decode(&post); err != nil {
+		t.Fatal("Failed to decode post:", err)
+	}
+
+	rec = request("GET", "/images/"+post.Filename(), nil)
+	if rec.Code != 200 || rec.Body.String() != "not really a video" {
+		t.Fatalf("Unexpected proxied response: %d: %s", rec.Code, rec.Body)
+	}
+
+	// The post's type is served, not whatever the media's host says.
+	if ctype := rec.Header().Get("Content-Type"); ctype != "video/mp4" {
+		t.Fatalf("Unexpected proxied content type %q", ctype)
+	}
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	rts := newTestRoutes(t)
+	s := testSignin(t, rts)
+
+	var request = func(method, path, token string, body url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	var createKey = func(t *testing.T, scope string) smolboard.APIKey {
+		t.Helper()
+
+		rec := request("POST", "/users/@me/api-keys", s.AuthToken, url.Values{"scope": {scope}})
+		if rec.Code != 200 {
+			t.Fatalf("Failed to create %s API key: %d", scope, rec.Code)
+		}
+
+		var k smolboard.APIKey
+		if err := json.NewDecoder(rec.Body).Decode(&k); err != nil {
+			t.Fatal("Failed to decode API key:", err)
+		}
+
+		return k
+	}
+
+	read := createKey(t, smolboard.ScopeRead)
+	write := createKey(t, smolboard.ScopeWrite)
+
+	t.Run("Read", func(t *testing.T) {
+		if rec := request("GET", "/posts", read.Token, nil); rec.Code != 200 {
+			t.Fatal("Unexpected status code listing posts:", rec.Code)
+		}
+
+		var tests = []struct {
+			method string
+			path   string
+		}{
+			{"POST", "/posts/favorites"},
+			{"DELETE", "/posts/1"},
+		}
+
+		for _, test := range tests {
+			rec := request(test.method, test.path, read.Token, nil)
+			if rec.Code != 403 {
+				t.Errorf("Unexpected status code for %s %s: %d", test.method, test.path, rec.Code)
+				continue
+			}
+
+			var resp smolboard.ErrResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+
+			if resp.Slug != httperr.ErrSlug(smolboard.ErrScopeReadOnly) {
+				t.Errorf("Unexpected slug for %s %s: %q", test.method, test.path, resp.Slug)
+			}
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		if rec := request("DELETE", "/posts/1", write.Token, nil); rec.Code != 404 {
+			t.Fatal("Unexpected status code deleting with a write key:", rec.Code)
+		}
+
+		// Keys can't manage keys, even with the write scope.
+		if rec := request("POST", "/users/@me/api-keys", write.Token, url.Values{"scope": {"write"}}); rec.Code != 403 {
+			t.Fatal("Unexpected status code creating a key with a key:", rec.Code)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		path := "/users/@me/api-keys/" + strconv.FormatInt(read.ID, 10)
+
+		if rec := request("DELETE", path, s.AuthToken, nil); rec.Code/100 != 2 {
+			t.Fatal("Unexpected status code revoking the read key:", rec.Code)
+		}
+
+		if rec := request("GET", "/posts", read.Token, nil); rec.Code != 401 {
+			t.Fatal("Unexpected status code using a revoked key:", rec.Code)
+		}
+
+		if rec := request("GET", "/posts", write.Token, nil); rec.Code != 200 {
+			t.Fatal("Unexpected status code using the other key:", rec.Code)
+		}
+	})
+}
+
+func TestReadOnlySession(t *testing.T) {
+	rts := newTestRoutes(t)
+
+	var request = func(method, path, token string, body url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	rec := request("POST", "/signin", "", url.Values{
+		"username": {"ひめありかわ"},
+		"password": {"password"},
+		"scope":    {smolboard.ScopeRead},
+	})
+
+	var s smolboard.Session
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	if s.Scope != smolboard.ScopeRead {
+		t.Fatalf("Unexpected session scope: %q", s.Scope)
+	}
+
+	if rec := request("GET", "/posts", s.AuthToken, nil); rec.Code != 200 {
+		t.Fatal("Unexpected status code listing posts:", rec.Code)
+	}
+
+	rec = request("POST", "/posts/favorites", s.AuthToken, nil)
+	if rec.Code != 403 {
+		t.Fatal("Unexpected status code favoriting as read-only:", rec.Code)
+	}
+
+	var resp smolboard.ErrResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	if resp.Slug != httperr.ErrSlug(smolboard.ErrScopeReadOnly) {
+		t.Fatalf("Unexpected slug favoriting as read-only: %q", resp.Slug)
+	}
+
+	// Signing out still works.
+	if rec := request("POST", "/signout", s.AuthToken, nil); rec.Code/100 != 2 {
+		t.Fatal("Unexpected status code signing out:", rec.Code)
+	}
+
+	if rec := request("GET", "/posts", s.AuthToken, nil); rec.Code != 410 {
+		t.Fatal("Unexpected status code after signing out:", rec.Code)
+	}
+}
+
+func TestExternalPostPrivateAddress(t *testing.T) {
+	var fetched bool
+
+	mediaSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Header().Set("Content-Type", "image/png")
+	}))
+	defer mediaSrv.Close()
+
+	rts := newTestRoutesWith(t, func(cfg *HTTPConfig) {
+		cfg.ExternalPosts = true
+		cfg.ExternalThumbnails = true
+	})
+	owner := testSignin(t, rts)
+
+	var form = url.Values{"url": {mediaSrv.URL + "/hime.png"}}
+
+	r := httptest.NewRequest("POST", "/posts/external", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+owner.AuthToken)
+
+	rec := httptest.NewRecorder()
+	rts.ServeHTTP(rec, r)
+
+	if rec.Code != 400 {
+		t.Fatalf("Unexpected status code for a loopback URL: %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp smolboard.ErrResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	if resp.Slug != httperr.ErrSlug(upload.ErrExternalAddress) {
+		t.Fatalf("Unexpected slug for a loopback URL: %q", resp.Slug)
+	}
+
+	if fetched {
+		t.Fatal("Media server on loopback was requested")
+	}
+}
+
+func TestRateLimitKeyCached(t *testing.T) {
+	rts := newTestRoutes(t)
+	s := testSignin(t, rts)
+
+	var keys []string
+
+	h := cacheRateLimitKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, rts.rateLimitKey(r))
+
+		// The session is gone, but the key was already resolved.
+		if err := rts.db.Acquire(r.Context(), s.AuthToken, (*db.Transaction).Signout); err != nil {
+			t.Fatal("Failed to sign out:", err)
+		}
+
+		keys = append(keys, rts.rateLimitKey(r))
+	}))
+
+	r := httptest.NewRequest("GET", "/posts", nil)
+	r.Header.Set("Authorization", "Bearer "+s.AuthToken)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(keys) != 2 || keys[0] != "user:"+s.Username || keys[1] != keys[0] {
+		t.Fatalf("Unexpected rate limit keys: %q", keys)
+	}
+
+	// Without the cache, the key is resolved again.
+	if key := rts.rateLimitKey(r); !strings.HasPrefix(key, "ip:") {
+		t.Fatalf("Unexpected uncached rate limit key %q", key)
+	}
+}
+
+func TestRequestPasswordResetSilent(t *testing.T) {
+	rts := newTestRoutes(t)
+
+	// Neither an unknown user nor one without an email is told apart from a
+	// reset that was sent.
+	for _, username := range []string{"かぐやありかわ", "ひめありかわ"} {
+		var form = url.Values{"username": {username}}
+
+		r := httptest.NewRequest("POST", "/reset-password", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rec := httptest.NewRecorder()
+		rts.ServeHTTP(rec, r)
+
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("Unexpected status code resetting %q: %d: %s", username, rec.Code, rec.Body)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package form
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/gorilla/schema"
 	"github.com/pkg/errors"
 )
@@ -13,8 +21,13 @@ const MaxMemory = int64(2 * datasize.MB)
 
 var decoder = schema.NewDecoder()
 
-// Unmarshal decodes the form in the given request into the interface.
+// Unmarshal decodes the form in the given request into the interface. The body
+// can also be a flat JSON object, whose fields are decoded like form values.
 func Unmarshal(r tx.Request, v interface{}) error {
+	if err := parseJSONBody(r.Request); err != nil {
+		return httperr.Wrap(err, 400, "Invalid JSON body")
+	}
+
 	// Prioritize multipart.
 	if err := r.ParseMultipartForm(MaxMemory); err == nil && r.MultipartForm != nil {
 		return decoder.Decode(v, r.MultipartForm.Value)
@@ -27,7 +40,100 @@ func Unmarshal(r tx.Request, v interface{}) error {
 	switch r.Method {
 	case http.MethodPatch, http.MethodPost, http.MethodPut:
 		return decoder.Decode(v, r.PostForm)
+	case http.MethodDelete:
+		if err := parseDeleteBody(r.Request); err != nil {
+			return err
+		}
+		fallthrough
 	default:
 		return decoder.Decode(v, r.Form)
 	}
 }
+
+// parseDeleteBody adds the URL-encoded body of a DELETE request to its form,
+// since ParseForm only reads the body of PATCH, POST and PUT requests. The body
+// values come first, like they do in ParseForm.
+func parseDeleteBody(r *http.Request) error {
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctype != "application/x-www-form-urlencoded" || r.Body == nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxMemory))
+	if err != nil {
+		return errors.Wrap(err, "Failed to read body")
+	}
+
+	// The body is consumed, and its values are kept in the form below.
+	r.Body = http.NoBody
+
+	body, err := url.ParseQuery(string(b))
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse body")
+	}
+
+	for k, v := range r.Form {
+		body[k] = append(body[k], v...)
+	}
+
+	r.Form = body
+	return nil
+}
+
+// parseJSONBody sets the form of a request with a JSON body to the body's
+// values, so that it's decoded like a URL-encoded body. Arrays become multiple
+// values, and nested objects are not allowed.
+func parseJSONBody(r *http.Request) error {
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctype != "application/json" || r.Body == nil || r.PostForm != nil {
+		return nil
+	}
+
+	var fields map[string]interface{}
+
+	d := json.NewDecoder(io.LimitReader(r.Body, MaxMemory))
+	d.UseNumber()
+
+	if err := d.Decode(&fields); err != nil {
+		return errors.Wrap(err, "Failed to decode JSON")
+	}
+
+	// The body is consumed, and its values are kept in the form below.
+	r.Body = http.NoBody
+
+	var body = make(url.Values, len(fields))
+
+	for k, field := range fields {
+		values, ok := field.([]interface{})
+		if !ok {
+			values = []interface{}{field}
+		}
+
+		for _, value := range values {
+			switch value := value.(type) {
+			case nil:
+				continue
+			case string:
+				body.Add(k, value)
+			case json.Number:
+				body.Add(k, value.String())
+			case bool:
+				body.Add(k, strconv.FormatBool(value))
+			default:
+				return fmt.Errorf("field %q must not be nested", k)
+			}
+		}
+	}
+
+	r.PostForm = body
+	r.Form = make(url.Values, len(body))
+
+	for k, v := range body {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	for k, v := range r.URL.Query() {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+
+	return nil
+}
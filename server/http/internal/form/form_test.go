@@ -0,0 +1,67 @@
+package form
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/go-test/deep"
+)
+
+func TestUnmarshalDeleteBody(t *testing.T) {
+	type deleteForm struct {
+		Reason string `schema:"reason"`
+		Hard   bool   `schema:"hard"`
+	}
+
+	q := httptest.NewRequest("DELETE", "/posts/1?hard=1", strings.NewReader("reason=%E3%81%B2%E3%82%81"))
+	q.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var r = tx.Request{Request: q}
+
+	// Decode twice to make sure the consumed body is kept.
+	for i := 0; i < 2; i++ {
+		var f deleteForm
+
+		if err := Unmarshal(r, &f); err != nil {
+			t.Fatal("Failed to unmarshal:", err)
+		}
+
+		if f.Reason != "ひめ" || !f.Hard {
+			t.Fatalf("Unexpected form: %#v", f)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	type jsonForm struct {
+		Tags  []string `schema:"t"`
+		Count int      `schema:"count"`
+		Hard  bool     `schema:"hard"`
+		Page  int      `schema:"page"`
+	}
+
+	q := httptest.NewRequest(
+		"POST", "/posts/tags?page=2",
+		strings.NewReader(`{"t": ["ひめ", "ありかわ"], "count": 100, "hard": true, "unset": null}`),
+	)
+	q.Header.Set("Content-Type", "application/json")
+
+	var f jsonForm
+
+	if err := Unmarshal(tx.Request{Request: q}, &f); err != nil {
+		t.Fatal("Failed to unmarshal:", err)
+	}
+
+	expect := jsonForm{
+		Tags:  []string{"ひめ", "ありかわ"},
+		Count: 100,
+		Hard:  true,
+	}
+
+	// The query isn't part of the body, like a URL-encoded body.
+	if eq := deep.Equal(f, expect); eq != nil {
+		t.Fatal("Unexpected form:", eq)
+	}
+}
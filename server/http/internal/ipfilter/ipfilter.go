@@ -0,0 +1,105 @@
+// Package ipfilter provides allowlists and denylists of client networks.
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Filter decides whether client IPs are allowed. A nil Filter allows all IPs.
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// New creates a new filter from lists of networks in CIDR notation or plain
+// IPs. Denied networks take precedence over allowed ones, and all IPs outside
+// the denied networks are allowed if the allowlist is empty. Nil is returned if
+// both lists are empty.
+func New(allow, deny []string) (*Filter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	a, err := parseNetworks(allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid allowed network")
+	}
+
+	d, err := parseNetworks(deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid denied network")
+	}
+
+	return &Filter{allow: a, deny: d}, nil
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var nets = make([]*net.IPNet, 0, len(networks))
+
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, errors.Errorf("%q is not an IP or network", network)
+			}
+
+			var bits = 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Allows returns true if the IP is allowed. A nil IP is only allowed if the
+// filter is nil.
+func (f *Filter) Allows(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	if contains(f.deny, ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || contains(f.allow, ip)
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestIP returns the IP in the request's RemoteAddr, or nil if it can't be
+// parsed. This is the client IP once Proxies' RealIP middleware has run, and
+// the TCP peer otherwise.
+func RequestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
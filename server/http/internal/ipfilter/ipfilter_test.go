@@ -0,0 +1,98 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := New([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1"}, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal("Failed to create filter:", err)
+	}
+
+	var tests = map[string]bool{
+		"10.1.2.3":    true,
+		"10.0.0.1":    false,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+		"bogus":       false,
+	}
+
+	for ip, allowed := range tests {
+		if f.Allows(net.ParseIP(ip)) != allowed {
+			t.Errorf("Expected %s to be allowed: %v", ip, allowed)
+		}
+	}
+
+	t.Run("Nil", func(t *testing.T) {
+		f, err := New(nil, nil)
+		if err != nil {
+			t.Fatal("Failed to create filter:", err)
+		}
+		if !f.Allows(nil) {
+			t.Fatal("Nil filter doesn't allow an unknown IP.")
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, network := range []string{"localhost", "10.0.0.0/33"} {
+			if _, err := New([]string{network}, nil); err == nil {
+				t.Errorf("No error parsing %q", network)
+			}
+		}
+	})
+}
+
+func TestProxiesClientIP(t *testing.T) {
+	p, err := NewProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal("Failed to create proxies:", err)
+	}
+
+	var tests = []struct {
+		name   string
+		peer   string
+		xff    string
+		realIP string
+		client string
+	}{
+		{"Direct", "203.0.113.1:1234", "", "", "203.0.113.1"},
+		{"Untrusted peer", "203.0.113.1:1234", "10.1.2.3", "10.1.2.3", "203.0.113.1"},
+		{"Trusted peer", "192.0.2.1:1234", "203.0.113.1", "", "203.0.113.1"},
+		{"Spoofed hops", "192.0.2.1:1234", "10.0.0.2, 198.51.100.1, 203.0.113.1", "", "203.0.113.1"},
+		{"Proxy chain", "192.0.2.1:1234", "198.51.100.1, 203.0.113.1, 10.0.0.2", "", "203.0.113.1"},
+		{"Only proxies", "192.0.2.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"Malformed hop", "192.0.2.1:1234", "203.0.113.1, bogus, 10.0.0.2", "", "10.0.0.2"},
+		{"Real IP", "192.0.2.1:1234", "", "203.0.113.1", "203.0.113.1"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.peer
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+
+		if ip := p.ClientIP(r); ip.String() != test.client {
+			t.Errorf("%s: unexpected client IP %s, expected %s", test.name, ip, test.client)
+		}
+	}
+
+	t.Run("Nil", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-Forwarded-For", "203.0.113.1")
+
+		var p *Proxies
+		if ip := p.ClientIP(r); ip.String() != "192.0.2.1" {
+			t.Fatal("Nil proxies believed X-Forwarded-For:", ip)
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Proxies are the trusted reverse proxies that the server is behind. Only
+// their X-Forwarded-For and X-Real-IP headers are believed. A nil Proxies
+// trusts nobody, so the client IP is always the TCP peer.
+type Proxies struct {
+	nets []*net.IPNet
+}
+
+// NewProxies creates trusted proxies from a list of networks in CIDR notation
+// or plain IPs. Nil is returned if the list is empty.
+func NewProxies(networks []string) (*Proxies, error) {
+	if len(networks) == 0 {
+		return nil, nil
+	}
+
+	n, err := parseNetworks(networks)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxy")
+	}
+
+	return &Proxies{nets: n}, nil
+}
+
+// Trusts returns true if the IP belongs to a trusted proxy.
+func (p *Proxies) Trusts(ip net.IP) bool {
+	return p != nil && ip != nil && contains(p.nets, ip)
+}
+
+// ClientIP returns the client IP of the request, or nil if it can't be parsed.
+// The headers are only read if the TCP peer is a trusted proxy. X-Forwarded-For
+// is then walked from right to left, and the first address that isn't a
+// trusted proxy is the client, since everything to its left could have been
+// sent by the client itself. X-Real-IP is used if there's no X-Forwarded-For.
+func (p *Proxies) ClientIP(r *http.Request) net.IP {
+	ip := RequestIP(r)
+	if !p.Trusts(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	if len(hops) == 0 {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real
+		}
+		return ip
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Nothing past a malformed hop can be trusted, so the last proxy
+			// that added one is the client.
+			return ip
+		}
+
+		ip = hop
+
+		if !p.Trusts(hop) {
+			return hop
+		}
+	}
+
+	// Every hop is a trusted proxy, so the leftmost one is the client.
+	return ip
+}
+
+// RealIP is a middleware that replaces the request's RemoteAddr with its
+// client IP, so that RequestIP and everything else that reads RemoteAddr see
+// the client instead of the proxy.
+func (p *Proxies) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p != nil {
+			if ip := p.ClientIP(r); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
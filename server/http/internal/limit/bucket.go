@@ -0,0 +1,189 @@
+package limit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/http/internal/middleware"
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+)
+
+// Rate describes a token bucket. PerSecond tokens are refilled every second up
+// to Burst tokens. Each request consumes a token.
+type Rate struct {
+	PerSecond float64 `toml:"perSecond"`
+	Burst     int     `toml:"burst"`
+}
+
+// KeyFunc returns the key that a request is limited by.
+type KeyFunc = func(r *http.Request) string
+
+// IPKey is a KeyFunc that returns the client's IP. It expects RemoteAddr to be
+// already resolved through the trusted proxies.
+func IPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// ErrRateLimited is returned when a request is over the rate limit.
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (err ErrRateLimited) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (err ErrRateLimited) Slug() string {
+	return "rate-limited"
+}
+
+func (err ErrRateLimited) Error() string {
+	return "rate limited, retry after " + err.RetryAfter.String()
+}
+
+// cleanupInterval is the interval between each sweep of idle buckets.
+const cleanupInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is an in-memory token bucket rate limiter. Idle buckets are
+// periodically swept while the limiter is in use.
+type Limiter struct {
+	rate Rate
+	key  KeyFunc
+	now  func() time.Time
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewLimiter creates a new limiter with the given rate. Requests are keyed
+// using the given KeyFunc; if it is nil, then IPKey is used.
+func NewLimiter(rate Rate, key KeyFunc) *Limiter {
+	if key == nil {
+		key = IPKey
+	}
+
+	return &Limiter{
+		rate:    rate,
+		key:     key,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// SetClock overrides the function used to get the current time. It should
+// only be used for testing.
+func (l *Limiter) SetClock(now func() time.Time) {
+	l.mutex.Lock()
+	l.now = now
+	l.mutex.Unlock()
+}
+
+// Allow consumes a token from the bucket with the given key. If the bucket is
+// empty, then false is returned along with the duration until the next token.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var now = l.now()
+
+	if now.Sub(l.swept) > cleanupInterval {
+		l.sweep(now)
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Burst), last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = l.refill(b, now)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / l.rate.PerSecond
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate.PerSecond
+	return math.Min(tokens, float64(l.rate.Burst))
+}
+
+// sweep removes all buckets that are full, since they are identical to a new
+// bucket.
+func (l *Limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.rate.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Len returns the number of tracked buckets.
+func (l *Limiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.buckets)
+}
+
+// Middleware returns a middleware that rejects requests over the rate limit
+// with a 429 and a Retry-After header.
+func (l *Limiter) Middleware() middleware.F {
+	return middleware.P(func(w http.ResponseWriter, r *http.Request) bool {
+		return l.check(w, r)
+	})
+}
+
+func (l *Limiter) check(w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := l.Allow(l.key(r))
+	if ok {
+		return true
+	}
+
+	// Round up, since Retry-After only has seconds precision.
+	secs := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	tx.RenderError(w, r, ErrRateLimited{RetryAfter: wait})
+	return false
+}
+
+// GroupLimiter limits requests with a different Limiter for each route group.
+type GroupLimiter struct {
+	group func(r *http.Request) *Limiter
+}
+
+// NewGroupLimiter creates a new GroupLimiter. The group function returns the
+// Limiter for the request, or nil if the request should not be limited.
+func NewGroupLimiter(group func(r *http.Request) *Limiter) GroupLimiter {
+	return GroupLimiter{group}
+}
+
+// Middleware returns the middleware for the GroupLimiter.
+func (g GroupLimiter) Middleware() middleware.F {
+	return middleware.P(func(w http.ResponseWriter, r *http.Request) bool {
+		if l := g.group(r); l != nil {
+			return l.check(w, r)
+		}
+		return true
+	})
+}
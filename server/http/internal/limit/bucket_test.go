@@ -0,0 +1,111 @@
+package limit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(rate Rate) (*Limiter, *testClock) {
+	var clock = &testClock{now: time.Unix(0, 0)}
+
+	l := NewLimiter(rate, nil)
+	l.SetClock(clock.Now)
+
+	return l, clock
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l, clock := newTestLimiter(Rate{PerSecond: 1, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Request %d unexpectedly limited", i)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("Request over burst not limited")
+	}
+	if wait != time.Second {
+		t.Fatalf("Unexpected wait duration: %v", wait)
+	}
+
+	// Other keys should have their own buckets.
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("Unrelated key limited")
+	}
+
+	clock.Add(time.Second)
+
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("Request limited after refill")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("Bucket over-refilled")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, clock := newTestLimiter(Rate{PerSecond: 1, Burst: 2})
+
+	l.Allow("a")
+	l.Allow("b")
+
+	if n := l.Len(); n != 2 {
+		t.Fatalf("Unexpected bucket count: %d", n)
+	}
+
+	clock.Add(cleanupInterval + time.Second)
+
+	// This triggers a sweep, which should remove both refilled buckets before
+	// making a new one.
+	l.Allow("c")
+
+	if n := l.Len(); n != 1 {
+		t.Fatalf("Unexpected bucket count after sweep: %d", n)
+	}
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	l, _ := newTestLimiter(Rate{PerSecond: 0.5, Burst: 1})
+
+	h := l.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request(); w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected status code: %d", w.Code)
+	}
+
+	w := request()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected status code for limited request: %d", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "2" {
+		t.Fatalf("Unexpected Retry-After: %q", ra)
+	}
+}
@@ -1,36 +1,48 @@
 package limit
 
 import (
+	"context"
+	"math"
 	"net/http"
-	"time"
 
 	"github.com/diamondburned/smolboard/server/http/internal/middleware"
-	"github.com/diamondburned/smolboard/server/http/internal/tx"
-	"github.com/didip/tollbooth/v6"
-	"github.com/didip/tollbooth/v6/errors"
-	"github.com/didip/tollbooth/v6/limiter"
 )
 
-func RateLimit(n float64) func(http.Handler) http.Handler {
-	l := tollbooth.NewLimiter(n, &limiter.ExpirableOptions{
-		DefaultExpirationTTL: time.Hour,
-	})
-	l.SetIPLookups([]string{"X-Forwarded-For", "RemoteAddr", "X-Real-IP"})
-	l.SetHeader("Cookie", []string{"token"})
-
-	return middleware.P(func(w http.ResponseWriter, r *http.Request) bool {
-		if err := tollbooth.LimitByRequest(l, w, r); err != nil {
-			tx.RenderError(w, rateErr{err})
-			return false
-		}
-		return true
-	})
+type ctxKey uint8
+
+const keyKeyFunc ctxKey = iota
+
+// KeyBy returns a middleware that makes the limiters of RateLimit key requests
+// with the given KeyFunc instead of IPKey, such as to limit signed in users by
+// their username.
+func KeyBy(key KeyFunc) middleware.F {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), keyKeyFunc, key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
 
-type rateErr struct {
-	*errors.HTTPError
+// requestKey returns the key of the request from the KeyFunc given to KeyBy,
+// or IPKey. The path is added, so that each route has its own bucket.
+func requestKey(r *http.Request) string {
+	key, ok := r.Context().Value(keyKeyFunc).(KeyFunc)
+	if !ok {
+		key = IPKey
+	}
+
+	return key(r) + " " + r.URL.Path
 }
 
-func (r rateErr) StatusCode() int {
-	return r.HTTPError.StatusCode
+// RateLimit returns a middleware that allows n requests per second to each
+// route from each client, with bursts of up to n requests. Clients are keyed
+// like KeyBy describes.
+func RateLimit(n float64) middleware.F {
+	var rate = Rate{
+		PerSecond: n,
+		Burst:     int(math.Max(1, n)),
+	}
+
+	return NewLimiter(rate, requestKey).Middleware()
 }
@@ -0,0 +1,45 @@
+package limit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimitKeyBy(t *testing.T) {
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	h = RateLimit(1)(h)
+	h = KeyBy(func(r *http.Request) string { return r.Header.Get("X-User") })(h)
+
+	request := func(user, path string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-User", user)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	var tests = []struct {
+		user string
+		path string
+		code int
+	}{
+		{"a", "/", http.StatusNoContent},
+		{"a", "/", http.StatusTooManyRequests},
+		// Other users behind the same IP have their own buckets.
+		{"b", "/", http.StatusNoContent},
+		// So do other routes.
+		{"a", "/other", http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		if code := request(test.user, test.path); code != test.code {
+			t.Errorf("Unexpected status code for %s on %s: %d", test.user, test.path, code)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package limit
+
+import (
+	"net/http"
+
+	"github.com/diamondburned/smolboard/server/http/internal/middleware"
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/httperr"
+)
+
+// ErrTooManyInFlight is returned when a route group already has as many
+// requests in flight as it allows.
+var ErrTooManyInFlight = httperr.New(http.StatusServiceUnavailable, "too many requests in progress")
+
+// Semaphore limits the number of requests that are handled at once. Unlike
+// Limiter, it doesn't care how often requests come in, only how many are in
+// flight, and it is shared by all users.
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// NewSemaphore creates a new semaphore that allows n requests in flight.
+func NewSemaphore(n int) *Semaphore {
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// TryAcquire takes a slot if there's one free. It never blocks.
+func (s *Semaphore) TryAcquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot taken by TryAcquire.
+func (s *Semaphore) Release() {
+	<-s.slots
+}
+
+// InFlight returns the number of taken slots.
+func (s *Semaphore) InFlight() int {
+	return len(s.slots)
+}
+
+// Middleware returns a middleware that rejects requests with a 503 and a
+// Retry-After header while all slots are taken.
+func (s *Semaphore) Middleware() middleware.F {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serve(next, w, r)
+		})
+	}
+}
+
+func (s *Semaphore) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if !s.TryAcquire() {
+		w.Header().Set("Retry-After", "1")
+		tx.RenderError(w, r, ErrTooManyInFlight)
+		return
+	}
+	defer s.Release()
+
+	next.ServeHTTP(w, r)
+}
+
+// GroupSemaphore limits requests with a different Semaphore for each route
+// group.
+type GroupSemaphore struct {
+	group func(r *http.Request) *Semaphore
+}
+
+// NewGroupSemaphore creates a new GroupSemaphore. The group function returns the
+// Semaphore for the request, or nil if the request should not be limited.
+func NewGroupSemaphore(group func(r *http.Request) *Semaphore) GroupSemaphore {
+	return GroupSemaphore{group}
+}
+
+// Middleware returns the middleware for the GroupSemaphore.
+func (g GroupSemaphore) Middleware() middleware.F {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s := g.group(r); s != nil {
+				s.serve(next, w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Package readonly provides the server-wide read-only mode.
+package readonly
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/smolboard"
+)
+
+// Mode is the server-wide read-only flag, which can be changed at runtime. It
+// is safe to use concurrently.
+type Mode struct {
+	enabled int32
+}
+
+// NewMode creates a new mode that starts out enabled or not.
+func NewMode(enabled bool) *Mode {
+	m := &Mode{}
+	m.Set(enabled)
+	return m
+}
+
+// Enabled returns true if the server is read-only.
+func (m *Mode) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Set enables or disables read-only mode.
+func (m *Mode) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+// Guard is a middleware that rejects writes with ErrReadOnly while read-only
+// mode is enabled. Reads are always let through. Routes that write but must
+// keep working, such as signing in, are simply left unguarded.
+func (m *Mode) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Enabled() && !IsRead(r) {
+			tx.RenderError(w, r, smolboard.ErrReadOnly)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsRead returns true if the request's method doesn't write anything.
+func IsRead(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
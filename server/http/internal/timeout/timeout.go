@@ -0,0 +1,59 @@
+package timeout
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/http/internal/middleware"
+	"github.com/diamondburned/smolboard/server/httperr"
+)
+
+// ErrTimeout is returned by the reads of the request body once the request has
+// timed out.
+var ErrTimeout = httperr.New(408, "request timed out")
+
+// Timeout returns a middleware that cancels the context of each request after
+// the duration returned by fn, which can be 0 for no timeout. The request body
+// stops being readable at the same time, so a slow client can't keep the
+// handler reading. The deadline is checked between reads, so a read that is
+// already blocked is only stopped by the server's own read timeout.
+func Timeout(fn func(r *http.Request) time.Duration) middleware.F {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var d = fn(r)
+			if d <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			r = r.WithContext(ctx)
+			if r.Body != nil {
+				r.Body = body{r.Body, ctx}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Exceeded returns true if the request has timed out.
+func Exceeded(r *http.Request) bool {
+	return r.Context().Err() == context.DeadlineExceeded
+}
+
+type body struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (b body) Read(p []byte) (int, error) {
+	if b.ctx.Err() != nil {
+		return 0, ErrTimeout
+	}
+	return b.ReadCloser.Read(p)
+}
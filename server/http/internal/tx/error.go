@@ -0,0 +1,87 @@
+package tx
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-chi/chi/middleware"
+)
+
+// ErrInternal is the error rendered in place of unexpected errors, so that
+// internal details are not leaked to the client.
+var ErrInternal = httperr.New(500, "internal server error")
+
+var (
+	// ErrNotFound is rendered when no route matches.
+	ErrNotFound = httperr.New(404, "not found")
+	// ErrMethodNotAllowed is rendered when the route doesn't allow the method.
+	ErrMethodNotAllowed = httperr.New(405, "method not allowed")
+)
+
+func RenderWrap(w http.ResponseWriter, r *http.Request, err error, code int, wrap string) {
+	RenderError(w, r, httperr.Wrap(err, code, wrap))
+}
+
+// RenderError renders the error as an ErrResponse with the error's status
+// code. Errors with a 5xx status code are logged and rendered as ErrInternal,
+// unless they're public errors made by httperr.New.
+func RenderError(w http.ResponseWriter, r *http.Request, err error) {
+	code := httperr.ErrCode(err)
+	reqID := middleware.GetReqID(r.Context())
+
+	if code >= 500 && !httperr.IsPublic(err) {
+		log.Printf("Request %s %s (ID %q) failed: %v", r.Method, r.URL.Path, reqID, err)
+		err = ErrInternal
+	}
+
+	var jsonError = smolboard.ErrResponse{
+		Error:     err.Error(),
+		Slug:      httperr.ErrSlug(err),
+		RequestID: reqID,
+		Fields:    httperr.ErrFields(err),
+	}
+
+	if reqID != "" {
+		w.Header().Set("X-Request-Id", reqID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(jsonError); err != nil {
+		log.Println("Encode failed:", err)
+	}
+}
+
+// NotFound renders ErrNotFound.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	RenderError(w, r, ErrNotFound)
+}
+
+// MethodNotAllowed renders ErrMethodNotAllowed.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	RenderError(w, r, ErrMethodNotAllowed)
+}
+
+// Recoverer recovers from panics in the next handler and renders them as
+// ErrInternal.
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+
+				log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				RenderError(w, r, ErrInternal)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
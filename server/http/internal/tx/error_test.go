@@ -0,0 +1,98 @@
+package tx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
+)
+
+func renderTestError(t *testing.T, err error) (int, smolboard.ErrResponse) {
+	t.Helper()
+
+	var w = httptest.NewRecorder()
+
+	h := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RenderError(w, r, err)
+	}))
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	var resp smolboard.ErrResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal("Failed to decode error response:", err)
+	}
+
+	if resp.RequestID == "" || resp.RequestID != w.Header().Get("X-Request-Id") {
+		t.Fatalf("Unexpected request ID %q", resp.RequestID)
+	}
+
+	return w.Code, resp
+}
+
+func TestRenderError(t *testing.T) {
+	code, resp := renderTestError(t, errors.Wrap(smolboard.ErrPostNotFound, "Failed to get post"))
+	if code != 404 {
+		t.Fatal("Unexpected status code:", code)
+	}
+	if resp.Error != "Failed to get post: post not found" {
+		t.Fatal("Unexpected error:", resp.Error)
+	}
+	if resp.Slug != "post-not-found" {
+		t.Fatal("Unexpected slug:", resp.Slug)
+	}
+}
+
+func TestRenderValidationError(t *testing.T) {
+	var verr = httperr.NewValidationError()
+	verr.Add("username", smolboard.ErrIllegalName)
+	verr.Add("password", smolboard.ErrPasswordTooShort)
+
+	code, resp := renderTestError(t, errors.Wrap(verr, "Failed to sign up"))
+	if code != 422 {
+		t.Fatal("Unexpected status code:", code)
+	}
+	if resp.Slug != httperr.ValidationSlug {
+		t.Fatal("Unexpected slug:", resp.Slug)
+	}
+	if len(resp.Fields) != 2 {
+		t.Fatal("Unexpected fields:", resp.Fields)
+	}
+	if resp.Fields["username"] != smolboard.ErrIllegalName.Error() {
+		t.Fatal("Unexpected username error:", resp.Fields["username"])
+	}
+	if resp.Fields["password"] != smolboard.ErrPasswordTooShort.Error() {
+		t.Fatal("Unexpected password error:", resp.Fields["password"])
+	}
+}
+
+func TestRenderErrorInternal(t *testing.T) {
+	var errs = []error{
+		errors.New("Failed to scan: sqlite3 is on fire"),
+		httperr.Wrap(errors.New("disk full"), 500, "Failed to write"),
+	}
+
+	for _, err := range errs {
+		code, resp := renderTestError(t, err)
+		if code != 500 {
+			t.Fatal("Unexpected status code:", code)
+		}
+		if resp.Error != ErrInternal.Error() {
+			t.Fatal("Internal error leaked:", resp.Error)
+		}
+	}
+}
+
+func TestRenderErrorPublic(t *testing.T) {
+	code, resp := renderTestError(t, smolboard.ErrReadOnly)
+	if code != 503 {
+		t.Fatal("Unexpected status code:", code)
+	}
+	if resp.Error != smolboard.ErrReadOnly.Error() {
+		t.Fatal("Public error was hidden:", resp.Error)
+	}
+}
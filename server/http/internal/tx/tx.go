@@ -1,16 +1,19 @@
 package tx
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/http/internal/ipfilter"
 	"github.com/diamondburned/smolboard/server/http/upload"
-	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 )
 
 type Request struct {
@@ -46,28 +49,78 @@ type Renderer = func(w http.ResponseWriter) error
 // Middlewarer is the interface for the transaction middleware.
 type Middlewarer = func(Handler) http.HandlerFunc
 
+// RequirePermission wraps the transaction middleware so that its handlers only
+// run for users with at least the given permission. Everyone else gets
+// ErrActionNotPermitted before the handler runs. It documents the access policy
+// of each route; the database still checks permissions on its own.
+func RequirePermission(m Middlewarer, min smolboard.Permission) Middlewarer {
+	return func(h Handler) http.HandlerFunc {
+		return m(func(r Request) (interface{}, error) {
+			if err := r.Tx.HasPermission(min, true); err != nil {
+				return nil, err
+			}
+			return h(r)
+		})
+	}
+}
+
 type Middleware struct {
 	db *db.Database
 	up upload.UploadConfig
+	// cookie is the name of the session token cookie.
+	cookie string
+	// admin is the filter of IPs that administrators can use their permission
+	// from. It is nil if they're not restricted.
+	admin *ipfilter.Filter
 }
 
 var _ Middlewarer = (Middleware{}).M
 
-func NewMiddleware(db *db.Database, up upload.UploadConfig) Middleware {
-	return Middleware{db: db, up: up}
+// NewMiddleware creates a new transaction middleware. The session token is
+// read from and written to the cookie with the given name. Users connecting
+// from IPs that admin doesn't allow are limited to the trusted permission;
+// admin can be nil to not restrict anyone.
+func NewMiddleware(
+	db *db.Database, up upload.UploadConfig, cookieName string, admin *ipfilter.Filter) Middleware {
+
+	return Middleware{db: db, up: up, cookie: cookieName, admin: admin}
 }
 
 func (m Middleware) M(h Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check cookies for the session.
-		if c, err := r.Cookie("token"); err == nil {
-			m.auth(h, c, w, r)
-		} else {
+		// Check the header and cookies for the session. API keys are only
+		// accepted from the header, so a page can't be made to send one.
+		token, bearer := SessionToken(r, m.cookie)
+
+		switch {
+		case token == "", !bearer && db.IsAPIKey(token):
 			m.noAuth(h, w, r)
+		default:
+			m.auth(h, token, bearer, w, r)
 		}
 	}
 }
 
+// SessionToken returns the session token of the request and whether it was
+// given as a bearer token. A bearer token in the Authorization header always
+// takes precedence over the cookie, so a request carrying both is authenticated
+// by the header alone. An empty string is returned if there's neither.
+func SessionToken(r *http.Request, cookieName string) (token string, bearer bool) {
+	const prefix = "Bearer "
+
+	if h := r.Header.Get("Authorization"); len(h) > len(prefix) {
+		if strings.EqualFold(h[:len(prefix)], prefix) {
+			return strings.TrimSpace(h[len(prefix):]), true
+		}
+	}
+
+	if c, err := r.Cookie(cookieName); err == nil {
+		return c.Value, false
+	}
+
+	return "", false
+}
+
 func (m Middleware) noAuth(h Handler, w http.ResponseWriter, r *http.Request) {
 	var v interface{}
 	var s smolboard.Session
@@ -81,14 +134,14 @@ func (m Middleware) noAuth(h Handler, w http.ResponseWriter, r *http.Request) {
 	)
 
 	if err != nil {
-		RenderError(w, err)
+		RenderError(w, r, err)
 		return
 	}
 
 	// If we have a new session, then send it over.
 	if !s.IsZero() {
 		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
+			Name:     m.cookie,
 			Value:    s.AuthToken,
 			Path:     "/",
 			Expires:  time.Unix(0, s.Deadline),
@@ -96,15 +149,28 @@ func (m Middleware) noAuth(h Handler, w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	render(w, v)
+	render(w, r, v)
 }
 
-func (m Middleware) auth(h Handler, c *http.Cookie, w http.ResponseWriter, r *http.Request) {
+// auth runs the handler with the session of the given token. Cookies are only
+// written back if the token came from a cookie; bearer clients get their token
+// from the session in the response body instead.
+func (m Middleware) auth(h Handler, token string, bearer bool, w http.ResponseWriter, r *http.Request) {
 	var v interface{}
 	var s smolboard.Session
 
-	err := m.db.Acquire(r.Context(), c.Value,
+	var adminAllowed = m.admin.Allows(ipfilter.RequestIP(r))
+
+	err := m.db.Acquire(r.Context(), token,
 		func(tx *db.Transaction) (err error) {
+			if !adminAllowed {
+				tx.LimitPermission(smolboard.PermissionTrusted)
+			}
+
+			if tx.Session.ReadOnly() && !safeMethod(r.Method) && !readOnlyAllowed(r) {
+				return smolboard.ErrScopeReadOnly
+			}
+
 			// Call the given handler with the transaction.
 			v, err = h(Request{r, w, &m.up, tx})
 			s = tx.Session
@@ -113,24 +179,67 @@ func (m Middleware) auth(h Handler, c *http.Cookie, w http.ResponseWriter, r *ht
 	)
 
 	if err != nil {
-		RenderError(w, err)
+		// Clear the cookie if the session is gone, so the client doesn't keep
+		// sending it.
+		if !bearer && errors.Is(err, smolboard.ErrSessionExpired) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     m.cookie,
+				Value:    "",
+				Path:     "/",
+				Expires:  time.Unix(0, 0),
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		RenderError(w, r, err)
 		return
 	}
 
-	// If the cookie has been changed, then override the cookie's fields to
-	// default and send it over.
-	if c.Expires.UnixNano() != s.Deadline || c.Value != s.AuthToken {
-		c.Path = "/"
-		c.Value = s.AuthToken
-		c.Expires = time.Unix(0, s.Deadline)
-		c.SameSite = http.SameSiteStrictMode
-		http.SetCookie(w, c)
+	// Refresh the cookie's token and expiry. Request cookies never carry an
+	// expiry, so this is always sent.
+	if !bearer {
+		http.SetCookie(w, &http.Cookie{
+			Name:     m.cookie,
+			Value:    s.AuthToken,
+			Path:     "/",
+			Expires:  time.Unix(0, s.Deadline),
+			SameSite: http.SameSiteStrictMode,
+		})
 	}
 
-	render(w, v)
+	render(w, r, v)
+}
+
+type ctxKey uint8
+
+const keyAllowReadOnly ctxKey = iota
+
+// AllowReadOnly is a middleware that lets read-only sessions and API keys use
+// the route regardless of its method, such as for signing out. It must come
+// before the transaction middleware.
+func AllowReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), keyAllowReadOnly, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func readOnlyAllowed(r *http.Request) bool {
+	allowed, _ := r.Context().Value(keyAllowReadOnly).(bool)
+	return allowed
+}
+
+// safeMethod returns true if requests of the method don't change anything.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
 }
 
-func render(w http.ResponseWriter, v interface{}) {
+func render(w http.ResponseWriter, r *http.Request, v interface{}) {
 	if v == nil {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -138,33 +247,16 @@ func render(w http.ResponseWriter, v interface{}) {
 
 	if fn, ok := v.(Renderer); ok {
 		if err := fn(w); err != nil {
-			RenderError(w, err)
+			RenderError(w, r, err)
 		}
 		return
 	}
 
-	w.WriteHeader(200)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
 
 	// Render the body as JSON.
 	if err := json.NewEncoder(w).Encode(v); err != nil {
 		log.Println("Encode failed:", err)
 	}
 }
-
-func RenderWrap(w http.ResponseWriter, err error, code int, wrap string) {
-	RenderError(w, httperr.Wrap(err, code, wrap))
-}
-
-func RenderError(w http.ResponseWriter, err error) {
-	code := httperr.ErrCode(err)
-	w.WriteHeader(code)
-
-	var jsonError = smolboard.ErrResponse{
-		Error: err.Error(),
-	}
-
-	if err := json.NewEncoder(w).Encode(jsonError); err != nil {
-		log.Println("Encode failed:", err)
-	}
-}
@@ -0,0 +1,42 @@
+package tx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionToken(t *testing.T) {
+	var tests = []struct {
+		name   string
+		header string
+		cookie string
+		token  string
+		bearer bool
+	}{
+		{name: "none"},
+		{name: "cookie", cookie: "a", token: "a"},
+		{name: "bearer", header: "Bearer b", token: "b", bearer: true},
+		{name: "lowercase", header: "bearer b", token: "b", bearer: true},
+		{name: "both", header: "Bearer b", cookie: "a", token: "b", bearer: true},
+		{name: "other scheme", header: "Basic Zm9vOmJhcg==", cookie: "a", token: "a"},
+		{name: "empty bearer", header: "Bearer ", cookie: "a", token: "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "token", Value: test.cookie})
+			}
+
+			token, bearer := SessionToken(r, "token")
+			if token != test.token || bearer != test.bearer {
+				t.Fatalf("Unexpected token %q (bearer %v)", token, bearer)
+			}
+		})
+	}
+}
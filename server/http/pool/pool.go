@@ -0,0 +1,110 @@
+package pool
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/diamondburned/smolboard/server/http/internal/form"
+	"github.com/diamondburned/smolboard/server/http/internal/limit"
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-chi/chi"
+)
+
+func Mount(m tx.Middlewarer) http.Handler {
+	mux := chi.NewMux()
+	mux.Use(limit.RateLimit(32))
+	mux.With(limit.RateLimit(4)).Post("/", m(CreatePool))
+
+	mux.Route("/{id}", func(r chi.Router) {
+		r.Get("/", m(GetPool))
+		r.Delete("/", m(DeletePool))
+
+		r.Post("/posts", m(AddToPool))
+		r.Delete("/posts/{postID}", m(RemoveFromPool))
+	})
+
+	return mux
+}
+
+type CreateParams struct {
+	Name string `schema:"name,required"`
+}
+
+func CreatePool(r tx.Request) (interface{}, error) {
+	var params CreateParams
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return r.Tx.CreatePool(params.Name)
+}
+
+func poolID(r tx.Request) (int64, error) {
+	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
+	if err != nil {
+		return 0, smolboard.ErrPoolNotFound
+	}
+	return i, nil
+}
+
+func GetPool(r tx.Request) (interface{}, error) {
+	i, err := poolID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p, posts, err := r.Tx.Pool(i)
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.PoolPosts{Pool: *p, Posts: posts}, nil
+}
+
+func DeletePool(r tx.Request) (interface{}, error) {
+	i, err := poolID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, r.Tx.DeletePool(i)
+}
+
+type AddParams struct {
+	PostID int64 `schema:"post,required"`
+	// Position is the 0-indexed position to insert the post at. The post is
+	// appended if this is negative.
+	Position int `schema:"pos"`
+}
+
+func AddToPool(r tx.Request) (interface{}, error) {
+	i, err := poolID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var params = AddParams{Position: -1}
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.AddToPool(i, params.PostID, params.Position)
+}
+
+func RemoveFromPool(r tx.Request) (interface{}, error) {
+	i, err := poolID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.ParseInt(r.Param("postID"), 10, 64)
+	if err != nil {
+		return nil, smolboard.ErrPostNotFound
+	}
+
+	return nil, r.Tx.RemoveFromPool(i, p)
+}
@@ -3,9 +3,12 @@ package post
 import (
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/diamondburned/duration"
 	"github.com/diamondburned/smolboard/server/http/internal/form"
 	"github.com/diamondburned/smolboard/server/http/internal/limit"
+	"github.com/diamondburned/smolboard/server/http/internal/timeout"
 	"github.com/diamondburned/smolboard/server/http/internal/tx"
 	"github.com/diamondburned/smolboard/server/httperr"
 	"github.com/diamondburned/smolboard/smolboard"
@@ -14,18 +17,41 @@ import (
 )
 
 func Mount(m tx.Middlewarer) http.Handler {
+	admin := tx.RequirePermission(m, smolboard.PermissionAdministrator)
+
 	mux := chi.NewMux()
 	mux.Use(limit.RateLimit(64))
 	mux.Get("/", m(ListPosts))
-	// POST but parse form before entering a transaction.
-	mux.With(preparseMultipart, limit.RateLimit(2)).Post("/", m(UploadPost))
+	// POST but parse form before entering a transaction. Uploads are limited
+	// by the upload rate limit of the routes instead.
+	mux.With(preparseMultipart).Post("/", m(UploadPost))
+	mux.Post("/external", m(CreateExternalPost))
+
+	mux.Get("/tags", m(GetTagStats))
+	mux.Post("/tags", m(TagPosts))
+	mux.Post("/tags/rename", admin(RenameTag))
+	mux.Post("/tags/delete", admin(DeleteTagEverywhere))
+	mux.Post("/tags/normalize", admin(NormalizeTags))
+	mux.Post("/delete", m(DeletePosts))
+	mux.Get("/favorites", m(ListFavorites))
+	mux.Post("/favorites", m(FavoritePosts))
+	mux.Post("/favorites/delete", m(UnfavoritePosts))
+	mux.Get("/orphans", admin(GetOrphanedFiles))
+	mux.Get("/shared/{token}", m(GetSharedPost))
+	mux.Get("/hash/{hash}", m(GetPostByHash))
+	mux.Post("/orphans/purge", admin(PurgeOrphanedFiles))
 
 	mux.Route("/{id}", func(r chi.Router) {
 		// GET gives both tags and permission.
 		r.Get("/", m(GetPost))
 		r.Delete("/", m(DeletePost))
+		r.Post("/restore", m(RestorePost))
+		r.With(limit.RateLimit(2)).Post("/report", m(ReportPost))
 
+		r.Post("/share", m(SharePost))
 		r.Patch("/permission", m(SetPostPermission))
+		r.Patch("/expiry", m(SetPostExpiry))
+		r.Post("/transfer", m(TransferPost))
 
 		r.Route("/tags", func(r chi.Router) {
 			r.Put("/", m(TagPost))
@@ -40,7 +66,13 @@ func Mount(m tx.Middlewarer) http.Handler {
 func preparseMultipart(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseMultipartForm(0); err != nil {
-			tx.RenderWrap(w, err, 400, "Failed to parse form")
+			// The body can't be read anymore once the upload times out.
+			if timeout.Exceeded(r) {
+				tx.RenderError(w, r, timeout.ErrTimeout)
+				return
+			}
+
+			tx.RenderWrap(w, r, err, 400, "Failed to parse form")
 			return
 		}
 
@@ -53,6 +85,9 @@ type ListParams struct {
 	Query string `schema:"q"`
 	Count uint   `schema:"c"`
 	Page  uint   `schema:"p"`
+	// Cursor is the cursor from the last results. The page is ignored if this
+	// is given.
+	Cursor string `schema:"cursor"`
 }
 
 func ListPosts(r tx.Request) (interface{}, error) {
@@ -62,6 +97,10 @@ func ListPosts(r tx.Request) (interface{}, error) {
 		return nil, httperr.Wrap(err, 400, "Invalid form")
 	}
 
+	if params.Cursor != "" {
+		return r.Tx.PostSearchAfter(params.Query, params.Cursor, params.Count)
+	}
+
 	return r.Tx.PostSearch(params.Query, params.Count, params.Page)
 }
 
@@ -76,6 +115,25 @@ func GetPost(r tx.Request) (interface{}, error) {
 
 type UploadParams struct {
 	Permission smolboard.Permission `schema:"p"` // default Normal
+	// TTL is how long until the posts expire, such as "1h" or "7d". The posts
+	// never expire if this is empty.
+	TTL string `schema:"ttl"`
+}
+
+// expiryFromTTL returns the time in Unix nanoseconds that a post made now with
+// the given TTL expires at, or nil if the TTL is empty.
+func expiryFromTTL(ttl string) (*int64, error) {
+	if ttl == "" {
+		return nil, nil
+	}
+
+	d, err := duration.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return nil, smolboard.ErrInvalidPostExpiry
+	}
+
+	var at = time.Now().Add(time.Duration(d)).UnixNano()
+	return &at, nil
 }
 
 func UploadPost(r tx.Request) (interface{}, error) {
@@ -85,12 +143,36 @@ func UploadPost(r tx.Request) (interface{}, error) {
 		return nil, httperr.Wrap(err, 400, "Invalid form")
 	}
 
+	var verr = httperr.NewValidationError()
+
+	if !p.Permission.IsValid() {
+		verr.Add("p", smolboard.ErrInvalidPermission)
+	}
+
+	expiresAt, err := expiryFromTTL(p.TTL)
+	if err != nil {
+		verr.Add("ttl", err)
+	}
+
 	files, ok := r.MultipartForm.File["file"]
 	if !ok {
-		return nil, httperr.New(400, "missing field 'file' in form")
+		verr.Add("file", errors.New("missing file"))
+	}
+
+	if err := verr.Err(); err != nil {
+		return nil, err
 	}
 
-	posts, err := r.Up.CreatePosts(files)
+	var up = r.Up
+
+	// Uploads without an account have stricter size limits. The database
+	// decides whether they're allowed at all.
+	if r.Tx.Session.Username == "" {
+		anon := r.Up.Anonymous()
+		up = &anon
+	}
+
+	posts, err := up.CreatePosts(r.Tx.PostIDs(), files)
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +180,7 @@ func UploadPost(r tx.Request) (interface{}, error) {
 	for _, post := range posts {
 		// Set the post's permission.
 		post.Permission = p.Permission
+		post.ExpiresAt = expiresAt
 
 		if err := r.Tx.SavePost(post); err != nil {
 			// Something failed. Before we exit, we need to clean up all
@@ -111,26 +194,263 @@ func UploadPost(r tx.Request) (interface{}, error) {
 	return posts, nil
 }
 
+type ExternalParams struct {
+	URL string `schema:"url,required"`
+	// ContentType is the media's type. It is guessed from the URL if empty.
+	ContentType string               `schema:"type"`
+	Permission  smolboard.Permission `schema:"p"` // default Normal
+	// TTL is the same as UploadParams' TTL.
+	TTL string `schema:"ttl"`
+}
+
+// CreateExternalPost creates a post that links to media hosted elsewhere.
+// External posts need an account, since the server may fetch their media.
+func CreateExternalPost(r tx.Request) (interface{}, error) {
+	var p ExternalParams
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	var verr = httperr.NewValidationError()
+
+	if !p.Permission.IsValid() {
+		verr.Add("p", smolboard.ErrInvalidPermission)
+	}
+
+	if err := smolboard.ValidateMediaURL(p.URL); err != nil {
+		verr.Add("url", err)
+	}
+
+	expiresAt, err := expiryFromTTL(p.TTL)
+	if err != nil {
+		verr.Add("ttl", err)
+	}
+
+	if err := verr.Err(); err != nil {
+		return nil, err
+	}
+
+	// Check before fetching anything, so guests can't make the server do so.
+	if err := r.Tx.HasPermission(smolboard.PermissionUser, true); err != nil {
+		return nil, err
+	}
+
+	post, err := r.Up.CreateExternalPost(r.Context(), r.Tx.PostIDs(), p.URL, p.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	post.Permission = p.Permission
+	post.ExpiresAt = expiresAt
+
+	if err := r.Tx.SavePost(post); err != nil {
+		r.Up.CleanupPost(*post)
+		return nil, errors.Wrap(err, "Failed to save post")
+	}
+
+	return post, nil
+}
+
+type DeleteParams struct {
+	// Hard purges the post immediately instead of soft-deleting it.
+	Hard bool `schema:"hard"`
+}
+
 func DeletePost(r tx.Request) (interface{}, error) {
 	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
 	if err != nil {
 		return nil, smolboard.ErrPostNotFound
 	}
 
-	p, err := r.Tx.Post(i)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to query post")
+	var params DeleteParams
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
 	}
 
-	if err := r.Tx.DeletePost(p.ID); err != nil {
-		return nil, errors.Wrap(err, "Failed to delete post")
+	// Soft-deleted posts keep their files until the janitor purges them.
+	if !params.Hard {
+		p, err := r.Tx.Post(i)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to query post")
+		}
+		if err := r.Tx.DeletePost(p.ID, false); err != nil {
+			return nil, errors.Wrap(err, "Failed to delete post")
+		}
+		return nil, nil
 	}
 
-	r.Up.CleanupPost(p.Post)
+	// Purging also works on soft-deleted posts, so it can't go through Post,
+	// which hides them.
+	p, err := r.Tx.PurgePost(i)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to purge post")
+	}
 
+	r.Up.CleanupPost(*p)
 	return nil, nil
 }
 
+type BulkDeleteParams struct {
+	IDs  []int64 `schema:"id,required"`
+	Hard bool    `schema:"hard"`
+}
+
+// DeletePosts deletes multiple posts. This is a POST endpoint, since some
+// proxies don't like DELETE requests with bodies.
+func DeletePosts(r tx.Request) (interface{}, error) {
+	var params BulkDeleteParams
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	results, deleted, err := r.Tx.DeletePosts(params.IDs, params.Hard)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to delete posts")
+	}
+
+	if params.Hard {
+		r.Up.CleanupPosts(deleted)
+	}
+
+	return results, nil
+}
+
+// FavoritesParams is the URL parameter for favorites pagination.
+type FavoritesParams struct {
+	Count uint `schema:"c"`
+	Page  uint `schema:"p"`
+}
+
+func ListFavorites(r tx.Request) (interface{}, error) {
+	var params = FavoritesParams{Count: 24}
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return r.Tx.Favorites(params.Count, params.Page)
+}
+
+type BulkFavoriteParams struct {
+	IDs []int64 `schema:"id,required"`
+}
+
+func FavoritePosts(r tx.Request) (interface{}, error) {
+	var params BulkFavoriteParams
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.FavoritePosts(params.IDs)
+}
+
+// UnfavoritePosts removes multiple posts from the favorites. Like DeletePosts,
+// this is a POST endpoint.
+func UnfavoritePosts(r tx.Request) (interface{}, error) {
+	var params BulkFavoriteParams
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.UnfavoritePosts(params.IDs)
+}
+
+func RestorePost(r tx.Request) (interface{}, error) {
+	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
+	if err != nil {
+		return nil, smolboard.ErrPostNotFound
+	}
+
+	return nil, r.Tx.RestorePost(i)
+}
+
+type ReportParams struct {
+	Reason string `schema:"reason,required"`
+}
+
+func ReportPost(r tx.Request) (interface{}, error) {
+	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
+	if err != nil {
+		return nil, smolboard.ErrPostNotFound
+	}
+
+	var p ReportParams
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.ReportPost(i, p.Reason)
+}
+
+type ShareParams struct {
+	// TTL is how long the link lasts, such as "12h" or "7d". Default 1 day.
+	TTL string `schema:"ttl"`
+}
+
+// SharePost creates a share link that lets anyone see the post until it
+// expires.
+func SharePost(r tx.Request) (interface{}, error) {
+	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
+	if err != nil {
+		return nil, smolboard.ErrPostNotFound
+	}
+
+	var p = ShareParams{TTL: "1d"}
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	ttl, err := duration.ParseDuration(p.TTL)
+	if err != nil {
+		return nil, smolboard.ErrInvalidShareLinkTTL
+	}
+
+	return r.Tx.CreateShareLink(i, time.Duration(ttl))
+}
+
+// GetSharedPost returns the post that the share link was made for.
+func GetSharedPost(r tx.Request) (interface{}, error) {
+	return r.Tx.SharedPost(r.Param("token"))
+}
+
+// GetPostByHash returns the post whose file has the given SHA-256 digest.
+func GetPostByHash(r tx.Request) (interface{}, error) {
+	return r.Tx.PostByHash(r.Param("hash"))
+}
+
+type PostExpiry struct {
+	// At is the time in Unix nanoseconds that the post expires at. The post
+	// never expires if this is 0.
+	At int64 `schema:"at"`
+}
+
+func SetPostExpiry(r tx.Request) (interface{}, error) {
+	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
+	if err != nil {
+		return nil, smolboard.ErrPostNotFound
+	}
+
+	var p PostExpiry
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	var at time.Time
+	if p.At != 0 {
+		at = time.Unix(0, p.At)
+	}
+
+	return nil, r.Tx.SetPostExpiry(i, at)
+}
+
 type PostPermission struct {
 	Permission smolboard.Permission `schema:"p,required"`
 }
@@ -151,6 +471,25 @@ func SetPostPermission(r tx.Request) (interface{}, error) {
 	return nil, r.Tx.SetPostPermission(i, p.Permission)
 }
 
+type Transfer struct {
+	To string `schema:"to,required"`
+}
+
+func TransferPost(r tx.Request) (interface{}, error) {
+	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
+	if err != nil {
+		return nil, smolboard.ErrPostNotFound
+	}
+
+	var t Transfer
+
+	if err := form.Unmarshal(r, &t); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.TransferPost(i, t.To)
+}
+
 type Tag struct {
 	Tag string `schema:"t,required"`
 }
@@ -170,6 +509,74 @@ func TagPost(r tx.Request) (interface{}, error) {
 	return nil, r.Tx.TagPost(i, t.Tag)
 }
 
+type BulkTag struct {
+	IDs []int64 `schema:"id,required"`
+	Tag string  `schema:"t,required"`
+}
+
+func TagPosts(r tx.Request) (interface{}, error) {
+	var t BulkTag
+
+	if err := form.Unmarshal(r, &t); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	n, err := r.Tx.AddTagToPosts(t.IDs, t.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.BulkTagResult{Updated: n}, nil
+}
+
+type TagStatsParams struct {
+	Count int `schema:"c"`
+}
+
+func GetTagStats(r tx.Request) (interface{}, error) {
+	var p TagStatsParams
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return r.Tx.TagStats(p.Count)
+}
+
+type TagRename struct {
+	From string `schema:"from,required"`
+	To   string `schema:"to,required"`
+}
+
+func RenameTag(r tx.Request) (interface{}, error) {
+	var t TagRename
+
+	if err := form.Unmarshal(r, &t); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.RenameTag(t.From, t.To)
+}
+
+func DeleteTagEverywhere(r tx.Request) (interface{}, error) {
+	var t Tag
+
+	if err := form.Unmarshal(r, &t); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.DeleteTagEverywhere(t.Tag)
+}
+
+func NormalizeTags(r tx.Request) (interface{}, error) {
+	n, err := r.Tx.NormalizeTags()
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.TagNormalizeResult{Normalized: n}, nil
+}
+
 func UntagPost(r tx.Request) (interface{}, error) {
 	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
 	if err != nil {
@@ -184,3 +591,34 @@ func UntagPost(r tx.Request) (interface{}, error) {
 
 	return nil, r.Tx.UntagPost(i, t.Tag)
 }
+
+// GetOrphanedFiles lists the stored files that don't belong to any post.
+func GetOrphanedFiles(r tx.Request) (interface{}, error) {
+	files, err := r.Up.FindOrphanedFiles(r.Tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.OrphanedFiles{Files: files}, nil
+}
+
+type PurgeOrphansParams struct {
+	// DryRun only lists the files that would be removed.
+	DryRun bool `schema:"dry_run"`
+}
+
+// PurgeOrphanedFiles removes the stored files that don't belong to any post.
+func PurgeOrphanedFiles(r tx.Request) (interface{}, error) {
+	var p PurgeOrphansParams
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	files, n, err := r.Up.PurgeOrphanedFiles(r.Tx, p.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.OrphanedFiles{Files: files, Purged: n}, nil
+}
@@ -0,0 +1,58 @@
+package report
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/diamondburned/smolboard/server/http/internal/form"
+	"github.com/diamondburned/smolboard/server/http/internal/limit"
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-chi/chi"
+)
+
+func Mount(m tx.Middlewarer) http.Handler {
+	admin := tx.RequirePermission(m, smolboard.PermissionAdministrator)
+
+	mux := chi.NewMux()
+	mux.Use(limit.RateLimit(8))
+	mux.Get("/", admin(ListReports))
+	mux.Post("/{id}/resolve", admin(ResolveReport))
+
+	return mux
+}
+
+type ListParams struct {
+	Offset int `schema:"o"`
+	Limit  int `schema:"l"`
+}
+
+func ListReports(r tx.Request) (interface{}, error) {
+	var params = ListParams{Limit: 50}
+
+	if err := form.Unmarshal(r, &params); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return r.Tx.PendingReports(params.Offset, params.Limit)
+}
+
+type Resolution struct {
+	Action smolboard.ReportAction `schema:"action,required"`
+}
+
+func ResolveReport(r tx.Request) (interface{}, error) {
+	i, err := strconv.ParseInt(r.Param("id"), 10, 64)
+	if err != nil {
+		return nil, smolboard.ErrReportNotFound
+	}
+
+	var res Resolution
+
+	if err := form.Unmarshal(r, &res); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.ResolveReport(i, res.Action)
+}
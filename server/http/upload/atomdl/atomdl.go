@@ -5,11 +5,67 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/pkg/errors"
 )
 
+// ErrStorage is returned when the file can't be stored, such as when the disk
+// is full. Errors reading from the source are returned as-is instead.
+type ErrStorage struct {
+	Err error
+	// Retryable is true if the failure is likely temporary, so the same file
+	// could be stored later, such as when the disk is full.
+	Retryable bool
+}
+
+// NewErrStorage wraps the given error into an ErrStorage, classifying whether
+// it is retryable. Nil is returned if the error is nil.
+func NewErrStorage(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return ErrStorage{Err: err, Retryable: isTransient(err)}
+}
+
+// transientErrnos are the errors that usually go away on their own.
+var transientErrnos = []syscall.Errno{
+	syscall.ENOSPC, // disk is full
+	syscall.EDQUOT, // disk quota exceeded
+	syscall.EAGAIN,
+	syscall.EBUSY,
+	syscall.EINTR,
+}
+
+func isTransient(err error) bool {
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return os.IsTimeout(err)
+}
+
+// StatusCode returns 503 Service Unavailable if the error is retryable, or 500
+// Internal Server Error otherwise.
+func (err ErrStorage) StatusCode() int {
+	if err.Retryable {
+		return 503
+	}
+	return 500
+}
+
+func (err ErrStorage) Error() string {
+	return "storage error: " + err.Err.Error()
+}
+
+func (err ErrStorage) Unwrap() error {
+	return err.Err
+}
+
 func Download(r io.Reader, dir string, p *smolboard.Post) error {
 	t, n, err := download(r, dir, p.Filename())
 	if err != nil {
@@ -22,21 +78,45 @@ func Download(r io.Reader, dir string, p *smolboard.Post) error {
 func download(r io.Reader, dir, file string) (tmpname string, n int64, err error) {
 	tmpname = filepath.Join(dir, "."+file)
 
-	w, err := os.Create(tmpname)
+	f, err := os.Create(tmpname)
 	if err != nil {
-		return tmpname, 0, errors.Wrap(err, "Failed to create file in directory")
+		return tmpname, 0, NewErrStorage(errors.Wrap(err, "Failed to create file in directory"))
 	}
-	defer w.Close()
+	defer f.Close()
+
+	// Tell write errors apart from read errors, which are the uploader's.
+	var w = storageWriter{w: f}
 
-	n, err = io.Copy(w, r)
+	n, err = io.Copy(&w, r)
 	if err != nil {
-		return tmpname, 0, errors.Wrap(err, "Failed to write file to disk")
+		if w.err != nil {
+			return tmpname, 0, NewErrStorage(errors.Wrap(w.err, "Failed to write file to disk"))
+		}
+		return tmpname, 0, errors.Wrap(err, "Failed to read file")
+	}
+
+	if err := f.Close(); err != nil {
+		return tmpname, 0, NewErrStorage(errors.Wrap(err, "Failed to write file to disk"))
 	}
 
 	if err := os.Rename(tmpname, filepath.Join(dir, file)); err != nil {
-		return tmpname, 0, errors.Wrap(err, "Failed to move file back")
+		return tmpname, 0, NewErrStorage(errors.Wrap(err, "Failed to move file back"))
 	}
 
 	// Already moved; no need to clean up.
 	return tmpname, n, nil
 }
+
+// storageWriter keeps the error of the last write.
+type storageWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *storageWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
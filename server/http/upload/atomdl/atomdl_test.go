@@ -0,0 +1,135 @@
+package atomdl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+func TestErrStorage(t *testing.T) {
+	var tests = []struct {
+		name      string
+		err       error
+		retryable bool
+		code      int
+	}{
+		{"DiskFull", &os.PathError{Op: "write", Path: "1.png", Err: syscall.ENOSPC}, true, 503},
+		{"Quota", &os.PathError{Op: "write", Path: "1.png", Err: syscall.EDQUOT}, true, 503},
+		{"Permission", &os.PathError{Op: "open", Path: "1.png", Err: syscall.EACCES}, false, 500},
+		{"IO", &os.PathError{Op: "write", Path: "1.png", Err: syscall.EIO}, false, 500},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			err := errors.Wrap(NewErrStorage(errors.Wrap(test.err, "Failed")), "Failed to save file")
+
+			var serr ErrStorage
+			if !errors.As(err, &serr) {
+				t.Fatalf("Error is not a storage error: %v", err)
+			}
+			if serr.Retryable != test.retryable {
+				t.Fatal("Unexpected retryable:", serr.Retryable)
+			}
+			if code := httperr.ErrCode(err); code != test.code {
+				t.Fatal("Unexpected status code:", code)
+			}
+			if !errors.Is(err, test.err.(*os.PathError).Err) {
+				t.Fatal("Storage error doesn't unwrap to the cause:", err)
+			}
+		})
+	}
+
+	if NewErrStorage(nil) != nil {
+		t.Fatal("Unexpected storage error for nil")
+	}
+}
+
+// errReader fails to read with the given error.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smolboard-atomdl")
+	if err != nil {
+		t.Fatal("Failed to create temp dir:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var post = smolboard.Post{ID: 1, ContentType: "image/png"}
+
+	t.Run("Success", func(t *testing.T) {
+		if err := Download(strings.NewReader("png"), dir, &post); err != nil {
+			t.Fatal("Failed to download:", err)
+		}
+		if post.Size != 3 {
+			t.Fatal("Unexpected size:", post.Size)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, post.Filename()))
+		if err != nil || string(b) != "png" {
+			t.Fatalf("Unexpected file %q: %v", b, err)
+		}
+	})
+
+	t.Run("MissingDirectory", func(t *testing.T) {
+		err := Download(strings.NewReader("png"), filepath.Join(dir, "missing"), &post)
+
+		var serr ErrStorage
+		if !errors.As(err, &serr) || serr.Retryable {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ReadError", func(t *testing.T) {
+		// Errors from the uploader's side aren't the storage's fault.
+		var readErr = httperr.New(413, "file too large")
+
+		err := Download(errReader{readErr}, dir, &smolboard.Post{ID: 2, ContentType: "image/png"})
+		if !errors.Is(err, readErr) || errors.As(err, new(ErrStorage)) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ".2.png")); !os.IsNotExist(err) {
+			t.Fatal("Temporary file was not cleaned up:", err)
+		}
+	})
+
+	t.Run("DiskFull", func(t *testing.T) {
+		if _, err := os.Stat("/dev/full"); err != nil {
+			t.Skip("No /dev/full to simulate a full disk.")
+		}
+
+		// Writing to /dev/full always fails with ENOSPC.
+		var w = storageWriter{w: mustOpen(t, "/dev/full")}
+		if _, err := w.Write([]byte("png")); err == nil {
+			t.Fatal("Unexpected success writing to /dev/full")
+		}
+
+		var serr ErrStorage
+		if !errors.As(NewErrStorage(w.err), &serr) || !serr.Retryable {
+			t.Fatalf("Unexpected error: %v", w.err)
+		}
+	})
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal("Failed to open file:", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f
+}
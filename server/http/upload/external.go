@@ -0,0 +1,350 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/http/upload/ff"
+	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+var ErrExternalPostsDisabled = httperr.New(403, "external posts are disabled")
+
+// ExternalThumbnailSize is the maximum width and height of the thumbnails that
+// are fetched for external posts. Thumbnails of other sizes aren't rendered,
+// since the media isn't kept.
+const ExternalThumbnailSize = 400
+
+// ExternalTimeout is the maximum duration of fetching an external post's media
+// to make its thumbnail.
+const ExternalTimeout = time.Minute
+
+// MaxExternalRedirects is the number of redirects that are followed when
+// fetching external media.
+const MaxExternalRedirects = 5
+
+var (
+	// ErrExternalAddress is returned when the media URL resolves to an
+	// address that isn't public, such as loopback or a private network.
+	ErrExternalAddress = httperr.New(400, "media URL does not resolve to a public address")
+	// ErrExternalRedirects is returned when the media URL redirects too many
+	// times.
+	ErrExternalRedirects = httperr.New(400, "media URL redirects too many times")
+)
+
+var (
+	// externalClient is the client that external media is fetched with. It
+	// only connects to public addresses.
+	externalClient = newExternalClient(dialPublicOnly)
+	// externalPrivateClient is externalClient for ExternalPrivateAddresses.
+	externalPrivateClient = newExternalClient(nil)
+)
+
+// newExternalClient creates a client with the given dial control. Proxies from
+// the environment are not used, since the control must see the media's
+// address. Every redirect is validated as a media URL.
+func newExternalClient(control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: control,
+	}
+
+	return &http.Client{
+		Timeout: ExternalTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= MaxExternalRedirects {
+				return ErrExternalRedirects
+			}
+			return smolboard.ValidateMediaURL(r.URL.String())
+		},
+	}
+}
+
+// dialPublicOnly is a dial control that rejects connections to addresses that
+// aren't public. It runs after the hostname is resolved, so a hostname can't
+// resolve to a public address when checked and a private one when dialed.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return ErrExternalAddress
+	}
+
+	return nil
+}
+
+// nonPublicNets are the networks that aren't reachable from the internet, on
+// top of what net.IP's methods check.
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8",          // "this" network
+	"10.0.0.0/8",         // private
+	"100.64.0.0/10",      // carrier-grade NAT
+	"172.16.0.0/12",      // private
+	"192.0.0.0/24",       // IETF protocol assignments
+	"192.168.0.0/16",     // private
+	"198.18.0.0/15",      // benchmarking
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+	"64:ff9b::/96",       // NAT64, which can reach private IPv4 addresses
+	"100::/64",           // discard
+	"2002::/16",          // 6to4, which can reach private IPv4 addresses
+	"fc00::/7",           // unique local
+	"fec0::/10",          // deprecated site local
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets = make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// isPublicIP returns true if the IP is a public unicast address.
+func isPublicIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// externalClient returns the client that external media is fetched with.
+func (c UploadConfig) externalClient() *http.Client {
+	if c.ExternalPrivateAddresses {
+		return externalPrivateClient
+	}
+	return externalClient
+}
+
+// fetchError wraps an error from fetching external media with a status code,
+// keeping ErrExternalAddress and ErrExternalRedirects as they are.
+func fetchError(err error, code int) error {
+	for _, known := range []error{ErrExternalAddress, ErrExternalRedirects} {
+		if errors.Is(err, known) {
+			return known
+		}
+	}
+	return httperr.Wrap(err, code, "Failed to fetch media")
+}
+
+// CreateExternalPost creates a new post with an ID from the given generator
+// that links to the media at the given URL. The content type is guessed from
+// the URL's extension if ctype is empty, and it must be allowed either way. If
+// ExternalThumbnails is true, then the media is fetched to make the thumbnail
+// and fill in the post's attributes, and the content type is taken from the
+// media instead.
+func (c UploadConfig) CreateExternalPost(
+	ctx context.Context, ids db.IDGenerator, mediaURL, ctype string) (*smolboard.Post, error) {
+
+	if !c.ExternalPosts {
+		return nil, ErrExternalPostsDisabled
+	}
+
+	if err := smolboard.ValidateMediaURL(mediaURL); err != nil {
+		return nil, err
+	}
+
+	if ctype == "" {
+		u, _ := url.Parse(mediaURL)
+
+		ctype, _, _ = mime.ParseMediaType(mime.TypeByExtension(path.Ext(u.Path)))
+		if ctype == "" {
+			return nil, smolboard.ErrUnknownMediaType
+		}
+	}
+
+	if !c.ContentTypeAllowed(ctype) {
+		return nil, ErrUnsupportedType{ctype}
+	}
+
+	p := db.NewEmptyPostFrom(ids, ctype)
+	p.External = true
+	p.MediaURL = mediaURL
+
+	if c.ExternalThumbnails {
+		if err := c.fetchExternal(ctx, &p); err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+// fetchExternal downloads the external post's media into a temporary file to
+// make its thumbnail and attributes. The file is removed afterwards.
+func (c UploadConfig) fetchExternal(ctx context.Context, p *smolboard.Post) error {
+	q, err := http.NewRequestWithContext(ctx, http.MethodGet, p.MediaURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create request")
+	}
+
+	r, err := c.externalClient().Do(q)
+	if err != nil {
+		return fetchError(err, 400)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return httperr.New(400, "media URL responded with "+r.Status)
+	}
+
+	lr, err := c.WrapReader(r.Body)
+	if err != nil {
+		return err
+	}
+
+	// The media's actual type takes precedence over the URL's extension.
+	p.ContentType = lr.CType
+
+	f, err := ioutil.TempFile(c.FileDirectory, ".external.")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create temporary file")
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, lr)
+	f.Close()
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to fetch media")
+	}
+
+	setAttributes(p, f.Name())
+
+	// A post without a thumbnail still works, so errors aren't fatal.
+	if err := c.saveExternalThumbnail(*p, f.Name()); err != nil {
+		log.Printf("Failed to make the thumbnail of %q: %v", p.MediaURL, err)
+	}
+
+	return nil
+}
+
+// saveExternalThumbnail saves the thumbnail of the media at the given path as
+// the external post's thumbnail.
+func (c UploadConfig) saveExternalThumbnail(p smolboard.Post, src string) error {
+	i, err := imaging.Open(src, imaging.AutoOrientation(true))
+	if err != nil {
+		// Resort to shelling out for videos.
+		i, err = ff.FirstFrame(src, ExternalThumbnailSize, ExternalThumbnailSize, ff.LanczosScaler)
+		if err != nil {
+			return err
+		}
+	}
+
+	i = imaging.Fit(i, ExternalThumbnailSize, ExternalThumbnailSize, imaging.Lanczos)
+
+	var dst = filepath.Join(c.FileDirectory, externalThumbnail(p))
+	var tmp = filepath.Join(c.FileDirectory, "."+externalThumbnail(p))
+
+	if err := imaging.Save(i, tmp, imaging.JPEGQuality(95)); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to save thumbnail")
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to move thumbnail")
+	}
+
+	return nil
+}
+
+// ExternalThumbnailPath returns the path to the thumbnail that was fetched for
+// the external post, or an empty string if the post isn't external. The file
+// may not exist.
+func (c UploadConfig) ExternalThumbnailPath(p smolboard.Post) string {
+	if !p.External {
+		return ""
+	}
+	return filepath.Join(c.FileDirectory, externalThumbnail(p))
+}
+
+func externalThumbnail(p smolboard.Post) string {
+	return p.Filename() + ".thumb.jpeg"
+}
+
+// proxyRange matches the single byte ranges that are passed through when
+// proxying.
+var proxyRange = regexp.MustCompile(`^bytes=(\d{1,19}-\d{0,19}|-\d{1,19})$`)
+
+// ProxyExternal copies the external post's media into the response. Only the
+// content headers are kept, and no more than the post's type is allowed to be
+// uploaded is copied.
+func (c UploadConfig) ProxyExternal(w http.ResponseWriter, r *http.Request, p smolboard.Post) error {
+	q, err := http.NewRequestWithContext(r.Context(), http.MethodGet, p.MediaURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create request")
+	}
+
+	// Single ranges are passed through, so that videos can still be seeked.
+	if rng := r.Header.Get("Range"); proxyRange.MatchString(rng) {
+		q.Header.Set("Range", rng)
+	}
+
+	resp, err := c.externalClient().Do(q)
+	if err != nil {
+		return fetchError(err, 502)
+	}
+	defer resp.Body.Close()
+
+	for _, key := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified"} {
+		if v := resp.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+
+	// The post's type is used, since the media's host could serve anything.
+	w.Header().Set("Content-Type", p.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(resp.StatusCode)
+
+	var lim = c.MaxFileSize
+	if l := c.MaxSize.SizeLimit(p.ContentType); l > 0 {
+		lim = l
+	}
+
+	_, err = io.Copy(w, io.LimitReader(resp.Body, int64(lim)))
+	return err
+}
@@ -0,0 +1,55 @@
+package upload
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	var tests = []struct {
+		ip     string
+		public bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"10.1.2.3", false},
+		{"172.31.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:127.0.0.1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"224.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+
+	for _, test := range tests {
+		if public := isPublicIP(net.ParseIP(test.ip)); public != test.public {
+			t.Errorf("isPublicIP(%q) = %v, expected %v", test.ip, public, test.public)
+		}
+	}
+}
+
+func TestExternalRedirects(t *testing.T) {
+	var via = make([]*http.Request, MaxExternalRedirects)
+
+	q, _ := http.NewRequest("GET", "https://example.com/a.png", nil)
+	if err := externalClient.CheckRedirect(q, via[:1]); err != nil {
+		t.Fatal("Unexpected error following a redirect:", err)
+	}
+
+	if err := externalClient.CheckRedirect(q, via); err != ErrExternalRedirects {
+		t.Fatal("Unexpected error following too many redirects:", err)
+	}
+
+	q, _ = http.NewRequest("GET", "file:///etc/passwd", nil)
+	if err := externalClient.CheckRedirect(q, via[:1]); err == nil {
+		t.Fatal("Redirect to a file URL was followed")
+	}
+}
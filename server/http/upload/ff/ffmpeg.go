@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"image"
 	"os/exec"
+	"strconv"
 
 	"github.com/pkg/errors"
 	"golang.org/x/image/bmp"
@@ -74,3 +75,28 @@ func FirstFrameJPEG(path string, maxw, maxh int, s ScalerAlgorithm) ([]byte, err
 
 	return b, nil
 }
+
+// EncodeWebP encodes the first frame of the file at src into a lossy WebP file
+// at dst. The quality ranges from 0 to 100.
+func EncodeWebP(src, dst string, quality int) error {
+	if err := acq(); err != nil {
+		return err
+	}
+	defer sema.Release(1)
+
+	cmd := exec.Command(
+		"ffmpeg",
+		"-v", "error", "-y",
+		"-i", src, "-vframes", "1",
+		"-c:v", "libwebp", "-quality", strconv.Itoa(quality), "-f", "webp", dst,
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to execute FFmpeg: %w\n%v", err, stderr.String())
+	}
+
+	return nil
+}
@@ -13,9 +13,11 @@ import (
 
 	"github.com/diamondburned/smolboard/server/http/internal/limit"
 	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/http/upload"
 	"github.com/diamondburned/smolboard/server/http/upload/ff"
 	"github.com/diamondburned/smolboard/server/http/upload/imgsrv/thumbcache"
 	"github.com/diamondburned/smolboard/server/httperr"
+	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/disintegration/imaging"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -23,11 +25,16 @@ import (
 	"github.com/pkg/errors"
 )
 
-// ThumbnailSize controls the dimension of the thumbnail.
+// ThumbnailSize controls the dimension of the thumbnail if no size is
+// requested.
 const ThumbnailSize = 400
 
+var defaultThumbSize = upload.ThumbnailSize{Width: ThumbnailSize, Height: ThumbnailSize}
+
 var (
-	ErrFileNotFound = httperr.New(404, "file not found")
+	ErrFileNotFound            = httperr.New(404, "file not found")
+	ErrThumbnailSizeNotAllowed = httperr.New(400, "thumbnail size not allowed")
+	ErrInvalidThumbnailSize    = httperr.New(400, "invalid thumbnail size")
 )
 
 // limit the thumbnail processors to 50 simultaneous requests.
@@ -37,6 +44,9 @@ func Mount(m tx.Middlewarer) http.Handler {
 	mux := chi.NewMux()
 	mux.Use(limit.RateLimit(100)) // 100 accesses per second
 
+	// Share links don't need a session.
+	mux.Get("/shared/{token}", m(ServeSharedPost))
+
 	// Parse the filename for the post ID.
 	mux.With(parseID).Route("/{file}", func(r chi.Router) {
 		r.Get("/", m(ServePost))
@@ -73,28 +83,102 @@ func ServePost(r tx.Request) (interface{}, error) {
 			return nil
 		}
 
-		var filepath = filepath.Join(r.Up.FileDirectory, name)
+		return servePostFile(w, r, *p)
+	}, nil
+}
 
-		// Try and stat the file for the modTime to be used as the ETag. If we
-		// can't stat the file, then don't serve anything.
-		s, err := os.Stat(filepath)
-		if err != nil {
-			return errors.Wrap(err, "Failed to stat file")
-		}
+// ServeSharedPost serves the file of the post that the share link's token was
+// made for, regardless of the post's permission.
+func ServeSharedPost(r tx.Request) (interface{}, error) {
+	p, err := r.Tx.SharedPost(r.Param("token"))
+	if err != nil {
+		return nil, err
+	}
 
-		// Write the ETag as a Unix timestamp in nanoseconds hexadecimal.
-		w.Header().Set("ETag", strconv.FormatInt(s.ModTime().UnixNano(), 16))
+	return func(w http.ResponseWriter) error {
+		// The link may expire or be revoked, so it's always revalidated.
+		w.Header().Set("Cache-Control", "private, no-cache")
+		return servePostFile(w, r, *p)
+	}, nil
+}
 
-		// ServeFile will actually validate the ETag for us.
-		http.ServeFile(w, r.Request, filepath)
+// servePostFile serves the post's file, or its media if it's external.
+func servePostFile(w http.ResponseWriter, r tx.Request, p smolboard.Post) error {
+	// External posts have no stored file to serve.
+	if p.External {
+		if r.Up.ExternalProxy {
+			return r.Up.ProxyExternal(w, r.Request, p)
+		}
 
+		http.Redirect(w, r.Request, p.MediaURL, http.StatusFound)
 		return nil
-	}, nil
+	}
+
+	var filepath = filepath.Join(r.Up.FileDirectory, p.Filename())
+	var etagSuffix string
+
+	// Serve the WebP variant instead if the client accepts it and the
+	// variant exists.
+	if variant := r.Up.WebPVariantPath(p); variant != "" {
+		// The response now depends on the Accept header.
+		w.Header().Add("Vary", "Accept")
+
+		if acceptsType(r.Header.Get("Accept"), "image/webp") {
+			if _, err := os.Stat(variant); err == nil {
+				filepath = variant
+				etagSuffix = "-webp"
+				w.Header().Set("Content-Type", "image/webp")
+			}
+		}
+	}
+
+	// Try and stat the file for the modTime to be used as the ETag. If we
+	// can't stat the file, then don't serve anything.
+	s, err := os.Stat(filepath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to stat file")
+	}
+
+	// Write the ETag as a Unix timestamp in nanoseconds hexadecimal.
+	w.Header().Set("ETag", strconv.FormatInt(s.ModTime().UnixNano(), 16)+etagSuffix)
+
+	// ServeFile will actually validate the ETag for us.
+	http.ServeFile(w, r.Request, filepath)
+
+	return nil
+}
+
+// thumbnailSize returns the thumbnail size requested with the w and h query
+// parameters, which must be both given or both left out. Only the default size
+// and the configured sizes are allowed, since each size is rendered on demand.
+func thumbnailSize(r tx.Request) (upload.ThumbnailSize, error) {
+	var query = r.URL.Query()
+	var w, h = query.Get("w"), query.Get("h")
+
+	if w == "" && h == "" {
+		return defaultThumbSize, nil
+	}
+
+	size, err := upload.ParseThumbnailSize(w + "x" + h)
+	if err != nil {
+		return upload.ThumbnailSize{}, ErrInvalidThumbnailSize
+	}
+
+	if size != defaultThumbSize && !r.Up.ThumbnailSizeAllowed(size) {
+		return upload.ThumbnailSize{}, ErrThumbnailSizeNotAllowed
+	}
+
+	return size, nil
 }
 
 func ServeThumbnail(r tx.Request) (interface{}, error) {
 	id, _ := getStored(r)
 
+	size, err := thumbnailSize(r)
+	if err != nil {
+		return nil, err
+	}
+
 	p, err := r.Tx.PostQuickGet(id)
 	if err != nil {
 		return nil, err
@@ -103,9 +187,23 @@ func ServeThumbnail(r tx.Request) (interface{}, error) {
 	return func(w http.ResponseWriter) error {
 		var name = p.Filename()
 
+		// External posts only have the thumbnail that was fetched when they
+		// were created, if any.
+		if thumb := r.Up.ExternalThumbnailPath(*p); thumb != "" {
+			if _, err := os.Stat(thumb); err == nil {
+				w.Header().Set("Cache-Control", "private, max-age=604800")
+				http.ServeFile(w, r.Request, thumb)
+				return nil
+			}
+
+			redirect := path.Dir(r.URL.Path) // remove /thumb
+			http.Redirect(w, r.Request, redirect, http.StatusFound)
+			return nil
+		}
+
 		// Try serving the thumbnail and redirect the user to the original
 		// content if there's none available.
-		if err := serveThumbnail(w, r, name); err != nil {
+		if err := serveThumbnail(w, r, name, size); err != nil {
 			log.Printf("Error serving thumbnail %q: %v\n", name, err)
 
 			redirect := path.Dir(r.URL.Path) // remove /thumb
@@ -123,9 +221,16 @@ var jpegOpts = &jpeg.EncoderOptions{
 	DCTMethod:      jpeg.DCTMethod(jpeg.DCTFloat),
 }
 
-func serveThumbnail(w http.ResponseWriter, r tx.Request, name string) error {
+func serveThumbnail(w http.ResponseWriter, r tx.Request, name string, size upload.ThumbnailSize) error {
 	var path = filepath.Join(r.Up.FileDirectory, name)
 
+	// The default size is cached under the file's name as it was before sizes
+	// could be requested.
+	var cacheName = name
+	if size != defaultThumbSize {
+		cacheName = thumbcache.VariantName(name, size.String())
+	}
+
 	// We should always check if the file still exists. It may not.
 	s, err := os.Stat(path)
 	if err != nil {
@@ -145,23 +250,19 @@ func serveThumbnail(w http.ResponseWriter, r tx.Request, name string) error {
 	w.Header().Set("Cache-Control", "private, max-age=604800")
 
 	// Check if the file is in the cache. If it is, return.
-	b, err := thumbcache.Get(name)
+	b, err := thumbcache.Get(cacheName)
 	if err == nil {
 		http.ServeContent(w, r.Request, "thumb.jpeg", modTime, bytes.NewReader(b))
 		return nil
 	}
 
-	b, err = tryNativeJPEG(r, path)
-	if err != nil {
-		b, err = tryFFmpeg(r, path)
-	}
-
+	b, err = renderThumbnail(path, size)
 	if err != nil {
 		return err
 	}
 
 	// Non-fatal cache error; ignore.
-	if err := thumbcache.Put(name, b); err != nil {
+	if err := thumbcache.Put(cacheName, b); err != nil {
 		log.Println("Failed to cache thumbnail:", err)
 	}
 
@@ -169,11 +270,21 @@ func serveThumbnail(w http.ResponseWriter, r tx.Request, name string) error {
 	return nil
 }
 
-func tryFFmpeg(r tx.Request, path string) ([]byte, error) {
-	return ff.FirstFrameJPEG(path, ThumbnailSize, ThumbnailSize, ff.LanczosScaler)
+// renderThumbnail renders the JPEG thumbnail of the file at the given path. It
+// falls back to FFmpeg for files that aren't images, such as videos.
+func renderThumbnail(path string, size upload.ThumbnailSize) ([]byte, error) {
+	b, err := tryNativeJPEG(path, size)
+	if err != nil {
+		b, err = tryFFmpeg(path, size)
+	}
+	return b, err
+}
+
+func tryFFmpeg(path string, size upload.ThumbnailSize) ([]byte, error) {
+	return ff.FirstFrameJPEG(path, size.Width, size.Height, ff.LanczosScaler)
 }
 
-func tryNativeJPEG(r tx.Request, path string) ([]byte, error) {
+func tryNativeJPEG(path string, size upload.ThumbnailSize) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to open file")
@@ -188,7 +299,7 @@ func tryNativeJPEG(r tx.Request, path string) ([]byte, error) {
 	// Early close.
 	f.Close()
 
-	nrgba := imaging.Fit(i, ThumbnailSize, ThumbnailSize, imaging.Lanczos)
+	nrgba := imaging.Fit(i, size.Width, size.Height, imaging.Lanczos)
 	// Since JPEG really wants an *RGBA, we need to redraw everything.
 	rgba := image.NewRGBA(nrgba.Rect)
 	draw.Draw(rgba, rgba.Rect, nrgba, rgba.Rect.Min, draw.Src)
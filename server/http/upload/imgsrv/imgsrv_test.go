@@ -0,0 +1,50 @@
+package imgsrv
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/diamondburned/smolboard/server/http/internal/tx"
+	"github.com/diamondburned/smolboard/server/http/upload"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	var up = upload.UploadConfig{
+		ThumbnailSizes: []string{"200x200", "800x600"},
+	}
+
+	var tests = []struct {
+		name  string
+		query string
+		size  upload.ThumbnailSize
+		err   error
+	}{
+		{name: "default", size: defaultThumbSize},
+		{name: "explicit default", query: "w=400&h=400", size: defaultThumbSize},
+		{name: "allowed", query: "w=200&h=200", size: upload.ThumbnailSize{Width: 200, Height: 200}},
+		{name: "allowed non-square", query: "w=800&h=600", size: upload.ThumbnailSize{Width: 800, Height: 600}},
+		{name: "swapped", query: "w=600&h=800", err: ErrThumbnailSizeNotAllowed},
+		{name: "not allowed", query: "w=201&h=200", err: ErrThumbnailSizeNotAllowed},
+		{name: "bomb", query: "w=100000&h=100000", err: ErrInvalidThumbnailSize},
+		{name: "width only", query: "w=200", err: ErrInvalidThumbnailSize},
+		{name: "negative", query: "w=-200&h=200", err: ErrInvalidThumbnailSize},
+		{name: "not a number", query: "w=a&h=b", err: ErrInvalidThumbnailSize},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := tx.Request{
+				Request: httptest.NewRequest("GET", "/1.png/thumb.jpg?"+test.query, nil),
+				Up:      &up,
+			}
+
+			size, err := thumbnailSize(r)
+			if err != test.err {
+				t.Fatalf("Unexpected error %v, expected %v", err, test.err)
+			}
+			if size != test.size {
+				t.Fatalf("Unexpected size %v, expected %v", size, test.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package imgsrv
+
+import (
+	"strconv"
+	"strings"
+)
+
+// acceptsType returns true if the given Accept header explicitly lists the
+// given content type with a non-zero quality. Wildcards are not matched, since
+// browsers send them for formats they can't actually decode.
+func acceptsType(accept, ctype string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+
+		if !strings.EqualFold(strings.TrimSpace(params[0]), ctype) {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			if err != nil || q <= 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
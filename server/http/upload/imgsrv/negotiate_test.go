@@ -0,0 +1,32 @@
+package imgsrv
+
+import "testing"
+
+func TestAcceptsType(t *testing.T) {
+	var tests = []struct {
+		name    string
+		accept  string
+		accepts bool
+	}{
+		{name: "empty"},
+		{
+			name:    "chrome",
+			accept:  "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8",
+			accepts: true,
+		},
+		{name: "wildcards only", accept: "image/png,image/*;q=0.8,*/*;q=0.5"},
+		{name: "uppercase", accept: "IMAGE/WEBP", accepts: true},
+		{name: "spaces", accept: "image/png , image/webp ; q=0.5", accepts: true},
+		{name: "zero quality", accept: "image/webp;q=0"},
+		{name: "invalid quality", accept: "image/webp;q=a"},
+		{name: "prefix", accept: "image/webpx"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if accepts := acceptsType(test.accept, "image/webp"); accepts != test.accepts {
+				t.Fatalf("Unexpected result %v for %q", accepts, test.accept)
+			}
+		})
+	}
+}
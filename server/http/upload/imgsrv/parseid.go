@@ -8,7 +8,6 @@ import (
 
 	"github.com/diamondburned/smolboard/server/http/internal/tx"
 	"github.com/go-chi/chi"
-	"github.com/pkg/errors"
 )
 
 type ctxKey uint8
@@ -24,7 +23,7 @@ func parseID(next http.Handler) http.Handler {
 
 		i, err := strconv.ParseInt(trimExt(fileName), 10, 64)
 		if err != nil {
-			tx.RenderError(w, errors.Wrap(err, "Failed to parse post ID"))
+			tx.RenderWrap(w, r, err, 400, "Failed to parse post ID")
 			return
 		}
 
@@ -0,0 +1,69 @@
+package imgsrv
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/http/upload"
+	"github.com/diamondburned/smolboard/server/http/upload/imgsrv/thumbcache"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/pkg/errors"
+)
+
+// regenerateLogEvery is the number of posts between each progress log of
+// RegenerateThumbnails.
+const regenerateLogEvery = 100
+
+// RegenerateThumbnails renders and caches the default thumbnail of every post
+// that doesn't have one yet, or of all posts if force is true, so that they
+// don't have to be rendered on the first request. The number of generated
+// thumbnails is returned. Posts whose files are missing or can't be rendered
+// are logged and skipped.
+//
+// Canceling the context stops early. Since generated thumbnails are skipped
+// unless force is true, calling this again resumes where it stopped.
+func RegenerateThumbnails(
+	ctx context.Context, d *db.Database, up upload.UploadConfig, force bool) (int, error) {
+
+	var seen, generated int
+
+	err := d.EachPost(ctx, func(p smolboard.Post) error {
+		if seen++; seen%regenerateLogEvery == 0 {
+			log.Printf("Regenerating thumbnails: %d posts checked, %d generated", seen, generated)
+		}
+
+		// The default size is cached under the file's name.
+		var name = p.Filename()
+
+		if !force {
+			if _, err := thumbcache.Get(name); err == nil {
+				return nil
+			}
+		}
+
+		var path = filepath.Join(up.FileDirectory, name)
+
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("Skipping the thumbnail of %q: %v", name, err)
+			return nil
+		}
+
+		b, err := renderThumbnail(path, defaultThumbSize)
+		if err != nil {
+			log.Printf("Failed to render the thumbnail of %q: %v", name, err)
+			return nil
+		}
+
+		if err := thumbcache.Put(name, b); err != nil {
+			return errors.Wrapf(err, "Failed to cache the thumbnail of %q", name)
+		}
+
+		generated++
+		return nil
+	})
+
+	return generated, err
+}
@@ -0,0 +1,120 @@
+package imgsrv
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/http/upload"
+	"github.com/diamondburned/smolboard/server/http/upload/imgsrv/thumbcache"
+	"github.com/diamondburned/smolboard/smolboard"
+)
+
+func TestRegenerateThumbnails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smolboard-thumbnail-test-")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := db.NewConfig()
+	cfg.Owner = "ひめありかわ"
+	cfg.DatabasePath = filepath.Join(dir, "smolboard.db")
+
+	if err := db.CreateOwner(cfg, "password"); err != nil {
+		t.Fatal("Failed to create owner:", err)
+	}
+
+	d, err := db.NewDatabase(cfg)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	var ctx = context.Background()
+	var session *smolboard.Session
+
+	err = d.AcquireGuest(ctx, func(tx *db.Transaction) (err error) {
+		session, err = tx.Signin(cfg.Owner, "password", "")
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	// The first post has a file, while the second one's file is missing.
+	var posts = []smolboard.Post{
+		db.NewEmptyPost("image/png"),
+		db.NewEmptyPost("image/png"),
+	}
+
+	err = d.Acquire(ctx, session.AuthToken, func(tx *db.Transaction) error {
+		for i := range posts {
+			posts[i].Size = 1
+			if err := tx.SavePost(&posts[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Failed to save posts:", err)
+	}
+
+	for _, post := range posts {
+		var name = post.Filename()
+		t.Cleanup(func() { thumbcache.Delete(name) })
+	}
+
+	up := upload.UploadConfig{FileDirectory: filepath.Join(dir, "files")}
+	if err := os.Mkdir(up.FileDirectory, os.ModePerm); err != nil {
+		t.Fatal("Failed to create file directory:", err)
+	}
+
+	f, err := os.Create(filepath.Join(up.FileDirectory, posts[0].Filename()))
+	if err != nil {
+		t.Fatal("Failed to create file:", err)
+	}
+	err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 800, 600)))
+	f.Close()
+	if err != nil {
+		t.Fatal("Failed to encode image:", err)
+	}
+
+	n, err := RegenerateThumbnails(ctx, d, up, false)
+	if err != nil {
+		t.Fatal("Failed to regenerate thumbnails:", err)
+	}
+	if n != 1 {
+		t.Fatal("Unexpected number of generated thumbnails:", n)
+	}
+
+	if _, err := thumbcache.Get(posts[0].Filename()); err != nil {
+		t.Fatal("Thumbnail not cached:", err)
+	}
+	if _, err := thumbcache.Get(posts[1].Filename()); err == nil {
+		t.Fatal("Thumbnail cached for a missing file")
+	}
+
+	// The existing thumbnail is only rendered again if forced.
+	if n, _ := RegenerateThumbnails(ctx, d, up, false); n != 0 {
+		t.Fatal("Existing thumbnail regenerated without force:", n)
+	}
+	if n, _ := RegenerateThumbnails(ctx, d, up, true); n != 1 {
+		t.Fatal("Existing thumbnail not regenerated with force:", n)
+	}
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if _, err := RegenerateThumbnails(ctx, d, up, true); err != context.Canceled {
+			t.Fatal("Unexpected error with a canceled context:", err)
+		}
+	})
+}
@@ -35,6 +35,18 @@ func Put(name string, b []byte) error {
 	return thumbCache.Write(name, b)
 }
 
+// VariantName returns the cache name of a thumbnail of the file with the given
+// variant, such as its size.
+func VariantName(name, variant string) string {
+	return name + "@" + variant
+}
+
+// Delete deletes the thumbnail of the file with the given name, including all
+// of its variants.
 func Delete(name string) error {
+	for key := range thumbCache.KeysPrefix(VariantName(name, ""), nil) {
+		thumbCache.Erase(key)
+	}
+
 	return thumbCache.Erase(name)
 }
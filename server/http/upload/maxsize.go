@@ -50,3 +50,20 @@ func (c MaxSize) SizeLimit(ctype string) (bytes datasize.ByteSize) {
 	}
 	return
 }
+
+// capped returns a copy of the overrides with none of them over max.
+func (c MaxSize) capped(max datasize.ByteSize) MaxSize {
+	var cpy = MaxSize{
+		vals: make(map[string]datasize.ByteSize, len(c.vals)),
+		keys: c.keys,
+	}
+
+	for k, v := range c.vals {
+		if v > max {
+			v = max
+		}
+		cpy.vals[k] = v
+	}
+
+	return cpy
+}
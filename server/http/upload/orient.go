@@ -0,0 +1,191 @@
+package upload
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// OrientedJPEGQuality is the quality that JPEGs are re-encoded with after being
+// rotated to match their EXIF orientation.
+const OrientedJPEGQuality = 95
+
+// orientation is the EXIF orientation tag's value. Values 2 to 8 require the
+// image to be flipped, rotated or both to be displayed correctly.
+type orientation uint16
+
+const (
+	orientationUnspecified orientation = 0
+	orientationNormal      orientation = 1
+	orientationTranspose   orientation = 8 // largest valid value
+)
+
+// fixOrientation physically rotates the JPEG at the given path according to
+// its EXIF orientation tag, so that clients ignoring the tag still display it
+// correctly. The rotated image is re-encoded without any EXIF data, which
+// clears the tag. True is returned if the file was changed.
+func fixOrientation(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to open file")
+	}
+	defer f.Close()
+
+	if o := readOrientation(bufio.NewReader(f)); o <= orientationNormal || o > orientationTranspose {
+		return false, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, errors.Wrap(err, "Failed to rewind file")
+	}
+
+	i, err := imaging.Decode(f, imaging.AutoOrientation(true))
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to decode image")
+	}
+
+	// Early close.
+	f.Close()
+
+	var dir, file = filepath.Split(path)
+	var tmp = filepath.Join(dir, ".oriented."+file)
+
+	w, err := os.Create(tmp)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to create file")
+	}
+
+	err = imaging.Encode(w, i, imaging.JPEG, imaging.JPEGQuality(OrientedJPEGQuality))
+	w.Close()
+
+	if err != nil {
+		os.Remove(tmp)
+		return false, errors.Wrap(err, "Failed to encode image")
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, errors.Wrap(err, "Failed to replace file")
+	}
+
+	return true, nil
+}
+
+// readOrientation reads the EXIF orientation tag of a JPEG.
+// orientationUnspecified is returned if the tag can't be found.
+func readOrientation(r io.Reader) orientation {
+	const (
+		markerSOI      = 0xffd8
+		markerAPP1     = 0xffe1
+		exifHeader     = 0x45786966 // "Exif"
+		byteOrderBE    = 0x4d4d
+		byteOrderLE    = 0x4949
+		orientationTag = 0x0112
+	)
+
+	var soi uint16
+	if err := binary.Read(r, binary.BigEndian, &soi); err != nil || soi != markerSOI {
+		return orientationUnspecified
+	}
+
+	// Skip to the APP1 segment, which holds the EXIF data.
+	for {
+		var marker, size uint16
+		if err := binary.Read(r, binary.BigEndian, &marker); err != nil {
+			return orientationUnspecified
+		}
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return orientationUnspecified
+		}
+		if marker>>8 != 0xff || size < 2 {
+			return orientationUnspecified
+		}
+		if marker == markerAPP1 {
+			break
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size-2)); err != nil {
+			return orientationUnspecified
+		}
+	}
+
+	// The EXIF header is "Exif" followed by 2 null bytes.
+	var header uint32
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil || header != exifHeader {
+		return orientationUnspecified
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, 2); err != nil {
+		return orientationUnspecified
+	}
+
+	// The TIFF header starts with the byte order, which all following offsets
+	// and values use.
+	var byteOrderTag uint16
+	var byteOrder binary.ByteOrder
+
+	if err := binary.Read(r, binary.BigEndian, &byteOrderTag); err != nil {
+		return orientationUnspecified
+	}
+
+	switch byteOrderTag {
+	case byteOrderBE:
+		byteOrder = binary.BigEndian
+	case byteOrderLE:
+		byteOrder = binary.LittleEndian
+	default:
+		return orientationUnspecified
+	}
+
+	// Skip the magic number, then jump to the first IFD. The offset counts
+	// from the start of the TIFF header, which is 8 bytes behind.
+	if _, err := io.CopyN(ioutil.Discard, r, 2); err != nil {
+		return orientationUnspecified
+	}
+
+	var offset uint32
+	if err := binary.Read(r, byteOrder, &offset); err != nil || offset < 8 {
+		return orientationUnspecified
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(offset-8)); err != nil {
+		return orientationUnspecified
+	}
+
+	var entries uint16
+	if err := binary.Read(r, byteOrder, &entries); err != nil {
+		return orientationUnspecified
+	}
+
+	// Each entry is 12 bytes: the tag, the type, the count, then the value.
+	for i := uint16(0); i < entries; i++ {
+		var tag uint16
+		if err := binary.Read(r, byteOrder, &tag); err != nil {
+			return orientationUnspecified
+		}
+
+		if tag != orientationTag {
+			if _, err := io.CopyN(ioutil.Discard, r, 10); err != nil {
+				return orientationUnspecified
+			}
+			continue
+		}
+
+		// Skip the type and count, as the orientation is always 1 SHORT.
+		if _, err := io.CopyN(ioutil.Discard, r, 6); err != nil {
+			return orientationUnspecified
+		}
+
+		var o uint16
+		if err := binary.Read(r, byteOrder, &o); err != nil {
+			return orientationUnspecified
+		}
+
+		return orientation(o)
+	}
+
+	return orientationUnspecified
+}
@@ -0,0 +1,130 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// writeOrientedJPEG writes a 32x16 JPEG with a red top-left corner and the
+// given EXIF orientation. The tag is omitted if o is 0.
+func writeOrientedJPEG(t *testing.T, path string, o orientation) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 8, 8), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal("Failed to encode JPEG:", err)
+	}
+
+	b := buf.Bytes()
+
+	if o != orientationUnspecified {
+		var exif bytes.Buffer
+		exif.WriteString("Exif\x00\x00")
+		exif.WriteString("MM\x00\x2a")                   // big endian TIFF
+		binary.Write(&exif, binary.BigEndian, uint32(8)) // IFD offset
+		binary.Write(&exif, binary.BigEndian, uint16(1)) // entries
+		binary.Write(&exif, binary.BigEndian, uint16(0x0112))
+		binary.Write(&exif, binary.BigEndian, uint16(3)) // SHORT
+		binary.Write(&exif, binary.BigEndian, uint32(1)) // count
+		binary.Write(&exif, binary.BigEndian, uint16(o))
+		binary.Write(&exif, binary.BigEndian, uint16(0)) // padding
+		binary.Write(&exif, binary.BigEndian, uint32(0)) // next IFD
+
+		var app1 bytes.Buffer
+		binary.Write(&app1, binary.BigEndian, uint16(0xffe1))
+		binary.Write(&app1, binary.BigEndian, uint16(exif.Len()+2))
+		app1.Write(exif.Bytes())
+
+		// Insert the segment right after the SOI marker.
+		b = append(b[:2:2], append(app1.Bytes(), b[2:]...)...)
+	}
+
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal("Failed to write JPEG:", err)
+	}
+}
+
+func TestFixOrientation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smolboard-orient-test-")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// corner is the expected corner of the red square after rotation, where
+	// 0 is the top or left and 1 is the bottom or right.
+	type corner struct{ x, y int }
+
+	var tests = []struct {
+		o      orientation
+		w, h   int
+		red    corner
+		change bool
+	}{
+		{orientationUnspecified, 32, 16, corner{0, 0}, false},
+		{1, 32, 16, corner{0, 0}, false},
+		{2, 32, 16, corner{1, 0}, true},
+		{3, 32, 16, corner{1, 1}, true},
+		{4, 32, 16, corner{0, 1}, true},
+		{5, 16, 32, corner{0, 0}, true},
+		{6, 16, 32, corner{1, 0}, true},
+		{7, 16, 32, corner{1, 1}, true},
+		{8, 16, 32, corner{0, 1}, true},
+	}
+
+	for _, test := range tests {
+		var path = filepath.Join(dir, string(rune('0'+test.o))+".jpg")
+		writeOrientedJPEG(t, path, test.o)
+
+		changed, err := fixOrientation(path)
+		if err != nil {
+			t.Fatalf("Failed to fix orientation %d: %v", test.o, err)
+		}
+		if changed != test.change {
+			t.Errorf("Orientation %d: changed = %v, expected %v", test.o, changed, test.change)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("Failed to open fixed file:", err)
+		}
+
+		if o := readOrientation(f); test.change && o != orientationUnspecified {
+			t.Errorf("Orientation %d: tag not cleared, got %d", test.o, o)
+		}
+		f.Close()
+
+		// Decode without applying the tag, as clients that ignore it would.
+		img, err := imaging.Open(path)
+		if err != nil {
+			t.Fatal("Failed to decode fixed file:", err)
+		}
+
+		if b := img.Bounds(); b.Dx() != test.w || b.Dy() != test.h {
+			t.Errorf("Orientation %d: size %dx%d, expected %dx%d",
+				test.o, b.Dx(), b.Dy(), test.w, test.h)
+		}
+
+		// Sample the middle of the expected corner's square.
+		x := 4 + test.red.x*(test.w-8)
+		y := 4 + test.red.y*(test.h-8)
+
+		if r, g, b, _ := img.At(x, y).RGBA(); r>>8 < 200 || g>>8 > 50 || b>>8 > 50 {
+			t.Errorf("Orientation %d: pixel at (%d, %d) is not red", test.o, x, y)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/http/upload/imgsrv/thumbcache"
+	"github.com/pkg/errors"
+)
+
+// OrphanGracePeriod is how long a file must be left untouched before it can be
+// considered orphaned. Files of uploads in progress are written before their
+// posts are saved, so they would otherwise look orphaned.
+const OrphanGracePeriod = time.Hour
+
+// FindOrphanedFiles returns the names of the files in the file directory that
+// don't belong to any post, including soft-deleted ones. Files that aren't
+// named after a post ID are never touched. Only administrators can do this.
+func (c UploadConfig) FindOrphanedFiles(tx *db.Transaction) ([]string, error) {
+	infos, err := ioutil.ReadDir(c.FileDirectory)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read file directory")
+	}
+
+	var until = time.Now().Add(-OrphanGracePeriod)
+	var names = map[int64][]string{}
+	var ids []int64
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || info.ModTime().After(until) {
+			continue
+		}
+
+		// Files are named after the post ID, optionally followed by the
+		// extension and the variant's extension.
+		var name = info.Name()
+
+		id, err := strconv.ParseInt(strings.SplitN(name, ".", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := names[id]; !ok {
+			ids = append(ids, id)
+		}
+		names[id] = append(names[id], name)
+	}
+
+	missing, err := tx.MissingPostIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, id := range missing {
+		orphans = append(orphans, names[id]...)
+	}
+
+	return orphans, nil
+}
+
+// PurgeOrphanedFiles removes the files that FindOrphanedFiles returns. If
+// dryRun is true, then the files are only returned. The number of removed
+// files is returned along with the files. Only administrators can do this.
+func (c UploadConfig) PurgeOrphanedFiles(tx *db.Transaction, dryRun bool) ([]string, int, error) {
+	orphans, err := c.FindOrphanedFiles(tx)
+	if err != nil || dryRun {
+		return orphans, 0, err
+	}
+
+	var purged int
+
+	for _, name := range orphans {
+		err := os.Remove(filepath.Join(c.FileDirectory, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return orphans, purged, errors.Wrapf(err, "Failed to remove %q", name)
+		}
+
+		// Make sure the thumbnail is not cached anymore.
+		thumbcache.Delete(name)
+
+		purged++
+	}
+
+	return orphans, purged, nil
+}
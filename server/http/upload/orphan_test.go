@@ -0,0 +1,164 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/smolboard"
+	"github.com/go-test/deep"
+)
+
+func TestOrphanedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smolboard-orphan-test-")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := db.NewConfig()
+	cfg.Owner = "ひめありかわ"
+	cfg.DatabasePath = filepath.Join(dir, "smolboard.db")
+
+	if err := db.CreateOwner(cfg, "password"); err != nil {
+		t.Fatal("Failed to create owner:", err)
+	}
+
+	d, err := db.NewDatabase(cfg)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	var ctx = context.Background()
+	var session *smolboard.Session
+	var post = db.NewEmptyPost("image/png")
+
+	err = d.AcquireGuest(ctx, func(tx *db.Transaction) (err error) {
+		session, err = tx.Signin(cfg.Owner, "password", "")
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to sign in:", err)
+	}
+
+	err = d.Acquire(ctx, session.AuthToken, func(tx *db.Transaction) error {
+		post.Size = 1
+		return tx.SavePost(&post)
+	})
+	if err != nil {
+		t.Fatal("Failed to save post:", err)
+	}
+
+	up := UploadConfig{FileDirectory: filepath.Join(dir, "files")}
+	if err := os.Mkdir(up.FileDirectory, os.ModePerm); err != nil {
+		t.Fatal("Failed to create file directory:", err)
+	}
+
+	var orphanID = strconv.FormatInt(post.ID+1, 10)
+	var old = time.Now().Add(-2 * OrphanGracePeriod)
+
+	// plant writes a file that was last modified at the given time.
+	var plant = func(name string, modTime time.Time) {
+		t.Helper()
+
+		var path = filepath.Join(up.FileDirectory, name)
+
+		if err := ioutil.WriteFile(path, []byte("ひめ"), 0644); err != nil {
+			t.Fatal("Failed to write file:", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal("Failed to change file times:", err)
+		}
+	}
+
+	plant(post.Filename(), old)
+	plant(post.Filename()+".webp", old)
+	plant(orphanID+".png", old)
+	plant(orphanID+".png.webp", old)
+	plant("notes.txt", old)
+	// An upload in progress, which has no post yet.
+	plant(strconv.FormatInt(post.ID+2, 10)+".png", time.Now())
+
+	var expect = []string{orphanID + ".png", orphanID + ".png.webp"}
+
+	// check runs fn in an owner transaction and checks the returned files.
+	var check = func(t *testing.T, fn func(tx *db.Transaction) ([]string, error)) {
+		t.Helper()
+
+		var files []string
+
+		err := d.Acquire(ctx, session.AuthToken, func(tx *db.Transaction) (err error) {
+			files, err = fn(tx)
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to get orphaned files:", err)
+		}
+
+		sort.Strings(files)
+
+		if eq := deep.Equal(files, expect); eq != nil {
+			t.Fatal("Unexpected orphaned files:", eq)
+		}
+	}
+
+	t.Run("Find", func(t *testing.T) {
+		check(t, up.FindOrphanedFiles)
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		check(t, func(tx *db.Transaction) ([]string, error) {
+			files, n, err := up.PurgeOrphanedFiles(tx, true)
+			if err == nil && n != 0 {
+				t.Fatal("Files purged in a dry run:", n)
+			}
+			return files, err
+		})
+
+		for _, name := range expect {
+			if _, err := os.Stat(filepath.Join(up.FileDirectory, name)); err != nil {
+				t.Fatal("Orphan removed in a dry run:", err)
+			}
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		check(t, func(tx *db.Transaction) ([]string, error) {
+			files, n, err := up.PurgeOrphanedFiles(tx, false)
+			if err == nil && n != len(expect) {
+				t.Fatal("Unexpected number of purged files:", n)
+			}
+			return files, err
+		})
+
+		infos, err := ioutil.ReadDir(up.FileDirectory)
+		if err != nil {
+			t.Fatal("Failed to read file directory:", err)
+		}
+
+		if len(infos) != 4 {
+			t.Fatal("Unexpected number of files left:", len(infos))
+		}
+
+		expect = nil
+		check(t, up.FindOrphanedFiles)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		err := d.AcquireGuest(ctx, func(tx *db.Transaction) error {
+			_, err := up.FindOrphanedFiles(tx)
+			return err
+		})
+		if !errors.Is(err, smolboard.ErrActionNotPermitted) {
+			t.Fatal("Unexpected error finding orphans as a guest:", err)
+		}
+	})
+}
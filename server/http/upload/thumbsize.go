@@ -0,0 +1,65 @@
+package upload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ThumbnailSize is the box that a thumbnail is fit into.
+type ThumbnailSize struct {
+	Width  int
+	Height int
+}
+
+// MaxThumbnailSize is the largest width and height of a thumbnail.
+const MaxThumbnailSize = 2048
+
+// ParseThumbnailSize parses a size in the "WxH" format, such as "200x200".
+func ParseThumbnailSize(s string) (ThumbnailSize, error) {
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return ThumbnailSize{}, fmt.Errorf("invalid thumbnail size %q, expected WxH", s)
+	}
+
+	w, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return ThumbnailSize{}, errors.Wrap(err, "invalid thumbnail width")
+	}
+
+	h, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ThumbnailSize{}, errors.Wrap(err, "invalid thumbnail height")
+	}
+
+	size := ThumbnailSize{w, h}
+	if !size.IsValid() {
+		return ThumbnailSize{}, fmt.Errorf(
+			"thumbnail size %q must be between 1x1 and %[2]dx%[2]d", s, MaxThumbnailSize)
+	}
+
+	return size, nil
+}
+
+// IsValid returns true if the size is positive and not over MaxThumbnailSize.
+func (s ThumbnailSize) IsValid() bool {
+	return s.Width > 0 && s.Width <= MaxThumbnailSize &&
+		s.Height > 0 && s.Height <= MaxThumbnailSize
+}
+
+func (s ThumbnailSize) String() string {
+	return fmt.Sprintf("%dx%d", s.Width, s.Height)
+}
+
+// ThumbnailSizeAllowed returns true if thumbnails of the given size can be
+// requested.
+func (c UploadConfig) ThumbnailSizeAllowed(size ThumbnailSize) bool {
+	for _, allowed := range c.ThumbnailSizes {
+		if s, err := ParseThumbnailSize(allowed); err == nil && s == size {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package upload
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -43,11 +45,53 @@ type UploadConfig struct {
 	MaxFileSize   datasize.ByteSize `toml:"maxFileSize"`
 	AllowedTypes  []string          `toml:"allowedTypes"`
 	MaxSize       MaxSize
+	// AnonymousMaxFileSize caps the size of all files uploaded without an
+	// account, regardless of the other limits.
+	AnonymousMaxFileSize datasize.ByteSize `toml:"anonymousMaxFileSize"`
+	// WebPVariants, if true, makes uploaded JPEG and PNG images also be saved
+	// as WebP, which is served instead to clients that accept it. This
+	// requires an FFmpeg built with libwebp.
+	WebPVariants bool `toml:"webpVariants"`
+	// ThumbnailSizes are the sizes in the "WxH" format that thumbnails can be
+	// requested in on top of the default size. Each requested size is
+	// rendered and cached on its own, so this should be kept short.
+	ThumbnailSizes []string `toml:"thumbnailSizes"`
+
+	// ExternalPosts, if true, allows posts that link to media hosted elsewhere
+	// instead of uploading it. The media is only ever downloaded by the
+	// server if ExternalThumbnails or ExternalProxy is true, which lets users
+	// make the server request any URL.
+	ExternalPosts bool `toml:"externalPosts"`
+	// ExternalThumbnails, if true, downloads the media of new external posts
+	// once to make their thumbnail, dimensions and blurhash. The media itself
+	// is not kept. Thumbnails redirect to the media otherwise.
+	ExternalThumbnails bool `toml:"externalThumbnails"`
+	// ExternalProxy, if true, serves external posts by proxying their media
+	// instead of redirecting to it, which hides the clients from the media's
+	// host.
+	ExternalProxy bool `toml:"externalProxy"`
+	// ExternalPrivateAddresses, if true, allows external media to be fetched
+	// from addresses that aren't public, such as loopback and private
+	// networks. It should only be enabled if every user is trusted, since the
+	// server could otherwise be used to reach internal services.
+	ExternalPrivateAddresses bool `toml:"externalPrivateAddresses"`
+}
+
+// WebPQuality is the quality of generated WebP variants.
+const WebPQuality = 80
+
+// webpTypes are the content types that benefit from a WebP variant. Animated
+// images are skipped, since only the first frame would be kept.
+var webpTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
 }
 
 func NewConfig() UploadConfig {
 	return UploadConfig{
-		MaxFileSize: 500 * datasize.MB,
+		MaxFileSize:          500 * datasize.MB,
+		AnonymousMaxFileSize: 10 * datasize.MB,
+		ThumbnailSizes:       []string{"200x200", "800x800"},
 		AllowedTypes: []string{
 			"image/jpeg", "image/png", "image/gif", "image/webp",
 			"video/avi", "video/mp4", "video/webm",
@@ -67,9 +111,25 @@ func (c *UploadConfig) Validate() error {
 		}
 	}
 
+	for _, size := range c.ThumbnailSizes {
+		if _, err := ParseThumbnailSize(size); err != nil {
+			return errors.Wrap(err, "invalid thumbnailSizes")
+		}
+	}
+
 	return nil
 }
 
+// Anonymous returns a copy of the config for uploads without an account, which
+// has all of its size limits capped to AnonymousMaxFileSize.
+func (c UploadConfig) Anonymous() UploadConfig {
+	if c.AnonymousMaxFileSize > 0 && c.MaxFileSize > c.AnonymousMaxFileSize {
+		c.MaxFileSize = c.AnonymousMaxFileSize
+	}
+	c.MaxSize = c.MaxSize.capped(c.MaxFileSize)
+	return c
+}
+
 // CleanupPost cleans up a single post asynchronously.
 func (c UploadConfig) CleanupPost(post smolboard.Post) {
 	c.CleanupPosts([]*smolboard.Post{&post})
@@ -90,12 +150,28 @@ func (c UploadConfig) CleanupPosts(posts []*smolboard.Post) {
 
 				// Make sure the thumbnail is not cached anymore.
 				thumbcache.Delete(fil)
+
+				// Remove the WebP variant if there's any.
+				err = os.Remove(filepath.Join(c.FileDirectory, webpVariant(*post)))
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("Failed to cleanup %q's WebP variant: %v", fil, err)
+				}
+
+				// Remove the fetched thumbnail of external posts.
+				err = os.Remove(filepath.Join(c.FileDirectory, externalThumbnail(*post)))
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("Failed to cleanup %q's thumbnail: %v", fil, err)
+				}
 			}
 		}
 	}()
 }
 
-func (c UploadConfig) CreatePosts(headers []*multipart.FileHeader) ([]*smolboard.Post, error) {
+// CreatePosts downloads the given files into new posts with IDs from the given
+// generator.
+func (c UploadConfig) CreatePosts(
+	ids db.IDGenerator, headers []*multipart.FileHeader) ([]*smolboard.Post, error) {
+
 	if len(headers) > MaxFiles {
 		return nil, ErrTooManyFiles
 	}
@@ -124,7 +200,7 @@ func (c UploadConfig) CreatePosts(headers []*multipart.FileHeader) ([]*smolboard
 
 		// This creates at best 128 goroutines at once.
 		errgp.Go(func() error {
-			p, err := c.createPost(headers[i])
+			p, err := c.createPost(ids, headers[i])
 			if err != nil {
 				return err
 			}
@@ -144,7 +220,9 @@ func (c UploadConfig) CreatePosts(headers []*multipart.FileHeader) ([]*smolboard
 	return posts, nil
 }
 
-func (c UploadConfig) createPost(header *multipart.FileHeader) (*smolboard.Post, error) {
+func (c UploadConfig) createPost(
+	ids db.IDGenerator, header *multipart.FileHeader) (*smolboard.Post, error) {
+
 	// Open the temporary file to read from.
 	f, err := header.Open()
 	if err != nil {
@@ -159,17 +237,56 @@ func (c UploadConfig) createPost(header *multipart.FileHeader) (*smolboard.Post,
 	}
 
 	// Create a new empty post.
-	p := db.NewEmptyPost(r.CType)
+	p := db.NewEmptyPostFrom(ids, r.CType)
+
+	// Hash the file as it was uploaded, since it may be rotated below, so that
+	// clients can find it by hashing their own copy.
+	h := sha256.New()
 
 	// Download the file atomically.
-	if err := atomdl.Download(r, c.FileDirectory, &p); err != nil {
+	if err := atomdl.Download(io.TeeReader(r, h), c.FileDirectory, &p); err != nil {
 		return nil, errors.Wrap(err, "Failed to save file")
 	}
 
+	p.ContentHash = hex.EncodeToString(h.Sum(nil))
+
 	var downloaded = filepath.Join(c.FileDirectory, p.Filename())
 
+	// Rotate the image to its EXIF orientation. A file that can't be rotated
+	// still works for clients that read the tag, so errors aren't fatal.
+	if p.ContentType == "image/jpeg" {
+		changed, err := fixOrientation(downloaded)
+		if err != nil {
+			log.Printf("Failed to fix the orientation of %q: %v", p.Filename(), err)
+		}
+
+		if changed {
+			s, err := os.Stat(downloaded)
+			if err != nil {
+				os.Remove(downloaded)
+				return nil, errors.Wrap(err, "Failed to stat rotated file")
+			}
+			p.Size = s.Size()
+		}
+	}
+
+	setAttributes(&p, downloaded)
+
+	// A missing variant only costs bandwidth, so errors aren't fatal.
+	if c.WebPVariants && webpTypes[p.ContentType] {
+		if err := c.createWebPVariant(p); err != nil {
+			log.Printf("Failed to create WebP variant of %q: %v", p.Filename(), err)
+		}
+	}
+
+	return &p, nil
+}
+
+// setAttributes sets the post's dimensions and blurhash from the file at the
+// given path. Files that can't be parsed are left without them.
+func setAttributes(p *smolboard.Post, path string) {
 	// Try parsing the file as an image.
-	i, err := imaging.Open(downloaded, imaging.AutoOrientation(true))
+	i, err := imaging.Open(path, imaging.AutoOrientation(true))
 	if err == nil {
 		bounds := i.Bounds()
 		p.Attributes.Width = bounds.Dx()
@@ -185,13 +302,13 @@ func (c UploadConfig) createPost(header *multipart.FileHeader) (*smolboard.Post,
 	} else {
 		// Failed to parse above as a normal image. Resort to shelling out, if
 		// possible.
-		s, err := ff.ProbeSize(downloaded)
+		s, err := ff.ProbeSize(path)
 		if err == nil {
 			p.Attributes.Width = s.Width
 			p.Attributes.Height = s.Height
 		}
 
-		i, err := ff.FirstFrame(downloaded, 50, 50, ff.NeighborScaler)
+		i, err := ff.FirstFrame(path, 50, 50, ff.NeighborScaler)
 		if err == nil {
 			h, err := blurhash.Encode(4, 3, i)
 			if err == nil {
@@ -199,8 +316,50 @@ func (c UploadConfig) createPost(header *multipart.FileHeader) (*smolboard.Post,
 			}
 		}
 	}
+}
 
-	return &p, nil
+// createWebPVariant encodes the post's file into WebP. The variant is not kept
+// if it is larger than the original.
+func (c UploadConfig) createWebPVariant(p smolboard.Post) error {
+	var src = filepath.Join(c.FileDirectory, p.Filename())
+	var dst = filepath.Join(c.FileDirectory, webpVariant(p))
+	var tmp = filepath.Join(c.FileDirectory, "."+webpVariant(p))
+
+	if err := ff.EncodeWebP(src, tmp, WebPQuality); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to stat variant")
+	}
+
+	if s.Size() >= p.Size {
+		os.Remove(tmp)
+		return nil
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to move variant")
+	}
+
+	return nil
+}
+
+// WebPVariantPath returns the path to the post's WebP variant, or an empty
+// string if the post can't have one. The file may not exist.
+func (c UploadConfig) WebPVariantPath(p smolboard.Post) string {
+	if !c.WebPVariants || !webpTypes[p.ContentType] {
+		return ""
+	}
+	return filepath.Join(c.FileDirectory, webpVariant(p))
+}
+
+func webpVariant(p smolboard.Post) string {
+	return p.Filename() + ".webp"
 }
 
 // WrapReader wraps the given reader and restrict its MIME type as well as
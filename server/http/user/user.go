@@ -1,9 +1,12 @@
 package user
 
 import (
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/diamondburned/duration"
 	"github.com/diamondburned/smolboard/server/http/internal/form"
 	"github.com/diamondburned/smolboard/server/http/internal/limit"
 	"github.com/diamondburned/smolboard/server/http/internal/tx"
@@ -14,10 +17,15 @@ import (
 )
 
 func Mount(m tx.Middlewarer) http.Handler {
+	admin := tx.RequirePermission(m, smolboard.PermissionAdministrator)
+	owner := tx.RequirePermission(m, smolboard.PermissionOwner)
+
 	mux := chi.NewMux()
 	mux.Use(limit.RateLimit(32))
 
-	mux.Get("/", m(GetUsers))
+	mux.Get("/", admin(GetUsers))
+	mux.Get("/@pending", admin(GetPendingUsers))
+	mux.Post("/@prune", owner(PruneInactiveUsers))
 
 	mux.Route("/{username}", func(r chi.Router) {
 		r.Get("/", m(GetUser))
@@ -25,6 +33,21 @@ func Mount(m tx.Middlewarer) http.Handler {
 		r.Delete("/", m(DeleteUser))
 
 		r.Patch("/permission", m(PromoteUser))
+		r.Post("/impersonate", owner(ImpersonateUser))
+		r.Post("/revoke-sessions", m(RevokeUserSessions))
+		r.Post("/transfer-posts", admin(TransferUserPosts))
+		r.Get("/quota", m(GetQuota))
+		r.Put("/quota", admin(SetQuota))
+		r.Delete("/quota", admin(ResetQuota))
+		r.Post("/approve", admin(ApproveUser))
+		r.Post("/reject", admin(RejectUser))
+		r.Put("/email", m(SetEmail)) // only @me
+
+		r.Route("/api-keys", func(r chi.Router) { // only @me
+			r.Get("/", m(GetAPIKeys))
+			r.Post("/", m(CreateAPIKey))
+			r.Delete(`/{keyID:\d+}`, m(RevokeAPIKey))
+		})
 
 		r.Route("/sessions", func(r chi.Router) {
 			r.Get("/", m(GetSessions))
@@ -33,6 +56,7 @@ func Mount(m tx.Middlewarer) http.Handler {
 			// {sessionID} or @this
 			r.Route(`/{sessionID:(\d+|@this)}`, func(r chi.Router) {
 				r.Get("/", m(GetSession))
+				r.Patch("/", m(RenameSession))
 				r.Delete("/", m(DeleteSession))
 			})
 		})
@@ -41,6 +65,21 @@ func Mount(m tx.Middlewarer) http.Handler {
 	return mux
 }
 
+// MountSessions mounts the routes for looking up any user's session.
+func MountSessions(m tx.Middlewarer) http.Handler {
+	admin := tx.RequirePermission(m, smolboard.PermissionAdministrator)
+	owner := tx.RequirePermission(m, smolboard.PermissionOwner)
+
+	mux := chi.NewMux()
+	mux.Get("/keepalive", m(KeepAlive))
+	mux.Post("/rotate", m(RotateToken))
+	mux.Get(`/{sessionID:\d+}`, admin(GetSessionByID))
+	mux.Delete(`/{sessionID:\d+}`, admin(AdminDeleteSession))
+	mux.Post("/expire-all", owner(ExpireAllSessions))
+
+	return mux
+}
+
 func username(r tx.Request) string {
 	var username = r.Param("username")
 	if username == "@me" {
@@ -79,6 +118,11 @@ func GetUsers(r tx.Request) (interface{}, error) {
 }
 
 func GetUser(r tx.Request) (interface{}, error) {
+	// Only the current user gets their counts.
+	if r.Param("username") == "@me" {
+		return r.Tx.Me()
+	}
+
 	return r.Tx.User(username(r))
 }
 
@@ -131,8 +175,21 @@ func GetCurrentSession(r tx.Request) (interface{}, error) {
 	return r.Tx.Session, nil
 }
 
+// SessionsParams is the URL parameter for session listing pagination. All
+// sessions are listed if the count is 0.
+type SessionsParams struct {
+	Count uint `schema:"c"`
+	Page  uint `schema:"p"`
+}
+
 func GetSessions(r tx.Request) (interface{}, error) {
-	return r.Tx.Sessions()
+	var p SessionsParams
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, errors.Wrap(err, "Invalid form")
+	}
+
+	return r.Tx.SessionList(p.Count, p.Page)
 }
 
 func GetSession(r tx.Request) (interface{}, error) {
@@ -150,7 +207,69 @@ func DeleteSession(r tx.Request) (interface{}, error) {
 		return nil, errors.Wrap(err, "Failed to parse session ID")
 	}
 
-	return nil, r.Tx.DeleteSessionID(i)
+	if err := r.Tx.DeleteSessionID(i); err != nil {
+		return nil, err
+	}
+
+	// Deleting the current session is signing out, so clear the cookie too.
+	if i == r.Tx.Session.ID {
+		r.SetSession(nil)
+	}
+
+	return nil, nil
+}
+
+type SessionRename struct {
+	Name string `schema:"name"`
+}
+
+// KeepAlive renews the current session like any other request would, then
+// returns it with the new deadline.
+func KeepAlive(r tx.Request) (interface{}, error) {
+	return r.Tx.KeepAlive()
+}
+
+// RotateToken replaces the current session's token. The cookie is updated with
+// the new token along with the response.
+func RotateToken(r tx.Request) (interface{}, error) {
+	return r.Tx.RotateToken()
+}
+
+func GetSessionByID(r tx.Request) (interface{}, error) {
+	i, err := sessionID(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse session ID")
+	}
+
+	return r.Tx.SessionByID(i)
+}
+
+func AdminDeleteSession(r tx.Request) (interface{}, error) {
+	i, err := sessionID(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse session ID")
+	}
+
+	return nil, r.Tx.AdminDeleteSession(i)
+}
+
+func RenameSession(r tx.Request) (interface{}, error) {
+	i, err := sessionID(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse session ID")
+	}
+
+	var p SessionRename
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	if err := r.Tx.RenameSession(i, p.Name); err != nil {
+		return nil, err
+	}
+
+	return r.Tx.SessionFromID(i)
 }
 
 func DeleteAllSessions(r tx.Request) (interface{}, error) {
@@ -171,9 +290,247 @@ func PromoteUser(r tx.Request) (interface{}, error) {
 	return nil, r.Tx.PromoteUser(username(r), p.Permission)
 }
 
+func GetPendingUsers(r tx.Request) (interface{}, error) {
+	return r.Tx.PendingUsers()
+}
+
+func ApproveUser(r tx.Request) (interface{}, error) {
+	return nil, r.Tx.ApproveUser(username(r))
+}
+
+func RejectUser(r tx.Request) (interface{}, error) {
+	return nil, r.Tx.RejectUser(username(r))
+}
+
+// ImpersonateUser returns a new session of the user. The current session is
+// kept, so the owner has to use the returned token explicitly.
+func ImpersonateUser(r tx.Request) (interface{}, error) {
+	return r.Tx.ImpersonateUser(username(r))
+}
+
+// RevokeUserSessions signs the user out of all their sessions and revokes their
+// API keys.
+func RevokeUserSessions(r tx.Request) (interface{}, error) {
+	n, err := r.Tx.RevokeUserSessions(username(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.SessionRevokeResult{Revoked: n}, nil
+}
+
+// ExpireAllSessions signs everyone out, including the current user, and revokes
+// all API keys.
+func ExpireAllSessions(r tx.Request) (interface{}, error) {
+	n, err := r.Tx.ExpireAllSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.SessionRevokeResult{Revoked: n}, nil
+}
+
+// onlyMe returns an error if the request's username isn't the current user.
+func onlyMe(r tx.Request) error {
+	if username(r) != r.Tx.Session.Username {
+		return smolboard.ErrActionNotPermitted
+	}
+	return nil
+}
+
+func GetAPIKeys(r tx.Request) (interface{}, error) {
+	if err := onlyMe(r); err != nil {
+		return nil, err
+	}
+
+	return r.Tx.ListAPIKeys()
+}
+
+type APIKeyForm struct {
+	Scope string `schema:"scope,required"`
+	Label string `schema:"label"`
+}
+
+func CreateAPIKey(r tx.Request) (interface{}, error) {
+	if err := onlyMe(r); err != nil {
+		return nil, err
+	}
+
+	var f APIKeyForm
+
+	if err := form.Unmarshal(r, &f); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return r.Tx.CreateAPIKey(f.Scope, f.Label)
+}
+
+func RevokeAPIKey(r tx.Request) (interface{}, error) {
+	if err := onlyMe(r); err != nil {
+		return nil, err
+	}
+
+	i, err := strconv.ParseInt(r.Param("keyID"), 10, 64)
+	if err != nil {
+		return nil, httperr.Wrap(err, 400, "Failed to parse API key ID")
+	}
+
+	return nil, r.Tx.RevokeAPIKey(i)
+}
+
+type PruneForm struct {
+	OlderThan string `schema:"older_than,required"`
+	DryRun    bool   `schema:"dry_run"`
+}
+
+// PruneInactiveUsers deletes users who have no posts and haven't signed in for
+// a while.
+func PruneInactiveUsers(r tx.Request) (interface{}, error) {
+	var f PruneForm
+
+	if err := form.Unmarshal(r, &f); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	age, err := duration.ParseDuration(f.OlderThan)
+	if err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid older_than")
+	}
+
+	u, err := r.Tx.PruneInactiveUsers(time.Duration(age), f.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.UserPruneResult{Usernames: u, DryRun: f.DryRun}, nil
+}
+
+type TransferForm struct {
+	To string `schema:"to,required"`
+}
+
+// TransferUserPosts gives all posts of the user to another user.
+func TransferUserPosts(r tx.Request) (interface{}, error) {
+	var f TransferForm
+
+	if err := form.Unmarshal(r, &f); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	n, err := r.Tx.TransferUserPosts(username(r), f.To)
+	if err != nil {
+		return nil, err
+	}
+
+	return smolboard.PostTransferResult{Transferred: n}, nil
+}
+
+func GetQuota(r tx.Request) (interface{}, error) {
+	return r.Tx.Quota(username(r))
+}
+
+type QuotaForm struct {
+	MaxBytes int64 `schema:"max_bytes"`
+	MaxPosts int   `schema:"max_posts"`
+}
+
+// SetQuota overrides the user's upload quota. Limits of 0 are unlimited.
+func SetQuota(r tx.Request) (interface{}, error) {
+	var f QuotaForm
+
+	if err := form.Unmarshal(r, &f); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	if err := r.Tx.SetUserQuota(username(r), f.MaxBytes, f.MaxPosts); err != nil {
+		return nil, err
+	}
+
+	return r.Tx.Quota(username(r))
+}
+
+// ResetQuota makes the user's upload quota the default again.
+func ResetQuota(r tx.Request) (interface{}, error) {
+	return nil, r.Tx.ResetUserQuota(username(r))
+}
+
+type EmailForm struct {
+	Email string `schema:"email,required"`
+}
+
+func SetEmail(r tx.Request) (interface{}, error) {
+	// Only allow @me.
+	if username(r) != r.Tx.Session.Username {
+		return nil, smolboard.ErrActionNotPermitted
+	}
+
+	var f EmailForm
+
+	if err := form.Unmarshal(r, &f); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return r.Tx.SetEmail(f.Email)
+}
+
+type MailToken struct {
+	Token string `schema:"token,required"`
+}
+
+func VerifyEmail(r tx.Request) (interface{}, error) {
+	var t MailToken
+
+	if err := form.Unmarshal(r, &t); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.VerifyEmail(t.Token)
+}
+
+type PasswordResetRequest struct {
+	Username string `schema:"username,required"`
+}
+
+func RequestPasswordReset(r tx.Request) (interface{}, error) {
+	var p PasswordResetRequest
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	// Don't tell the requester anything about the mail or even whether the
+	// user exists, since anyone can request a reset for anyone.
+	err := r.Tx.RequestPasswordReset(p.Username)
+	switch {
+	case errors.Is(err, smolboard.ErrUserNotFound), errors.Is(err, smolboard.ErrNoEmail):
+		log.Printf("Password reset for %q not sent: %v", p.Username, err)
+	case err != nil:
+		return nil, errors.Wrap(err, "Failed to request password reset")
+	}
+
+	return nil, nil
+}
+
+type PasswordReset struct {
+	MailToken
+	Password string `schema:"password,required"`
+}
+
+func ResetPassword(r tx.Request) (interface{}, error) {
+	var p PasswordReset
+
+	if err := form.Unmarshal(r, &p); err != nil {
+		return nil, httperr.Wrap(err, 400, "Invalid form")
+	}
+
+	return nil, r.Tx.ResetPassword(p.Token, p.Password)
+}
+
 type Authentication struct {
 	Username string `schema:"username,required"`
 	Password string `schema:"password,required"`
+	// Scope is optional and defaults to smolboard.ScopeWrite.
+	Scope string `schema:"scope"`
 }
 
 func Signin(r tx.Request) (interface{}, error) {
@@ -188,7 +545,11 @@ func Signin(r tx.Request) (interface{}, error) {
 		return nil, httperr.Wrap(err, 400, "Invalid form")
 	}
 
-	s, err := r.Tx.Signin(auth.Username, auth.Password, r.UserAgent())
+	if auth.Scope == "" {
+		auth.Scope = smolboard.ScopeWrite
+	}
+
+	s, err := r.Tx.SigninScoped(auth.Username, auth.Password, r.UserAgent(), auth.Scope)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to sign in")
 	}
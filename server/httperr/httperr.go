@@ -2,6 +2,8 @@ package httperr
 
 import (
 	"net/http"
+	"strings"
+	"unicode"
 
 	"github.com/pkg/errors"
 )
@@ -10,6 +12,51 @@ type StatusCoder interface {
 	StatusCode() int
 }
 
+// Slugger is an interface for errors that have a short, stable and
+// machine-readable identifier.
+type Slugger interface {
+	Slug() string
+}
+
+// ErrSlug returns the slug of the error, or an empty string if the error does
+// not have one.
+func ErrSlug(err error) string {
+	var s Slugger
+
+	if errors.As(err, &s) {
+		return s.Slug()
+	}
+
+	return ""
+}
+
+// Slugify makes a slug out of the given error message. Anything after a colon
+// or an opening parenthesis is ignored, as that's usually variable.
+func Slugify(msg string) string {
+	if i := strings.IndexAny(msg, ":("); i > -1 {
+		msg = msg[:i]
+	}
+
+	var b strings.Builder
+	b.Grow(len(msg))
+
+	var dash bool
+
+	for _, r := range strings.TrimSpace(msg) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	return b.String()
+}
+
 func ErrCode(err error) int {
 	var sc StatusCoder
 
@@ -33,12 +80,20 @@ type basicError struct {
 var (
 	_ error       = (*basicError)(nil)
 	_ StatusCoder = (*basicError)(nil)
+	_ Slugger     = (*basicError)(nil)
 )
 
 func New(code int, msg string) error {
 	return basicError{code, msg}
 }
 
+// IsPublic returns true if the error itself was made by New. Its message was
+// written for clients, unlike wrapped errors, which may carry internal details.
+func IsPublic(err error) bool {
+	_, ok := err.(basicError)
+	return ok
+}
+
 func (e basicError) Error() string {
 	return e.msg
 }
@@ -47,6 +102,10 @@ func (e basicError) StatusCode() int {
 	return e.code
 }
 
+func (e basicError) Slug() string {
+	return Slugify(e.msg)
+}
+
 type wrapError struct {
 	code int
 	wrap error
@@ -55,6 +114,7 @@ type wrapError struct {
 var (
 	_ error       = (*wrapError)(nil)
 	_ StatusCoder = (*wrapError)(nil)
+	_ Slugger     = (*wrapError)(nil)
 )
 
 func Wrap(err error, code int, msg string) error {
@@ -78,3 +138,8 @@ func (e wrapError) Error() string {
 func (e wrapError) StatusCode() int {
 	return e.code
 }
+
+// Slug returns the slug of the wrapped error, if any.
+func (e wrapError) Slug() string {
+	return ErrSlug(e.wrap)
+}
@@ -0,0 +1,18 @@
+package httperr
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	var tests = map[string]string{
+		"post not found":              "post-not-found",
+		"tag is too long (max 128)":   "tag-is-too-long",
+		"action not permitted: nope":  "action-not-permitted",
+		"  Weird,  spacing & stuff! ": "weird-spacing-stuff",
+	}
+
+	for msg, slug := range tests {
+		if s := Slugify(msg); s != slug {
+			t.Errorf("Slugify(%q) = %q, expected %q", msg, s, slug)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package httperr
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ValidationSlug is the slug of validation errors.
+const ValidationSlug = "validation-failed"
+
+// Fielder is an interface for errors that are caused by one or more invalid
+// input fields.
+type Fielder interface {
+	// ErrFields returns a map of field names to their error messages.
+	ErrFields() map[string]string
+}
+
+// ErrFields returns the field errors of the error, or nil if the error does not
+// have any.
+func ErrFields(err error) map[string]string {
+	var f Fielder
+
+	if errors.As(err, &f) {
+		return f.ErrFields()
+	}
+
+	return nil
+}
+
+// ValidationError is an error that collects the errors of invalid input
+// fields, so that all of them can be reported at once. Its status code is 422.
+type ValidationError struct {
+	fields map[string]error
+}
+
+var (
+	_ error       = (*ValidationError)(nil)
+	_ StatusCoder = (*ValidationError)(nil)
+	_ Slugger     = (*ValidationError)(nil)
+	_ Fielder     = (*ValidationError)(nil)
+)
+
+// NewValidationError creates an empty validation error.
+func NewValidationError() *ValidationError {
+	return &ValidationError{}
+}
+
+// Add adds the error of the given field. Nil errors are ignored, and only the
+// first error of each field is kept.
+func (v *ValidationError) Add(field string, err error) {
+	if err == nil {
+		return
+	}
+
+	if v.fields == nil {
+		v.fields = map[string]error{}
+	}
+
+	if _, ok := v.fields[field]; !ok {
+		v.fields[field] = err
+	}
+}
+
+// Err returns the validation error, or nil if no field has an error.
+func (v *ValidationError) Err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return v
+}
+
+// Error joins the field errors ordered by the field name.
+func (v *ValidationError) Error() string {
+	var names = make([]string, 0, len(v.fields))
+	for name := range v.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("invalid fields: ")
+
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(v.fields[name].Error())
+	}
+
+	return b.String()
+}
+
+func (v *ValidationError) StatusCode() int {
+	return 422
+}
+
+func (v *ValidationError) Slug() string {
+	return ValidationSlug
+}
+
+func (v *ValidationError) ErrFields() map[string]string {
+	var fields = make(map[string]string, len(v.fields))
+	for name, err := range v.fields {
+		fields[name] = err.Error()
+	}
+	return fields
+}
+
+// Is returns true if any of the field errors is the target, so that callers
+// can still check for a specific error.
+func (v *ValidationError) Is(target error) bool {
+	for _, err := range v.fields {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+// Package mailer provides the interface used by the backend to send emails.
+package mailer
+
+// Mailer is the interface for anything that can send a plain text email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// Noop is a Mailer that silently drops all mails. It is the default mailer if
+// none is configured.
+var Noop Mailer = noop{}
+
+type noop struct{}
+
+func (noop) Send(to, subject, body string) error { return nil }
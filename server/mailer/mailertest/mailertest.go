@@ -0,0 +1,62 @@
+// Package mailertest provides a mock Mailer for testing.
+package mailertest
+
+import (
+	"sync"
+
+	"github.com/diamondburned/smolboard/server/mailer"
+)
+
+// Mail is a single mail sent through the Mock mailer.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mock is a Mailer that records all mails sent through it. A zero-value
+// instance is a valid instance.
+type Mock struct {
+	mutex sync.Mutex
+	mails []Mail
+
+	// Err, if not nil, is returned on every Send call. The mail is not
+	// recorded if Err is set.
+	Err error
+}
+
+var _ mailer.Mailer = (*Mock)(nil)
+
+// Send records the mail or returns Err.
+func (m *Mock) Send(to, subject, body string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.Err != nil {
+		return m.Err
+	}
+
+	m.mails = append(m.mails, Mail{to, subject, body})
+	return nil
+}
+
+// Mails returns a copy of all recorded mails.
+func (m *Mock) Mails() []Mail {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cpy := make([]Mail, len(m.mails))
+	copy(cpy, m.mails)
+	return cpy
+}
+
+// Last returns the last recorded mail. It returns false if there is none.
+func (m *Mock) Last() (Mail, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.mails) == 0 {
+		return Mail{}, false
+	}
+	return m.mails[len(m.mails)-1], true
+}
@@ -0,0 +1,100 @@
+// Package smtpmailer provides a Mailer that sends emails over SMTP.
+package smtpmailer
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"github.com/diamondburned/smolboard/server/mailer"
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	Host     string `toml:"host"`
+	Port     int    `toml:"port"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// From is the sender's address, which may have a display name, such as
+	// "smolboard <noreply@example.com>".
+	From string `toml:"from"`
+}
+
+func NewConfig() Config {
+	return Config{
+		Port: 587,
+	}
+}
+
+// IsZero returns true if the config does not have a host, which means that
+// SMTP should not be used.
+func (c Config) IsZero() bool {
+	return c.Host == ""
+}
+
+func (c *Config) Validate() error {
+	if c.IsZero() {
+		return nil
+	}
+
+	if c.From == "" {
+		return errors.New("missing smtp `from' value")
+	}
+
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return errors.Wrap(err, "invalid smtp `from' value")
+	}
+
+	return nil
+}
+
+// Mailer sends mails using an SMTP server.
+type Mailer struct {
+	addr string
+	from string
+	// envelope is the bare address of from, which is what MAIL FROM takes.
+	envelope string
+	auth     smtp.Auth
+}
+
+var _ mailer.Mailer = (*Mailer)(nil)
+
+// New creates a new SMTP mailer. PLAIN authentication is used if the config has
+// a username.
+func New(cfg Config) *Mailer {
+	m := &Mailer{
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		from:     cfg.From,
+		envelope: cfg.From,
+	}
+
+	// The display name is only kept in the From header.
+	if a, err := mail.ParseAddress(cfg.From); err == nil {
+		m.envelope = a.Address
+	}
+
+	if cfg.Username != "" {
+		m.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	return m
+}
+
+// Send sends a plain text email to the given address.
+func (m *Mailer) Send(to, subject, body string) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(body)
+
+	err := smtp.SendMail(m.addr, m.auth, m.envelope, []string{to}, []byte(msg.String()))
+	return errors.Wrap(err, "Failed to send mail")
+}
@@ -0,0 +1,34 @@
+package smtpmailer
+
+import "testing"
+
+func TestEnvelopeSender(t *testing.T) {
+	var tests = map[string]string{
+		"noreply@example.com":                "noreply@example.com",
+		"smolboard <noreply@example.com>":    "noreply@example.com",
+		`"Hime, Arikawa" <hime@example.com>`: "hime@example.com",
+	}
+
+	for from, envelope := range tests {
+		cfg := NewConfig()
+		cfg.Host = "localhost"
+		cfg.From = from
+
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Failed to validate %q: %v", from, err)
+			continue
+		}
+
+		if m := New(cfg); m.envelope != envelope || m.from != from {
+			t.Errorf("Unexpected sender of %q: envelope %q, header %q", from, m.envelope, m.from)
+		}
+	}
+
+	cfg := NewConfig()
+	cfg.Host = "localhost"
+	cfg.From = "not an address"
+
+	if err := cfg.Validate(); err == nil {
+		t.Error("No error validating an invalid from address")
+	}
+}
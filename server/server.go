@@ -1,8 +1,14 @@
 package server
 
 import (
+	"context"
+	"time"
+
 	"github.com/diamondburned/smolboard/server/db"
+	"github.com/diamondburned/smolboard/server/db/redisstore"
 	"github.com/diamondburned/smolboard/server/http"
+	"github.com/diamondburned/smolboard/server/http/upload/imgsrv"
+	"github.com/diamondburned/smolboard/smolboard"
 	"github.com/pkg/errors"
 )
 
@@ -10,12 +16,16 @@ import (
 type Config struct {
 	db.DBConfig
 	http.HTTPConfig
+
+	// Redis, if configured, replaces the database as the session store.
+	Redis redisstore.Config `toml:"redis"`
 }
 
 func NewConfig() Config {
 	return Config{
 		DBConfig:   db.NewConfig(),
 		HTTPConfig: http.NewConfig(),
+		Redis:      redisstore.NewConfig(),
 	}
 }
 
@@ -25,6 +35,21 @@ type Validator interface {
 }
 
 func (c *Config) Validate() error {
+	// Redis must be validated first, as the session store is set from it
+	// before the database config is validated.
+	if err := c.Redis.Validate(); err != nil {
+		return err
+	}
+
+	if !c.Redis.IsZero() {
+		if c.SessionMode != db.SessionModeDatabase {
+			return errors.New("redis can only be used with the database `sessionMode'")
+		}
+		if c.SessionStore == nil {
+			c.SessionStore = redisstore.New(c.Redis)
+		}
+	}
+
 	var fields = []Validator{
 		&c.DBConfig,
 		&c.HTTPConfig,
@@ -42,9 +67,80 @@ func CreateOwner(config Config, password []byte) error {
 	return db.CreateOwner(config.DBConfig, string(password))
 }
 
+// RegenerateThumbnails opens the database and renders the thumbnails that are
+// missing, or all of them if force is true. See imgsrv.RegenerateThumbnails.
+func RegenerateThumbnails(ctx context.Context, config Config, force bool) (int, error) {
+	if err := config.Validate(); err != nil {
+		return 0, err
+	}
+
+	d, err := db.NewDatabase(config.DBConfig)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to create database")
+	}
+	defer d.Close()
+
+	return imgsrv.RegenerateThumbnails(ctx, d, config.UploadConfig, force)
+}
+
+// ExpireAllSessions opens the database and signs out every user. See
+// db.Database's ExpireAllSessions.
+func ExpireAllSessions(ctx context.Context, config Config) (int, error) {
+	if err := config.Validate(); err != nil {
+		return 0, err
+	}
+
+	d, err := db.NewDatabase(config.DBConfig)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to create database")
+	}
+	defer d.Close()
+
+	return d.ExpireAllSessions(ctx)
+}
+
+// PruneInactiveUsers opens the database and deletes users with no posts who
+// haven't signed in within olderThan. See db.Database's PruneInactiveUsers.
+func PruneInactiveUsers(
+	ctx context.Context, config Config, olderThan time.Duration, dryRun bool) ([]string, error) {
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	d, err := db.NewDatabase(config.DBConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create database")
+	}
+	defer d.Close()
+
+	return d.PruneInactiveUsers(ctx, olderThan, dryRun)
+}
+
+// BackfillSessionMetadata opens the database and fills in the metadata of old
+// sessions. See db.Database's BackfillSessionMetadata.
+func BackfillSessionMetadata(ctx context.Context, config Config) (int, error) {
+	if err := config.Validate(); err != nil {
+		return 0, err
+	}
+
+	d, err := db.NewDatabase(config.DBConfig)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to create database")
+	}
+	defer d.Close()
+
+	return d.BackfillSessionMetadata(ctx)
+}
+
+// JanitorInterval is the interval between each janitor run.
+const JanitorInterval = time.Hour
+
 type App struct {
 	*http.Routes
 	Database *db.Database
+
+	stopJanitor func()
 }
 
 func New(config Config) (*App, error) {
@@ -67,5 +163,19 @@ func New(config Config) (*App, error) {
 		Database: d,
 	}
 
+	app.stopJanitor = d.StartJanitor(JanitorInterval, func(posts []smolboard.Post) {
+		var ptrs = make([]*smolboard.Post, len(posts))
+		for i := range posts {
+			ptrs[i] = &posts[i]
+		}
+		config.UploadConfig.CleanupPosts(ptrs)
+	})
+
 	return app, nil
 }
+
+// Close stops the janitor and closes the database.
+func (a *App) Close() error {
+	a.stopJanitor()
+	return a.Database.Close()
+}
@@ -4,10 +4,12 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/diamondburned/smolboard/server/httperr"
@@ -48,8 +50,39 @@ func NameIsLegal(name string) error {
 // error.
 type ErrResponse struct {
 	Error string `json:"error"`
+	// Slug is a short machine-readable identifier of the error, such as
+	// "post-not-found". It is empty for errors that don't have one.
+	Slug string `json:"slug,omitempty"`
+	// RequestID is the ID of the failed request, which can be used to find the
+	// error in the server logs.
+	RequestID string `json:"request_id,omitempty"`
+	// Fields maps the names of invalid input fields to their error messages.
+	// It is only set for validation errors.
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
+// Version is the version of smolboard. It is overridden at build time using
+// -ldflags "-X github.com/diamondburned/smolboard/smolboard.Version=...".
+var Version = "dev"
+
+// APIVersion is the version of the HTTP API. It is only bumped on breaking
+// changes.
+const APIVersion = 1
+
+// VersionInfo is returned from /version.
+type VersionInfo struct {
+	Version    string `json:"version"`
+	APIVersion int    `json:"api_version"`
+}
+
+// ReadOnlyState is returned from /read-only.
+type ReadOnlyState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ErrReadOnly is returned for writes while the server is in read-only mode.
+var ErrReadOnly = httperr.New(503, "server is in read-only mode")
+
 type Permission int8
 
 var ErrInvalidPermission = httperr.New(400, "invalid permission")
@@ -60,7 +93,8 @@ const (
 	// PermissionUser is a normal user's base permission. It allows uploading.
 	PermissionUser
 	// PermissionTrusted has access to posts marked as trusted-only. Trusted
-	// users can mark a post as trusted.
+	// users can mark a post as trusted and create a limited number of limited
+	// use tokens.
 	PermissionTrusted
 	// PermissionAdministrator can create limited use tokens as well as banning
 	// and promoting people up to Trusted. This permission inherits all
@@ -117,6 +151,17 @@ func (p Permission) String() string {
 	}
 }
 
+// ParsePermission parses the permission from its name, as returned by String.
+// The name is case-insensitive.
+func ParsePermission(name string) (Permission, error) {
+	for _, p := range permissions {
+		if strings.EqualFold(p.String(), name) {
+			return p, nil
+		}
+	}
+	return PermissionGuest, ErrInvalidPermission
+}
+
 func (p Permission) HasPermission(min Permission, inclusive bool) error {
 	// Is this a valid permission?
 	if min < PermissionGuest || min > PermissionOwner {
@@ -209,14 +254,86 @@ type Post struct {
 	ContentType string        `json:"content_type" db:"contenttype"`
 	Permission  Permission    `json:"permission"   db:"permission"`
 	Attributes  PostAttribute `json:"attributes"   db:"attributes"`
+	// DeletedAt is the time in Unix nanoseconds that the post was soft-deleted
+	// at. It is nil if the post is not deleted.
+	DeletedAt *int64 `json:"deleted_at,omitempty" db:"deletedat"`
+	// CreatedAt is the time in Unix nanoseconds that the post was saved at.
+	CreatedAt int64 `json:"created_at" db:"createdat"`
+	// UpdatedAt is the time in Unix nanoseconds that the post's permission or
+	// tags were last changed at. It is the same as CreatedAt if the post was
+	// never changed.
+	UpdatedAt int64 `json:"updated_at" db:"updatedat"`
+	// Anonymous is true if the post was uploaded without an account, in which
+	// case the poster is the server's reserved anonymous user.
+	Anonymous bool `json:"anonymous,omitempty" db:"anonymous"`
+	// External is true if the post links to media hosted elsewhere, which is
+	// at MediaURL, instead of a stored file. Its size is 0.
+	External bool   `json:"external,omitempty"  db:"external"`
+	MediaURL string `json:"media_url,omitempty" db:"mediaurl"`
+	// ExpiresAt is the time in Unix nanoseconds that the post expires at, after
+	// which it is hidden and then purged. It is nil if the post never expires.
+	ExpiresAt *int64 `json:"expires_at,omitempty" db:"expiresat"`
+	// ContentHash is the hex SHA-256 digest of the file as it was uploaded,
+	// before the server changed it in any way, such as rotating it. It is
+	// empty for external posts and posts uploaded before it was recorded.
+	ContentHash string `json:"content_hash,omitempty" db:"contenthash"`
+}
+
+// Event types that are sent to live clients.
+const (
+	EventPostCreate = "post.create"
+	EventPostDelete = "post.delete"
+)
+
+// Event is a live update about a post.
+type Event struct {
+	Type string `json:"type"`
+	Post Post   `json:"post"`
 }
 
 var (
 	ErrMissingExt     = httperr.New(400, "file does not have extension")
 	ErrPostNotFound   = httperr.New(404, "post not found")
 	ErrPageCountLimit = httperr.New(400, "count is over 100 limit")
+	ErrInvalidCursor  = httperr.New(400, "invalid cursor")
+
+	ErrInvalidMediaURL  = httperr.New(400, "media URL must be an absolute http or https URL")
+	ErrUnknownMediaType = httperr.New(400, "unknown media type; give the content type instead")
+
+	ErrShareLinksDisabled  = httperr.New(403, "share links are disabled")
+	ErrInvalidShareLinkTTL = httperr.New(400, "share link TTL must be between 0 and 30 days")
+	ErrInvalidShareLink    = httperr.New(403, "invalid share link")
+	ErrShareLinkExpired    = httperr.New(410, "share link expired")
+
+	ErrInvalidPostExpiry = httperr.New(400, "post expiry must be in the future")
+
+	ErrInvalidContentHash = httperr.New(400, "content hash must be a hex SHA-256 digest")
 )
 
+// ShareLink is a token that lets anyone see a single post until it expires,
+// regardless of the post's permission.
+type ShareLink struct {
+	Token string `json:"token"`
+	// ExpiresAt is the time in Unix nanoseconds that the link expires at.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// ValidateMediaURL returns ErrInvalidMediaURL if the external post's media URL
+// is not an absolute http or https URL.
+func ValidateMediaURL(mediaURL string) error {
+	u, err := url.Parse(mediaURL)
+	if err != nil || u.Host == "" || u.User != nil {
+		return ErrInvalidMediaURL
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return nil
+	default:
+		return ErrInvalidMediaURL
+	}
+}
+
 // SetPoster sets the post's poster.
 func (p *Post) SetPoster(poster string) {
 	cpy := poster
@@ -245,8 +362,12 @@ func (p Post) Filename() string {
 }
 
 // CreatedTime returns the time the post was created. It's milliseconds
-// accurate.
+// accurate if the time is taken from the ID, which is only done if CreatedAt is
+// missing, as sequential IDs don't have a time.
 func (p Post) CreatedTime() time.Time {
+	if p.CreatedAt > 0 {
+		return time.Unix(0, p.CreatedAt)
+	}
 	return time.Unix(0, snowflake.ID(p.ID).Time()*ms)
 }
 
@@ -272,9 +393,99 @@ var (
 	ErrEmptyTag        = httperr.New(400, "empty tag not allowed")
 	ErrIllegalTag      = httperr.New(400, "tag contains illegal character")
 	ErrTagAlreadyAdded = httperr.New(400, "tag is already added")
+	ErrTagNotFound     = httperr.New(404, "tag not found")
 	ErrTagTooLong      = httperr.New(400, fmt.Sprintf("tag is too long (max %d)", MaxTagLen))
+	ErrTooManyTags     = httperr.New(400, "post has too many tags")
 )
 
+// MaxBulkPosts is the maximum number of posts that a bulk action can be done
+// on at once.
+const MaxBulkPosts = 100
+
+var (
+	ErrNoPostsGiven = httperr.New(400, "no posts given")
+	ErrTooManyPosts = httperr.New(400, fmt.Sprintf("too many posts (max %d)", MaxBulkPosts))
+)
+
+// BulkPostResult is the result of a bulk action on a single post.
+type BulkPostResult struct {
+	ID int64 `json:"id"`
+	// Error is empty if the action succeeded on this post.
+	Error string `json:"error,omitempty"`
+	// Slug is the slug of the error, if any.
+	Slug string `json:"slug,omitempty"`
+}
+
+// OK returns true if the action succeeded on this post.
+func (r BulkPostResult) OK() bool {
+	return r.Error == ""
+}
+
+// OrphanedFiles is the result of looking for or purging stored files that
+// don't belong to any post.
+type OrphanedFiles struct {
+	Files []string `json:"files"`
+	// Purged is the number of files that were removed. It is 0 for dry runs.
+	Purged int `json:"purged"`
+}
+
+// PostTransferResult is returned after transferring all posts of a user.
+type PostTransferResult struct {
+	// Transferred is the number of posts that were transferred, including the
+	// soft-deleted ones.
+	Transferred int `json:"transferred"`
+}
+
+// BulkTagResult is returned after tagging multiple posts.
+type BulkTagResult struct {
+	// Updated is the number of posts that the tag was added to. Posts that
+	// already have the tag or cannot be changed are not counted.
+	Updated int `json:"updated"`
+}
+
+// TagStat is the usage of a tag among the posts that the user can see.
+type TagStat struct {
+	TagName string `db:"tagname" json:"tag_name"`
+	// Count is the number of posts with the tag.
+	Count int `db:"count" json:"count"`
+	// LastUsed is the time in Unix nanoseconds that the tag was last added to
+	// a post.
+	LastUsed int64 `db:"lastused" json:"last_used"`
+}
+
+// TagNormalizeResult is returned after normalizing all tags.
+type TagNormalizeResult struct {
+	// Normalized is the number of distinct tags that were renamed to or merged
+	// into their normalized form.
+	Normalized int `json:"normalized"`
+}
+
+// NormalizeTag returns the canonical form of the tag, which is lower-cased,
+// trimmed and with each run of spaces inside collapsed into an underscore.
+// Other whitespace within the tag is kept so that TagIsValid still rejects it.
+func NormalizeTag(tagName string) string {
+	tagName = strings.ToLower(strings.TrimSpace(tagName))
+
+	var b strings.Builder
+	b.Grow(len(tagName))
+
+	var space bool
+
+	for _, r := range tagName {
+		if unicode.IsSpace(r) && unicode.IsGraphic(r) {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte('_')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
 // Escaped returns the escaped tag string.
 func (t PostTag) Escaped() string {
 	return EscapeTag(t.TagName)
@@ -323,14 +534,42 @@ var (
 // AllPosts searches for all posts; it is a zero value instance of PostQuery.
 var AllPosts = Query{}
 
-// SearchResults is the results returned from the queried posts.
+// Page is the pagination metadata of a list. It is embedded into each list
+// type next to its items.
+type Page struct {
+	// Total is the number of items in all pages.
+	Total int `json:"total"`
+	// Offset is the number of items before this page.
+	Offset int `json:"offset"`
+	// Limit is the maximum number of items in a page, or 0 if there's no
+	// limit.
+	Limit int `json:"limit"`
+	// HasMore is true if there are items after this page.
+	HasMore bool `json:"has_more"`
+}
+
+// NewPage returns the metadata of the page at the given offset that has n
+// items.
+func NewPage(total, offset, limit, n int) Page {
+	return Page{
+		Total:   total,
+		Offset:  offset,
+		Limit:   limit,
+		HasMore: offset+n < total,
+	}
+}
+
+// SearchResults is the results returned from the queried posts. Total is
+// zero if Posts is empty, and Offset is zero for pages after a cursor.
 type SearchResults struct {
+	Page
 	// Posts contains the paginated list of posts.
 	Posts []Post `json:"posts"`
-	// Total is the total number of posts found. It is zero if Posts is empty.
-	Total int `json:"total"`
 	// Sizes is the total size of all posts found. It is zero if Posts is empty.
 	Sizes int64 `json:"sizes"`
+	// Cursor is the opaque cursor for the next page. It is empty if there are
+	// no more posts.
+	Cursor string `json:"cursor,omitempty"`
 	// User is the user stated in the search query. It is nil if there's no user
 	// stated.
 	User *UserPart `json:"user,omitempty"`
@@ -423,6 +662,10 @@ func (q Query) String() string {
 	return b.String()
 }
 
+// DefaultCookieName is the default name of the cookie that holds the session
+// token.
+const DefaultCookieName = "token"
+
 type Session struct {
 	ID       int64  `json:"id"       db:"id"`
 	Username string `json:"username" db:"username"`
@@ -430,15 +673,95 @@ type Session struct {
 	// current one, then AuthToken will be empty.
 	AuthToken string `json:"auth_token,omitempty" db:"authtoken"`
 	// Deadline is gradually updated with each Session call, which is per
-	// request.
+	// request. It never goes past the server's absolute session timeout, if
+	// any, so it is always when the session expires if it's left unused.
 	Deadline int64 `json:"deadline" db:"deadline"`
 	// UserAgent is obtained once on login.
 	UserAgent string `json:"user_agent" db:"useragent"`
+	// ImpersonatedBy is the username of the owner that issued this session to
+	// impersonate the user. It is empty for normal sessions.
+	ImpersonatedBy string `json:"impersonated_by,omitempty" db:"impersonatedby"`
+	// Name is the name that the user gave the session, such as "My laptop".
+	// It is empty if the session was never named.
+	Name string `json:"name,omitempty" db:"name"`
+	// Device is a label of the device parsed from UserAgent, such as "Firefox
+	// on Linux".
+	Device string `json:"device,omitempty" db:"device"`
+	// Scope is either ScopeRead or ScopeWrite. Sessions that were made before
+	// scopes have none, which is the same as ScopeWrite.
+	Scope string `json:"scope,omitempty" db:"scope"`
+}
+
+// Scopes of sessions and API keys.
+const (
+	// ScopeRead only allows requests that don't change anything, which are
+	// GET, HEAD and OPTIONS requests, and signing out.
+	ScopeRead = "read"
+	// ScopeWrite allows everything that the user can do.
+	ScopeWrite = "write"
+)
+
+var (
+	ErrInvalidScope  = httperr.New(400, "scope must be read or write")
+	ErrScopeReadOnly = httperr.New(403, "session or API key is read-only")
+)
+
+// ValidScope returns ErrInvalidScope if the scope is neither ScopeRead nor
+// ScopeWrite.
+func ValidScope(scope string) error {
+	if scope != ScopeRead && scope != ScopeWrite {
+		return ErrInvalidScope
+	}
+	return nil
+}
+
+// APIKeyPrefix starts every API key, which tells them apart from session
+// tokens.
+const APIKeyPrefix = "sbk_"
+
+// MaxAPIKeys is the maximum number of API keys that each user can have.
+const MaxAPIKeys = 16
+
+// APIKey is a long-lived token that authenticates as a user without a session,
+// such as for automation. It is only sent as a bearer token. Even with
+// ScopeWrite, keys can't manage keys or account credentials.
+type APIKey struct {
+	ID       int64  `json:"id"       db:"id"`
+	Username string `json:"username" db:"username"`
+	Scope    string `json:"scope"    db:"scope"`
+	Label    string `json:"label"    db:"label"`
+	// Token is only given once when the key is created, since only its hash
+	// is stored.
+	Token string `json:"token,omitempty" db:"-"`
+	// CreatedAt and LastUsed are in Unix nanoseconds. LastUsed is 0 if the
+	// key was never used, and it is only updated about once a minute.
+	CreatedAt int64 `json:"created_at" db:"createdat"`
+	LastUsed  int64 `json:"last_used"  db:"lastused"`
+}
+
+var (
+	ErrInvalidAPIKey    = httperr.New(401, "invalid API key")
+	ErrAPIKeyNotFound   = httperr.New(404, "API key not found")
+	ErrTooManyAPIKeys   = httperr.New(400, "too many API keys")
+	ErrAPIKeyNotAllowed = httperr.New(403, "action not permitted with an API key")
+)
+
+// SessionList is a page of the current user's sessions.
+type SessionList struct {
+	Page
+	Sessions []Session `json:"sessions"`
 }
 
+// MaxSessionNameLen is the maximum length of a session name in runes.
+const MaxSessionNameLen = 64
+
 var (
-	ErrSessionNotFound = httperr.New(401, "session not found")
-	ErrSessionExpired  = httperr.New(410, "session expired")
+	ErrSessionNotFound    = httperr.New(401, "session not found")
+	ErrSessionExpired     = httperr.New(410, "session expired")
+	ErrSessionNameTooLong = httperr.New(400, "session name too long")
+	ErrRotateUnsupported  = httperr.New(400, "session tokens can't be rotated on this server")
+
+	ErrImpersonating = httperr.New(403, "action not permitted while impersonating")
 )
 
 // IsZero returns true if the session is a guest one.
@@ -446,10 +769,84 @@ func (s Session) IsZero() bool {
 	return s.ID == 0
 }
 
+// IsImpersonation returns true if the session was issued by the owner to
+// impersonate the user.
+func (s Session) IsImpersonation() bool {
+	return s.ImpersonatedBy != ""
+}
+
+// ReadOnly returns true if the session has ScopeRead.
+func (s Session) ReadOnly() bool {
+	return s.Scope == ScopeRead
+}
+
+// CleanSessionName strips control characters and surrounding spaces from the
+// given session name. An error is returned if the name is too long.
+func CleanSessionName(name string) (string, error) {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name))
+
+	if utf8.RuneCountInString(name) > MaxSessionNameLen {
+		return "", ErrSessionNameTooLong
+	}
+
+	return name, nil
+}
+
 func (s Session) CreatedAt() time.Time {
 	return time.Unix(0, snowflake.ID(s.ID).Time()*ms)
 }
 
+// Remaining returns the time left until the session expires if it's left
+// unused, which is the lesser of the inactivity and absolute timeouts.
+func (s Session) Remaining() time.Duration {
+	return time.Until(time.Unix(0, s.Deadline))
+}
+
+// SessionRevokeResult is returned after revoking a user's sessions.
+type SessionRevokeResult struct {
+	// Revoked is the number of sessions that were revoked. Stores that can't
+	// list all sessions, such as JWT, may undercount.
+	Revoked int `json:"revoked"`
+}
+
+// SessionExport is the metadata of a session without its token. It is what
+// administrators see when looking up other users' sessions.
+type SessionExport struct {
+	ID             int64  `json:"id"`
+	Username       string `json:"username"`
+	Name           string `json:"name,omitempty"`
+	UserAgent      string `json:"user_agent"`
+	Device         string `json:"device,omitempty"`
+	ImpersonatedBy string `json:"impersonated_by,omitempty"`
+	Scope          string `json:"scope,omitempty"`
+	// CreatedAt and Deadline are in Unix nanoseconds.
+	CreatedAt int64 `json:"created_at"`
+	Deadline  int64 `json:"deadline"`
+	// Current is true if this is the session making the request. It is only
+	// set by the client's ListSessions.
+	Current bool `json:"current,omitempty"`
+}
+
+// Export returns the session's metadata.
+func (s Session) Export() SessionExport {
+	return SessionExport{
+		ID:             s.ID,
+		Username:       s.Username,
+		Name:           s.Name,
+		UserAgent:      s.UserAgent,
+		Device:         s.Device,
+		ImpersonatedBy: s.ImpersonatedBy,
+		Scope:          s.Scope,
+		CreatedAt:      s.CreatedAt().UnixNano(),
+		Deadline:       s.Deadline,
+	}
+}
+
 type TokenList struct {
 	Tokens   []Token             `json:"tokens"`
 	Creators map[string]UserPart `json:"creators"`
@@ -467,6 +864,7 @@ var (
 	ErrUnknownToken   = httperr.New(401, "unknown token")
 	ErrOverUseLimit   = httperr.New(400, "requested use is over limit")
 	ErrZeroNotAllowed = httperr.New(400, "zero use not allowed")
+	ErrTooManyTokens  = httperr.New(403, "too many outstanding tokens")
 )
 
 // HashCost controls the bcrypt hash cost.
@@ -480,8 +878,38 @@ type UserPart struct {
 	Username   string     `db:"username"   json:"username"`
 	JoinTime   int64      `db:"jointime"   json:"join_time"`
 	Permission Permission `db:"permission" json:"permission"`
+	// Pending is true if the user signed up with the Guest permission and is
+	// awaiting approval. Pending users can't upload.
+	Pending bool `db:"-" json:"pending,omitempty"`
+	// SessionCount and PostCount are the number of active sessions and posts
+	// of the user. They are only set for the current user, except for
+	// SessionCount, which is also set in user lists.
+	SessionCount int `db:"-" json:"session_count,omitempty"`
+	PostCount    int `db:"-" json:"post_count,omitempty"`
+	// LastLogin is the time in Unix nanoseconds that the user last signed in
+	// with their password. It is 0 if the user never did, or if the current
+	// user is neither the user nor an administrator.
+	LastLogin int64 `db:"lastlogin" json:"last_login,omitempty"`
+}
+
+// UserQuota is the upload quota of a user. Limits of 0 are unlimited.
+type UserQuota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxPosts int   `json:"max_posts"`
+	// UsedBytes and UsedPosts are the total size and number of the user's
+	// posts, including soft-deleted ones.
+	UsedBytes int64 `json:"used_bytes"`
+	UsedPosts int   `json:"used_posts"`
+	// Override is true if the limits were set for the user by an
+	// administrator instead of being the server's defaults.
+	Override bool `json:"override,omitempty"`
 }
 
+var (
+	ErrQuotaExceeded = httperr.New(413, "upload quota exceeded")
+	ErrInvalidQuota  = httperr.New(400, "quota must not be negative")
+)
+
 type User struct {
 	UserPart
 	Passhash []byte `db:"passhash"`
@@ -495,7 +923,24 @@ var (
 	ErrPasswordTooShort   = httperr.New(400, "password too short")
 	ErrUsernameTooLong    = httperr.New(400, "username too long")
 	ErrUsernameTaken      = httperr.New(409, "username taken")
+	ErrUsernameReserved   = httperr.New(403, "username is reserved")
 	ErrIllegalName        = httperr.New(403, "username contains illegal characters")
+	ErrUserPending        = httperr.New(403, "account is awaiting approval")
+	ErrUserNotPending     = httperr.New(400, "user is not awaiting approval")
+	ErrPruneAgeTooShort   = httperr.New(400, "prune age must be at least a day")
+)
+
+// UserPruneResult is returned after pruning inactive users.
+type UserPruneResult struct {
+	// Usernames contains the users that were pruned, or those that would be if
+	// DryRun is true.
+	Usernames []string `json:"usernames"`
+	DryRun    bool     `json:"dry_run"`
+}
+
+var (
+	ErrUnsupportedPasswordScheme = httperr.New(400, "unsupported password scheme")
+	ErrMalformedPasswordHash     = httperr.New(400, "malformed password hash")
 )
 
 // Joined returns the time the user joined.
@@ -503,6 +948,15 @@ func (u UserPart) Joined() time.Time {
 	return time.Unix(0, u.JoinTime)
 }
 
+// LastLoginTime returns the time the user last signed in, or a zero time if
+// it's unknown.
+func (u UserPart) LastLoginTime() time.Time {
+	if u.LastLogin == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, u.LastLogin)
+}
+
 // CanChangePost returns nil if the user can change the given post. This is kept
 // in sync with the backend functions.
 func (u UserPart) CanChangePost(p Post) error {
@@ -544,9 +998,121 @@ func (u UserPart) AllowedPermissions() []Permission {
 	return allPerm
 }
 
+// MailStatus is returned from actions that may send an email. Failing to send
+// the email does not fail the action itself. The email is only sent once the
+// action's transaction is committed, which is when the status is filled in.
+type MailStatus struct {
+	// Sent is true if the mail was sent.
+	Sent bool `json:"sent"`
+	// Warning is non-empty if the mail could not be sent.
+	Warning string `json:"warning,omitempty"`
+}
+
+var (
+	ErrInvalidEmail     = httperr.New(400, "invalid email")
+	ErrNoEmail          = httperr.New(404, "user has no email")
+	ErrUnknownMailToken = httperr.New(401, "unknown or expired token")
+)
+
+// AuditEntry is a single entry in the audit log. Entries are written for
+// moderation and administrative actions.
+type AuditEntry struct {
+	ID     int64  `json:"id"     db:"id"`
+	Actor  string `json:"actor"  db:"actor"`
+	Action string `json:"action" db:"action"`
+	Target string `json:"target" db:"target"`
+	Detail string `json:"detail" db:"detail"`
+}
+
+// Time returns the time the entry was written.
+func (e AuditEntry) Time() time.Time {
+	return time.Unix(0, snowflake.ID(e.ID).Time()*ms)
+}
+
+// ReportAction is the action taken to resolve a report.
+type ReportAction uint8
+
+const (
+	// ReportPending is the zero-value of ReportAction, which indicates that
+	// the report has not been resolved yet.
+	ReportPending ReportAction = iota
+	// ReportDismiss dismisses the report and keeps the post.
+	ReportDismiss
+	// ReportDelete deletes the reported post.
+	ReportDelete
+)
+
+// IsValid returns true if the action is a valid resolution. ReportPending is
+// not a valid resolution.
+func (a ReportAction) IsValid() bool {
+	return a == ReportDismiss || a == ReportDelete
+}
+
+func (a ReportAction) String() string {
+	switch a {
+	case ReportPending:
+		return "pending"
+	case ReportDismiss:
+		return "dismiss"
+	case ReportDelete:
+		return "delete"
+	default:
+		return "???"
+	}
+}
+
+// MaxReportReasonLen is the maximum length of a report's reason in bytes.
+const MaxReportReasonLen = 1024
+
+// Report is a user's report on a post.
+type Report struct {
+	ID         int64        `json:"id"         db:"id"`
+	PostID     int64        `json:"post_id"    db:"postid"`
+	Reporter   string       `json:"reporter"   db:"reporter"`
+	Reason     string       `json:"reason"     db:"reason"`
+	Resolution ReportAction `json:"resolution" db:"resolution"`
+}
+
+var (
+	ErrAlreadyReported     = httperr.New(409, "post already reported")
+	ErrReportNotFound      = httperr.New(404, "report not found")
+	ErrInvalidReportAction = httperr.New(400, "invalid report action")
+	ErrEmptyReportReason   = httperr.New(400, "empty report reason")
+	ErrReportReasonTooLong = httperr.New(400,
+		fmt.Sprintf("report reason is too long (max %d)", MaxReportReasonLen))
+)
+
+// MaxPoolNameLen is the maximum length of a pool's name in bytes.
+const MaxPoolNameLen = 256
+
+// Pool is a user's ordered album of posts.
+type Pool struct {
+	ID    int64  `json:"id"    db:"id"`
+	Owner string `json:"owner" db:"owner"`
+	Name  string `json:"name"  db:"name"`
+	// CreatedAt is the time in Unix nanoseconds that the pool was created at.
+	CreatedAt int64 `json:"created_at" db:"createdat"`
+	// PostIDs contains the IDs of the pool's posts in order. Posts that the
+	// viewer can't see are left out.
+	PostIDs []int64 `json:"post_ids" db:"-"`
+}
+
+// PoolPosts is a pool along with its visible posts in order.
+type PoolPosts struct {
+	Pool
+	Posts []Post `json:"posts"`
+}
+
+var (
+	ErrPoolNotFound    = httperr.New(404, "pool not found")
+	ErrEmptyPoolName   = httperr.New(400, "empty pool name")
+	ErrPoolNameTooLong = httperr.New(400,
+		fmt.Sprintf("pool name is too long (max %d)", MaxPoolNameLen))
+)
+
 type UserList struct {
+	Page
 	Users []UserPart `json:"users"`
-	Total int        `json:"total"`
 }
 
 // NoUsers is a zero-value user list containing no users.